@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/restapi"
+)
+
+func printAtUsage() {
+	println("Usage: at [--modem <name>] <CONFIG FILE> <AT command>")
+	println()
+	println("Sends an AT command to a modem of the running gateway using the /admin/at REST endpoint and prints the response.")
+	println("The REST API address and the [admin] credentials are taken from the config file.")
+	println()
+	println("--modem <name> => Modem to use, default is the modem with the highest priority")
+}
+
+// runAtCommand implements the 'at' sub-command
+func runAtCommand(args []string) {
+
+	modemName := ""
+	var positional []string
+
+	for idx := 0; idx < len(args); idx = idx + 1 {
+		arg := args[idx]
+		switch arg {
+		case "-h", "-help", "--help":
+			printAtUsage()
+			return
+		case "--modem":
+			if idx+1 >= len(args) {
+				panic("'" + arg + "' option requires an argument")
+			}
+			modemName = args[idx+1]
+			idx = idx + 1
+		default:
+			if strings.HasPrefix(arg, "--") {
+				panic("Invalid command line - unknown option '" + arg + "'")
+			}
+			positional = append(positional, arg)
+		}
+	}
+	if len(positional) != 2 {
+		panic("Invalid command line - expected config file and AT command")
+	}
+
+	appConfig, err := config.LoadConfig(positional[0], false)
+	if err != nil {
+		panic(err)
+	}
+	if appConfig.GetAdminUser() == "" {
+		panic("Admin endpoints are disabled, please configure [admin] user and password")
+	}
+
+	host := appConfig.GetBindIp()
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		host = "127.0.0.1"
+	}
+	url := "http://" + net.JoinHostPort(host, strconv.Itoa(appConfig.GetBindPort())) + "/admin/at"
+
+	body, err := json.Marshal(restapi.AtCommandRequest{Modem: modemName, Command: positional[1]})
+	if err != nil {
+		panic(err)
+	}
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.SetBasicAuth(appConfig.GetAdminUser(), appConfig.GetAdminPassword())
+
+	// the modem may take a while to answer, serial link timeouts apply on the server side
+	client := http.Client{Timeout: 2 * time.Minute}
+	response, err := client.Do(request)
+	if err != nil {
+		println("Failed to reach gateway at " + url + ": " + err.Error())
+		os.Exit(1)
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		println("Failed to read response: " + err.Error())
+		os.Exit(1)
+	}
+	if response.StatusCode != http.StatusOK {
+		println("Gateway returned " + response.Status + " " + string(data))
+		os.Exit(1)
+	}
+	var result restapi.AtCommandResponse
+	if err = json.Unmarshal(data, &result); err != nil {
+		println("Failed to parse response: " + err.Error())
+		os.Exit(1)
+	}
+	for _, line := range result.Lines {
+		println(line)
+	}
+	if !result.Ok {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,199 @@
+package balance
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code-sourcery.de/sms-gateway/logger"
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/msgqueue"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+var log = logger.GetLogger("balance")
+
+var initialized atomic.Bool
+var threadLock sync.Mutex
+var threadRunning atomic.Bool
+var shutdown atomic.Bool
+
+var threadAlive sync.WaitGroup
+var shutdownLatch sync.WaitGroup
+
+var appState *state.State
+var appModems []modem.Modem
+
+// when the balance of each modem was checked most recently, by modem name
+var lastChecked = make(map[string]time.Time)
+
+// parseBalance extracts the balance from the network's answer to a USSD request,
+// accepting both '.' and ',' as decimal separator
+func parseBalance(text string, regex *regexp.Regexp) (float64, error) {
+	match := regex.FindStringSubmatch(text)
+	if match == nil {
+		return 0, errors.New("Balance regex '" + regex.String() + "' does not match '" + text + "'")
+	}
+	value := match[0]
+	if len(match) > 1 {
+		value = match[1]
+	}
+	balance, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(value), ",", "."), 64)
+	if err != nil {
+		return 0, errors.New("Failed to parse balance '" + value + "' - " + err.Error())
+	}
+	return balance, nil
+}
+
+func formatBalance(balance float64) string {
+	return strconv.FormatFloat(balance, 'f', 2, 64)
+}
+
+// checkBalance queries the prepaid balance of a modem and records it in the balance history
+func checkBalance(ctx context.Context, m modem.Modem) (float64, error) {
+	modemConfig := m.GetConfig()
+	response, err := m.SendUssd(ctx, modemConfig.GetBalanceUssdCode())
+	if err != nil {
+		return 0, err
+	}
+	if response.IsSessionOpen() {
+		// the network presented a menu instead of just answering
+		if err = m.CancelUssd(ctx); err != nil {
+			log.Warn("Failed to cancel USSD session of modem '" + m.Name() + "': " + err.Error())
+		}
+	}
+	if response.Status != modem.USSD_STATUS_DONE && response.Status != modem.USSD_STATUS_ACTION_REQUIRED {
+		return 0, errors.New("USSD request '" + modemConfig.GetBalanceUssdCode() + "' failed with status " + response.Status.String())
+	}
+	balance, err := parseBalance(response.Text, modemConfig.GetBalanceRegex())
+	if err != nil {
+		return 0, err
+	}
+	appState.RememberBalance(m.Name(), balance, state.UnixTimestamp(time.Now().Unix()))
+	return balance, nil
+}
+
+// alertIfLow enqueues an alert SMS when the balance fell below the modem's threshold.
+// Only a single alert is sent until the balance is above the threshold again.
+func alertIfLow(m modem.Modem, balance float64) {
+	threshold := m.GetConfig().GetBalanceThreshold()
+	if threshold == nil {
+		return
+	}
+	if balance >= *threshold {
+		if appState.IsLowBalanceAlerted(m.Name()) {
+			log.Info("Prepaid balance of modem '" + m.Name() + "' is above the threshold again")
+			appState.SetLowBalanceAlerted(m.Name(), false)
+		}
+		return
+	}
+	if appState.IsLowBalanceAlerted(m.Name()) {
+		log.Debug("Low balance alert for modem '" + m.Name() + "' was sent already")
+		return
+	}
+
+	text := "Prepaid balance of modem '" + m.Name() + "' is low: " + formatBalance(balance) +
+		" (threshold " + formatBalance(*threshold) + ")"
+	log.Warn(text)
+	msgId := appState.NewMessageId()
+	err := msgqueue.StoreMessage(msgId, text)
+	if err != nil {
+		appState.DiscardMessageId(msgId)
+		log.Error("Failed to schedule low balance alert: " + err.Error())
+		return
+	}
+	log.Info("Successfully scheduled low balance alert for modem '" + m.Name() + "'")
+	appState.SetLowBalanceAlerted(m.Name(), true)
+}
+
+// isCheckDue returns TRUE if the balance of a modem was not checked within its balance check interval
+func isCheckDue(m modem.Modem) bool {
+	interval := m.GetConfig().GetBalanceCheckInterval()
+	if interval == nil {
+		return false
+	}
+	last, found := lastChecked[m.Name()]
+	if !found {
+		// do not check again right after a restart
+		if latest := appState.GetLatestBalance(m.Name()); latest != nil {
+			last = latest.Timestamp.ToTime()
+		}
+	}
+	return interval.IsShorterThan(time.Since(last))
+}
+
+func balanceThread() {
+	threadRunning.Store(true)
+	threadAlive.Done()
+
+	defer func() {
+		shutdownLatch.Done()
+		log.Info("Balance thread terminated.")
+		threadRunning.Store(false)
+	}()
+
+	log.Info("Balance thread started")
+
+	for !shutdown.Load() {
+		for _, m := range appModems {
+			if shutdown.Load() || !isCheckDue(m) {
+				continue
+			}
+			// failed checks are retried after the check interval as well
+			lastChecked[m.Name()] = time.Now()
+			balance, err := checkBalance(context.Background(), m)
+			if err != nil {
+				log.Error("Failed to check prepaid balance of modem '" + m.Name() + "': " + err.Error())
+				continue
+			}
+			log.Info("Prepaid balance of modem '" + m.Name() + "' is " + formatBalance(balance))
+			alertIfLow(m, balance)
+			_ = appState.WriteState()
+		}
+		time.Sleep(1 * time.Second)
+	}
+	log.Info("Balance thread was asked to shut down")
+}
+
+func Init(state *state.State, modems []modem.Modem) {
+
+	appState = state
+	appModems = modems
+
+	enabled := false
+	for _, m := range modems {
+		if m.GetConfig().GetBalanceCheckInterval() != nil {
+			log.Info("Checking prepaid balance of modem '" + m.Name() + "' every " + m.GetConfig().GetBalanceCheckInterval().String())
+			enabled = true
+		}
+	}
+	if !enabled {
+		log.Info("No balance check interval configured, won't start thread.")
+		return
+	}
+
+	threadLock.Lock()
+	defer threadLock.Unlock()
+
+	if !initialized.CompareAndSwap(false, true) {
+		panic("Already initialized")
+	}
+	shutdownLatch.Add(1)
+	threadAlive.Add(1)
+	go balanceThread()
+	threadAlive.Wait()
+}
+
+func Shutdown() {
+	threadLock.Lock()
+	defer threadLock.Unlock()
+	shutdown.Store(true)
+	if threadRunning.Load() {
+		shutdownLatch.Wait()
+	}
+}
@@ -0,0 +1,70 @@
+package balance
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"testing"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+func TestParseBalance(t *testing.T) {
+	defaultRegex := regexp.MustCompile(`(-?\d+(?:[.,]\d+)?)`)
+	for text, expected := range map[string]float64{
+		"Your balance is 10.00 EUR.":      10,
+		"Ihr Guthaben beträgt 4,20 EUR":   4.2,
+		"Balance: -1.5 EUR, valid 30d":    -1.5,
+		"You have 3 EUR left on your SIM": 3,
+	} {
+		balance, err := parseBalance(text, defaultRegex)
+		if err != nil || balance != expected {
+			t.Errorf("expected %f for '%s', got %f / %v", expected, text, balance, err)
+		}
+	}
+	if balance, err := parseBalance("Bonus 5.00, Guthaben 7.50", regexp.MustCompile(`Guthaben (\d+\.\d+)`)); err != nil || balance != 7.5 {
+		t.Errorf("capturing group not used, got %f / %v", balance, err)
+	}
+	if _, err := parseBalance("Service unavailable", defaultRegex); err == nil {
+		t.Errorf("expected error for answer without balance")
+	}
+}
+
+func TestCheckBalance(t *testing.T) {
+	dataDir := t.TempDir()
+	content := "[common]\ndataDirectory=" + dataDir + "\n" +
+		"[restapi]\nbindIp=127.0.0.1\nport=9999\nuser=user\npassword=password\n" +
+		"[modem]\ndriver=simulator\nsimPin=1234\nbalanceCheckInterval=1h\nbalanceThreshold=5\n" +
+		"[simulator]\nbalance=4.20\n" +
+		"[sms]\nrecipients=+491111111111\n"
+	configFile := dataDir + "/test.conf"
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %s", err.Error())
+	}
+	appConfig, err := config.LoadConfig(configFile, false)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err.Error())
+	}
+	appState, err = state.Init(appConfig)
+	if err != nil {
+		t.Fatalf("failed to initialize state: %s", err.Error())
+	}
+	m := modem.New(appConfig, appState, appConfig.GetModems()[0])
+
+	if !isCheckDue(m) {
+		t.Errorf("balance that was never checked must be due")
+	}
+	balance, err := checkBalance(context.Background(), m)
+	if err != nil || balance != 4.2 {
+		t.Fatalf("expected balance 4.20, got %f / %v", balance, err)
+	}
+	latest := appState.GetLatestBalance(m.Name())
+	if latest == nil || latest.Balance != 4.2 || len(appState.GetBalanceHistory(m.Name())) != 1 {
+		t.Errorf("balance not recorded, got %+v", appState.GetBalanceHistory(m.Name()))
+	}
+	if isCheckDue(m) {
+		t.Errorf("balance checked just now must not be due")
+	}
+}
@@ -128,6 +128,23 @@ func FileExist(file string) bool {
 	return !FileDoesNotExist(file)
 }
 
+// CreateDirIfMissing creates a directory inside parentDir unless it already exists, returning the directory's path
+func CreateDirIfMissing(parentDir string, childName string) (string, error) {
+	dataDir := parentDir
+	if !strings.HasSuffix(dataDir, "/") {
+		dataDir += "/"
+	}
+	dir := dataDir + childName
+	if !FileExist(dir) {
+		err := os.Mkdir(dir, 0755)
+		if err != nil {
+			log.Error("Failed to create directory '" + dir + "' - " + err.Error())
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
 func FileIsSmallerThan(file string, offset int64) (bool, error) {
 	stat, err := os.Stat(file)
 	if err != nil {
@@ -4,11 +4,15 @@ import (
 	_ "embed"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"code-sourcery.de/sms-gateway/common"
 	"code-sourcery.de/sms-gateway/logger"
@@ -66,6 +70,347 @@ func stringToDebugFlags(s string) (int32, error) {
 	return result, nil
 }
 
+type SmsMode int
+
+const (
+	SMS_MODE_TEXT SmsMode = iota // AT+CMGF=1
+	SMS_MODE_PDU                 // AT+CMGF=0
+)
+
+func ParseSmsMode(s string) (SmsMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "text":
+		return SMS_MODE_TEXT, nil
+	case "pdu":
+		return SMS_MODE_PDU, nil
+	}
+	return SMS_MODE_TEXT, errors.New("Unknown SMS mode '" + s + "', valid choices are 'text' and 'pdu'")
+}
+
+func (m SmsMode) String() string {
+	switch m {
+	case SMS_MODE_TEXT:
+		return "text"
+	case SMS_MODE_PDU:
+		return "pdu"
+	}
+	panic("Internal error, unknown SMS mode " + strconv.Itoa(int(m)))
+}
+
+type ModemDriver int
+
+const (
+	MODEM_DRIVER_SERIAL    ModemDriver = iota // AT commands via serial port
+	MODEM_DRIVER_SIMULATOR                    // in-process simulated modem, no hardware required
+	MODEM_DRIVER_HILINK                       // Huawei HiLink stick, HTTP API instead of AT commands
+)
+
+func ParseModemDriver(s string) (ModemDriver, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "serial":
+		return MODEM_DRIVER_SERIAL, nil
+	case "simulator":
+		return MODEM_DRIVER_SIMULATOR, nil
+	case "hilink":
+		return MODEM_DRIVER_HILINK, nil
+	}
+	return MODEM_DRIVER_SERIAL, errors.New("Unknown modem driver '" + s + "', valid choices are 'serial', 'simulator' and 'hilink'")
+}
+
+func (d ModemDriver) String() string {
+	switch d {
+	case MODEM_DRIVER_SERIAL:
+		return "serial"
+	case MODEM_DRIVER_SIMULATOR:
+		return "simulator"
+	case MODEM_DRIVER_HILINK:
+		return "hilink"
+	}
+	panic("Internal error, unknown modem driver " + strconv.Itoa(int(d)))
+}
+
+// SimulatorConfig holds the settings of the simulated modem driver
+type SimulatorConfig struct {
+	// network registration state, one of SIMULATOR_REGISTRATION_STATES
+	Registration string
+	// SIM card PIN state, one of SIMULATOR_PIN_STATES
+	PinState string
+	// PIN of the simulated SIM card, compared against [modem] simPin
+	Pin string
+	// PUK of the simulated SIM card
+	Puk string
+	// probability (0...1) that a modem operation fails
+	FailureRate float64
+	// how long every modem operation takes
+	Latency time.Duration
+	// prepaid balance reported by the *100# USSD code
+	Balance string
+}
+
+var SIMULATOR_REGISTRATION_STATES = []string{"home", "roaming", "searching", "denied", "not_searching", "unknown"}
+var SIMULATOR_PIN_STATES = []string{"ready", "pin", "puk"}
+
+type ModemSelection int
+
+const (
+	MODEM_SELECTION_PRIORITY    ModemSelection = iota // always prefer the healthy modem with the lowest priority value
+	MODEM_SELECTION_ROUND_ROBIN                       // take turns among all healthy modems
+)
+
+func ParseModemSelection(s string) (ModemSelection, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "priority":
+		return MODEM_SELECTION_PRIORITY, nil
+	case "roundrobin", "round-robin":
+		return MODEM_SELECTION_ROUND_ROBIN, nil
+	}
+	return MODEM_SELECTION_PRIORITY, errors.New("Unknown modem selection '" + s + "', valid choices are 'priority' and 'roundrobin'")
+}
+
+func (m ModemSelection) String() string {
+	switch m {
+	case MODEM_SELECTION_PRIORITY:
+		return "priority"
+	case MODEM_SELECTION_ROUND_ROBIN:
+		return "roundrobin"
+	}
+	panic("Internal error, unknown modem selection " + strconv.Itoa(int(m)))
+}
+
+type RecoveryStep int
+
+const (
+	RECOVERY_STEP_REOPEN     RecoveryStep = iota // close and re-open the serial port
+	RECOVERY_STEP_SOFT_RESET                     // restart the modem using AT+CFUN=1,1
+	RECOVERY_STEP_USB_RESET                      // re-authorize (or unbind/bind) the modem's USB device via sysfs
+	RECOVERY_STEP_REDISCOVER                     // discover the modem's serial port again, it may have changed
+)
+
+func ParseRecoveryStep(s string) (RecoveryStep, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "reopen":
+		return RECOVERY_STEP_REOPEN, nil
+	case "soft_reset":
+		return RECOVERY_STEP_SOFT_RESET, nil
+	case "usb_reset":
+		return RECOVERY_STEP_USB_RESET, nil
+	case "rediscover":
+		return RECOVERY_STEP_REDISCOVER, nil
+	}
+	return RECOVERY_STEP_REOPEN, errors.New("Unknown recovery step '" + s + "', valid choices are 'reopen', 'soft_reset', 'usb_reset' and 'rediscover'")
+}
+
+func (r RecoveryStep) String() string {
+	switch r {
+	case RECOVERY_STEP_REOPEN:
+		return "reopen"
+	case RECOVERY_STEP_SOFT_RESET:
+		return "soft_reset"
+	case RECOVERY_STEP_USB_RESET:
+		return "usb_reset"
+	case RECOVERY_STEP_REDISCOVER:
+		return "rediscover"
+	}
+	panic("Internal error, unknown recovery step " + strconv.Itoa(int(r)))
+}
+
+// parseRecoverySteps parses a comma-separated list of recovery steps, 'none' disables recovery
+func parseRecoverySteps(s string) ([]RecoveryStep, error) {
+	if strings.ToLower(strings.TrimSpace(s)) == "none" {
+		return []RecoveryStep{}, nil
+	}
+	var result []RecoveryStep
+	for _, token := range strings.Split(s, ",") {
+		step, err := ParseRecoveryStep(token)
+		if err != nil {
+			return nil, err
+		}
+		if slices.Contains(result, step) {
+			return nil, errors.New("Recovery step '" + step.String() + "' is listed more than once")
+		}
+		result = append(result, step)
+	}
+	return result, nil
+}
+
+type ModemProfile int
+
+const (
+	MODEM_PROFILE_AUTO    ModemProfile = iota // detect the profile using the USB vendor ID or ATI
+	MODEM_PROFILE_HUAWEI                      // Huawei E3351, E3372 and similar sticks
+	MODEM_PROFILE_QUECTEL                     // Quectel EC25 and similar LTE modules
+	MODEM_PROFILE_SIMCOM                      // SIMCom SIM7600 and similar LTE modules
+	MODEM_PROFILE_GENERIC                     // plain 3GPP TS 27.005/27.007 commands only
+)
+
+func ParseModemProfile(s string) (ModemProfile, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "auto":
+		return MODEM_PROFILE_AUTO, nil
+	case "huawei":
+		return MODEM_PROFILE_HUAWEI, nil
+	case "quectel":
+		return MODEM_PROFILE_QUECTEL, nil
+	case "simcom":
+		return MODEM_PROFILE_SIMCOM, nil
+	case "generic":
+		return MODEM_PROFILE_GENERIC, nil
+	}
+	return MODEM_PROFILE_AUTO, errors.New("Unknown modem profile '" + s + "', valid choices are 'auto', 'huawei', 'quectel', 'simcom' and 'generic'")
+}
+
+func (p ModemProfile) String() string {
+	switch p {
+	case MODEM_PROFILE_AUTO:
+		return "auto"
+	case MODEM_PROFILE_HUAWEI:
+		return "huawei"
+	case MODEM_PROFILE_QUECTEL:
+		return "quectel"
+	case MODEM_PROFILE_SIMCOM:
+		return "simcom"
+	case MODEM_PROFILE_GENERIC:
+		return "generic"
+	}
+	panic("Internal error, unknown modem profile " + strconv.Itoa(int(p)))
+}
+
+type PortBusyAction int
+
+const (
+	PORT_BUSY_FAIL  PortBusyAction = iota // give up right away if another process holds the serial port
+	PORT_BUSY_WAIT                        // wait until the other process releases the serial port or portBusyTimeoutSeconds elapsed
+	PORT_BUSY_RETRY                       // try again a limited number of times, with exponential backoff
+)
+
+func ParsePortBusyAction(s string) (PortBusyAction, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "fail":
+		return PORT_BUSY_FAIL, nil
+	case "wait":
+		return PORT_BUSY_WAIT, nil
+	case "retry":
+		return PORT_BUSY_RETRY, nil
+	}
+	return PORT_BUSY_FAIL, errors.New("Unknown port busy action '" + s + "', valid choices are 'fail', 'wait' and 'retry'")
+}
+
+func (a PortBusyAction) String() string {
+	switch a {
+	case PORT_BUSY_FAIL:
+		return "fail"
+	case PORT_BUSY_WAIT:
+		return "wait"
+	case PORT_BUSY_RETRY:
+		return "retry"
+	}
+	panic("Internal error, unknown port busy action " + strconv.Itoa(int(a)))
+}
+
+// splitCommands splits a list of AT commands separated by literal '\r', returning nil if there are none
+func splitCommands(s string) []string {
+	var result []string
+	for _, cmd := range strings.Split(s, "\\r") {
+		if cmd = strings.TrimSpace(cmd); cmd != "" {
+			result = append(result, cmd)
+		}
+	}
+	return result
+}
+
+// name of the modem configured by a plain [modem] section without any [modem.<name>] sections
+const DEFAULT_MODEM_NAME = "default"
+
+// prefixes of [modem] serialPort values that connect to a serial server (like ser2net) instead of opening a local device:
+// raw TCP and telnet with RFC 2217 COM port control
+const SERIAL_PORT_TCP_PREFIX = "tcp://"
+const SERIAL_PORT_RFC2217_PREFIX = "rfc2217://"
+
+// prefix of [modem] serialPort values that replay a transcript recorded by [modem] transcriptFile instead of talking to a modem
+const SERIAL_PORT_REPLAY_PREFIX = "replay://"
+
+// [modem] serialPort value that makes the gateway probe the candidate serial ports for the one answering AT
+const SERIAL_PORT_AUTO = "auto"
+
+// IsRemoteSerialPort returns TRUE if the serial port is the tcp:// or rfc2217:// address of a serial server
+func IsRemoteSerialPort(serialPort string) bool {
+	return strings.HasPrefix(serialPort, SERIAL_PORT_TCP_PREFIX) || strings.HasPrefix(serialPort, SERIAL_PORT_RFC2217_PREFIX)
+}
+
+// IsReplaySerialPort returns TRUE if the serial port is the replay://<file> address of a transcript
+func IsReplaySerialPort(serialPort string) bool {
+	return strings.HasPrefix(serialPort, SERIAL_PORT_REPLAY_PREFIX)
+}
+
+// AT commands the AT console refuses unless [admin] deniedCommands says otherwise:
+// entering or changing PINs and locks may block the SIM card, AT+CFUN may switch the radio off for good
+// and AT+CMGS/AT+CMGW leave the modem waiting for a message body at the '>' prompt until the command times out
+const DEFAULT_DENIED_COMMANDS = "AT+CPIN=,AT+CLCK,AT+CPWD,AT+CFUN=,AT+CMGS,AT+CMGW"
+
+// ModemConfig holds the settings of a single modem, configured either by the [modem] section
+// or by a [modem.<name>] section that inherits all keys it does not set from [modem]
+type ModemConfig struct {
+	name     string
+	priority int
+	driver   ModemDriver
+	simPin   string
+	smsMode  SmsMode
+	// vendor profile, detected when opening the serial port if set to auto
+	profile ModemProfile
+	// init commands replacing the profile's ones (nil to use the profile's) and init commands sent on top of those
+	initCmds      []string
+	extraInitCmds []string
+	// network registration queries replacing the profile's ones, nil to use the profile's
+	registrationCmds []string
+	// per-modem rate limits, on top of the [sms] ones
+	rateLimit1 *util.RateLimit
+	rateLimit2 *util.RateLimit
+	simulator  *SimulatorConfig
+	// how long to cache signal quality, operator and SIM identity
+	diagnosticsRefreshInterval time.Duration
+	// whether USSD strings are exchanged as hex-encoded, packed GSM-7, nil to use the profile's setting
+	ussdPacked *bool
+	// AT+CMEE mode, 1 = numeric error codes, 2 = error texts
+	cmeeMode int
+	// prepaid balance check, disabled if no interval is set
+	balanceCheckInterval *util.TimeInterval
+	balanceUssdCode      string
+	balanceRegex         *regexp.Regexp
+	balanceThreshold     *float64
+	// health watchdog, disabled if no interval is set
+	watchdogInterval         *util.TimeInterval
+	watchdogFailureThreshold int
+	watchdogRecoverySteps    []RecoveryStep
+	// serial
+	usbDeviceId *common.UsbDeviceId
+	// USB serial number and bus path for telling apart identical USB devices, empty to accept any
+	usbSerial string
+	usbPath   string
+	// bInterfaceNumber of the USB interface to use, nil if serialPort is an index into the device's serial ports
+	usbInterface      *int
+	serialPort        string
+	serialSpeed       int
+	serialReadTimeout time.Duration
+	// whether to re-initialize the modem when its USB device gets unplugged/re-enumerated
+	usbHotplug bool
+	// what to do if another process holds the serial port, how often to try again with portBusy=retry
+	// and how long to wait with portBusy=wait
+	portBusyAction  PortBusyAction
+	portBusyRetries int
+	portBusyTimeout time.Duration
+	// file recording everything sent to and received from the modem, "" to disable
+	transcriptFile string
+	// size in bytes at which the transcript file gets rotated
+	transcriptMaxSize int64
+	// hilink
+	hilinkUrl      string
+	hilinkUser     string
+	hilinkPassword string
+	hilinkTimeout  time.Duration
+}
+
+var validModemName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
 type TlsConfig struct {
 	CertFilePath       string
 	PrivateKeyFilePath string
@@ -81,22 +426,26 @@ type Config struct {
 	restPassword string
 	restPort     int
 	bindIp       string
+	// admin endpoints
+	adminUser       string
+	adminPassword   string
+	allowedCommands []string
+	deniedCommands  []string
 	// SIM
 	maxLength         int
-	simPin            string
+	maxSegments       int
+	concatRefBits     int
 	smsRecipients     []string
 	rateLimit1        *util.RateLimit
 	rateLimit2        *util.RateLimit
 	keepAliveInterval *util.TimeInterval
 	keepAliveMessage  string
+	receiveInterval   *util.TimeInterval
 	dropOnRateLimit   bool
-	// modem
-	modemInitCmds []string
-	// serial
-	usbDeviceId       *common.UsbDeviceId
-	serialPort        string
-	serialSpeed       int
-	serialReadTimeout time.Duration
+	deliveryReports   bool
+	// modems, ordered ascending by priority
+	modems         []ModemConfig
+	modemSelection ModemSelection
 }
 
 var log = logger.GetLogger("config")
@@ -134,7 +483,362 @@ func parseTimeInterval(interval string) (*util.TimeInterval, error) {
 		return nil, errors.New("Invalid time Interval string: '" + interval + "'")
 	}
 	unitStr, err := util.StringToTimeUnit(match[2])
-	return &util.TimeInterval{valueStr, unitStr}, err
+	return &util.TimeInterval{Value: valueStr, Unit: unitStr}, err
+}
+
+func parseSimulatorConfig(section *ini.Section) (*SimulatorConfig, error) {
+
+	result := SimulatorConfig{}
+
+	// [simulator] registration
+	result.Registration = strings.ToLower(strings.TrimSpace(section.Key("registration").MustString("home")))
+	if !slices.Contains(SIMULATOR_REGISTRATION_STATES, result.Registration) {
+		return nil, errors.New("key 'registration' must be one of " + strings.Join(SIMULATOR_REGISTRATION_STATES, ", "))
+	}
+
+	// [simulator] pinState
+	result.PinState = strings.ToLower(strings.TrimSpace(section.Key("pinState").MustString("ready")))
+	if !slices.Contains(SIMULATOR_PIN_STATES, result.PinState) {
+		return nil, errors.New("key 'pinState' must be one of " + strings.Join(SIMULATOR_PIN_STATES, ", "))
+	}
+
+	// [simulator] pin
+	result.Pin = strings.TrimSpace(section.Key("pin").MustString("1234"))
+
+	// [simulator] puk
+	result.Puk = strings.TrimSpace(section.Key("puk").MustString("12345678"))
+
+	// [simulator] failureRate
+	var err error
+	result.FailureRate, err = section.Key("failureRate").Float64()
+	if err != nil && section.Key("failureRate").String() != "" {
+		return nil, errors.New("key 'failureRate' must be a number - " + err.Error())
+	}
+	if result.FailureRate < 0 || result.FailureRate > 1 {
+		return nil, errors.New("key 'failureRate' must be in the range 0...1")
+	}
+
+	// [simulator] latencyMillis
+	latencyMillis := section.Key("latencyMillis").MustInt(0)
+	if latencyMillis < 0 {
+		return nil, errors.New("key 'latencyMillis' must not be negative")
+	}
+	result.Latency = time.Duration(latencyMillis) * time.Millisecond
+
+	// [simulator] balance
+	result.Balance = strings.TrimSpace(section.Key("balance").MustString("10.00"))
+	return &result, nil
+}
+
+// parseModemConfig parses the settings of a single modem, simulatorSection is only used with driver=simulator
+func parseModemConfig(name string, section *ini.Section, simulatorSection *ini.Section) (*ModemConfig, error) {
+
+	result := ModemConfig{name: name}
+	var err error
+
+	// [modem] priority
+	result.priority, err = section.Key("priority").Int()
+	if err != nil && section.Key("priority").String() != "" {
+		return nil, errors.New("key 'priority' must be an integer - " + err.Error())
+	}
+
+	// [modem] driver
+	result.driver, err = ParseModemDriver(section.Key("driver").String())
+	if err != nil {
+		return nil, err
+	}
+
+	if result.driver == MODEM_DRIVER_SERIAL {
+		// [modem] usbDeviceId
+		usbVendorId := section.Key("usbVendorId").MustString("")
+		usbProductId := section.Key("usbProductId").MustString("")
+		if usbVendorId != "" || usbProductId != "" {
+			if usbVendorId == "" || usbProductId == "" {
+				return nil, errors.New("either none or both of usbVendorId and usbProductId need to be specified")
+			}
+			vendorId, err := ParseHex16Bit(usbVendorId)
+			if err != nil {
+				return nil, errors.New("invalid value for key 'usbVendorId' - " + err.Error())
+			}
+			productId, err := ParseHex16Bit(usbProductId)
+			if err != nil {
+				return nil, errors.New("invalid value for key 'usbProductId' - " + err.Error())
+			}
+			result.usbDeviceId = &common.UsbDeviceId{VendorId: vendorId, ProductId: productId}
+		}
+
+		// [modem] usbSerial
+		result.usbSerial = strings.TrimSpace(section.Key("usbSerial").String())
+		// [modem] usbPath
+		result.usbPath = strings.TrimSpace(section.Key("usbPath").String())
+		if (result.usbSerial != "" || result.usbPath != "") && result.usbDeviceId == nil {
+			return nil, errors.New("usbSerial and usbPath require usbVendorId and usbProductId")
+		}
+
+		// [modem] usbInterface
+		if value := strings.TrimSpace(section.Key("usbInterface").String()); value != "" {
+			if result.usbDeviceId == nil {
+				return nil, errors.New("usbInterface requires usbVendorId and usbProductId")
+			}
+			number, err := strconv.Atoi(value)
+			if err != nil || number < 0 || number > 255 {
+				return nil, errors.New("invalid value for key 'usbInterface' - expected an interface number between 0 and 255")
+			}
+			result.usbInterface = &number
+		}
+
+		// [modem] usbHotplug
+		result.usbHotplug, err = stringToBool(section.Key("usbHotplug").MustString("true"))
+		if err != nil {
+			return nil, errors.New("invalid value for key 'usbHotplug' - " + err.Error())
+		}
+
+		// [modem] serialPort
+		result.serialPort = strings.TrimSpace(section.Key("serialPort").String())
+		if result.usbInterface != nil {
+			if result.serialPort != "" {
+				return nil, errors.New("usbInterface and serialPort are mutually exclusive")
+			}
+		} else if result.serialPort == "" {
+			return nil, errors.New("a value for key 'serialPort' is required")
+		}
+		if IsRemoteSerialPort(result.serialPort) {
+			if result.usbDeviceId != nil {
+				return nil, errors.New("usbVendorId/usbProductId cannot be combined with a tcp:// or rfc2217:// serialPort")
+			}
+			address := strings.TrimPrefix(strings.TrimPrefix(result.serialPort, SERIAL_PORT_TCP_PREFIX), SERIAL_PORT_RFC2217_PREFIX)
+			host, port, err := net.SplitHostPort(address)
+			if err != nil || host == "" {
+				return nil, errors.New("invalid value for key 'serialPort' - expected tcp://<host>:<port> or rfc2217://<host>:<port>")
+			}
+			if val, err := strconv.Atoi(port); err != nil || val <= 0 || val > 65535 {
+				return nil, errors.New("invalid value for key 'serialPort' - port must be between 1 and 65535")
+			}
+		}
+		if IsReplaySerialPort(result.serialPort) {
+			if result.usbDeviceId != nil {
+				return nil, errors.New("usbVendorId/usbProductId cannot be combined with a replay:// serialPort")
+			}
+			if strings.TrimPrefix(result.serialPort, SERIAL_PORT_REPLAY_PREFIX) == "" {
+				return nil, errors.New("invalid value for key 'serialPort' - expected replay://<transcript file>")
+			}
+		}
+		if result.usbDeviceId != nil && result.usbInterface == nil && result.serialPort != SERIAL_PORT_AUTO {
+			val, err := strconv.Atoi(result.serialPort)
+			if err != nil || val < 0 {
+				return nil, errors.New("when usbVendorId/usbProductId is configured, serialPort has to be a positive integer number or 'auto'")
+			}
+		}
+
+		// [modem] serialSpeed
+		result.serialSpeed, err = section.Key("serialSpeed").Int()
+		if err != nil {
+			return nil, errors.New("invalid value for key 'serialSpeed' - " + err.Error())
+		}
+
+		// [modem] serialReadTimeoutSeconds
+		readTimeoutSeconds, err := section.Key("serialReadTimeoutSeconds").Int()
+		if err != nil {
+			return nil, errors.New("invalid value for key 'serialReadTimeoutSeconds' - " + err.Error())
+		}
+		result.serialReadTimeout = time.Duration(readTimeoutSeconds) * time.Second
+
+		// [modem] portBusy
+		result.portBusyAction, err = ParsePortBusyAction(section.Key("portBusy").String())
+		if err != nil {
+			return nil, err
+		}
+
+		// [modem] portBusyRetries
+		result.portBusyRetries = section.Key("portBusyRetries").MustInt(5)
+		if result.portBusyRetries <= 0 {
+			return nil, errors.New("key 'portBusyRetries' must be > 0")
+		}
+
+		// [modem] portBusyTimeoutSeconds
+		portBusyTimeoutSeconds := section.Key("portBusyTimeoutSeconds").MustInt(60)
+		if portBusyTimeoutSeconds <= 0 {
+			return nil, errors.New("key 'portBusyTimeoutSeconds' must be > 0")
+		}
+		result.portBusyTimeout = time.Duration(portBusyTimeoutSeconds) * time.Second
+
+		// [modem] transcriptFile
+		result.transcriptFile = strings.TrimSpace(section.Key("transcriptFile").String())
+
+		// [modem] transcriptMaxSizeKb
+		transcriptMaxSizeKb := section.Key("transcriptMaxSizeKb").MustInt(10240)
+		if transcriptMaxSizeKb <= 0 {
+			return nil, errors.New("key 'transcriptMaxSizeKb' must be > 0")
+		}
+		result.transcriptMaxSize = int64(transcriptMaxSizeKb) * 1024
+	}
+
+	if result.driver == MODEM_DRIVER_HILINK {
+		// [modem] hilinkUrl
+		result.hilinkUrl = strings.TrimSuffix(strings.TrimSpace(section.Key("hilinkUrl").MustString("http://192.168.8.1")), "/")
+		parsed, err := url.Parse(result.hilinkUrl)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, errors.New("invalid value for key 'hilinkUrl' - expected something like http://192.168.8.1")
+		}
+
+		// [modem] hilinkUser
+		result.hilinkUser = strings.TrimSpace(section.Key("hilinkUser").MustString("admin"))
+
+		// [modem] hilinkPassword
+		result.hilinkPassword = section.Key("hilinkPassword").String()
+
+		// [modem] hilinkTimeoutSeconds
+		timeoutSeconds := section.Key("hilinkTimeoutSeconds").MustInt(10)
+		if timeoutSeconds <= 0 {
+			return nil, errors.New("key 'hilinkTimeoutSeconds' must be > 0")
+		}
+		result.hilinkTimeout = time.Duration(timeoutSeconds) * time.Second
+	}
+
+	if result.driver == MODEM_DRIVER_SIMULATOR {
+		result.simulator, err = parseSimulatorConfig(simulatorSection)
+		if err != nil {
+			return nil, errors.New("invalid configuration in [" + simulatorSection.Name() + "] section - " + err.Error())
+		}
+	}
+
+	// [modem] simPin
+	result.simPin = section.Key("simPin").String()
+	if strings.TrimSpace(result.simPin) == "" {
+		return nil, errors.New("value for key 'simPin' cannot be empty/blank/missing")
+	}
+
+	// [modem] profile
+	result.profile, err = ParseModemProfile(section.Key("profile").String())
+	if err != nil {
+		return nil, err
+	}
+
+	// [modem] initCmds
+	if section.HasKey("initCmds") {
+		result.initCmds = splitCommands(section.Key("initCmds").String())
+		if result.initCmds == nil {
+			result.initCmds = []string{}
+		}
+	}
+
+	// [modem] extraInitCmds
+	result.extraInitCmds = splitCommands(section.Key("extraInitCmds").String())
+
+	// [modem] registrationCmds
+	for _, cmd := range strings.Split(section.Key("registrationCmds").String(), ",") {
+		cmd = strings.ToUpper(strings.TrimSpace(cmd))
+		if cmd == "" {
+			continue
+		}
+		if cmd != "AT+CREG?" && cmd != "AT+CGREG?" && cmd != "AT+CEREG?" && cmd != "AT+C5GREG?" {
+			return nil, errors.New("invalid value for key 'registrationCmds' - '" + cmd + "' is none of AT+CREG?, AT+CGREG?, AT+CEREG? and AT+C5GREG?")
+		}
+		result.registrationCmds = append(result.registrationCmds, cmd)
+	}
+
+	// [modem] smsMode
+	result.smsMode, err = ParseSmsMode(section.Key("smsMode").String())
+	if err != nil {
+		return nil, err
+	}
+	if result.driver == MODEM_DRIVER_HILINK {
+		// HiLink sticks take the whole message and split it into concatenated SMS themselves
+		result.smsMode = SMS_MODE_PDU
+	}
+
+	// [modem] rateLimit1
+	result.rateLimit1, err = parseRateLimit(section.Key("rateLimit1").String())
+	if err != nil {
+		return nil, err
+	}
+
+	// [modem] rateLimit2
+	result.rateLimit2, err = parseRateLimit(section.Key("rateLimit2").String())
+	if err != nil {
+		return nil, err
+	}
+
+	// [modem] diagnosticsRefreshInterval
+	refreshInterval, err := parseTimeInterval(section.Key("diagnosticsRefreshInterval").MustString("1m"))
+	if err != nil {
+		return nil, errors.New("invalid value for key 'diagnosticsRefreshInterval' - " + err.Error())
+	}
+	result.diagnosticsRefreshInterval = time.Duration(refreshInterval.ToSeconds()) * time.Second
+
+	// [modem] ussdPacked
+	if s := section.Key("ussdPacked").String(); s != "" {
+		packed, err := stringToBool(s)
+		if err != nil {
+			return nil, errors.New("invalid value for key 'ussdPacked' - " + err.Error())
+		}
+		result.ussdPacked = &packed
+	}
+
+	// [modem] cmeeMode
+	result.cmeeMode = section.Key("cmeeMode").MustInt(1)
+	if result.cmeeMode != 1 && result.cmeeMode != 2 {
+		return nil, errors.New("key 'cmeeMode' must be 1 or 2")
+	}
+
+	// [modem] balanceCheckInterval
+	if s := section.Key("balanceCheckInterval").String(); s != "" {
+		result.balanceCheckInterval, err = parseTimeInterval(s)
+		if err != nil {
+			return nil, errors.New("invalid value for key 'balanceCheckInterval' - " + err.Error())
+		}
+	}
+
+	// [modem] balanceUssdCode
+	result.balanceUssdCode = strings.TrimSpace(section.Key("balanceUssdCode").MustString("*100#"))
+
+	// [modem] balanceRegex
+	result.balanceRegex, err = regexp.Compile(section.Key("balanceRegex").MustString(`(-?\d+(?:[.,]\d+)?)`))
+	if err != nil {
+		return nil, errors.New("invalid value for key 'balanceRegex' - " + err.Error())
+	}
+
+	// [modem] balanceThreshold
+	if s := section.Key("balanceThreshold").String(); s != "" {
+		threshold, err := section.Key("balanceThreshold").Float64()
+		if err != nil {
+			return nil, errors.New("key 'balanceThreshold' must be a number - " + err.Error())
+		}
+		result.balanceThreshold = &threshold
+	}
+
+	// [modem] watchdogInterval
+	if s := section.Key("watchdogInterval").String(); s != "" {
+		result.watchdogInterval, err = parseTimeInterval(s)
+		if err != nil {
+			return nil, errors.New("invalid value for key 'watchdogInterval' - " + err.Error())
+		}
+	}
+
+	// [modem] watchdogFailureThreshold
+	result.watchdogFailureThreshold = section.Key("watchdogFailureThreshold").MustInt(3)
+	if result.watchdogFailureThreshold < 1 {
+		return nil, errors.New("key 'watchdogFailureThreshold' must be at least 1")
+	}
+
+	// [modem] watchdogRecoverySteps
+	result.watchdogRecoverySteps, err = parseRecoverySteps(section.Key("watchdogRecoverySteps").MustString("reopen,soft_reset,usb_reset,rediscover"))
+	if err != nil {
+		return nil, errors.New("invalid value for key 'watchdogRecoverySteps' - " + err.Error())
+	}
+	return &result, nil
+}
+
+// parseCommandPrefixes parses a comma-separated list of AT command prefixes, upper-casing them
+func parseCommandPrefixes(s string) []string {
+	var result []string
+	for _, prefix := range strings.Split(s, ",") {
+		prefix = NormalizeAtCommand(prefix)
+		if prefix != "" {
+			result = append(result, prefix)
+		}
+	}
+	return result
 }
 
 func fail(msg string) (*Config, error) {
@@ -251,6 +955,28 @@ func LoadConfig(path string, createIfMissing bool) (*Config, error) {
 		return fail("Invalid configuration value for key 'port' in [restapi] section " + convError.Error())
 	}
 
+	// [admin] user
+	result.adminUser = strings.TrimSpace(cfg.Section("admin").Key("user").String())
+
+	// [admin] password
+	result.adminPassword = cfg.Section("admin").Key("password").String()
+	if result.adminUser != "" && strings.TrimSpace(result.adminPassword) == "" {
+		return fail("Invalid configuration value for key 'password' in [admin] section - a value is required if 'user' is set")
+	}
+	if result.adminUser != "" && result.adminUser == result.restUser {
+		return fail("Invalid configuration value for key 'user' in [admin] section - must differ from [restapi] user")
+	}
+
+	// [admin] allowedCommands
+	result.allowedCommands = parseCommandPrefixes(cfg.Section("admin").Key("allowedCommands").String())
+
+	// [admin] deniedCommands
+	if cfg.Section("admin").HasKey("deniedCommands") {
+		result.deniedCommands = parseCommandPrefixes(cfg.Section("admin").Key("deniedCommands").String())
+	} else {
+		result.deniedCommands = parseCommandPrefixes(DEFAULT_DENIED_COMMANDS)
+	}
+
 	// [sms] dropOnRateLimit
 	s := cfg.Section("sms").Key("dropOnRateLimit").MustString("")
 	if s == "" {
@@ -279,6 +1005,23 @@ func LoadConfig(path string, createIfMissing bool) (*Config, error) {
 		result.maxLength = -1
 	}
 
+	// [sms] maxSegments
+	sMaxSegments := cfg.Section("sms").Key("maxSegments").MustString("")
+	if sMaxSegments != "" {
+		result.maxSegments, convError = strconv.Atoi(sMaxSegments)
+		if convError != nil || result.maxSegments < 1 || result.maxSegments > 255 {
+			return fail("Value for key 'maxSegments' in [sms] section must be an integer in the range 1...255")
+		}
+	} else {
+		result.maxSegments = 1
+	}
+
+	// [sms] concatReferenceBits
+	result.concatRefBits = cfg.Section("sms").Key("concatReferenceBits").MustInt(8)
+	if result.concatRefBits != 8 && result.concatRefBits != 16 {
+		return fail("Value for key 'concatReferenceBits' in [sms] section must be either 8 or 16")
+	}
+
 	// [sms] rateLimit1
 	result.rateLimit1, convError = parseRateLimit(cfg.Section("sms").Key("rateLimit1").String())
 	if convError != nil {
@@ -325,60 +1068,76 @@ func LoadConfig(path string, createIfMissing bool) (*Config, error) {
 		}
 	}
 
-	// [modem] usbDeviceId
-	usbVendorId := cfg.Section("modem").Key("usbVendorId").MustString("")
-	usbProductId := cfg.Section("modem").Key("usbProductId").MustString("")
-	if usbVendorId != "" || usbProductId != "" {
-		if usbVendorId == "" || usbProductId == "" {
-			return fail("Either none or both of [modem] usbVendorId and usbProductId need to be specified")
-		}
-		vendorId, convError := ParseHex16Bit(usbVendorId)
-		if convError != nil {
-			return fail("Invalid configuration value for key 'usbVendorId' in [modem] section - " + convError.Error())
-		}
-		productId, convError := ParseHex16Bit(usbProductId)
+	// [sms] receivePollInterval
+	iv = cfg.Section("sms").Key("receivePollInterval").String()
+	if strings.TrimSpace(iv) != "" {
+		result.receiveInterval, convError = parseTimeInterval(iv)
 		if convError != nil {
-			return fail("Invalid configuration value for key 'usbProductId' in [modem] section - " + convError.Error())
+			return fail("Invalid configuration value for key 'receivePollInterval' in [sms] section - " + convError.Error())
 		}
-		result.usbDeviceId = &common.UsbDeviceId{VendorId: vendorId, ProductId: productId}
-	} else {
-		result.usbDeviceId = nil
 	}
 
-	// [modem] serialPort
-	result.serialPort = strings.TrimSpace(cfg.Section("modem").Key("serialPort").String())
-	if result.serialPort == "" {
-		return fail("A value for [modem] serialPort is required")
-	}
-	if result.usbDeviceId != nil {
-		val, convError := strconv.Atoi(result.serialPort)
-		if convError != nil || val < 0 {
-			return fail("When [modem] usbVendorId/usbProductId is configured, [modem] serialPort has to be a positive integer number.")
+	// [sms] deliveryReports
+	s = cfg.Section("sms").Key("deliveryReports").MustString("")
+	if s != "" {
+		result.deliveryReports, convError = stringToBool(s)
+		if convError != nil {
+			return fail("Invalid configuration boolean value for key 'deliveryReports' in [sms] section " + convError.Error())
+		}
+		if result.deliveryReports && result.receiveInterval == nil {
+			return fail("[sms] deliveryReports requires [sms] receivePollInterval to be set as status reports are fetched from the modem")
 		}
 	}
 
-	// [modem] serialSpeed
-	result.serialSpeed, convError = cfg.Section("modem").Key("serialSpeed").Int()
+	// [sms] modemSelection
+	result.modemSelection, convError = ParseModemSelection(cfg.Section("sms").Key("modemSelection").String())
 	if convError != nil {
-		return fail("Invalid configuration value for key 'serialSpeed' in [modem] section " + convError.Error())
+		return fail("Invalid configuration value for key 'modemSelection' in [sms] section - " + convError.Error())
 	}
 
-	// [modem] serialReadTimeoutSeconds
-	readTimeoutSeconds, convError := cfg.Section("modem").Key("serialReadTimeoutSeconds").Int()
-	if convError != nil {
-		return fail("Invalid configuration value for key 'serialReadTimeoutSeconds' in [modem] section " + convError.Error())
+	// [modem.<name>] sections, falling back to a single modem configured by [modem]
+	for _, section := range cfg.Sections() {
+		name, found := strings.CutPrefix(section.Name(), "modem.")
+		if !found {
+			continue
+		}
+		if !validModemName.MatchString(name) {
+			return fail("Invalid modem name in section [" + section.Name() + "], only letters, digits, '-' and '_' are allowed")
+		}
+		modemConfig, convError := parseModemConfig(name, section, cfg.Section("simulator."+name))
+		if convError != nil {
+			return fail("Invalid configuration in [" + section.Name() + "] section - " + convError.Error())
+		}
+		result.modems = append(result.modems, *modemConfig)
 	}
-	result.serialReadTimeout = time.Duration(readTimeoutSeconds) * time.Second
-
-	// [modem] simPin
-	result.simPin = cfg.Section("modem").Key("simPin").String()
-	if strings.TrimSpace(result.simPin) == "" {
-		return fail("Invalid configuration value for key 'simPin' in [modem] section - value cannot be empty/blank/missing")
+	if len(result.modems) == 0 {
+		modemConfig, convError := parseModemConfig(DEFAULT_MODEM_NAME, cfg.Section("modem"), cfg.Section("simulator"))
+		if convError != nil {
+			return fail("Invalid configuration in [modem] section - " + convError.Error())
+		}
+		result.modems = append(result.modems, *modemConfig)
+	}
+	slices.SortStableFunc(result.modems, func(a, b ModemConfig) int {
+		return a.priority - b.priority
+	})
+
+	for idx, modem := range result.modems {
+		for _, other := range result.modems[idx+1:] {
+			if modem.driver == MODEM_DRIVER_SERIAL && other.driver == MODEM_DRIVER_SERIAL && modem.usbDeviceId == nil &&
+				other.usbDeviceId == nil && modem.serialPort == other.serialPort && modem.serialPort != SERIAL_PORT_AUTO {
+				return fail("Modems '" + modem.name + "' and '" + other.name + "' must not use the same serial port " + modem.serialPort)
+			}
+			if modem.transcriptFile != "" && modem.transcriptFile == other.transcriptFile {
+				return fail("Modems '" + modem.name + "' and '" + other.name + "' must not use the same transcript file " + modem.transcriptFile)
+			}
+			if modem.driver == MODEM_DRIVER_HILINK && other.driver == MODEM_DRIVER_HILINK && modem.hilinkUrl == other.hilinkUrl {
+				return fail("Modems '" + modem.name + "' and '" + other.name + "' must not use the same HiLink URL " + modem.hilinkUrl)
+			}
+		}
+		if result.maxSegments > 1 && modem.smsMode != SMS_MODE_PDU {
+			log.Warn("[sms] maxSegments > 1 requires smsMode=pdu, messages sent by modem '" + modem.name + "' will be sent as a single segment")
+		}
 	}
-
-	// [modem] initCmds
-	initCmds := cfg.Section("modem").Key("initCmds").String()
-	result.modemInitCmds = strings.Split(initCmds, "\\r")
 	return &result, nil
 }
 
@@ -398,58 +1157,62 @@ func (c Config) GetPassword() string {
 	return c.restPassword
 }
 
-func (c Config) GetTLSConfig() *TlsConfig {
-	// FIXME: Add TLS support
-	return nil
+// GetAdminUser returns the user for the /admin REST endpoints, "" if they are disabled
+func (c Config) GetAdminUser() string {
+	return c.adminUser
 }
 
-func (c Config) GetRateLimit1() *util.RateLimit {
-	return c.rateLimit1
+func (c Config) GetAdminPassword() string {
+	return c.adminPassword
 }
 
-func (c Config) GetRateLimit2() *util.RateLimit {
-	return c.rateLimit2
+// NormalizeAtCommand upper-cases an AT command and removes all whitespace outside of quoted strings,
+// modems ignore it (ITU-T V.250) so 'AT+CFUN =0' needs to be matched just like 'AT+CFUN=0'
+func NormalizeAtCommand(cmd string) string {
+	var sb strings.Builder
+	quoted := false
+	for _, c := range cmd {
+		if c == '"' {
+			quoted = !quoted
+		}
+		if !quoted && unicode.IsSpace(c) {
+			continue
+		}
+		sb.WriteRune(c)
+	}
+	return strings.ToUpper(sb.String())
 }
 
-func (c Config) GetSerialSpeed() int {
-	return c.serialSpeed
+// IsAtCommandAllowed returns TRUE if an AT console command matches none of the denied command prefixes and,
+// if allowed command prefixes are configured, at least one of those
+func (c Config) IsAtCommandAllowed(cmd string) bool {
+	cmd = NormalizeAtCommand(cmd)
+	hasPrefix := func(prefix string) bool {
+		return strings.HasPrefix(cmd, prefix)
+	}
+	if slices.ContainsFunc(c.deniedCommands, hasPrefix) {
+		return false
+	}
+	return len(c.allowedCommands) == 0 || slices.ContainsFunc(c.allowedCommands, hasPrefix)
 }
 
-func (c Config) GetSerialPort() (string, error) {
-
-	if c.GetUsbDeviceId() != nil {
-		iFaces, err := serialportdiscovery.DiscoverUsbInterfaces(*c.usbDeviceId)
-		if err != nil {
-			return "", err
-		}
-		if len(iFaces) == 0 {
-			return "", errors.New("serial-port auto discovery found no usb interfaces")
-		}
+func (c Config) GetTLSConfig() *TlsConfig {
+	// FIXME: Add TLS support
+	return nil
+}
 
-		idx, _ := strconv.Atoi(c.serialPort)
-		if len(iFaces) <= idx {
-			return "", errors.New("serial-port auto discovery found only " + strconv.Itoa(len(iFaces)) + " interfaces but" +
-				"[modem] serialPort config requested interface #" + strconv.Itoa(idx))
-		}
-		discovered := iFaces[idx]
-		log.Info("Going to use device #" + strconv.Itoa(idx) + " [" + discovered + "]")
-		return discovered, nil
-	}
-	return c.serialPort, nil
+func (c Config) GetRateLimit1() *util.RateLimit {
+	return c.rateLimit1
 }
 
-func (c Config) GetSerialReadTimeout() time.Duration {
-	return c.serialReadTimeout
+func (c Config) GetRateLimit2() *util.RateLimit {
+	return c.rateLimit2
 }
 
 func (c Config) GetDataDirectory() string {
 	return c.dataDirectory
 }
 
-func (c Config) GetSimPin() string {
-	return c.simPin
-}
-
 func (c Config) GetSmsRecipients() []string {
 	return c.smsRecipients
 }
@@ -458,10 +1221,6 @@ func (c Config) GetLogLevel() logger.LogLevel {
 	return c.logLevel
 }
 
-func (c Config) GetModemInitCmds() []string {
-	return c.modemInitCmds
-}
-
 func (c Config) GetKeepAliveInterval() *util.TimeInterval {
 	if c.keepAliveInterval == nil {
 		return nil
@@ -470,6 +1229,15 @@ func (c Config) GetKeepAliveInterval() *util.TimeInterval {
 	return &clone
 }
 
+// GetReceivePollInterval returns how often to check the modem for incoming messages, nil if receiving is disabled
+func (c Config) GetReceivePollInterval() *util.TimeInterval {
+	if c.receiveInterval == nil {
+		return nil
+	}
+	clone := *c.receiveInterval
+	return &clone
+}
+
 func (c Config) GetKeepAliveMessage() string {
 	return c.keepAliveMessage
 }
@@ -489,14 +1257,297 @@ func (c Config) IsNotSet(flag DebugFlag) bool {
 	return !c.IsSet(flag)
 }
 
-func (c Config) GetUsbDeviceId() *common.UsbDeviceId {
-	return c.usbDeviceId
-}
-
 func (c Config) IsDropOnRateLimit() bool {
 	return c.dropOnRateLimit
 }
 
+// GetMaxMessageLength returns the maximum number of characters per SMS segment or -1 if not limited
 func (c Config) GetMaxMessageLength() int {
 	return c.maxLength
 }
+
+// IsDeliveryReports returns whether delivery status reports should be requested for every SMS sent
+func (c Config) IsDeliveryReports() bool {
+	return c.deliveryReports
+}
+
+// GetMaxSegments returns the maximum number of segments a concatenated SMS may consist of
+func (c Config) GetMaxSegments() int {
+	return c.maxSegments
+}
+
+// GetConcatReferenceBits returns the size (8 or 16 bits) of the reference number used in concatenated SMS
+func (c Config) GetConcatReferenceBits() int {
+	return c.concatRefBits
+}
+
+// GetModems returns all configured modems, ordered ascending by priority
+func (c Config) GetModems() []ModemConfig {
+	return slices.Clone(c.modems)
+}
+
+// GetModemSelection returns how to choose the modem for sending a message
+func (c Config) GetModemSelection() ModemSelection {
+	return c.modemSelection
+}
+
+// GetName returns the modem's name, DEFAULT_MODEM_NAME unless configured by a [modem.<name>] section
+func (m ModemConfig) GetName() string {
+	return m.name
+}
+
+// GetPriority returns the modem's priority, modems with lower values get tried first
+func (m ModemConfig) GetPriority() int {
+	return m.priority
+}
+
+func (m ModemConfig) GetModemDriver() ModemDriver {
+	return m.driver
+}
+
+func (m ModemConfig) GetSimPin() string {
+	return m.simPin
+}
+
+// GetProfile returns the configured vendor profile, MODEM_PROFILE_AUTO if it should be detected
+func (m ModemConfig) GetProfile() ModemProfile {
+	return m.profile
+}
+
+// GetModemInitCmds returns the init commands replacing the ones of the modem's profile, nil if the profile's should be used
+func (m ModemConfig) GetModemInitCmds() []string {
+	return slices.Clone(m.initCmds)
+}
+
+// GetExtraInitCmds returns the init commands to send after the ones of the modem's profile
+func (m ModemConfig) GetExtraInitCmds() []string {
+	return slices.Clone(m.extraInitCmds)
+}
+
+// GetRegistrationCmds returns the network registration queries replacing the ones of the modem's profile,
+// nil if the profile's should be used
+func (m ModemConfig) GetRegistrationCmds() []string {
+	return slices.Clone(m.registrationCmds)
+}
+
+func (m ModemConfig) GetSmsMode() SmsMode {
+	return m.smsMode
+}
+
+// GetRateLimit1 returns the modem's own rate limit #1, nil if not configured
+func (m ModemConfig) GetRateLimit1() *util.RateLimit {
+	return m.rateLimit1
+}
+
+// GetRateLimit2 returns the modem's own rate limit #2, nil if not configured
+func (m ModemConfig) GetRateLimit2() *util.RateLimit {
+	return m.rateLimit2
+}
+
+// GetSimulatorConfig returns the simulated modem's settings, nil unless driver=simulator
+func (m ModemConfig) GetSimulatorConfig() *SimulatorConfig {
+	return m.simulator
+}
+
+func (m ModemConfig) GetUsbDeviceId() *common.UsbDeviceId {
+	return m.usbDeviceId
+}
+
+// IsUsbHotplug returns TRUE if the modem's USB device should be watched for removal and re-enumeration,
+// only applies if usbVendorId/usbProductId are configured
+func (m ModemConfig) IsUsbHotplug() bool {
+	return m.usbHotplug && m.usbDeviceId != nil
+}
+
+func (m ModemConfig) GetSerialSpeed() int {
+	return m.serialSpeed
+}
+
+// GetUsbSelector returns what identifies the modem's USB device, nil unless usbVendorId/usbProductId are configured
+func (m ModemConfig) GetUsbSelector() *serialportdiscovery.UsbSelector {
+	if m.usbDeviceId == nil {
+		return nil
+	}
+	return &serialportdiscovery.UsbSelector{DeviceId: *m.usbDeviceId, Serial: m.usbSerial, Path: m.usbPath}
+}
+
+// IsAutoSerialPort returns TRUE if serialPort=auto, the serial port needs to be found by probing the
+// candidates returned by GetSerialPortCandidates() then
+func (m ModemConfig) IsAutoSerialPort() bool {
+	return m.serialPort == SERIAL_PORT_AUTO
+}
+
+// GetSerialPortCandidates returns the serial ports to probe if serialPort=auto: the ones of the configured
+// USB device or, without usbVendorId/usbProductId, the ones of all USB devices
+func (m ModemConfig) GetSerialPortCandidates() ([]string, error) {
+	if selector := m.GetUsbSelector(); selector != nil {
+		return serialportdiscovery.DiscoverUsbInterfaces(*selector)
+	}
+	devices, err := serialportdiscovery.ListUsbDevices()
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, device := range devices {
+		result = append(result, device.Ports()...)
+	}
+	if len(result) == 0 {
+		return nil, errors.New("Found no USB serial ports")
+	}
+	return result, nil
+}
+
+// GetSerialPort returns the serial port to open, running USB interface discovery if usbVendorId/usbProductId
+// are configured. Fails if serialPort=auto.
+func (m ModemConfig) GetSerialPort() (string, error) {
+
+	if m.IsAutoSerialPort() {
+		return "", errors.New("serial port of modem '" + m.name + "' needs to be probed")
+	}
+	if selector := m.GetUsbSelector(); selector != nil {
+		device, err := serialportdiscovery.SelectUsbDevice(*selector)
+		if err != nil {
+			return "", err
+		}
+		if m.usbInterface != nil {
+			discovered, err := device.PortOfInterface(*m.usbInterface)
+			if err != nil {
+				return "", err
+			}
+			log.Info("Going to use interface " + strconv.Itoa(*m.usbInterface) + " [" + discovered + "] of USB device " +
+				device.Path + " for modem '" + m.name + "'")
+			return discovered, nil
+		}
+
+		iFaces := device.Ports()
+		if len(iFaces) == 0 {
+			return "", errors.New("serial-port auto discovery found no usb interfaces")
+		}
+		idx, _ := strconv.Atoi(m.serialPort)
+		if len(iFaces) <= idx {
+			return "", errors.New("serial-port auto discovery found only " + strconv.Itoa(len(iFaces)) + " interfaces but " +
+				"modem '" + m.name + "' serialPort config requested interface #" + strconv.Itoa(idx))
+		}
+		discovered := iFaces[idx]
+		log.Info("Going to use device #" + strconv.Itoa(idx) + " [" + discovered + "] for modem '" + m.name + "'")
+		return discovered, nil
+	}
+	return m.serialPort, nil
+}
+
+func (m ModemConfig) GetSerialReadTimeout() time.Duration {
+	return m.serialReadTimeout
+}
+
+// GetPortBusyAction returns what to do if another process holds the serial port when opening it
+func (m ModemConfig) GetPortBusyAction() PortBusyAction {
+	return m.portBusyAction
+}
+
+// GetPortBusyRetries returns how often to try opening a busy serial port again with portBusy=retry
+func (m ModemConfig) GetPortBusyRetries() int {
+	return m.portBusyRetries
+}
+
+// GetPortBusyTimeout returns how long to wait for a busy serial port to get released with portBusy=wait
+func (m ModemConfig) GetPortBusyTimeout() time.Duration {
+	return m.portBusyTimeout
+}
+
+// GetTranscriptFile returns the file recording everything sent to and received from the modem, relative paths
+// are relative to the data directory. Returns "" if no transcript is recorded.
+func (m ModemConfig) GetTranscriptFile() string {
+	return m.transcriptFile
+}
+
+// GetTranscriptMaxSize returns the size in bytes at which the transcript file gets rotated
+func (m ModemConfig) GetTranscriptMaxSize() int64 {
+	return m.transcriptMaxSize
+}
+
+// GetHilinkUrl returns the base URL of a HiLink stick's web interface (without trailing slash), "" unless driver=hilink
+func (m ModemConfig) GetHilinkUrl() string {
+	return m.hilinkUrl
+}
+
+func (m ModemConfig) GetHilinkUser() string {
+	return m.hilinkUser
+}
+
+// GetHilinkPassword returns the password of the HiLink web interface, "" if the stick does not require a login
+func (m ModemConfig) GetHilinkPassword() string {
+	return m.hilinkPassword
+}
+
+// GetHilinkTimeout returns how long to wait for the HiLink stick to answer a single HTTP request
+func (m ModemConfig) GetHilinkTimeout() time.Duration {
+	return m.hilinkTimeout
+}
+
+// GetDiagnosticsRefreshInterval returns how long modem diagnostics (signal quality, operator, SIM identity) may be cached
+func (m ModemConfig) GetDiagnosticsRefreshInterval() time.Duration {
+	return m.diagnosticsRefreshInterval
+}
+
+// GetUssdPacked returns whether the modem expects and returns USSD strings as hex-encoded, packed GSM-7
+// (like most Huawei modems), nil if the modem's profile decides
+func (m ModemConfig) GetUssdPacked() *bool {
+	if m.ussdPacked == nil {
+		return nil
+	}
+	packed := *m.ussdPacked
+	return &packed
+}
+
+// GetCmeeMode returns how the modem should report errors, 1 = numeric +CME/+CMS ERROR codes, 2 = error texts
+func (m ModemConfig) GetCmeeMode() int {
+	return m.cmeeMode
+}
+
+// GetBalanceCheckInterval returns how often to query the prepaid balance, nil if the balance should not be checked
+func (m ModemConfig) GetBalanceCheckInterval() *util.TimeInterval {
+	if m.balanceCheckInterval == nil {
+		return nil
+	}
+	clone := *m.balanceCheckInterval
+	return &clone
+}
+
+// GetBalanceUssdCode returns the USSD code that queries the prepaid balance
+func (m ModemConfig) GetBalanceUssdCode() string {
+	return m.balanceUssdCode
+}
+
+// GetBalanceRegex returns the regular expression that extracts the balance from the network's answer,
+// using the first capturing group if there is one and the whole match otherwise
+func (m ModemConfig) GetBalanceRegex() *regexp.Regexp {
+	return m.balanceRegex
+}
+
+// GetBalanceThreshold returns the balance below which an alert SMS gets sent, nil if no alert should be sent
+func (m ModemConfig) GetBalanceThreshold() *float64 {
+	if m.balanceThreshold == nil {
+		return nil
+	}
+	clone := *m.balanceThreshold
+	return &clone
+}
+
+// GetWatchdogInterval returns how often the health watchdog probes the modem, nil if the modem should not be watched
+func (m ModemConfig) GetWatchdogInterval() *util.TimeInterval {
+	if m.watchdogInterval == nil {
+		return nil
+	}
+	clone := *m.watchdogInterval
+	return &clone
+}
+
+// GetWatchdogFailureThreshold returns how many probes in a row need to fail before the watchdog starts recovering the modem
+func (m ModemConfig) GetWatchdogFailureThreshold() int {
+	return m.watchdogFailureThreshold
+}
+
+// GetWatchdogRecoverySteps returns the recovery steps the watchdog may take, in the order it tries them
+func (m ModemConfig) GetWatchdogRecoverySteps() []RecoveryStep {
+	return slices.Clone(m.watchdogRecoverySteps)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+
+	"code-sourcery.de/sms-gateway/serialportdiscovery"
+)
+
+func printListDevicesUsage() {
+	println("Usage: list-devices")
+	println()
+	println("Prints every USB device along with its serial ports and their USB interface numbers.")
+	println("Use the values shown as [modem] usbVendorId/usbProductId, usbSerial or usbPath and usbInterface.")
+}
+
+// runListDevices implements the 'list-devices' sub-command
+func runListDevices(args []string) {
+
+	for _, arg := range args {
+		if arg == "-h" || arg == "-help" || arg == "--help" {
+			printListDevicesUsage()
+			return
+		}
+		panic("Invalid command line - unknown argument '" + arg + "'")
+	}
+
+	devices, err := serialportdiscovery.ListUsbDevices()
+	if err != nil {
+		println("Failed to list USB devices: " + err.Error())
+		os.Exit(1)
+	}
+	if len(devices) == 0 {
+		println("Found no USB devices")
+		return
+	}
+	for _, device := range devices {
+		line := "usbPath=" + device.Path + " usbVendorId=" + strings.Replace(device.DeviceId.String(), ":", " usbProductId=", 1)
+		if device.Serial != "" {
+			line += " usbSerial=" + device.Serial
+		}
+		if name := strings.TrimSpace(device.Manufacturer + " " + device.Product); name != "" {
+			line += " (" + name + ")"
+		}
+		println(line)
+		if len(device.Interfaces) == 0 {
+			println("    no serial ports")
+		}
+		for _, iface := range device.Interfaces {
+			println("    usbInterface=" + strconv.Itoa(iface.Number) + " " + iface.Port)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"code-sourcery.de/sms-gateway/emulator"
+)
+
+func printEmulateUsage() {
+	println("Usage: emulate [--pin <pin>] [--puk <puk>] [--pin-state ready|pin|puk] [--pin-retries <1-3>] [--registration <0-5>] [--delay <millis>] [--script <file>] [--link <path>]")
+	println()
+	println("Runs an AT command emulator that behaves like a Huawei E3372 USB stick on a pseudo-terminal.")
+	println()
+	println("--pin <pin> => SIM card PIN, default is 1234")
+	println("--puk <puk> => SIM card PUK, default is 12345678")
+	println("--pin-state <state> => Initial SIM card state, default is 'ready'")
+	println("--pin-retries <1-3> => Remaining PIN attempts, default is 3")
+	println("--registration <0-5> => Network registration reported by AT+CREG?, default is 1 (home network)")
+	println("--delay <millis> => How long the modem takes to answer every command")
+	println("--script <file> => Load response rules from a script file, see emulator/script.go for the syntax")
+	println("--link <path> => Create a symbolic link to the pseudo-terminal, use this as [modem] serialPort")
+}
+
+// runEmulator implements the 'emulate' sub-command
+func runEmulator(args []string) {
+
+	options := emulator.Options{}
+	scriptFile := ""
+	link := ""
+
+	requireValue := func(idx int) string {
+		if idx+1 >= len(args) {
+			panic("'" + args[idx] + "' option requires an argument")
+		}
+		return args[idx+1]
+	}
+
+	for idx := 0; idx < len(args); idx = idx + 1 {
+		arg := args[idx]
+		switch arg {
+		case "-h", "-help", "--help":
+			printEmulateUsage()
+			return
+		case "--pin":
+			options.Pin = requireValue(idx)
+		case "--puk":
+			options.Puk = requireValue(idx)
+		case "--pin-state":
+			pinState, err := emulator.ParsePinState(requireValue(idx))
+			if err != nil {
+				panic(err)
+			}
+			options.PinState = pinState
+		case "--pin-retries":
+			retries, err := strconv.Atoi(requireValue(idx))
+			if err != nil || retries < 1 || retries > 3 {
+				panic("--pin-retries requires a number in the range 1...3")
+			}
+			options.PinRetries = retries
+		case "--registration":
+			registration, err := strconv.Atoi(requireValue(idx))
+			if err != nil || registration < 0 || registration > 5 {
+				panic("--registration requires a number in the range 0...5")
+			}
+			if registration == 0 {
+				registration = -1
+			}
+			options.Registration = registration
+		case "--delay":
+			millis, err := strconv.Atoi(requireValue(idx))
+			if err != nil || millis < 0 {
+				panic("--delay requires a non-negative number of milliseconds")
+			}
+			options.Delay = time.Duration(millis) * time.Millisecond
+		case "--script":
+			scriptFile = requireValue(idx)
+		case "--link":
+			link = requireValue(idx)
+		default:
+			panic("Invalid command line - unknown option '" + arg + "'")
+		}
+		if strings.HasPrefix(arg, "--") {
+			idx = idx + 1
+		}
+	}
+
+	var rules []emulator.Rule
+	if scriptFile != "" {
+		var err error
+		rules, err = emulator.LoadScript(scriptFile)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	emu, err := emulator.New(options)
+	if err != nil {
+		panic(err)
+	}
+	defer emu.Close()
+
+	for _, rule := range rules {
+		emu.AddRule(rule)
+	}
+
+	if link != "" {
+		_ = os.Remove(link)
+		err = os.Symlink(emu.Path(), link)
+		if err != nil {
+			panic("Failed to create symbolic link " + link + " - " + err.Error())
+		}
+		defer func() {
+			_ = os.Remove(link)
+		}()
+		log.Info("Created symbolic link " + link + " -> " + emu.Path())
+	}
+	println("Emulated modem available at " + emu.Path())
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	sig := <-sigChan
+	log.Info("Shutting down emulator, received signal " + sig.String())
+}
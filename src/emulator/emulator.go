@@ -0,0 +1,789 @@
+package emulator
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code-sourcery.de/sms-gateway/logger"
+)
+
+/*
+ * A scriptable AT command emulator that answers on a pseudo-terminal like a Huawei E3372 USB stick would.
+ */
+
+var log = logger.GetLogger("emulator")
+
+type PinState int
+
+const (
+	PIN_STATE_READY PinState = iota // SIM card unlocked
+	PIN_STATE_PIN                   // SIM card needs PIN
+	PIN_STATE_PUK                   // SIM card needs PUK
+)
+
+func ParsePinState(s string) (PinState, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "ready":
+		return PIN_STATE_READY, nil
+	case "pin":
+		return PIN_STATE_PIN, nil
+	case "puk":
+		return PIN_STATE_PUK, nil
+	}
+	return PIN_STATE_READY, errors.New("Unknown PIN state '" + s + "', valid choices are 'ready', 'pin' and 'puk'")
+}
+
+func (s PinState) String() string {
+	switch s {
+	case PIN_STATE_READY:
+		return "ready"
+	case PIN_STATE_PIN:
+		return "pin"
+	case PIN_STATE_PUK:
+		return "puk"
+	}
+	panic("Internal error, unknown PIN state " + strconv.Itoa(int(s)))
+}
+
+// how many wrong PINs are accepted before the SIM card requires the PUK
+const pinAttempts = 3
+
+// number of PUK attempts before the SIM card is blocked for good
+const pukAttempts = 10
+
+// Options configure the initial state of the emulated modem, zero values select sensible defaults
+type Options struct {
+	// SIM card PIN, defaults to 1234
+	Pin string
+	// SIM card PUK, defaults to 12345678
+	Puk      string
+	PinState PinState
+	// remaining PIN attempts, defaults to 3
+	PinRetries int
+	// network registration as reported by AT+CREG?, defaults to 1 (registered, home network).
+	// Use -1 for 0 (not registered, not searching).
+	Registration int
+	// how long the modem takes to answer every command
+	Delay time.Duration
+	// prepaid balance reported by the *100# USSD code, defaults to 10.00
+	Balance string
+}
+
+// Rule overrides the emulator's response to commands matching a regular expression
+type Rule struct {
+	Pattern *regexp.Regexp
+	// response lines, a "> " line makes the emulator wait for a message body terminated by CTRL-Z
+	// before sending the remaining lines
+	Response []string
+	// additional delay before responding
+	Delay time.Duration
+	// how often the rule applies, 0 = unlimited
+	Times int
+	used  int
+}
+
+// StoredMessage is an entry of the emulated modem's message storage
+type StoredMessage struct {
+	// 0 = received unread, 1 = received read, 2 = stored unsent, 3 = stored sent
+	Status int
+	// SMS-DELIVER or SMS-STATUS-REPORT PDU (including SMSC address), returned by AT+CMGL in PDU mode
+	Pdu string
+	// sender, timestamp ("yy/MM/dd,hh:mm:ss+zz") and text returned by AT+CMGL in text mode
+	Sender    string
+	Timestamp string
+	Text      string
+}
+
+// SubmittedSms is a message received via AT+CMGS
+type SubmittedSms struct {
+	// recipient (text mode only)
+	Recipient string
+	// TPDU length (PDU mode only)
+	Length int
+	// message text (text mode) or hex-encoded PDU (PDU mode)
+	Body string
+	// message reference returned to the caller
+	Reference int
+}
+
+var statusNames = []string{"REC UNREAD", "REC READ", "STO UNSENT", "STO SENT"}
+
+var cmeErrors = map[int]string{
+	3:   "operation not allowed",
+	10:  "SIM not inserted",
+	11:  "SIM PIN required",
+	12:  "SIM PUK required",
+	16:  "incorrect password",
+	30:  "no network service",
+	100: "unknown",
+	262: "SIM blocked",
+}
+
+var cmsErrors = map[int]string{
+	302: "operation not allowed",
+	304: "invalid PDU mode parameter",
+	311: "SIM PIN required",
+	316: "SIM PUK required",
+	321: "invalid memory index",
+	331: "no network service",
+	500: "unknown error",
+}
+
+type Emulator struct {
+	master *os.File
+	// the emulator keeps the slave side open so that reading from the master
+	// does not fail while the gateway has closed the serial port
+	slave     *os.File
+	slavePath string
+
+	writeMutex    sync.Mutex
+	closed        atomic.Bool
+	readerStopped sync.WaitGroup
+
+	// protects all fields below
+	mutex           sync.Mutex
+	options         Options
+	echo            bool
+	cmeeMode        int
+	textMode        bool
+	charset         string
+	pinState        PinState
+	pin             string
+	pinAttemptsLeft int
+	pukAttemptsLeft int
+	newMsgIndicator bool
+	nextReference   int
+	storage         map[int]StoredMessage
+	submitted       []SubmittedSms
+	commands        []string
+	rules           []*Rule
+	ussdSession     bool
+	// called with the message body once CTRL-Z has been received after a "> " prompt
+	pendingBody func(body string) string
+}
+
+// New creates a pseudo-terminal and starts answering AT commands on it
+func New(options Options) (*Emulator, error) {
+
+	if options.Pin == "" {
+		options.Pin = "1234"
+	}
+	if options.Puk == "" {
+		options.Puk = "12345678"
+	}
+	if options.PinRetries == 0 {
+		options.PinRetries = pinAttempts
+	}
+	if options.Balance == "" {
+		options.Balance = "10.00"
+	}
+	if options.Registration == 0 {
+		options.Registration = 1
+	} else if options.Registration < 0 {
+		options.Registration = 0
+	}
+
+	master, slavePath, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	slave, err := os.OpenFile(slavePath, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, errors.New("Failed to open " + slavePath + " - " + err.Error())
+	}
+	err = makeRaw(slave)
+	if err != nil {
+		_ = master.Close()
+		_ = slave.Close()
+		return nil, err
+	}
+
+	result := &Emulator{
+		master:          master,
+		slave:           slave,
+		slavePath:       slavePath,
+		options:         options,
+		echo:            true,
+		cmeeMode:        1,
+		charset:         "IRA",
+		pinState:        options.PinState,
+		pin:             options.Pin,
+		pinAttemptsLeft: options.PinRetries,
+		pukAttemptsLeft: pukAttempts,
+		storage:         make(map[int]StoredMessage),
+	}
+	result.readerStopped.Add(1)
+	go result.readLoop()
+	log.Info("Emulated modem listening on " + slavePath)
+	return result, nil
+}
+
+// Path returns the device the gateway needs to open, like /dev/pts/3
+func (e *Emulator) Path() string {
+	return e.slavePath
+}
+
+// Close hangs up the pseudo-terminal, making all further reads/writes on the slave side fail
+func (e *Emulator) Close() {
+	if !e.closed.CompareAndSwap(false, true) {
+		return
+	}
+	_ = e.master.Close()
+	_ = e.slave.Close()
+	e.readerStopped.Wait()
+	log.Info("Emulated modem on " + e.slavePath + " shut down")
+}
+
+// AddRule overrides the response to commands matching a rule, rules are checked in the order they were added
+func (e *Emulator) AddRule(rule Rule) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.rules = append(e.rules, &rule)
+}
+
+// Commands returns all commands received so far
+func (e *Emulator) Commands() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return slices.Clone(e.commands)
+}
+
+// Submitted returns all messages received via AT+CMGS so far
+func (e *Emulator) Submitted() []SubmittedSms {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return slices.Clone(e.submitted)
+}
+
+// PinState returns the current SIM card PIN state
+func (e *Emulator) PinState() PinState {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.pinState
+}
+
+// SetRegistration changes the network registration reported by AT+CREG? (0...5)
+func (e *Emulator) SetRegistration(registration int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.options.Registration = registration
+}
+
+// StoreMessage adds a message to the emulated message storage, returning its index.
+// Sends a +CMTI unsolicited result code if new message indications were enabled using AT+CNMI.
+func (e *Emulator) StoreMessage(msg StoredMessage) int {
+	e.mutex.Lock()
+	index := 0
+	for {
+		if _, exists := e.storage[index]; !exists {
+			break
+		}
+		index++
+	}
+	e.storage[index] = msg
+	indicate := e.newMsgIndicator
+	e.mutex.Unlock()
+
+	if indicate {
+		e.SendUnsolicited("+CMTI: \"SM\"," + strconv.Itoa(index))
+	}
+	return index
+}
+
+// SendUnsolicited sends an unsolicited result code like '+CMTI: "SM",1' or '^RSSI: 20'
+func (e *Emulator) SendUnsolicited(line string) {
+	e.write("\r\n" + line + "\r\n")
+}
+
+func (e *Emulator) write(s string) {
+	e.writeMutex.Lock()
+	defer e.writeMutex.Unlock()
+	if e.closed.Load() {
+		return
+	}
+	_, err := e.master.Write([]byte(s))
+	if err != nil {
+		log.Error("Failed to write to pseudo-terminal: " + err.Error())
+	}
+}
+
+func (e *Emulator) readLoop() {
+	defer e.readerStopped.Done()
+
+	buffer := make([]byte, 256)
+	var line []byte
+	for {
+		count, err := e.master.Read(buffer)
+		if err != nil {
+			if !e.closed.Load() {
+				log.Error("Failed to read from pseudo-terminal: " + err.Error())
+			}
+			return
+		}
+		for _, b := range buffer[:count] {
+			e.mutex.Lock()
+			awaitingBody := e.pendingBody != nil
+			e.mutex.Unlock()
+
+			if awaitingBody {
+				switch b {
+				case 0x1a: // CTRL-Z sends the message
+					e.handleMessageBody(string(line), false)
+					line = nil
+				case 0x1b: // ESC aborts
+					e.handleMessageBody(string(line), true)
+					line = nil
+				default:
+					line = append(line, b)
+				}
+				continue
+			}
+			switch b {
+			case '\r':
+				cmd := strings.TrimSpace(string(line))
+				line = nil
+				if cmd != "" {
+					e.handleCommand(cmd)
+				}
+			case '\n':
+			default:
+				line = append(line, b)
+			}
+		}
+	}
+}
+
+func (e *Emulator) handleMessageBody(body string, aborted bool) {
+	e.mutex.Lock()
+	callback := e.pendingBody
+	e.pendingBody = nil
+	echo := e.echo
+	e.mutex.Unlock()
+
+	if echo {
+		e.write(body)
+	}
+	if aborted {
+		e.respond(okResult())
+		return
+	}
+	e.respond(callback(body))
+}
+
+func (e *Emulator) respond(response string) {
+	if e.options.Delay > 0 {
+		time.Sleep(e.options.Delay)
+	}
+	e.write(response)
+}
+
+func (e *Emulator) handleCommand(cmd string) {
+	e.mutex.Lock()
+	e.commands = append(e.commands, cmd)
+	echo := e.echo
+	rule := e.matchingRule(cmd)
+	var response string
+	if rule == nil {
+		response = e.execute(cmd)
+	}
+	e.mutex.Unlock()
+
+	log.Debug("Received command '" + cmd + "'")
+	if echo {
+		e.write(cmd + "\r")
+	}
+	if rule != nil {
+		if rule.Delay > 0 {
+			time.Sleep(rule.Delay)
+		}
+		response = e.ruleResponse(rule)
+	}
+	e.respond(response)
+}
+
+// matchingRule returns the first rule matching a command, needs to be called with the mutex held
+func (e *Emulator) matchingRule(cmd string) *Rule {
+	for _, rule := range e.rules {
+		if (rule.Times == 0 || rule.used < rule.Times) && rule.Pattern.MatchString(cmd) {
+			rule.used++
+			return rule
+		}
+	}
+	return nil
+}
+
+func (e *Emulator) ruleResponse(rule *Rule) string {
+	var sb strings.Builder
+	for idx, line := range rule.Response {
+		if line == "> " {
+			remaining := rule.Response[idx+1:]
+			e.mutex.Lock()
+			e.pendingBody = func(body string) string {
+				return formatLines(remaining)
+			}
+			e.mutex.Unlock()
+			sb.WriteString("\r\n> ")
+			return sb.String()
+		}
+		sb.WriteString("\r\n" + line + "\r\n")
+	}
+	return sb.String()
+}
+
+func formatLines(lines []string) string {
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString("\r\n" + line + "\r\n")
+	}
+	return sb.String()
+}
+
+func okResult(lines ...string) string {
+	return formatLines(append(lines, "OK"))
+}
+
+func errorResult() string {
+	return formatLines([]string{"ERROR"})
+}
+
+func (e *Emulator) cmeError(code int) string {
+	return e.extendedError("+CME ERROR: ", code, cmeErrors)
+}
+
+func (e *Emulator) cmsError(code int) string {
+	return e.extendedError("+CMS ERROR: ", code, cmsErrors)
+}
+
+func (e *Emulator) extendedError(prefix string, code int, texts map[int]string) string {
+	switch e.cmeeMode {
+	case 0:
+		return errorResult()
+	case 2:
+		if text, found := texts[code]; found {
+			return formatLines([]string{prefix + text})
+		}
+	}
+	return formatLines([]string{prefix + strconv.Itoa(code)})
+}
+
+// isRegistered returns TRUE if the emulated modem is registered to its home network or roaming, needs to be called with the mutex held
+func (e *Emulator) isRegistered() bool {
+	return e.options.Registration == 1 || e.options.Registration == 5
+}
+
+// simError returns the error to send if an SMS command is issued while the SIM card is locked, "" if the SIM card is ready
+func (e *Emulator) simError() string {
+	switch e.pinState {
+	case PIN_STATE_PIN:
+		return e.cmsError(311)
+	case PIN_STATE_PUK:
+		return e.cmsError(316)
+	}
+	return ""
+}
+
+// unquote returns the comma-separated, optionally double-quoted arguments of an AT command
+func unquote(args string) []string {
+	var result []string
+	for _, arg := range strings.Split(args, ",") {
+		result = append(result, strings.Trim(strings.TrimSpace(arg), "\""))
+	}
+	return result
+}
+
+// execute runs a command and returns the response, needs to be called with the mutex held
+func (e *Emulator) execute(cmd string) string {
+
+	upper := strings.ToUpper(cmd)
+	args := ""
+	if idx := strings.Index(cmd, "="); idx != -1 {
+		args = cmd[idx+1:]
+	}
+
+	switch {
+	case upper == "AT":
+		return okResult()
+	case upper == "ATE0" || upper == "ATE1" || upper == "ATE":
+		e.echo = upper == "ATE1"
+		return okResult()
+	case upper == "ATZ":
+		e.echo = true
+		e.cmeeMode = 1
+		return okResult()
+	case upper == "ATI":
+		return okResult("Manufacturer: huawei", "Model: E3372", "Revision: 22.200.15.00.00", "IMEI: 860000000000000", "+GCAP: +CGSM,+DS,+ES")
+	case upper == "AT+CGMI":
+		return okResult("huawei")
+	case upper == "AT+CGMM":
+		return okResult("E3372")
+	case upper == "AT+CGSN":
+		return okResult("860000000000000")
+	case upper == "AT+CGMR":
+		return okResult("22.200.15.00.00")
+	case upper == "AT+CSQ":
+		return okResult("+CSQ: 20,99")
+	case upper == "AT^HCSQ?":
+		if !e.isRegistered() {
+			return okResult("^HCSQ: \"NOSERVICE\"")
+		}
+		return okResult("^HCSQ: \"LTE\",52,40,143,22")
+	case upper == "AT+COPS?":
+		if !e.isRegistered() {
+			return okResult("+COPS: 0")
+		}
+		return okResult("+COPS: 0,0,\"Telekom.de\",7")
+	case upper == "AT+CSCA?":
+		return okResult("+CSCA: \"+491710760000\",145")
+	case upper == "AT+CIMI":
+		switch e.pinState {
+		case PIN_STATE_PIN:
+			return e.cmeError(11)
+		case PIN_STATE_PUK:
+			return e.cmeError(12)
+		}
+		return okResult("262011234567890")
+	case upper == "AT^ICCID?":
+		return okResult("^ICCID: 89490200001234567890")
+	case strings.HasPrefix(upper, "AT^CURC="):
+		return okResult()
+	case strings.HasPrefix(upper, "AT+CMEE="):
+		mode, err := strconv.Atoi(args)
+		if err != nil || mode < 0 || mode > 2 {
+			return errorResult()
+		}
+		e.cmeeMode = mode
+		return okResult()
+	case upper == "AT+CFUN?":
+		return okResult("+CFUN: 1")
+	case strings.HasPrefix(upper, "AT+CFUN="):
+		// AT+CFUN=<fun>[,<rst>], <rst> = 1 restarts the modem
+		params := unquote(args)
+		if len(params) > 1 && params[1] == "1" {
+			e.restart()
+		}
+		return okResult()
+	case upper == "AT+CPIN?":
+		switch e.pinState {
+		case PIN_STATE_PIN:
+			return okResult("+CPIN: SIM PIN")
+		case PIN_STATE_PUK:
+			return okResult("+CPIN: SIM PUK")
+		}
+		return okResult("+CPIN: READY")
+	case upper == "AT+CPINR" || strings.HasPrefix(upper, "AT+CPINR="):
+		return okResult("+CPINR: SIM PIN,"+strconv.Itoa(e.pinAttemptsLeft)+","+strconv.Itoa(pinAttempts),
+			"+CPINR: SIM PUK,"+strconv.Itoa(e.pukAttemptsLeft)+","+strconv.Itoa(pukAttempts))
+	case upper == "AT^CPIN?":
+		// ^CPIN: <code>,[<times>],<puk_times>,<pin_times>,<puk2_times>,<pin2_times>
+		code, times := "READY", ""
+		switch e.pinState {
+		case PIN_STATE_PIN:
+			code, times = "SIM PIN", strconv.Itoa(e.pinAttemptsLeft)
+		case PIN_STATE_PUK:
+			code, times = "SIM PUK", strconv.Itoa(e.pukAttemptsLeft)
+		}
+		return okResult("^CPIN: " + code + "," + times + "," + strconv.Itoa(e.pukAttemptsLeft) + "," +
+			strconv.Itoa(e.pinAttemptsLeft) + ",10,3")
+	case strings.HasPrefix(upper, "AT+CPIN="):
+		return e.enterPin(unquote(args))
+	case strings.HasPrefix(upper, "AT+CUSD="):
+		return e.ussd(unquote(args))
+	case upper == "AT+CREG?":
+		return okResult("+CREG: 0," + strconv.Itoa(e.options.Registration))
+	case upper == "AT+CEREG?":
+		return okResult("+CEREG: 0," + strconv.Itoa(e.options.Registration))
+	case upper == "AT+CSCS?":
+		return okResult("+CSCS: \"" + e.charset + "\"")
+	case strings.HasPrefix(upper, "AT+CSCS="):
+		charset := strings.ToUpper(strings.Trim(args, "\""))
+		if charset != "IRA" && charset != "GSM" && charset != "UCS2" {
+			return e.cmeError(4)
+		}
+		e.charset = charset
+		return okResult()
+	case upper == "AT+CMGF?":
+		if e.textMode {
+			return okResult("+CMGF: 1")
+		}
+		return okResult("+CMGF: 0")
+	case strings.HasPrefix(upper, "AT+CMGF="):
+		if args != "0" && args != "1" {
+			return errorResult()
+		}
+		e.textMode = args == "1"
+		return okResult()
+	case strings.HasPrefix(upper, "AT+CSMP="):
+		return okResult()
+	case strings.HasPrefix(upper, "AT+CNMI="):
+		if simError := e.simError(); simError != "" {
+			return simError
+		}
+		// AT+CNMI=<mode>,<mt>,<bm>,<ds>,<bfr>, <mt> != 0 enables +CMTI indications
+		params := unquote(args)
+		e.newMsgIndicator = len(params) > 1 && params[1] != "0"
+		return okResult()
+	case strings.HasPrefix(upper, "AT+CMGS="):
+		if simError := e.simError(); simError != "" {
+			return simError
+		}
+		return e.submit(unquote(args)[0])
+	case strings.HasPrefix(upper, "AT+CMGL"):
+		if simError := e.simError(); simError != "" {
+			return simError
+		}
+		return e.listMessages(unquote(args)[0])
+	case strings.HasPrefix(upper, "AT+CMGD="):
+		if simError := e.simError(); simError != "" {
+			return simError
+		}
+		index, err := strconv.Atoi(unquote(args)[0])
+		if err != nil {
+			return e.cmsError(321)
+		}
+		if _, exists := e.storage[index]; !exists {
+			return e.cmsError(321)
+		}
+		delete(e.storage, index)
+		return okResult()
+	}
+	return errorResult()
+}
+
+// restart restores the power-on defaults, a SIM card with PIN needs to be unlocked again.
+// Needs to be called with the mutex held.
+func (e *Emulator) restart() {
+	log.Info("Emulated modem on " + e.slavePath + " restarting")
+	e.echo = true
+	e.cmeeMode = 1
+	e.textMode = false
+	e.charset = "IRA"
+	e.newMsgIndicator = false
+	e.ussdSession = false
+	if e.pinState == PIN_STATE_READY && e.options.PinState == PIN_STATE_PIN {
+		e.pinState = PIN_STATE_PIN
+	}
+}
+
+func (e *Emulator) enterPin(args []string) string {
+	switch e.pinState {
+	case PIN_STATE_READY:
+		return e.cmeError(3)
+	case PIN_STATE_PIN:
+		if args[0] != e.pin {
+			e.pinAttemptsLeft--
+			if e.pinAttemptsLeft <= 0 {
+				log.Warn("Too many wrong PINs, SIM card now requires PUK")
+				e.pinState = PIN_STATE_PUK
+			}
+			return e.cmeError(16)
+		}
+	case PIN_STATE_PUK:
+		if len(args) < 2 {
+			return e.cmeError(12)
+		}
+		if e.pukAttemptsLeft <= 0 {
+			return e.cmeError(262)
+		}
+		if args[0] != e.options.Puk {
+			e.pukAttemptsLeft--
+			return e.cmeError(16)
+		}
+		e.pin = args[1]
+		e.pukAttemptsLeft = pukAttempts
+	}
+	e.pinState = PIN_STATE_READY
+	e.pinAttemptsLeft = pinAttempts
+	return okResult()
+}
+
+// submit handles AT+CMGS, the argument is the recipient (text mode) or the TPDU length (PDU mode)
+func (e *Emulator) submit(arg string) string {
+	length := 0
+	if !e.textMode {
+		var err error
+		length, err = strconv.Atoi(arg)
+		if err != nil || length <= 0 {
+			return e.cmsError(304)
+		}
+	}
+	e.pendingBody = func(body string) string {
+		e.mutex.Lock()
+		defer e.mutex.Unlock()
+
+		if !e.textMode {
+			pdu, err := hex.DecodeString(body)
+			if err != nil || len(pdu) == 0 || len(pdu)-1-int(pdu[0]) != length {
+				return e.cmsError(304)
+			}
+		}
+		if !e.isRegistered() {
+			return e.cmsError(331)
+		}
+		sms := SubmittedSms{Body: body, Reference: e.nextReference}
+		if e.textMode {
+			sms.Recipient = arg
+		} else {
+			sms.Length = length
+		}
+		e.nextReference = (e.nextReference + 1) % 256
+		e.submitted = append(e.submitted, sms)
+		return okResult("+CMGS: " + strconv.Itoa(sms.Reference))
+	}
+	return "\r\n> "
+}
+
+// listMessages handles AT+CMGL, the argument is the requested status (a number in PDU mode, a string like "ALL" in text mode)
+func (e *Emulator) listMessages(filter string) string {
+
+	wanted := -1 // all
+	if filter == "" {
+		wanted = 0 // received unread
+	} else if e.textMode {
+		if filter != "ALL" {
+			wanted = slices.Index(statusNames, filter)
+			if wanted == -1 {
+				return e.cmsError(302)
+			}
+		}
+	} else if filter != "4" {
+		var err error
+		wanted, err = strconv.Atoi(filter)
+		if err != nil || wanted < 0 || wanted > 3 {
+			return e.cmsError(302)
+		}
+	}
+
+	var indices []int
+	for index := range e.storage {
+		indices = append(indices, index)
+	}
+	slices.Sort(indices)
+
+	var lines []string
+	for _, index := range indices {
+		msg := e.storage[index]
+		if wanted != -1 && msg.Status != wanted {
+			continue
+		}
+		if e.textMode {
+			lines = append(lines, "+CMGL: "+strconv.Itoa(index)+",\""+statusNames[msg.Status]+"\",\""+msg.Sender+"\",,\""+msg.Timestamp+"\"", msg.Text)
+			continue
+		}
+		pdu, err := hex.DecodeString(msg.Pdu)
+		length := 0
+		if err == nil && len(pdu) > 0 {
+			length = len(pdu) - 1 - int(pdu[0])
+		}
+		lines = append(lines, "+CMGL: "+strconv.Itoa(index)+","+strconv.Itoa(msg.Status)+",,"+strconv.Itoa(length), msg.Pdu)
+	}
+	return okResult(lines...)
+}
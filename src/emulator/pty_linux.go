@@ -0,0 +1,78 @@
+//go:build linux
+
+package emulator
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// withFd runs f with the file descriptor of a file. Unlike File.Fd() this does not
+// switch the file to blocking mode, so Close() still interrupts pending reads.
+func withFd(file *os.File, f func(fd int) error) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var result error
+	err = conn.Control(func(fd uintptr) {
+		result = f(int(fd))
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// openPty creates a new pseudo-terminal, returning the master side and the path of the slave device
+func openPty() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", errors.New("Failed to open /dev/ptmx - " + err.Error())
+	}
+	var ptyNumber uint32
+	err = withFd(master, func(fd int) error {
+		// unlockpt()
+		err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0)
+		if err != nil {
+			return errors.New("Failed to unlock pseudo-terminal - " + err.Error())
+		}
+		// ptsname()
+		ptyNumber, err = unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+		if err != nil {
+			return errors.New("Failed to get pseudo-terminal number - " + err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		_ = master.Close()
+		return nil, "", err
+	}
+	return master, "/dev/pts/" + strconv.Itoa(int(ptyNumber)), nil
+}
+
+// makeRaw disables all line discipline processing (echo, CR/LF translation, ...) on a terminal
+func makeRaw(file *os.File) error {
+	return withFd(file, func(fd int) error {
+		termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+		if err != nil {
+			return errors.New("Failed to get terminal attributes - " + err.Error())
+		}
+		termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+		termios.Oflag &^= unix.OPOST
+		termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+		termios.Cflag &^= unix.CSIZE | unix.PARENB
+		termios.Cflag |= unix.CS8
+		termios.Cc[unix.VMIN] = 1
+		termios.Cc[unix.VTIME] = 0
+		err = unix.IoctlSetTermios(fd, unix.TCSETS, termios)
+		if err != nil {
+			return errors.New("Failed to set terminal attributes - " + err.Error())
+		}
+		return nil
+	})
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package emulator
+
+import (
+	"errors"
+	"os"
+)
+
+func openPty() (*os.File, string, error) {
+	return nil, "", errors.New("The modem emulator requires Linux pseudo-terminals")
+}
+
+func makeRaw(file *os.File) error {
+	return errors.New("The modem emulator requires Linux pseudo-terminals")
+}
@@ -0,0 +1,74 @@
+package emulator
+
+import (
+	"errors"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * Script files contain one rule per line:
+ *
+ * # comment
+ * <regular expression> => <response line> | <response line> | ... [@ <delay in milliseconds>]
+ *
+ * Example:
+ *
+ * ^AT\+CSQ$ => +CSQ: 31,99 | OK
+ * ^AT\+CMGS= => >  | +CMS ERROR: 500 @ 2000
+ */
+
+// ParseScript parses rules from a script
+func ParseScript(script string) ([]Rule, error) {
+	var result []Rule
+	for lineNo, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		location := "line " + strconv.Itoa(lineNo+1)
+		parts := strings.SplitN(line, "=>", 2)
+		if len(parts) != 2 {
+			return nil, errors.New(location + ": expected '<regex> => <response>'")
+		}
+		pattern, err := regexp.Compile(strings.TrimSpace(parts[0]))
+		if err != nil {
+			return nil, errors.New(location + ": invalid regular expression - " + err.Error())
+		}
+		rule := Rule{Pattern: pattern}
+		response := parts[1]
+		if idx := strings.LastIndex(response, "@"); idx != -1 {
+			millis, err := strconv.Atoi(strings.TrimSpace(response[idx+1:]))
+			if err != nil || millis < 0 {
+				return nil, errors.New(location + ": delay must be a non-negative number of milliseconds")
+			}
+			rule.Delay = time.Duration(millis) * time.Millisecond
+			response = response[:idx]
+		}
+		for _, responseLine := range strings.Split(response, "|") {
+			if strings.TrimSpace(responseLine) == ">" {
+				rule.Response = append(rule.Response, "> ")
+			} else {
+				rule.Response = append(rule.Response, strings.TrimSpace(responseLine))
+			}
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+// LoadScript reads rules from a script file
+func LoadScript(path string) ([]Rule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("Failed to read script " + path + " - " + err.Error())
+	}
+	rules, err := ParseScript(string(content))
+	if err != nil {
+		return nil, errors.New("Invalid script " + path + ", " + err.Error())
+	}
+	return rules, nil
+}
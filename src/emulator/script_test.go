@@ -0,0 +1,29 @@
+package emulator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScript(t *testing.T) {
+	rules, err := ParseScript("# comment\n\n^AT\\+CSQ$ => +CSQ: 31,99 | OK\n^AT\\+CMGS= => > | +CMS ERROR: 500 @ 2000\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(rules) != 2 {
+		t.Fatalf("expected 2 rules, got %d", len(rules))
+	}
+	if !rules[0].Pattern.MatchString("AT+CSQ") || len(rules[0].Response) != 2 || rules[0].Response[0] != "+CSQ: 31,99" {
+		t.Errorf("wrong first rule %+v", rules[0])
+	}
+	if rules[1].Response[0] != "> " || rules[1].Response[1] != "+CMS ERROR: 500" || rules[1].Delay != 2*time.Second {
+		t.Errorf("wrong second rule %+v", rules[1])
+	}
+
+	if _, err = ParseScript("AT+CSQ OK"); err == nil {
+		t.Errorf("expected error for rule without '=>'")
+	}
+	if _, err = ParseScript("^AT[ => OK"); err == nil {
+		t.Errorf("expected error for invalid regular expression")
+	}
+}
@@ -0,0 +1,129 @@
+package emulator
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// how long the emulated network takes to answer a USSD request
+const ussdDelay = 50 * time.Millisecond
+
+const ussdMenu = "1: Balance\n2: Exit"
+
+// isPacked returns TRUE if a USSD string looks like hex-encoded, packed GSM-7 (as Huawei modems use)
+func isPacked(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil && len(s) > 0
+}
+
+// unpackAscii unpacks hex-encoded GSM-7 septets, only characters that GSM-7 and ASCII share are supported
+func unpackAscii(s string) string {
+	data, _ := hex.DecodeString(s)
+	var sb strings.Builder
+	count := len(data) * 8 / 7
+	for i := 0; i < count; i++ {
+		bitOffset := i * 7
+		value := uint16(data[bitOffset/8]) >> (bitOffset % 8)
+		if bitOffset%8 > 1 && bitOffset/8+1 < len(data) {
+			value |= uint16(data[bitOffset/8+1]) << (8 - bitOffset%8)
+		}
+		septet := byte(value & 0x7f)
+		if septet == '\r' && i == count-1 {
+			break
+		}
+		sb.WriteByte(septet)
+	}
+	return sb.String()
+}
+
+// packAscii packs text as hex-encoded GSM-7 septets, only characters that GSM-7 and ASCII share are supported
+func packAscii(text string) string {
+	septets := []byte(text)
+	if len(septets)%8 == 7 {
+		septets = append(septets, '\r')
+	}
+	var result []byte
+	var accumulator uint32
+	bits := 0
+	for _, septet := range septets {
+		accumulator |= uint32(septet&0x7f) << bits
+		bits += 7
+		for bits >= 8 {
+			result = append(result, byte(accumulator))
+			accumulator >>= 8
+			bits -= 8
+		}
+	}
+	if bits > 0 {
+		result = append(result, byte(accumulator))
+	}
+	return strings.ToUpper(hex.EncodeToString(result))
+}
+
+func encodeUcs2Hex(text string) string {
+	var data []byte
+	for _, unit := range utf16.Encode([]rune(text)) {
+		data = append(data, byte(unit>>8), byte(unit))
+	}
+	return strings.ToUpper(hex.EncodeToString(data))
+}
+
+// ussd handles AT+CUSD=<n>[,<str>[,<dcs>]], answering with a +CUSD unsolicited result code after the final OK.
+// "*100#" returns the balance, "*101#" opens a menu session and "*102#" returns an UCS-2 encoded answer.
+// Needs to be called with the mutex held.
+func (e *Emulator) ussd(params []string) string {
+
+	if params[0] == "2" {
+		e.ussdSession = false
+		return okResult()
+	}
+	if len(params) < 2 {
+		return okResult()
+	}
+	if !e.isRegistered() {
+		return e.cmeError(30)
+	}
+
+	packed := isPacked(params[1])
+	request := params[1]
+	if packed {
+		request = unpackAscii(request)
+	}
+	status, text, dcs := 0, "", 15
+	balance := "Your balance is " + e.options.Balance + " EUR."
+	switch {
+	case e.ussdSession && request == "1":
+		e.ussdSession = false
+		text = balance
+	case e.ussdSession && request == "2":
+		e.ussdSession = false
+		status = 2
+	case e.ussdSession:
+		status, text = 1, "Invalid choice\n"+ussdMenu
+	case request == "*100#":
+		text = balance
+	case request == "*101#":
+		e.ussdSession = true
+		status, text = 1, ussdMenu
+	case request == "*102#":
+		text, dcs = encodeUcs2Hex("Guthaben: "+strings.ReplaceAll(e.options.Balance, ".", ",")+" €"), 72
+	default:
+		status = 4
+	}
+
+	answer := "+CUSD: " + strconv.Itoa(status)
+	if text != "" {
+		if packed && dcs == 15 {
+			text = packAscii(text)
+		}
+		answer += ",\"" + text + "\"," + strconv.Itoa(dcs)
+	}
+	go func() {
+		time.Sleep(ussdDelay)
+		e.SendUnsolicited(answer)
+	}()
+	return okResult()
+}
@@ -0,0 +1,236 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/logger"
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+var log = logger.GetLogger("health")
+
+var initialized atomic.Bool
+var threadLock sync.Mutex
+var threadRunning atomic.Bool
+var shutdown atomic.Bool
+
+var threadAlive sync.WaitGroup
+var shutdownLatch sync.WaitGroup
+
+var appState *state.State
+var appModems []modem.Modem
+
+// modemHealth is what the watchdog knows about a single modem
+type modemHealth struct {
+	lastProbe time.Time
+	// number of probes in a row that failed
+	consecutiveFailures int
+	// index of the recovery step to try next
+	nextStep int
+}
+
+// protects healthByModem
+var healthMutex sync.Mutex
+
+// health of each watched modem, by modem name
+var healthByModem = make(map[string]*modemHealth)
+
+// GetConsecutiveFailures returns how many health probes of a modem failed in a row, 0 if the modem is not watched
+func GetConsecutiveFailures(modemName string) int {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	if health, found := healthByModem[modemName]; found {
+		return health.consecutiveFailures
+	}
+	return 0
+}
+
+func getHealth(modemName string) *modemHealth {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	health, found := healthByModem[modemName]
+	if !found {
+		health = &modemHealth{}
+		healthByModem[modemName] = health
+	}
+	return health
+}
+
+// probe checks that a modem answers and is registered to a network
+func probe(m modem.Modem) error {
+	status, err := m.Probe(context.Background())
+	if err != nil {
+		return err
+	}
+	if !status.IsRegistered() {
+		return errors.New("Modem is not registered to a network, status " + status.String())
+	}
+	return nil
+}
+
+// recoverModem takes a recovery step, recording the attempt in the application state.
+// Returns TRUE if the modem passed the health probe afterwards.
+func recoverModem(m modem.Modem, step config.RecoveryStep) bool {
+	err := m.Recover(context.Background(), step)
+	if err == nil {
+		err = probe(m)
+	}
+	attempt := state.RecoveryAttempt{Timestamp: state.UnixTimestamp(time.Now().Unix()), Step: step.String(), Success: err == nil}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	appState.RememberRecoveryAttempt(m.Name(), attempt)
+	_ = appState.WriteState()
+
+	if err != nil {
+		log.Error("Recovery step " + step.String() + " failed for modem '" + m.Name() + "': " + err.Error())
+		return false
+	}
+	log.Info("Modem '" + m.Name() + "' recovered using recovery step " + step.String())
+	return true
+}
+
+// checkModem probes a modem and, once the configured number of probes in a row failed,
+// takes the next recovery step for every further failed probe
+func checkModem(m modem.Modem) {
+	health := getHealth(m.Name())
+	threshold := m.GetConfig().GetWatchdogFailureThreshold()
+	steps := m.GetConfig().GetWatchdogRecoverySteps()
+
+	err := probe(m)
+
+	healthMutex.Lock()
+	health.lastProbe = time.Now()
+	if err == nil {
+		if health.consecutiveFailures > 0 {
+			log.Info("Modem '" + m.Name() + "' is healthy again")
+		}
+		health.consecutiveFailures = 0
+		health.nextStep = 0
+		healthMutex.Unlock()
+		return
+	}
+	health.consecutiveFailures++
+	failures := health.consecutiveFailures
+	nextStep := health.nextStep
+	healthMutex.Unlock()
+
+	log.Warn("Health probe of modem '" + m.Name() + "' failed (" + strconv.Itoa(failures) + "/" + strconv.Itoa(threshold) + "): " + err.Error())
+	if failures < threshold {
+		return
+	}
+	if len(steps) == 0 {
+		if failures == threshold {
+			log.Error("Modem '" + m.Name() + "' is unhealthy but no recovery steps are allowed")
+		}
+		return
+	}
+
+	log.Warn("Trying to recover modem '" + m.Name() + "' using recovery step " + strconv.Itoa(nextStep+1) + "/" +
+		strconv.Itoa(len(steps)) + " (" + steps[nextStep].String() + ")")
+	recovered := recoverModem(m, steps[nextStep])
+
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	// recovering may take a while, do not probe again right away
+	health.lastProbe = time.Now()
+	if recovered {
+		health.consecutiveFailures = 0
+		health.nextStep = 0
+		return
+	}
+	health.nextStep++
+	if health.nextStep == len(steps) {
+		// start over once another threshold's worth of probes failed
+		log.Error("All recovery steps failed for modem '" + m.Name() + "'")
+		health.consecutiveFailures = 0
+		health.nextStep = 0
+	}
+}
+
+// isProbeDue returns TRUE if a modem was not probed within its watchdog interval
+func isProbeDue(m modem.Modem) bool {
+	interval := m.GetConfig().GetWatchdogInterval()
+	if interval == nil {
+		return false
+	}
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+
+	health, found := healthByModem[m.Name()]
+	return !found || interval.IsShorterThan(time.Since(health.lastProbe))
+}
+
+func watchdogThread() {
+	threadRunning.Store(true)
+	threadAlive.Done()
+
+	defer func() {
+		shutdownLatch.Done()
+		log.Info("Health watchdog thread terminated.")
+		threadRunning.Store(false)
+	}()
+
+	log.Info("Health watchdog thread started")
+
+	for !shutdown.Load() {
+		for _, m := range appModems {
+			if shutdown.Load() || !isProbeDue(m) {
+				continue
+			}
+			checkModem(m)
+		}
+		time.Sleep(1 * time.Second)
+	}
+	log.Info("Health watchdog thread was asked to shut down")
+}
+
+func Init(state *state.State, modems []modem.Modem) {
+
+	appState = state
+	appModems = modems
+
+	enabled := false
+	for _, m := range modems {
+		modemConfig := m.GetConfig()
+		if modemConfig.GetWatchdogInterval() != nil {
+			log.Info("Probing modem '" + m.Name() + "' every " + modemConfig.GetWatchdogInterval().String() + ", recovering after " +
+				strconv.Itoa(modemConfig.GetWatchdogFailureThreshold()) + " failed probes")
+			enabled = true
+		}
+	}
+	if !enabled {
+		log.Info("No watchdog interval configured, won't start thread.")
+		return
+	}
+
+	threadLock.Lock()
+	defer threadLock.Unlock()
+
+	if !initialized.CompareAndSwap(false, true) {
+		panic("Already initialized")
+	}
+	shutdownLatch.Add(1)
+	threadAlive.Add(1)
+	go watchdogThread()
+	threadAlive.Wait()
+}
+
+func Shutdown() {
+	threadLock.Lock()
+	defer threadLock.Unlock()
+	shutdown.Store(true)
+	if threadRunning.Load() {
+		shutdownLatch.Wait()
+	}
+}
@@ -0,0 +1,103 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+// wedgedModem stops answering until it gets recovered using a particular recovery step
+type wedgedModem struct {
+	*modem.Simulator
+	healthy bool
+	fixedBy config.RecoveryStep
+	steps   []config.RecoveryStep
+}
+
+func (w *wedgedModem) Probe(context.Context) (modem.ConnectionStatus, error) {
+	if w.healthy {
+		return modem.CON_STATUS_REGISTERED_HOME, nil
+	}
+	return modem.CON_STATUS_UNKNOWN, errors.New("Modem did not answer AT with OK: ''")
+}
+
+func (w *wedgedModem) Recover(_ context.Context, step config.RecoveryStep) error {
+	w.steps = append(w.steps, step)
+	w.healthy = step == w.fixedBy
+	return nil
+}
+
+func newWedgedModem(t *testing.T, fixedBy config.RecoveryStep) *wedgedModem {
+	dataDir := t.TempDir()
+	content := "[common]\ndataDirectory=" + dataDir + "\n" +
+		"[restapi]\nbindIp=127.0.0.1\nport=9999\nuser=user\npassword=password\n" +
+		"[modem]\ndriver=simulator\nsimPin=1234\nwatchdogInterval=1m\nwatchdogFailureThreshold=2\n" +
+		"watchdogRecoverySteps=reopen,soft_reset,usb_reset\n" +
+		"[sms]\nrecipients=+491111111111\n"
+	configFile := dataDir + "/test.conf"
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %s", err.Error())
+	}
+	appConfig, err := config.LoadConfig(configFile, false)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err.Error())
+	}
+	appState, err = state.Init(appConfig)
+	if err != nil {
+		t.Fatalf("failed to initialize state: %s", err.Error())
+	}
+	healthByModem = make(map[string]*modemHealth)
+	return &wedgedModem{Simulator: modem.NewSimulator(appConfig, appState, appConfig.GetModems()[0]), fixedBy: fixedBy}
+}
+
+func TestWatchdogEscalatesRecoverySteps(t *testing.T) {
+	m := newWedgedModem(t, config.RECOVERY_STEP_USB_RESET)
+
+	if !isProbeDue(m) {
+		t.Errorf("modem that was never probed must be due")
+	}
+	checkModem(m)
+	if len(m.steps) != 0 || GetConsecutiveFailures(m.Name()) != 1 {
+		t.Fatalf("expected no recovery before the failure threshold, got %v", m.steps)
+	}
+	if isProbeDue(m) {
+		t.Errorf("modem probed just now must not be due")
+	}
+	for range 3 {
+		checkModem(m)
+	}
+	expected := []config.RecoveryStep{config.RECOVERY_STEP_REOPEN, config.RECOVERY_STEP_SOFT_RESET, config.RECOVERY_STEP_USB_RESET}
+	if !slices.Equal(m.steps, expected) {
+		t.Fatalf("expected recovery steps %v, got %v", expected, m.steps)
+	}
+	if GetConsecutiveFailures(m.Name()) != 0 {
+		t.Errorf("recovered modem must not count failures")
+	}
+	attempts := appState.GetRecoveryAttempts(m.Name())
+	if len(attempts) != 3 || attempts[0].Step != "reopen" || attempts[0].Success || attempts[0].Error == "" ||
+		attempts[2].Step != "usb_reset" || !attempts[2].Success {
+		t.Errorf("recovery attempts not recorded properly, got %+v", attempts)
+	}
+}
+
+func TestWatchdogStartsOverAfterLastRecoveryStep(t *testing.T) {
+	m := newWedgedModem(t, config.RECOVERY_STEP_REDISCOVER)
+
+	for range 5 {
+		checkModem(m)
+	}
+	if len(m.steps) != 3 || GetConsecutiveFailures(m.Name()) != 1 {
+		t.Fatalf("expected all steps to be tried once before waiting for the threshold again, got %v and %d failures",
+			m.steps, GetConsecutiveFailures(m.Name()))
+	}
+	checkModem(m)
+	if len(m.steps) != 4 || m.steps[3] != config.RECOVERY_STEP_REOPEN {
+		t.Errorf("expected recovery to start over with the first step, got %v", m.steps)
+	}
+}
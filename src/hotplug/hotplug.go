@@ -0,0 +1,334 @@
+package hotplug
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/logger"
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/serialportdiscovery"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+var log = logger.GetLogger("hotplug")
+
+var initialized atomic.Bool
+var threadLock sync.Mutex
+var threadRunning atomic.Bool
+var shutdown atomic.Bool
+
+var threadAlive sync.WaitGroup
+var shutdownLatch sync.WaitGroup
+
+// closed to wake up the hotplug thread when shutting down
+var stop = make(chan struct{})
+
+// signals the hotplug thread that a USB device or serial port was added or removed
+var changes = make(chan struct{}, 1)
+
+// how often to scan for USB devices if kernel uevents are not available
+var pollInterval = 2 * time.Second
+
+// how often to scan for USB devices although uevents arrive, in case the kernel dropped some
+var rescanInterval = 30 * time.Second
+
+// how long to wait after a uevent for the serial ports of a new USB device to show up
+var settleDelay = 500 * time.Millisecond
+
+// discovers the serial ports of a USB device, replaced by tests
+var discoverInterfaces = serialportdiscovery.DiscoverUsbInterfaces
+
+// how many events to keep per modem
+const maxEvents = 20
+
+const (
+	EVENT_ADDED        = "added"        // USB device was plugged in
+	EVENT_REMOVED      = "removed"      // USB device was unplugged
+	EVENT_REENUMERATED = "reenumerated" // USB device shows up with different serial ports
+)
+
+// Event is a change of a modem's USB device
+type Event struct {
+	Timestamp state.UnixTimestamp `json:"timestamp"`
+	// one of EVENT_ADDED, EVENT_REMOVED and EVENT_REENUMERATED
+	Type string `json:"type"`
+	// serial ports of the USB device after the event, empty if it was removed
+	Interfaces []string `json:"interfaces,omitempty"`
+	// why re-initializing the modem failed, empty on success or after removal
+	Error string `json:"error,omitempty"`
+}
+
+// watchedModem is what the hotplug monitor knows about a modem with a USB device ID
+type watchedModem struct {
+	modem modem.Modem
+	// serial ports found by the most recent scan, nil if the USB device was absent
+	interfaces []string
+	// TRUE if re-initializing the modem after its USB device (re-)appeared failed and needs to be retried
+	initPending bool
+	events      []Event
+}
+
+// protects watched and all watchedModem fields
+var watchedMutex sync.Mutex
+var watched []*watchedModem
+
+func findWatched(modemName string) *watchedModem {
+	for _, w := range watched {
+		if w.modem.Name() == modemName {
+			return w
+		}
+	}
+	return nil
+}
+
+// GetEvents returns the USB events of a modem, oldest first, nil if the modem's USB device is not watched
+func GetEvents(modemName string) []Event {
+	watchedMutex.Lock()
+	defer watchedMutex.Unlock()
+
+	if w := findWatched(modemName); w != nil {
+		return append([]Event{}, w.events...)
+	}
+	return nil
+}
+
+// IsPresent returns whether the USB device of a modem is plugged in, nil if the modem's USB device is not watched
+func IsPresent(modemName string) *bool {
+	watchedMutex.Lock()
+	defer watchedMutex.Unlock()
+
+	if w := findWatched(modemName); w != nil {
+		present := w.interfaces != nil
+		return &present
+	}
+	return nil
+}
+
+// discover returns the serial ports of a modem's USB device, nil if the device is absent
+func discover(m modem.Modem) []string {
+	interfaces, err := discoverInterfaces(*m.GetConfig().GetUsbSelector())
+	if err != nil || len(interfaces) == 0 {
+		return nil
+	}
+	return interfaces
+}
+
+func remember(w *watchedModem, event Event) {
+	watchedMutex.Lock()
+	defer watchedMutex.Unlock()
+
+	w.events = append(w.events, event)
+	if len(w.events) > maxEvents {
+		w.events = w.events[len(w.events)-maxEvents:]
+	}
+}
+
+// reinit closes the modem's serial port and opens it again, discovering the port anew
+func reinit(w *watchedModem) error {
+	err := w.modem.Recover(context.Background(), config.RECOVERY_STEP_REDISCOVER)
+
+	watchedMutex.Lock()
+	w.initPending = err != nil
+	watchedMutex.Unlock()
+
+	if err != nil {
+		log.Error("Failed to re-initialize modem '" + w.modem.Name() + "': " + err.Error())
+		return err
+	}
+	log.Info("Re-initialized modem '" + w.modem.Name() + "'")
+	return nil
+}
+
+// scan compares the serial ports of a modem's USB device with the ones found by the previous scan,
+// closing the modem when the device went away and re-initializing it when the device (re-)appeared
+func scan(w *watchedModem) {
+	interfaces := discover(w.modem)
+
+	watchedMutex.Lock()
+	previous := w.interfaces
+	w.interfaces = interfaces
+	pending := w.initPending
+	watchedMutex.Unlock()
+
+	deviceId := w.modem.GetConfig().GetUsbSelector().String()
+	now := state.UnixTimestamp(time.Now().Unix())
+	switch {
+	case previous != nil && interfaces == nil:
+		log.Warn("USB device " + deviceId + " of modem '" + w.modem.Name() + "' was removed, closing serial port")
+		w.modem.Close()
+		watchedMutex.Lock()
+		w.initPending = false
+		watchedMutex.Unlock()
+		remember(w, Event{Timestamp: now, Type: EVENT_REMOVED})
+	case interfaces != nil && previous == nil:
+		log.Info("USB device " + deviceId + " of modem '" + w.modem.Name() + "' was added with serial ports " +
+			strings.Join(interfaces, ", "))
+		event := Event{Timestamp: now, Type: EVENT_ADDED, Interfaces: interfaces}
+		if err := reinit(w); err != nil {
+			event.Error = err.Error()
+		}
+		remember(w, event)
+	case interfaces != nil && strings.Join(interfaces, ",") != strings.Join(previous, ","):
+		log.Warn("USB device " + deviceId + " of modem '" + w.modem.Name() + "' was re-enumerated, serial ports changed from " +
+			strings.Join(previous, ", ") + " to " + strings.Join(interfaces, ", "))
+		event := Event{Timestamp: now, Type: EVENT_REENUMERATED, Interfaces: interfaces}
+		if err := reinit(w); err != nil {
+			event.Error = err.Error()
+		}
+		remember(w, event)
+	case interfaces != nil && pending:
+		log.Info("Retrying to re-initialize modem '" + w.modem.Name() + "'")
+		_ = reinit(w)
+	}
+}
+
+func scanAll() {
+	watchedMutex.Lock()
+	modems := append([]*watchedModem{}, watched...)
+	watchedMutex.Unlock()
+
+	for _, w := range modems {
+		if shutdown.Load() {
+			return
+		}
+		scan(w)
+	}
+}
+
+// isInitPending returns TRUE if any modem needs to be re-initialized again
+func isInitPending() bool {
+	watchedMutex.Lock()
+	defer watchedMutex.Unlock()
+
+	for _, w := range watched {
+		if w.initPending {
+			return true
+		}
+	}
+	return false
+}
+
+// notify wakes up the hotplug thread
+func notify() {
+	select {
+	case changes <- struct{}{}:
+	default:
+	}
+}
+
+// uevents are only a hint, scanning sysfs tells what actually changed
+func ueventThread(listener *serialportdiscovery.UeventListener, failed *atomic.Bool) {
+	for {
+		event, err := listener.Next()
+		if err != nil {
+			if !shutdown.Load() {
+				log.Warn("No longer receiving kernel uevents, polling /sys/bus/usb/devices instead - " + err.Error())
+				failed.Store(true)
+			}
+			return
+		}
+		if event.IsUsbChange() {
+			log.Debug("Received uevent " + event.Action + " " + event.DevPath)
+			notify()
+		}
+	}
+}
+
+func hotplugThread(listener *serialportdiscovery.UeventListener) {
+	threadRunning.Store(true)
+	threadAlive.Done()
+
+	defer func() {
+		if listener != nil {
+			listener.Close()
+		}
+		shutdownLatch.Done()
+		log.Info("Hotplug thread terminated.")
+		threadRunning.Store(false)
+	}()
+
+	log.Info("Hotplug thread started")
+
+	var ueventsFailed atomic.Bool
+	ueventsFailed.Store(listener == nil)
+	if listener != nil {
+		go ueventThread(listener, &ueventsFailed)
+	}
+
+	for !shutdown.Load() {
+		interval := rescanInterval
+		if ueventsFailed.Load() || isInitPending() {
+			interval = pollInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-changes:
+			// more events are likely to follow, the serial ports show up after the USB device
+			time.Sleep(settleDelay)
+			select {
+			case <-changes:
+			default:
+			}
+		case <-timer.C:
+		case <-stop:
+		}
+		timer.Stop()
+		if !shutdown.Load() {
+			scanAll()
+		}
+	}
+	log.Info("Hotplug thread was asked to shut down")
+}
+
+// Init starts watching the USB devices of all serial modems with usbVendorId/usbProductId and usbHotplug enabled
+func Init(modems []modem.Modem) {
+
+	watchedMutex.Lock()
+	for _, m := range modems {
+		modemConfig := m.GetConfig()
+		if modemConfig.GetModemDriver() != config.MODEM_DRIVER_SERIAL || !modemConfig.IsUsbHotplug() {
+			continue
+		}
+		log.Info("Watching USB device " + modemConfig.GetUsbSelector().String() + " of modem '" + m.Name() + "'")
+		watched = append(watched, &watchedModem{modem: m, interfaces: discover(m)})
+	}
+	count := len(watched)
+	watchedMutex.Unlock()
+
+	if count == 0 {
+		log.Info("No modem with usbVendorId/usbProductId and usbHotplug enabled, won't start thread.")
+		return
+	}
+
+	listener, err := serialportdiscovery.ListenUevents()
+	if err != nil {
+		log.Warn("Polling /sys/bus/usb/devices every " + pollInterval.String() + " - " + err.Error())
+		listener = nil
+	}
+
+	threadLock.Lock()
+	defer threadLock.Unlock()
+
+	if !initialized.CompareAndSwap(false, true) {
+		panic("Already initialized")
+	}
+	shutdownLatch.Add(1)
+	threadAlive.Add(1)
+	go hotplugThread(listener)
+	threadAlive.Wait()
+}
+
+func Shutdown() {
+	threadLock.Lock()
+	defer threadLock.Unlock()
+	if shutdown.CompareAndSwap(false, true) {
+		close(stop)
+	}
+	if threadRunning.Load() {
+		shutdownLatch.Wait()
+	}
+}
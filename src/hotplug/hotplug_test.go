@@ -0,0 +1,145 @@
+package hotplug
+
+import (
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+
+	"code-sourcery.de/sms-gateway/common"
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/serialportdiscovery"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+// pluggableModem records being closed and re-initialized
+type pluggableModem struct {
+	*modem.Simulator
+	closed  int
+	steps   []config.RecoveryStep
+	initErr error
+}
+
+func (p *pluggableModem) Close() {
+	p.closed++
+}
+
+func (p *pluggableModem) Recover(_ context.Context, step config.RecoveryStep) error {
+	p.steps = append(p.steps, step)
+	return p.initErr
+}
+
+// newPluggableModem creates a modem with USB device ID 12d1:1506 whose serial ports are taken from ports,
+// nil meaning the device is unplugged
+func newPluggableModem(t *testing.T, ports *[]string) *pluggableModem {
+	dataDir := t.TempDir()
+	content := "[common]\ndataDirectory=" + dataDir + "\n" +
+		"[restapi]\nbindIp=127.0.0.1\nport=9999\nuser=user\npassword=password\n" +
+		"[modem]\nsimPin=1234\nusbVendorId=12d1\nusbProductId=1506\nserialPort=0\nserialSpeed=115200\nserialReadTimeoutSeconds=1\n" +
+		"[sms]\nrecipients=+491111111111\n"
+	configFile := dataDir + "/test.conf"
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %s", err.Error())
+	}
+	appConfig, err := config.LoadConfig(configFile, false)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err.Error())
+	}
+	appState, err := state.Init(appConfig)
+	if err != nil {
+		t.Fatalf("failed to initialize state: %s", err.Error())
+	}
+
+	discoverInterfaces = func(selector serialportdiscovery.UsbSelector) ([]string, error) {
+		if selector.DeviceId != (common.UsbDeviceId{VendorId: 0x12d1, ProductId: 0x1506}) {
+			t.Errorf("unexpected device ID %s", selector.String())
+		}
+		if *ports == nil {
+			return []string{}, errors.New("Found no USB device with ID " + selector.String())
+		}
+		return *ports, nil
+	}
+	m := &pluggableModem{Simulator: modem.NewSimulator(appConfig, appState, appConfig.GetModems()[0])}
+	watched = []*watchedModem{{modem: m, interfaces: discover(m)}}
+	return m
+}
+
+func eventTypes(modemName string) []string {
+	var result []string
+	for _, event := range GetEvents(modemName) {
+		result = append(result, event.Type)
+	}
+	return result
+}
+
+func TestHotplugReinitializesModem(t *testing.T) {
+	ports := []string{"/dev/ttyUSB0", "/dev/ttyUSB1", "/dev/ttyUSB2"}
+	m := newPluggableModem(t, &ports)
+	w := watched[0]
+
+	scan(w)
+	if m.closed != 0 || len(m.steps) != 0 || len(GetEvents(m.Name())) != 0 {
+		t.Fatalf("unchanged device must not touch the modem")
+	}
+	if present := IsPresent(m.Name()); present == nil || !*present {
+		t.Errorf("expected device to be present")
+	}
+
+	ports = nil
+	scan(w)
+	if m.closed != 1 || len(m.steps) != 0 {
+		t.Errorf("expected removal to close the modem, closed %d times, steps %v", m.closed, m.steps)
+	}
+	if present := IsPresent(m.Name()); present == nil || *present {
+		t.Errorf("expected device to be absent")
+	}
+
+	// stick comes back with different port numbers
+	ports = []string{"/dev/ttyUSB3", "/dev/ttyUSB4", "/dev/ttyUSB5"}
+	scan(w)
+	ports = []string{"/dev/ttyUSB5", "/dev/ttyUSB6", "/dev/ttyUSB7"}
+	scan(w)
+	if !slices.Equal(m.steps, []config.RecoveryStep{config.RECOVERY_STEP_REDISCOVER, config.RECOVERY_STEP_REDISCOVER}) {
+		t.Errorf("expected modem to be re-initialized twice, got %v", m.steps)
+	}
+	expected := []string{EVENT_REMOVED, EVENT_ADDED, EVENT_REENUMERATED}
+	if types := eventTypes(m.Name()); !slices.Equal(types, expected) {
+		t.Errorf("expected events %v, got %v", expected, types)
+	}
+	events := GetEvents(m.Name())
+	if !slices.Equal(events[2].Interfaces, ports) || events[2].Error != "" {
+		t.Errorf("unexpected event %+v", events[2])
+	}
+	if GetEvents("unknown") != nil || IsPresent("unknown") != nil {
+		t.Errorf("modem that is not watched must have no events")
+	}
+}
+
+func TestHotplugRetriesFailedInit(t *testing.T) {
+	var ports []string
+	m := newPluggableModem(t, &ports)
+	w := watched[0]
+
+	// serial ports are there but the modem does not answer yet
+	m.initErr = errors.New("Modem did not answer AT with OK")
+	ports = []string{"/dev/ttyUSB0"}
+	scan(w)
+	if !isInitPending() {
+		t.Fatal("expected failed re-initialization to be retried")
+	}
+	if events := GetEvents(m.Name()); len(events) != 1 || events[0].Error == "" {
+		t.Errorf("expected failed re-initialization to be recorded, got %+v", events)
+	}
+
+	m.initErr = nil
+	scan(w)
+	if isInitPending() || len(m.steps) != 2 {
+		t.Errorf("expected modem to be re-initialized on retry, got %v", m.steps)
+	}
+	scan(w)
+	if len(m.steps) != 2 || len(GetEvents(m.Name())) != 1 {
+		t.Errorf("expected no further re-initialization, got %v", m.steps)
+	}
+}
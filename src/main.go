@@ -7,11 +7,16 @@ import (
 	"strings"
 	"syscall"
 
+	"code-sourcery.de/sms-gateway/balance"
 	"code-sourcery.de/sms-gateway/common"
 	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/health"
+	"code-sourcery.de/sms-gateway/hotplug"
 	"code-sourcery.de/sms-gateway/keepalive"
 	"code-sourcery.de/sms-gateway/logger"
+	"code-sourcery.de/sms-gateway/modem"
 	"code-sourcery.de/sms-gateway/msgqueue"
+	"code-sourcery.de/sms-gateway/received"
 	"code-sourcery.de/sms-gateway/restapi"
 	"code-sourcery.de/sms-gateway/state"
 )
@@ -25,6 +30,23 @@ var buildVersion string
 func main() {
 	log.Info("sms-gateway v" + buildVersion + " (" + buildTimestamp + " @ " + gitCommit + ")")
 
+	if len(os.Args) > 1 && os.Args[1] == "emulate" {
+		runEmulator(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "at" {
+		runAtCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "list-devices" {
+		runListDevices(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "probe" {
+		runProbe(os.Args[2:])
+		return
+	}
+
 	configFile := ""
 	testSms := ""
 
@@ -35,10 +57,18 @@ func main() {
 		if idx > 0 {
 			if arg == "-h" || arg == "-help" || arg == "--help" {
 				println("Usage: [-h|-help|--help] [-t|--test <message>] [-d|--debug <flags>] <CONFIG FILE>")
+				println("       emulate [--help] [options]")
+				println("       at [--help] [--modem <name>] <CONFIG FILE> <AT command>")
+				println("       list-devices [--help]")
+				println("       probe [--help] [--speed <baud rate>] [<serial port> ...]")
 				println()
 				println("-h | -help | --help => Print help")
 				println("-t | --test => Send test SMS")
 				println("<-d | --debug> <flags> => Set debug flags. Possible flags are: 'modem_always_fail', 'modem_always_succeed'")
+				println("emulate => Run a modem emulator on a pseudo-terminal, see 'emulate --help'")
+				println("at => Send an AT command to a modem of the running gateway, see 'at --help'")
+				println("list-devices => Print USB devices and their serial ports, see 'list-devices --help'")
+				println("probe => Find the serial ports answering AT commands, see 'probe --help'")
 				return
 			} else if arg == "-d" || arg == "--debug" {
 
@@ -90,8 +120,9 @@ func main() {
 	}
 
 	if appConfig.GetMaxMessageLength() > 0 {
-		log.Info("Will truncate messages exceeding " + strconv.Itoa(appConfig.GetMaxMessageLength()) + " characters")
+		log.Info("Will limit SMS segments to " + strconv.Itoa(appConfig.GetMaxMessageLength()) + " characters")
 	}
+	log.Info("Will truncate messages exceeding " + strconv.Itoa(appConfig.GetMaxSegments()) + " segment(s)")
 
 	if config.StartWatching(configFile) == nil {
 		defer config.StopWatching()
@@ -107,18 +138,50 @@ func main() {
 		_ = appState.WriteState()
 	}(appState)
 
+	appModems := modem.NewAll(appConfig, appState)
+	for _, m := range appModems {
+		log.Info("Using modem '" + m.Name() + "' with " + m.GetConfig().GetModemDriver().String() + " driver, priority " +
+			strconv.Itoa(m.GetConfig().GetPriority()))
+	}
+	if len(appModems) > 1 {
+		log.Info("Choosing modems by " + appConfig.GetModemSelection().String())
+	}
+
 	log.Debug("Starting REST api....")
-	err = restapi.Init(appConfig, appState)
+	err = restapi.Init(appConfig, appState, appModems)
 	if err != nil {
 		panic(err)
 	}
 	log.Debug("REST api started.")
 
+	log.Debug("Starting receiver...")
+	err = received.Init(appConfig, appState, appModems)
+	if err != nil {
+		panic(err)
+	}
+	defer received.Shutdown()
+	log.Debug("Receiver started.")
+
 	log.Debug("Starting keep-alive...")
 	keepalive.Init(appConfig, appState)
 	defer keepalive.Shutdown()
 	log.Debug("Keep-alive started.")
 
+	log.Debug("Starting balance check...")
+	balance.Init(appState, appModems)
+	defer balance.Shutdown()
+	log.Debug("Balance check started.")
+
+	log.Debug("Starting health watchdog...")
+	health.Init(appState, appModems)
+	defer health.Shutdown()
+	log.Debug("Health watchdog started.")
+
+	log.Debug("Starting USB hotplug monitor...")
+	hotplug.Init(appModems)
+	defer hotplug.Shutdown()
+	log.Debug("USB hotplug monitor started.")
+
 	if len(testSms) > 0 {
 		msgId := appState.NewMessageId()
 
@@ -0,0 +1,68 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"code-sourcery.de/sms-gateway/config"
+)
+
+// ValidateAtCommand checks that a command for the AT console is a single AT command.
+// Line breaks, Ctrl-Z and ESC are rejected as they would let a caller smuggle in further commands or message bodies.
+// So are commands chained on a single line (like 'AT+CSQ;+CLCK=...' or 'ATE0+CPIN=...') as [admin] allowedCommands
+// and deniedCommands only get matched against the start of the command.
+func ValidateAtCommand(cmd string) error {
+	if !strings.HasPrefix(strings.ToUpper(cmd), "AT") {
+		return errors.New("AT command needs to start with 'AT'")
+	}
+	for _, c := range cmd {
+		if c < 0x20 || c == 0x7f {
+			return errors.New("AT command must not contain control characters")
+		}
+	}
+	quoted := false
+	// modems ignore whitespace, 'AT +CSQ' is a single command just like 'AT+CSQ'
+	for idx, c := range config.NormalizeAtCommand(cmd) {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == ';':
+			return errors.New("AT command must not contain ';', only a single command is supported")
+		case (c == '+' || c == '^' || c == '&') && idx > 2:
+			// the prefix of an extended or '&' command anywhere but right after 'AT' starts another command
+			return errors.New("AT command must not chain several commands, found another command starting with '" + string(c) + "'")
+		}
+	}
+	return nil
+}
+
+// SendAtCommand sends an arbitrary AT command as-is and returns the modem's response.
+// A response containing ERROR is not considered a failure, only not getting a response at all is.
+func (m *serialModem) SendAtCommand(ctx context.Context, cmd string) (ModemResponse, error) {
+
+	if err := ValidateAtCommand(cmd); err != nil {
+		return ModemResponse{}, err
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return ModemResponse{Lines: []string{"OK"}}, nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return ModemResponse{}, errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return ModemResponse{}, err
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.link == nil {
+		return ModemResponse{}, errors.New("Serial port of modem '" + m.Name() + "' is not open")
+	}
+	log.Info("Sending AT command '" + cmd + "' from console to modem '" + m.Name() + "'")
+	return m.sendCmd(ctx, cmd, true)
+}
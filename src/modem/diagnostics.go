@@ -0,0 +1,292 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+)
+
+// Diagnostics holds information about the modem, the SIM card and the mobile network.
+// Fields the modem did not report are left empty.
+type Diagnostics struct {
+	// received signal strength in dBm from AT+CSQ
+	SignalStrength *int `json:"signal_strength_dbm,omitempty"`
+	// signal strength icon (0...5) reported by HiLink sticks
+	SignalBars *int `json:"signal_bars,omitempty"`
+	// bit error rate (0...7) from AT+CSQ
+	BitErrorRate *int `json:"bit_error_rate,omitempty"`
+	// system mode reported by Huawei's AT^HCSQ? (like "LTE", "WCDMA", "GSM" or "NOSERVICE")
+	SystemMode string `json:"system_mode,omitempty"`
+	// LTE reference signal received power in dBm
+	Rsrp *float64 `json:"rsrp_dbm,omitempty"`
+	// LTE reference signal received quality in dB
+	Rsrq *float64 `json:"rsrq_db,omitempty"`
+	// LTE signal to interference plus noise ratio in dB
+	Sinr *float64 `json:"sinr_db,omitempty"`
+	// operator name and access technology from AT+COPS?
+	Operator         string `json:"operator,omitempty"`
+	AccessTechnology string `json:"access_technology,omitempty"`
+	Imei             string `json:"imei,omitempty"`
+	Imsi             string `json:"imsi,omitempty"`
+	Iccid            string `json:"iccid,omitempty"`
+	Manufacturer     string `json:"manufacturer,omitempty"`
+	Model            string `json:"model,omitempty"`
+	Firmware         string `json:"firmware,omitempty"`
+	// SMS service centre number from AT+CSCA?
+	Smsc string `json:"smsc,omitempty"`
+	// when the diagnostics were queried from the modem
+	Updated time.Time `json:"-"`
+}
+
+// diagnosticsCache keeps the most recent diagnostics of a modem so that frequent status requests
+// do not need to talk to the modem every time
+type diagnosticsCache struct {
+	mutex    sync.Mutex
+	updated  time.Time
+	value    Diagnostics
+	queryErr error
+}
+
+// get returns the cached diagnostics, querying the modem if they are older than maxAge
+func (c *diagnosticsCache) get(ctx context.Context, maxAge time.Duration, query func(context.Context) (Diagnostics, error)) (Diagnostics, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.updated.IsZero() || time.Since(c.updated) >= maxAge {
+		value, err := query(ctx)
+		if ctx.Err() != nil {
+			// the caller gave up, that says nothing about the modem
+			return value, err
+		}
+		c.value, c.queryErr = value, err
+		c.updated = time.Now()
+		c.value.Updated = c.updated
+	}
+	return c.value, c.queryErr
+}
+
+var accessTechnologies = map[int]string{
+	0: "GSM",
+	1: "GSM Compact",
+	2: "UTRAN",
+	3: "GSM w/EGPRS",
+	4: "UTRAN w/HSDPA",
+	5: "UTRAN w/HSUPA",
+	6: "UTRAN w/HSDPA and HSUPA",
+	7: "E-UTRAN",
+}
+
+// parseCsq parses a "+CSQ: <rssi>,<ber>" line, returning nil for values the modem reported as unknown (99)
+func parseCsq(line string) (*int, *int, error) {
+	parts := strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "+CSQ:")), ",")
+	if len(parts) != 2 {
+		return nil, nil, errors.New("Malformed +CSQ response: " + line)
+	}
+	rssi, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	ber, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil {
+		return nil, nil, errors.New("Malformed +CSQ response: " + line)
+	}
+	var signalStrength, bitErrorRate *int
+	if rssi >= 0 && rssi <= 31 {
+		dbm := -113 + 2*rssi
+		signalStrength = &dbm
+	}
+	if ber >= 0 && ber <= 7 {
+		bitErrorRate = &ber
+	}
+	return signalStrength, bitErrorRate, nil
+}
+
+// parseHcsq parses a Huawei '^HCSQ: "<sysmode>",<value1>,...' line. LTE reports
+// RSSI, RSRP, SINR and RSRQ, values are converted according to Huawei's AT command reference.
+func parseHcsq(line string, diagnostics *Diagnostics) error {
+	parts := unquoteAll(strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "^HCSQ:")), ","))
+	if len(parts) == 0 || parts[0] == "" {
+		return errors.New("Malformed ^HCSQ response: " + line)
+	}
+	diagnostics.SystemMode = parts[0]
+	if parts[0] != "LTE" || len(parts) < 5 {
+		return nil
+	}
+	values := make([]int, 4)
+	for idx := range values {
+		value, err := strconv.Atoi(parts[idx+1])
+		if err != nil {
+			return errors.New("Malformed ^HCSQ response: " + line)
+		}
+		values[idx] = value
+	}
+	// 255 = unknown/undetectable
+	if values[1] != 255 {
+		rsrp := float64(-141 + values[1])
+		diagnostics.Rsrp = &rsrp
+	}
+	if values[2] != 255 {
+		sinr := -20.2 + float64(values[2])*0.2
+		diagnostics.Sinr = &sinr
+	}
+	if values[3] != 255 {
+		rsrq := -20 + float64(values[3])*0.5
+		diagnostics.Rsrq = &rsrq
+	}
+	return nil
+}
+
+// parseCops parses a '+COPS: <mode>[,<format>,"<operator>"[,<AcT>]]' line, returning operator and access technology
+func parseCops(line string) (string, string) {
+	parts := unquoteAll(strings.Split(strings.TrimSpace(strings.TrimPrefix(line, "+COPS:")), ","))
+	if len(parts) < 3 {
+		// not registered
+		return "", ""
+	}
+	accessTechnology := ""
+	if len(parts) > 3 {
+		act, err := strconv.Atoi(parts[3])
+		if err == nil {
+			accessTechnology = accessTechnologies[act]
+		}
+	}
+	return parts[2], accessTechnology
+}
+
+func unquoteAll(parts []string) []string {
+	var result []string
+	for _, part := range parts {
+		result = append(result, strings.Trim(strings.TrimSpace(part), "\""))
+	}
+	return result
+}
+
+var extendedResultPrefix = regexp.MustCompile(`^[+^]?[A-Z]+:\s*`)
+
+// plainValue returns the value of a single-line response like "860000000000000", "^ICCID: 8949..." or "ICCID: 8949...",
+// stripping any response prefix and quotes. Returns "" if the response has no such line.
+func plainValue(response ModemResponse, cmd string) string {
+	for _, line := range response.Lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || trimmed == "OK" || trimmed == cmd {
+			continue
+		}
+		value := extendedResultPrefix.ReplaceAllString(trimmed, "")
+		return strings.Trim(strings.Split(value, ",")[0], "\"")
+	}
+	return ""
+}
+
+// queryValue sends a command and returns its single-line value, "" if the modem does not support the command
+func (m *serialModem) queryValue(ctx context.Context, cmd string) (string, error) {
+	response, err := m.sendCmd(ctx, cmd, true)
+	if err != nil {
+		return "", err
+	}
+	if response.isError() {
+		log.Debug("Modem '" + m.Name() + "' does not support " + cmd + ": " + response.String())
+		return "", nil
+	}
+	return plainValue(response, cmd), nil
+}
+
+func (m *serialModem) GetDiagnostics(ctx context.Context) (Diagnostics, error) {
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return Diagnostics{Updated: time.Now()}, nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return Diagnostics{}, errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+	return m.diagnostics.get(ctx, m.modemConfig.GetDiagnosticsRefreshInterval(), m.queryDiagnostics)
+}
+
+func (m *serialModem) queryDiagnostics(ctx context.Context) (Diagnostics, error) {
+
+	result := Diagnostics{}
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// IMSI, operator and SMSC need an unlocked SIM card, report everything else anyway
+	err := m.unlockSim(ctx)
+	if err != nil {
+		log.Warn("Failed to unlock SIM card of modem '" + m.Name() + "' for diagnostics: " + err.Error())
+		if m.link == nil {
+			return result, err
+		}
+	}
+
+	values := []struct {
+		cmd    string
+		target *string
+	}{
+		{"AT+CGMI", &result.Manufacturer},
+		{"AT+CGMM", &result.Model},
+		{"AT+CGMR", &result.Firmware},
+		{"AT+CGSN", &result.Imei},
+		{"AT+CIMI", &result.Imsi},
+		{m.profile.IccidCmd, &result.Iccid},
+	}
+	for _, value := range values {
+		*value.target, err = m.queryValue(ctx, value.cmd)
+		if err != nil {
+			return result, err
+		}
+	}
+	if result.Iccid == "" && m.profile.IccidCmd != "AT+CCID" {
+		result.Iccid, err = m.queryValue(ctx, "AT+CCID")
+		if err != nil {
+			return result, err
+		}
+	}
+
+	response, err := m.sendCmd(ctx, "AT+CSQ", true)
+	if err != nil {
+		return result, err
+	}
+	if line := response.getLineByPrefix("+CSQ:"); line != nil {
+		result.SignalStrength, result.BitErrorRate, err = parseCsq(*line)
+		if err != nil {
+			log.Warn(err.Error())
+		}
+	}
+
+	if m.profile.HuaweiCmds {
+		response, err = m.sendCmd(ctx, "AT^HCSQ?", true)
+		if err != nil {
+			return result, err
+		}
+		if line := response.getLineByPrefix("^HCSQ:"); line != nil {
+			err = parseHcsq(*line, &result)
+			if err != nil {
+				log.Warn(err.Error())
+			}
+		}
+	}
+
+	response, err = m.sendCmd(ctx, "AT+COPS?", true)
+	if err != nil {
+		return result, err
+	}
+	if line := response.getLineByPrefix("+COPS:"); line != nil {
+		result.Operator, result.AccessTechnology = parseCops(*line)
+	}
+
+	response, err = m.sendCmd(ctx, "AT+CSCA?", true)
+	if err != nil {
+		return result, err
+	}
+	if response.isOK() {
+		result.Smsc = plainValue(response, "AT+CSCA?")
+	}
+	return result, nil
+}
@@ -0,0 +1,57 @@
+package modem
+
+import (
+	"testing"
+)
+
+func TestParseCsq(t *testing.T) {
+	signalStrength, bitErrorRate, err := parseCsq("+CSQ: 20,3")
+	if err != nil || *signalStrength != -73 || *bitErrorRate != 3 {
+		t.Errorf("wrong result %v/%v/%v", signalStrength, bitErrorRate, err)
+	}
+	signalStrength, bitErrorRate, err = parseCsq("+CSQ: 99,99")
+	if err != nil || signalStrength != nil || bitErrorRate != nil {
+		t.Errorf("unknown values must yield nil, got %v/%v/%v", signalStrength, bitErrorRate, err)
+	}
+	if _, _, err = parseCsq("+CSQ: garbage"); err == nil {
+		t.Errorf("expected error for malformed response")
+	}
+}
+
+func TestParseHcsq(t *testing.T) {
+	diagnostics := Diagnostics{}
+	if err := parseHcsq(`^HCSQ: "LTE",52,40,143,22`, &diagnostics); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if diagnostics.SystemMode != "LTE" || *diagnostics.Rsrp != -101 || *diagnostics.Rsrq != -9 {
+		t.Errorf("wrong result %+v", diagnostics)
+	}
+	if *diagnostics.Sinr < 8.39 || *diagnostics.Sinr > 8.41 {
+		t.Errorf("wrong SINR %f", *diagnostics.Sinr)
+	}
+
+	diagnostics = Diagnostics{}
+	if err := parseHcsq(`^HCSQ: "WCDMA",30,30,58`, &diagnostics); err != nil || diagnostics.SystemMode != "WCDMA" || diagnostics.Rsrp != nil {
+		t.Errorf("wrong result for WCDMA %+v / %v", diagnostics, err)
+	}
+}
+
+func TestParseCops(t *testing.T) {
+	operator, accessTechnology := parseCops(`+COPS: 0,0,"Telekom.de",7`)
+	if operator != "Telekom.de" || accessTechnology != "E-UTRAN" {
+		t.Errorf("wrong result %s/%s", operator, accessTechnology)
+	}
+	operator, accessTechnology = parseCops(`+COPS: 0`)
+	if operator != "" || accessTechnology != "" {
+		t.Errorf("expected no operator when not registered, got %s/%s", operator, accessTechnology)
+	}
+}
+
+func TestPlainValue(t *testing.T) {
+	if value := plainValue(ModemResponse{Lines: []string{"AT+CGSN", "860000000000000", "OK"}}, "AT+CGSN"); value != "860000000000000" {
+		t.Errorf("wrong value '%s'", value)
+	}
+	if value := plainValue(ModemResponse{Lines: []string{`+CSCA: "+491710760000",145`, "OK"}}, "AT+CSCA?"); value != "+491710760000" {
+		t.Errorf("wrong value '%s'", value)
+	}
+}
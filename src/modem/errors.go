@@ -0,0 +1,201 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ModemError is a '+CME ERROR' (mobile equipment) or '+CMS ERROR' (SMS service) final result code
+type ModemError struct {
+	// "+CME ERROR" or "+CMS ERROR"
+	Prefix string
+	// error code, -1 if the modem sent a text the code could not be looked up for
+	Code        int
+	Description string
+	// TRUE if retrying is pointless, like for an invalid destination number or a missing SIM card
+	Permanent bool
+	// TRUE if the error concerns the recipient and not the modem or its SIM card, like an unassigned number,
+	// so other modems would fail just the same
+	RecipientFault bool
+}
+
+func (e *ModemError) Error() string {
+	if e.Code < 0 {
+		return e.Prefix + ": " + e.Description
+	}
+	return e.Prefix + ": " + strconv.Itoa(e.Code) + " (" + e.Description + ")"
+}
+
+// Classification returns "permanent" or "transient"
+func (e *ModemError) Classification() string {
+	if e.Permanent {
+		return "permanent"
+	}
+	return "transient"
+}
+
+// TimeoutError is returned if the modem did not finish answering a command before the command's deadline
+type TimeoutError struct {
+	Cmd     string
+	Timeout time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return "Modem did not answer " + e.Cmd + " within " + e.Timeout.String()
+}
+
+// Unwrap makes errors.Is(err, context.DeadlineExceeded) hold for timeouts
+func (e *TimeoutError) Unwrap() error {
+	return context.DeadlineExceeded
+}
+
+type errorInfo struct {
+	description    string
+	permanent      bool
+	recipientFault bool
+}
+
+// mobile equipment errors, 3GPP TS 27.007 section 9.2
+var cmeErrors = map[int]errorInfo{
+	0:   {"phone failure", false, false},
+	1:   {"no connection to phone", false, false},
+	3:   {"operation not allowed", false, false},
+	4:   {"operation not supported", true, false},
+	5:   {"PH-SIM PIN required", true, false},
+	10:  {"SIM not inserted", true, false},
+	11:  {"SIM PIN required", false, false},
+	12:  {"SIM PUK required", true, false},
+	13:  {"SIM failure", true, false},
+	14:  {"SIM busy", false, false},
+	15:  {"SIM wrong", true, false},
+	16:  {"incorrect password", true, false},
+	17:  {"SIM PIN2 required", true, false},
+	18:  {"SIM PUK2 required", true, false},
+	20:  {"memory full", false, false},
+	21:  {"invalid index", false, false},
+	22:  {"not found", false, false},
+	23:  {"memory failure", false, false},
+	30:  {"no network service", false, false},
+	31:  {"network timeout", false, false},
+	32:  {"network not allowed - emergency calls only", false, false},
+	100: {"unknown", false, false},
+	// PUK-locked, messages stay queued until the SIM card gets unlocked via /sim/unlock, see newPukRequiredError()
+	262: {"SIM blocked", false, false},
+}
+
+// SMS service errors, 3GPP TS 27.005 section 3.2.5 and TS 24.011 annex E (RP cause values)
+var cmsErrors = map[int]errorInfo{
+	1:   {"unassigned (unallocated) number", true, true},
+	8:   {"operator determined barring", true, true},
+	10:  {"call barred", true, true},
+	21:  {"short message transfer rejected", true, true},
+	22:  {"memory capacity exceeded", false, false},
+	27:  {"destination out of service", false, false},
+	28:  {"unidentified subscriber", true, true},
+	29:  {"facility rejected", true, true},
+	30:  {"unknown subscriber", true, true},
+	38:  {"network out of order", false, false},
+	41:  {"temporary failure", false, false},
+	42:  {"congestion", false, false},
+	47:  {"resources unavailable, unspecified", false, false},
+	50:  {"requested facility not subscribed", true, true},
+	69:  {"requested facility not implemented", true, false},
+	81:  {"invalid short message transfer reference value", false, false},
+	95:  {"invalid message, unspecified", true, true},
+	96:  {"invalid mandatory information", true, true},
+	97:  {"message type non-existent or not implemented", true, false},
+	111: {"protocol error, unspecified", false, false},
+	127: {"interworking, unspecified", false, false},
+	300: {"ME failure", false, false},
+	301: {"SMS service of ME reserved", true, false},
+	302: {"operation not allowed", false, false},
+	303: {"operation not supported", true, false},
+	304: {"invalid PDU mode parameter", true, false},
+	305: {"invalid text mode parameter", true, false},
+	310: {"SIM not inserted", true, false},
+	311: {"SIM PIN required", false, false},
+	312: {"PH-SIM PIN required", true, false},
+	313: {"SIM failure", true, false},
+	314: {"SIM busy", false, false},
+	315: {"SIM wrong", true, false},
+	// messages stay queued until the SIM card gets unlocked via /sim/unlock, see newPukRequiredError()
+	316: {"SIM PUK required", false, false},
+	317: {"SIM PIN2 required", true, false},
+	318: {"SIM PUK2 required", true, false},
+	320: {"memory failure", false, false},
+	321: {"invalid memory index", false, false},
+	322: {"memory full", false, false},
+	330: {"SMSC address unknown", true, false},
+	331: {"no network service", false, false},
+	332: {"network timeout", false, false},
+	340: {"no +CNMA acknowledgement expected", false, false},
+	500: {"unknown error", false, false},
+}
+
+var modemErrorRegEx = regexp.MustCompile(`^(\+CM[ES] ERROR):\s*(.*)$`)
+
+// parseModemError parses a '+CME ERROR: <err>' or '+CMS ERROR: <err>' line. Both numeric codes (AT+CMEE=1) and
+// texts (AT+CMEE=2) are understood. Codes we do not know about are considered transient.
+func parseModemError(line string) *ModemError {
+	match := modemErrorRegEx.FindStringSubmatch(strings.TrimSpace(line))
+	if match == nil {
+		return nil
+	}
+	table := cmeErrors
+	if match[1] == "+CMS ERROR" {
+		table = cmsErrors
+	}
+	value := strings.TrimSpace(match[2])
+	result := &ModemError{Prefix: match[1], Code: -1, Description: value}
+	if code, err := strconv.Atoi(value); err == nil {
+		result.Code = code
+		result.Description = "unknown error code"
+		if info, found := table[code]; found {
+			result.Description = info.description
+			result.Permanent = info.permanent
+			result.RecipientFault = info.recipientFault
+		}
+		return result
+	}
+	for code, info := range table {
+		if strings.EqualFold(info.description, value) {
+			result.Code = code
+			result.Description = info.description
+			result.Permanent = info.permanent
+			result.RecipientFault = info.recipientFault
+			break
+		}
+	}
+	return result
+}
+
+func newCmeError(code int) *ModemError {
+	return parseModemError("+CME ERROR: " + strconv.Itoa(code))
+}
+
+func newCmsError(code int) *ModemError {
+	return parseModemError("+CMS ERROR: " + strconv.Itoa(code))
+}
+
+// asModemError returns the ModemError an error is or wraps, nil if there is none
+func asModemError(err error) *ModemError {
+	var modemErr *ModemError
+	if errors.As(err, &modemErr) {
+		return modemErr
+	}
+	return nil
+}
+
+// getModemError returns the '+CME ERROR' or '+CMS ERROR' the modem responded with, nil if there is none
+func (r *ModemResponse) getModemError() *ModemError {
+	for _, line := range r.Lines {
+		if result := parseModemError(line); result != nil {
+			return result
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package modem
+
+import (
+	"testing"
+)
+
+func TestParseModemError(t *testing.T) {
+	modemErr := parseModemError("+CMS ERROR: 1")
+	if modemErr == nil || modemErr.Code != 1 || !modemErr.Permanent || !modemErr.RecipientFault ||
+		modemErr.Error() != "+CMS ERROR: 1 (unassigned (unallocated) number)" {
+		t.Errorf("wrong result for unassigned number %+v", modemErr)
+	}
+	// the modem is at fault and not the recipient, another modem may be able to send the message
+	modemErr = parseModemError("+CMS ERROR: 310")
+	if modemErr == nil || !modemErr.Permanent || modemErr.RecipientFault {
+		t.Errorf("missing SIM card must not be blamed on the recipient, got %+v", modemErr)
+	}
+	modemErr = parseModemError("+CMS ERROR: 332")
+	if modemErr == nil || modemErr.Permanent || modemErr.Description != "network timeout" {
+		t.Errorf("network timeout must be transient, got %+v", modemErr)
+	}
+	// a PUK-locked SIM card can be unlocked, messages need to stay queued until then
+	for _, line := range []string{"+CMS ERROR: 316", "+CME ERROR: 262"} {
+		if modemErr = parseModemError(line); modemErr == nil || modemErr.Permanent {
+			t.Errorf("PUK-locked SIM card must be transient, got %+v", modemErr)
+		}
+	}
+	// AT+CMEE=2
+	modemErr = parseModemError("+CME ERROR: SIM PUK required")
+	if modemErr == nil || modemErr.Prefix != "+CME ERROR" || modemErr.Code != 12 || !modemErr.Permanent {
+		t.Errorf("wrong result for error text %+v", modemErr)
+	}
+	modemErr = parseModemError("+CME ERROR: something odd")
+	if modemErr == nil || modemErr.Code != -1 || modemErr.Permanent || modemErr.Error() != "+CME ERROR: something odd" {
+		t.Errorf("unknown error texts must be transient, got %+v", modemErr)
+	}
+	if modemErr = parseModemError("+CMS ERROR: 999"); modemErr == nil || modemErr.Permanent {
+		t.Errorf("unknown error codes must be transient, got %+v", modemErr)
+	}
+	if parseModemError("ERROR") != nil || parseModemError("+CMGS: 12") != nil {
+		t.Errorf("only +CME/+CMS errors must be parsed")
+	}
+}
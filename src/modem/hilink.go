@@ -0,0 +1,811 @@
+package modem
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+// Huawei HiLink sticks (like the E3372h with HiLink firmware) act as a router and expose an XML-over-HTTP API
+// instead of AT serial ports. Every request needs a session cookie and a request verification token, both
+// obtained from /api/webserver/SesTokInfo (and by logging in if the web interface is password protected).
+
+// error codes returned by the HiLink API if the session or token expired or the request needs a login
+var hilinkSessionErrors = []int{100003, 125001, 125002, 125003}
+
+// SimState values returned by /api/pin/status
+const (
+	hilinkSimStateReady       = 257
+	hilinkSimStatePinDisabled = 258
+	hilinkSimStatePinVerified = 259
+	hilinkSimStatePin         = 260
+	hilinkSimStatePuk         = 261
+)
+
+// OperateType values accepted by /api/pin/operate
+const (
+	hilinkPinVerify = 0
+	hilinkPinPuk    = 4
+)
+
+// format of the dates exchanged with the HiLink API, in the stick's local time
+const hilinkDateFormat = "2006-01-02 15:04:05"
+
+// how many messages to request per /api/sms/sms-list page, HiLink sticks return at most 50
+const hilinkPageSize = 20
+
+// how often to poll the stick while waiting for a message to be sent or a USSD answer
+var hilinkPollInterval = 500 * time.Millisecond
+
+// hilinkError is the <error> document the HiLink API answers with if a request failed
+type hilinkError struct {
+	Code    int    `xml:"code"`
+	Message string `xml:"message"`
+}
+
+func (e *hilinkError) Error() string {
+	result := "HiLink API error " + strconv.Itoa(e.Code)
+	if e.Message != "" {
+		result += " (" + e.Message + ")"
+	}
+	return result
+}
+
+// hilinkModem talks to a Huawei HiLink stick using its HTTP API
+type hilinkModem struct {
+	appConfig   *config.Config
+	appState    *state.State
+	modemConfig config.ModemConfig
+	client      *http.Client
+
+	mutex sync.Mutex
+	// session cookie and request verification token, "" if there is no session yet
+	session string
+	token   string
+	pins    pinGuard
+
+	diagnostics diagnosticsCache
+}
+
+func newHilinkModem(appConfig *config.Config, appState *state.State, modemConfig config.ModemConfig) *hilinkModem {
+	return &hilinkModem{
+		appConfig:   appConfig,
+		appState:    appState,
+		modemConfig: modemConfig,
+		client:      &http.Client{Timeout: modemConfig.GetHilinkTimeout()},
+	}
+}
+
+func (m *hilinkModem) Name() string {
+	return m.modemConfig.GetName()
+}
+
+func (m *hilinkModem) GetConfig() config.ModemConfig {
+	return m.modemConfig
+}
+
+// send performs a single HTTP request using the current session, decoding the response into result.
+// Needs to be called with the mutex held.
+func (m *hilinkModem) send(ctx context.Context, method string, path string, request any, result any) error {
+
+	var body io.Reader
+	if request != nil {
+		data, err := xml.Marshal(request)
+		if err != nil {
+			return errors.New("Failed to encode HiLink request - " + err.Error())
+		}
+		body = bytes.NewReader(append([]byte(xml.Header), data...))
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, method, m.modemConfig.GetHilinkUrl()+path, body)
+	if err != nil {
+		return err
+	}
+	if request != nil {
+		httpRequest.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=UTF-8")
+	}
+	if m.session != "" {
+		httpRequest.Header.Set("Cookie", m.session)
+	}
+	if m.token != "" {
+		httpRequest.Header.Set("__RequestVerificationToken", m.token)
+	}
+
+	response, err := m.client.Do(httpRequest)
+	if err != nil {
+		return errors.New("HiLink stick of modem '" + m.Name() + "' did not answer " + path + " - " + err.Error())
+	}
+	defer func() {
+		_ = response.Body.Close()
+	}()
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		return errors.New("Failed to read HiLink response to " + path + " - " + err.Error())
+	}
+	if response.StatusCode != http.StatusOK {
+		return errors.New("HiLink stick of modem '" + m.Name() + "' answered " + path + " with " + response.Status)
+	}
+
+	// tokens may only be used once, the stick hands out the next ones with every response
+	if token := response.Header.Get("__RequestVerificationTokenone"); token != "" {
+		m.token = token
+	} else if token := response.Header.Get("__RequestVerificationToken"); token != "" {
+		m.token, _, _ = strings.Cut(token, "#")
+	}
+	for _, cookie := range response.Cookies() {
+		if cookie.Name == "SessionID" {
+			m.session = cookie.Name + "=" + cookie.Value
+		}
+	}
+
+	var root struct {
+		XMLName xml.Name
+	}
+	if err = xml.Unmarshal(data, &root); err != nil {
+		return errors.New("Malformed HiLink response to " + path + " - " + err.Error())
+	}
+	if root.XMLName.Local == "error" {
+		apiErr := &hilinkError{}
+		if err = xml.Unmarshal(data, apiErr); err != nil {
+			return errors.New("Malformed HiLink error response to " + path + " - " + err.Error())
+		}
+		return apiErr
+	}
+	if result == nil {
+		return nil
+	}
+	if err = xml.Unmarshal(data, result); err != nil {
+		return errors.New("Malformed HiLink response to " + path + " - " + err.Error())
+	}
+	return nil
+}
+
+// call performs an API request, establishing a new session and retrying once if the stick rejected
+// the session or the token. Needs to be called with the mutex held.
+func (m *hilinkModem) call(ctx context.Context, method string, path string, request any, result any) error {
+
+	if m.session == "" {
+		if err := m.openSession(ctx); err != nil {
+			return err
+		}
+	}
+	err := m.send(ctx, method, path, request, result)
+	var apiErr *hilinkError
+	if errors.As(err, &apiErr) && slices.Contains(hilinkSessionErrors, apiErr.Code) {
+		log.Info("HiLink stick of modem '" + m.Name() + "' rejected session (" + apiErr.Error() + "), starting a new one")
+		m.session = ""
+		m.token = ""
+		if err = m.openSession(ctx); err != nil {
+			return err
+		}
+		err = m.send(ctx, method, path, request, result)
+	}
+	return err
+}
+
+// openSession obtains a session cookie and token and logs in if a password is configured.
+// Needs to be called with the mutex held.
+func (m *hilinkModem) openSession(ctx context.Context) error {
+
+	m.session = ""
+	m.token = ""
+	var tokInfo struct {
+		SesInfo string `xml:"SesInfo"`
+		TokInfo string `xml:"TokInfo"`
+	}
+	if err := m.send(ctx, http.MethodGet, "/api/webserver/SesTokInfo", nil, &tokInfo); err != nil {
+		return errors.New("Failed to obtain HiLink session - " + err.Error())
+	}
+	if tokInfo.SesInfo == "" || tokInfo.TokInfo == "" {
+		return errors.New("HiLink stick of modem '" + m.Name() + "' returned no session/token")
+	}
+	m.session = tokInfo.SesInfo
+	m.token = tokInfo.TokInfo
+
+	if password := m.modemConfig.GetHilinkPassword(); password != "" {
+		user := m.modemConfig.GetHilinkUser()
+		request := hilinkLoginRequest{Username: user, Password: hilinkPasswordHash(user, password, m.token), PasswordType: 4}
+		if err := m.send(ctx, http.MethodPost, "/api/user/login", request, nil); err != nil {
+			m.session = ""
+			m.token = ""
+			return errors.New("Failed to log into HiLink stick of modem '" + m.Name() + "' - " + err.Error())
+		}
+	}
+	log.Info("Opened HiLink session with modem '" + m.Name() + "' at " + m.modemConfig.GetHilinkUrl())
+	return nil
+}
+
+type hilinkLoginRequest struct {
+	XMLName      xml.Name `xml:"request"`
+	Username     string   `xml:"Username"`
+	Password     string   `xml:"Password"`
+	PasswordType int      `xml:"password_type"`
+}
+
+// hilinkPasswordHash returns the login password for password_type 4:
+// base64(sha256hex(user + base64(sha256hex(password)) + token))
+func hilinkPasswordHash(user string, password string, token string) string {
+	sha256Hex := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	passwordHash := base64.StdEncoding.EncodeToString([]byte(sha256Hex(password)))
+	return base64.StdEncoding.EncodeToString([]byte(sha256Hex(user + passwordHash + token)))
+}
+
+func (m *hilinkModem) Init(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.prepare(ctx)
+}
+
+func (m *hilinkModem) Close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.session != "" {
+		log.Info("Closing HiLink session with modem '" + m.Name() + "'")
+	}
+	m.session = ""
+	m.token = ""
+}
+
+// prepare opens a session if necessary and unlocks the SIM card, needs to be called with the mutex held
+func (m *hilinkModem) prepare(ctx context.Context) error {
+	if m.session == "" {
+		if err := m.openSession(ctx); err != nil {
+			return err
+		}
+	}
+	return m.unlockSim(ctx)
+}
+
+type hilinkPinStatus struct {
+	SimState    int    `xml:"SimState"`
+	SimPinTimes string `xml:"SimPinTimes"`
+	SimPukTimes string `xml:"SimPukTimes"`
+}
+
+type hilinkPinRequest struct {
+	XMLName     xml.Name `xml:"request"`
+	OperateType int      `xml:"OperateType"`
+	CurrentPin  string   `xml:"CurrentPin"`
+	NewPin      string   `xml:"NewPin"`
+	PukCode     string   `xml:"PukCode"`
+}
+
+// queryPinStatus needs to be called with the mutex held
+func (m *hilinkModem) queryPinStatus(ctx context.Context) (SimStatus, error) {
+	var status hilinkPinStatus
+	if err := m.call(ctx, http.MethodGet, "/api/pin/status", nil, &status); err != nil {
+		return SimStatus{}, err
+	}
+	result := SimStatus{PinState: MODEM_PIN_RESPONSE_NOT_RECOGNIZED, PinRetries: -1, PukRetries: -1}
+	switch status.SimState {
+	case hilinkSimStateReady, hilinkSimStatePinDisabled, hilinkSimStatePinVerified:
+		result.PinState = MODEM_PIN_NOT_REQUIRED
+	case hilinkSimStatePin:
+		result.PinState = MODEM_PIN_REQUIRED
+	case hilinkSimStatePuk:
+		result.PinState = MODEM_PIN_PUK_REQUIRED
+	}
+	if retries, err := strconv.Atoi(strings.TrimSpace(status.SimPinTimes)); err == nil {
+		result.PinRetries = retries
+	}
+	if retries, err := strconv.Atoi(strings.TrimSpace(status.SimPukTimes)); err == nil {
+		result.PukRetries = retries
+	}
+	return result, nil
+}
+
+// unlockSim enters the configured PIN if the SIM card asks for it, needs to be called with the mutex held
+func (m *hilinkModem) unlockSim(ctx context.Context) error {
+
+	status, err := m.queryPinStatus(ctx)
+	if err != nil {
+		return err
+	}
+	switch status.PinState {
+	case MODEM_PIN_NOT_REQUIRED:
+		return nil
+	case MODEM_PIN_REQUIRED:
+		pin := m.modemConfig.GetSimPin()
+		if err = m.pins.checkPin(pin); err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		if err = checkRetries(status.PinRetries, "PIN"); err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		err = m.call(ctx, http.MethodPost, "/api/pin/operate", hilinkPinRequest{OperateType: hilinkPinVerify, CurrentPin: pin}, nil)
+		var apiErr *hilinkError
+		if errors.As(err, &apiErr) {
+			// only an answer by the stick means the SIM card rejected the PIN
+			m.pins.rejectedPin = pin
+		}
+		if err != nil {
+			return errors.New("Unlocking PIN failed - " + err.Error())
+		}
+		log.Info("Successfully unlocked SIM card of modem '" + m.Name() + "' using PIN")
+		return nil
+	case MODEM_PIN_PUK_REQUIRED:
+		log.Error("Modem requires PUK, please unlock SIM card using the /sim/unlock REST endpoint or the HiLink web interface")
+		return newPukRequiredError()
+	}
+	return errors.New("HiLink stick of modem '" + m.Name() + "' reported unknown SIM state")
+}
+
+func (m *hilinkModem) GetSimStatus(ctx context.Context) (SimStatus, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.queryPinStatus(ctx)
+}
+
+func (m *hilinkModem) UnlockSimWithPuk(ctx context.Context, puk string, newPin string) error {
+
+	if err := ValidateSimCodes(puk, newPin); err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status, err := m.queryPinStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if status.PinState != MODEM_PIN_PUK_REQUIRED {
+		return errors.New("SIM card is not PUK-locked (state " + status.PinState.String() + ")")
+	}
+	if err = checkRetries(status.PukRetries, "PUK"); err != nil {
+		return err
+	}
+	err = m.call(ctx, http.MethodPost, "/api/pin/operate", hilinkPinRequest{OperateType: hilinkPinPuk, NewPin: newPin, PukCode: puk}, nil)
+	if err != nil {
+		return errors.New("Unlocking SIM card with PUK failed - " + err.Error())
+	}
+	log.Info("Successfully unlocked SIM card of modem '" + m.Name() + "' using PUK")
+	m.pins.rejectedPin = ""
+	return nil
+}
+
+type hilinkMonitoringStatus struct {
+	ConnectionStatus   int `xml:"ConnectionStatus"`
+	SignalIcon         int `xml:"SignalIcon"`
+	CurrentNetworkType int `xml:"CurrentNetworkType"`
+	RoamingStatus      int `xml:"RoamingStatus"`
+	SimStatus          int `xml:"SimStatus"`
+	ServiceStatus      int `xml:"ServiceStatus"`
+}
+
+// registration maps the monitoring status to the network registration, ServiceStatus 2 = service available
+func (s hilinkMonitoringStatus) registration() ConnectionStatus {
+	switch {
+	case s.ServiceStatus == 2 && s.RoamingStatus == 1:
+		return CON_STATUS_REGISTERED_ROAMING
+	case s.ServiceStatus == 2:
+		return CON_STATUS_REGISTERED_HOME
+	case s.ServiceStatus == 0:
+		return CON_STATUS_NOT_REGISTERED_SEARCHING
+	}
+	return CON_STATUS_UNKNOWN
+}
+
+// systemMode maps the CurrentNetworkType of the monitoring status to the system modes reported by AT^HCSQ?
+func (s hilinkMonitoringStatus) systemMode() string {
+	switch {
+	case s.CurrentNetworkType == 0:
+		return "NOSERVICE"
+	case s.CurrentNetworkType <= 3:
+		return "GSM"
+	case s.CurrentNetworkType == 19 || s.CurrentNetworkType == 101:
+		return "LTE"
+	}
+	return "WCDMA"
+}
+
+// queryMonitoringStatus needs to be called with the mutex held
+func (m *hilinkModem) queryMonitoringStatus(ctx context.Context) (hilinkMonitoringStatus, error) {
+	var status hilinkMonitoringStatus
+	err := m.call(ctx, http.MethodGet, "/api/monitoring/status", nil, &status)
+	return status, err
+}
+
+func (m *hilinkModem) GetConnectionStatus(ctx context.Context) (ConnectionStatus, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.prepare(ctx); err != nil {
+		return CON_STATUS_UNKNOWN, err
+	}
+	status, err := m.queryMonitoringStatus(ctx)
+	if err != nil {
+		return CON_STATUS_UNKNOWN, err
+	}
+	return status.registration(), nil
+}
+
+func (m *hilinkModem) Probe(ctx context.Context) (ConnectionStatus, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status, err := m.queryMonitoringStatus(ctx)
+	if err != nil {
+		return CON_STATUS_UNKNOWN, err
+	}
+	return status.registration(), nil
+}
+
+type hilinkSendRequest struct {
+	XMLName  xml.Name `xml:"request"`
+	Index    int      `xml:"Index"`
+	Phones   []string `xml:"Phones>Phone"`
+	Sca      string   `xml:"Sca"`
+	Content  string   `xml:"Content"`
+	Length   int      `xml:"Length"`
+	Reserved int      `xml:"Reserved"`
+	Date     string   `xml:"Date"`
+}
+
+type hilinkSendStatus struct {
+	Phone      string `xml:"Phone"`
+	SucPhone   string `xml:"SucPhone"`
+	FailPhone  string `xml:"FailPhone"`
+	TotalCount int    `xml:"TotalCount"`
+	CurIndex   int    `xml:"CurIndex"`
+}
+
+// containsPhone returns TRUE if a ';' or ',' separated list of phone numbers returned by /api/sms/send-status contains the number
+func containsPhone(list string, phone string) bool {
+	return slices.Contains(strings.FieldsFunc(list, func(r rune) bool {
+		return r == ';' || r == ','
+	}), phone)
+}
+
+func (m *hilinkModem) SendSms(ctx context.Context, message string, recipients []string) SendResult {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.prepare(ctx); err != nil {
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error(), Error: asModemError(err)}
+	}
+	return sendToRecipients(ctx, m.appConfig, m.appState, m.modemConfig, message, recipients, m.sendSegments)
+}
+
+// sendSegments hands the whole message to the stick, which splits it into concatenated SMS itself,
+// and waits until the stick reports the outcome. Needs to be called with the mutex held.
+func (m *hilinkModem) sendSegments(ctx context.Context, recipient string, segments []string, _ DataCoding, _ int) SendResult {
+
+	text := strings.Join(segments, "")
+	request := hilinkSendRequest{Index: -1, Phones: []string{recipient}, Content: text, Length: len([]rune(text)), Reserved: 1,
+		Date: time.Now().Format(hilinkDateFormat)}
+	if err := m.call(ctx, http.MethodPost, "/api/sms/send-sms", request, nil); err != nil {
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+	}
+
+	deadline := time.Now().Add(m.modemConfig.GetHilinkTimeout())
+	for {
+		var status hilinkSendStatus
+		if err := m.call(ctx, http.MethodGet, "/api/sms/send-status", nil, &status); err != nil {
+			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+		}
+		if containsPhone(status.FailPhone, recipient) {
+			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: "HiLink stick failed to send message to " + recipient}
+		}
+		if containsPhone(status.SucPhone, recipient) {
+			break
+		}
+		if time.Now().After(deadline) {
+			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR,
+				Details: "HiLink stick did not report whether message to " + recipient + " got sent"}
+		}
+		if err := sleep(ctx, hilinkPollInterval); err != nil {
+			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+		}
+	}
+
+	// the stick does not return message references
+	var submissions []Submission
+	for range segments {
+		submissions = append(submissions, Submission{Recipient: recipient, Reference: -1})
+	}
+	return SendResult{Success: true, Reason: MODEM_ERR_NONE, Details: "success", SegmentsSent: len(submissions), Submissions: submissions}
+}
+
+type hilinkListRequest struct {
+	XMLName         xml.Name `xml:"request"`
+	PageIndex       int      `xml:"PageIndex"`
+	ReadCount       int      `xml:"ReadCount"`
+	BoxType         int      `xml:"BoxType"`
+	SortType        int      `xml:"SortType"`
+	Ascending       int      `xml:"Ascending"`
+	UnreadPreferred int      `xml:"UnreadPreferred"`
+}
+
+type hilinkMessage struct {
+	Index   int    `xml:"Index"`
+	Phone   string `xml:"Phone"`
+	Content string `xml:"Content"`
+	Date    string `xml:"Date"`
+}
+
+type hilinkMessageList struct {
+	Count    int             `xml:"Count"`
+	Messages []hilinkMessage `xml:"Messages>Message"`
+}
+
+// ReadMessages lists the stick's inbox. HiLink sticks reassemble concatenated messages themselves
+// and do not keep delivery status reports.
+func (m *hilinkModem) ReadMessages(ctx context.Context) ([]ReceivedSms, []ReceivedStatusReport, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.prepare(ctx); err != nil {
+		return nil, nil, err
+	}
+	result := []ReceivedSms{}
+	for page := 1; ; page++ {
+		var list hilinkMessageList
+		request := hilinkListRequest{PageIndex: page, ReadCount: hilinkPageSize, BoxType: 1, Ascending: 1}
+		if err := m.call(ctx, http.MethodPost, "/api/sms/sms-list", request, &list); err != nil {
+			return nil, nil, errors.New("Failed to list messages - " + err.Error())
+		}
+		for _, msg := range list.Messages {
+			timestamp, err := time.ParseInLocation(hilinkDateFormat, strings.TrimSpace(msg.Date), time.Local)
+			if err != nil {
+				log.Warn("Message " + strconv.Itoa(msg.Index) + " has malformed date '" + msg.Date + "'")
+			}
+			result = append(result, ReceivedSms{StorageIndex: msg.Index,
+				SmsDeliver: SmsDeliver{Sender: msg.Phone, Timestamp: timestamp, Text: msg.Content}})
+		}
+		if len(list.Messages) < hilinkPageSize || len(result) >= list.Count {
+			break
+		}
+	}
+	return result, []ReceivedStatusReport{}, nil
+}
+
+type hilinkDeleteRequest struct {
+	XMLName xml.Name `xml:"request"`
+	Index   int      `xml:"Index"`
+}
+
+func (m *hilinkModem) DeleteMessage(ctx context.Context, storageIndex int) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.prepare(ctx); err != nil {
+		return err
+	}
+	if err := m.call(ctx, http.MethodPost, "/api/sms/delete-sms", hilinkDeleteRequest{Index: storageIndex}, nil); err != nil {
+		return errors.New("Failed to delete message " + strconv.Itoa(storageIndex) + " - " + err.Error())
+	}
+	return nil
+}
+
+type hilinkDeviceInformation struct {
+	DeviceName      string `xml:"DeviceName"`
+	Imei            string `xml:"Imei"`
+	Imsi            string `xml:"Imsi"`
+	Iccid           string `xml:"Iccid"`
+	SoftwareVersion string `xml:"SoftwareVersion"`
+}
+
+type hilinkSignal struct {
+	Rssi string `xml:"rssi"`
+	Rsrp string `xml:"rsrp"`
+	Rsrq string `xml:"rsrq"`
+	Sinr string `xml:"sinr"`
+}
+
+type hilinkPlmn struct {
+	FullName string `xml:"FullName"`
+	Rat      string `xml:"Rat"`
+}
+
+// values like "-97dBm", "&gt;=-51dBm" or "-10.5dB"
+var hilinkSignalRegEx = regexp.MustCompile(`-?\d+(?:\.\d+)?`)
+
+// parseHilinkSignal returns the number contained in a signal value reported by /api/device/signal, nil if there is none
+func parseHilinkSignal(s string) *float64 {
+	match := hilinkSignalRegEx.FindString(s)
+	if match == "" {
+		return nil
+	}
+	value, err := strconv.ParseFloat(match, 64)
+	if err != nil {
+		return nil
+	}
+	return &value
+}
+
+func (m *hilinkModem) GetDiagnostics(ctx context.Context) (Diagnostics, error) {
+	return m.diagnostics.get(ctx, m.modemConfig.GetDiagnosticsRefreshInterval(), m.queryDiagnostics)
+}
+
+func (m *hilinkModem) queryDiagnostics(ctx context.Context) (Diagnostics, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	result := Diagnostics{Manufacturer: "Huawei"}
+	if err := m.prepare(ctx); err != nil {
+		return result, err
+	}
+
+	status, err := m.queryMonitoringStatus(ctx)
+	if err != nil {
+		return result, err
+	}
+	result.SystemMode = status.systemMode()
+	signalBars := status.SignalIcon
+	result.SignalBars = &signalBars
+
+	var info hilinkDeviceInformation
+	if err = m.call(ctx, http.MethodGet, "/api/device/information", nil, &info); err != nil {
+		log.Warn("Failed to query device information of modem '" + m.Name() + "' - " + err.Error())
+	} else {
+		result.Model = info.DeviceName
+		result.Firmware = info.SoftwareVersion
+		result.Imei = info.Imei
+		result.Imsi = info.Imsi
+		result.Iccid = info.Iccid
+	}
+
+	var signal hilinkSignal
+	if err = m.call(ctx, http.MethodGet, "/api/device/signal", nil, &signal); err != nil {
+		log.Warn("Failed to query signal quality of modem '" + m.Name() + "' - " + err.Error())
+	} else {
+		if rssi := parseHilinkSignal(signal.Rssi); rssi != nil {
+			dbm := int(*rssi)
+			result.SignalStrength = &dbm
+		}
+		result.Rsrp = parseHilinkSignal(signal.Rsrp)
+		result.Rsrq = parseHilinkSignal(signal.Rsrq)
+		result.Sinr = parseHilinkSignal(signal.Sinr)
+	}
+
+	var plmn hilinkPlmn
+	if err = m.call(ctx, http.MethodGet, "/api/net/current-plmn", nil, &plmn); err != nil {
+		log.Warn("Failed to query operator of modem '" + m.Name() + "' - " + err.Error())
+	} else {
+		result.Operator = plmn.FullName
+		if rat, err := strconv.Atoi(strings.TrimSpace(plmn.Rat)); err == nil {
+			result.AccessTechnology = accessTechnologies[rat]
+		}
+	}
+	return result, nil
+}
+
+type hilinkUssdRequest struct {
+	XMLName  xml.Name `xml:"request"`
+	Content  string   `xml:"content"`
+	CodeType string   `xml:"codeType"`
+	Timeout  string   `xml:"timeout"`
+}
+
+func (m *hilinkModem) SendUssd(ctx context.Context, code string) (UssdResponse, error) {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.prepare(ctx); err != nil {
+		return UssdResponse{}, err
+	}
+	if err := m.call(ctx, http.MethodPost, "/api/ussd/send", hilinkUssdRequest{Content: code, CodeType: "CodeType"}, nil); err != nil {
+		return UssdResponse{}, errors.New("Failed to send USSD request - " + err.Error())
+	}
+
+	// result 1 = still waiting for the network's answer
+	deadline := time.Now().Add(m.modemConfig.GetHilinkTimeout())
+	for {
+		var status struct {
+			Result int `xml:"result"`
+		}
+		if err := m.call(ctx, http.MethodGet, "/api/ussd/status", nil, &status); err != nil {
+			return UssdResponse{}, err
+		}
+		if status.Result != 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			return UssdResponse{Status: USSD_STATUS_TIMEOUT}, nil
+		}
+		if err := sleep(ctx, hilinkPollInterval); err != nil {
+			return UssdResponse{}, err
+		}
+	}
+	var answer struct {
+		Content string `xml:"content"`
+	}
+	if err := m.call(ctx, http.MethodGet, "/api/ussd/get", nil, &answer); err != nil {
+		return UssdResponse{}, errors.New("Failed to read USSD answer - " + err.Error())
+	}
+	// the stick does not tell whether the network expects further input
+	return UssdResponse{Status: USSD_STATUS_DONE, Text: answer.Content}, nil
+}
+
+func (m *hilinkModem) CancelUssd(ctx context.Context) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.call(ctx, http.MethodGet, "/api/ussd/release", nil, nil)
+}
+
+type hilinkControlRequest struct {
+	XMLName xml.Name `xml:"request"`
+	Control int      `xml:"Control"`
+}
+
+// Recover starts a new session (reopen, rediscover) or reboots the stick (soft_reset), the stick's USB
+// device cannot be reset as it is a network interface
+func (m *hilinkModem) Recover(ctx context.Context, step config.RecoveryStep) error {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	log.Info("Recovering modem '" + m.Name() + "' using step " + step.String())
+	switch step {
+	case config.RECOVERY_STEP_REOPEN, config.RECOVERY_STEP_REDISCOVER:
+		return m.openSession(ctx)
+	case config.RECOVERY_STEP_SOFT_RESET:
+		// Control 1 = reboot, the stick may not even answer
+		err := m.call(ctx, http.MethodPost, "/api/device/control", hilinkControlRequest{Control: 1}, nil)
+		if err != nil {
+			log.Warn("Modem '" + m.Name() + "' did not acknowledge reboot - " + err.Error())
+		}
+		m.session = ""
+		m.token = ""
+		return m.awaitRestart(ctx)
+	case config.RECOVERY_STEP_USB_RESET:
+		return errors.New("Recovery step " + step.String() + " is not supported by the hilink driver")
+	}
+	panic("Internal error, unhandled recovery step " + step.String())
+}
+
+// awaitRestart waits for the stick to come back after a reboot, needs to be called with the mutex held
+func (m *hilinkModem) awaitRestart(ctx context.Context) error {
+	if err := sleep(ctx, resetDelay); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(resetTimeout)
+	for {
+		err := m.openSession(ctx)
+		if err == nil {
+			log.Info("Modem '" + m.Name() + "' is back after reboot")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("Modem did not come back within " + resetTimeout.String() + " after reboot - " + err.Error())
+		}
+		if err = sleep(ctx, time.Second); err != nil {
+			return err
+		}
+	}
+}
+
+func (m *hilinkModem) SendAtCommand(context.Context, string) (ModemResponse, error) {
+	return ModemResponse{}, errors.New("Modem '" + m.Name() + "' uses the hilink driver which does not support AT commands")
+}
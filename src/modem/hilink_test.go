@@ -0,0 +1,374 @@
+package modem
+
+import (
+	"context"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHilink mimics the XML API of a Huawei HiLink stick
+type fakeHilink struct {
+	t        *testing.T
+	mutex    sync.Mutex
+	password string
+
+	sessionCount int
+	session      string
+	token        string
+	loggedIn     bool
+	// answer the next API request with "wrong session" to simulate an expired session
+	expireSession bool
+
+	simState int
+	pin      string
+	pinTimes int
+	pinTries int
+
+	serviceStatus int
+	roaming       int
+	// recipient -> texts the stick sent
+	sent map[string][]string
+	// recipients the stick fails to send to
+	failing    map[string]bool
+	sendStatus hilinkSendStatus
+	inbox      []hilinkMessage
+	ussdAnswer string
+}
+
+func newFakeHilink(t *testing.T, password string) (*fakeHilink, *httptest.Server) {
+	fake := &fakeHilink{t: t, password: password, simState: hilinkSimStateReady, pin: "1234", pinTimes: 3, serviceStatus: 2,
+		sent: make(map[string][]string), failing: make(map[string]bool)}
+	server := httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(server.Close)
+	return fake, server
+}
+
+func newHilinkTestModem(t *testing.T, server *httptest.Server, modemSettings string, smsSettings string) *hilinkModem {
+	oldPollInterval := hilinkPollInterval
+	hilinkPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		hilinkPollInterval = oldPollInterval
+	})
+	appConfig, appState := loadTestConfig(t, "driver=hilink\nhilinkUrl="+server.URL+"\nhilinkTimeoutSeconds=2\n"+modemSettings, smsSettings, "")
+	return New(appConfig, appState, appConfig.GetModems()[0]).(*hilinkModem)
+}
+
+func (f *fakeHilink) reply(w http.ResponseWriter, body string) {
+	_, _ = w.Write([]byte(xml.Header + body))
+}
+
+func (f *fakeHilink) replyError(w http.ResponseWriter, code int) {
+	f.reply(w, "<error><code>"+strconv.Itoa(code)+"</code><message></message></error>")
+}
+
+func (f *fakeHilink) decode(r *http.Request, request any) {
+	data, err := io.ReadAll(r.Body)
+	if err == nil {
+		err = xml.Unmarshal(data, request)
+	}
+	if err != nil {
+		f.t.Errorf("malformed request to %s: %s", r.URL.Path, err.Error())
+	}
+}
+
+func (f *fakeHilink) serve(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.URL.Path == "/api/webserver/SesTokInfo" {
+		f.sessionCount++
+		f.session = "SessionID=session" + strconv.Itoa(f.sessionCount)
+		f.token = "token" + strconv.Itoa(f.sessionCount)
+		f.loggedIn = false
+		f.reply(w, "<response><SesInfo>"+f.session+"</SesInfo><TokInfo>"+f.token+"</TokInfo></response>")
+		return
+	}
+	if r.Header.Get("Cookie") != f.session || f.expireSession {
+		f.expireSession = false
+		f.replyError(w, 125002)
+		return
+	}
+	if r.Method == http.MethodPost {
+		if r.Header.Get("__RequestVerificationToken") != f.token {
+			f.replyError(w, 125003)
+			return
+		}
+		// tokens are single-use
+		f.token = f.token + "x"
+		w.Header().Set("__RequestVerificationToken", f.token)
+	}
+	if r.URL.Path == "/api/user/login" {
+		var request hilinkLoginRequest
+		f.decode(r, &request)
+		if request.Password != hilinkPasswordHash("admin", f.password, strings.TrimSuffix(f.token, "x")) {
+			f.replyError(w, 108006)
+			return
+		}
+		f.loggedIn = true
+		// logging in changes the session
+		f.session = "SessionID=loggedin" + strconv.Itoa(f.sessionCount)
+		http.SetCookie(w, &http.Cookie{Name: "SessionID", Value: strings.TrimPrefix(f.session, "SessionID=")})
+		f.reply(w, "<response>OK</response>")
+		return
+	}
+	if f.password != "" && !f.loggedIn {
+		f.replyError(w, 100003)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/pin/status":
+		f.reply(w, "<response><SimState>"+strconv.Itoa(f.simState)+"</SimState><PinOptState>258</PinOptState><SimPinTimes>"+
+			strconv.Itoa(f.pinTimes)+"</SimPinTimes><SimPukTimes>10</SimPukTimes></response>")
+	case "/api/pin/operate":
+		var request hilinkPinRequest
+		f.decode(r, &request)
+		f.pinTries++
+		if request.OperateType != hilinkPinVerify || request.CurrentPin != f.pin {
+			f.pinTimes--
+			f.replyError(w, 103002)
+			return
+		}
+		f.simState = hilinkSimStateReady
+		f.reply(w, "<response>OK</response>")
+	case "/api/monitoring/status":
+		f.reply(w, "<response><ConnectionStatus>901</ConnectionStatus><SignalIcon>4</SignalIcon><CurrentNetworkType>19</CurrentNetworkType>"+
+			"<CurrentServiceDomain>3</CurrentServiceDomain><RoamingStatus>"+strconv.Itoa(f.roaming)+"</RoamingStatus><SimStatus>1</SimStatus>"+
+			"<ServiceStatus>"+strconv.Itoa(f.serviceStatus)+"</ServiceStatus></response>")
+	case "/api/sms/send-sms":
+		var request hilinkSendRequest
+		f.decode(r, &request)
+		if len(request.Phones) != 1 || request.Index != -1 || request.Length != len([]rune(request.Content)) {
+			f.t.Errorf("unexpected send-sms request %+v", request)
+		}
+		phone := strings.Join(request.Phones, ";")
+		f.sendStatus = hilinkSendStatus{Phone: phone, TotalCount: 1, CurIndex: 1}
+		if f.failing[phone] {
+			f.sendStatus.FailPhone = phone
+		} else {
+			f.sendStatus.SucPhone = phone
+			f.sent[phone] = append(f.sent[phone], request.Content)
+		}
+		f.reply(w, "<response>OK</response>")
+	case "/api/sms/send-status":
+		status := f.sendStatus
+		f.reply(w, "<response><Phone>"+status.Phone+"</Phone><SucPhone>"+status.SucPhone+"</SucPhone><FailPhone>"+status.FailPhone+
+			"</FailPhone><TotalCount>"+strconv.Itoa(status.TotalCount)+"</TotalCount><CurIndex>"+strconv.Itoa(status.CurIndex)+"</CurIndex></response>")
+	case "/api/sms/sms-list":
+		var request hilinkListRequest
+		f.decode(r, &request)
+		if request.BoxType != 1 {
+			f.t.Errorf("expected inbox to be listed, got box type %d", request.BoxType)
+		}
+		from := min((request.PageIndex-1)*request.ReadCount, len(f.inbox))
+		to := min(from+request.ReadCount, len(f.inbox))
+		var sb strings.Builder
+		for _, msg := range f.inbox[from:to] {
+			sb.WriteString("<Message><Smstat>0</Smstat><Index>" + strconv.Itoa(msg.Index) + "</Index><Phone>" + msg.Phone +
+				"</Phone><Content>" + msg.Content + "</Content><Date>" + msg.Date + "</Date><Sca></Sca><SaveType>4</SaveType>" +
+				"<Priority>0</Priority><SmsType>1</SmsType></Message>")
+		}
+		f.reply(w, "<response><Count>"+strconv.Itoa(len(f.inbox))+"</Count><Messages>"+sb.String()+"</Messages></response>")
+	case "/api/sms/delete-sms":
+		var request hilinkDeleteRequest
+		f.decode(r, &request)
+		for idx, msg := range f.inbox {
+			if msg.Index == request.Index {
+				f.inbox = append(f.inbox[:idx], f.inbox[idx+1:]...)
+				f.reply(w, "<response>OK</response>")
+				return
+			}
+		}
+		f.replyError(w, 113114)
+	case "/api/device/information":
+		f.reply(w, "<response><DeviceName>E3372h-320</DeviceName><SerialNumber>ABC</SerialNumber><Imei>861234567890123</Imei>"+
+			"<Imsi>262011234567890</Imsi><Iccid>8949000000000000001</Iccid><HardwareVersion>CL4E3372HM</HardwareVersion>"+
+			"<SoftwareVersion>11.0.1.2(H697SP1C983)</SoftwareVersion></response>")
+	case "/api/device/signal":
+		f.reply(w, "<response><pci>123</pci><rssi>-71dBm</rssi><rsrp>-101dBm</rsrp><rsrq>-10.5dB</rsrq><sinr>12dB</sinr></response>")
+	case "/api/net/current-plmn":
+		f.reply(w, "<response><State>0</State><FullName>Telekom.de</FullName><ShortName>TDG</ShortName><Numeric>26201</Numeric><Rat>7</Rat></response>")
+	case "/api/ussd/send":
+		f.reply(w, "<response>OK</response>")
+	case "/api/ussd/status":
+		f.reply(w, "<response><result>0</result></response>")
+	case "/api/ussd/get":
+		f.reply(w, "<response><content>"+f.ussdAnswer+"</content></response>")
+	default:
+		f.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		http.NotFound(w, r)
+	}
+}
+
+func TestHilinkSendsSms(t *testing.T) {
+	fake, server := newFakeHilink(t, "secret")
+	fake.simState = hilinkSimStatePin
+	modem := newHilinkTestModem(t, server, "hilinkPassword=secret", "maxSegments=3")
+
+	text := strings.Repeat("0123456789", 20)
+	result := modem.SendSms(context.Background(), text, testRecipients)
+	if !result.Success {
+		t.Fatalf("sending failed: %s", result.Details)
+	}
+	if result.SegmentsSent != 4 || len(result.Submissions) != 4 || result.Submissions[0].Reference != -1 {
+		t.Errorf("expected 2 segments without reference to each of 2 recipients, got %+v", result.Submissions)
+	}
+	for _, recipient := range testRecipients {
+		if len(fake.sent[recipient]) != 1 || fake.sent[recipient][0] != text {
+			t.Errorf("expected whole message to be handed to the stick once for %s, got %v", recipient, fake.sent[recipient])
+		}
+	}
+	if fake.pinTries != 1 || fake.simState != hilinkSimStateReady {
+		t.Errorf("expected SIM card to be unlocked with a single PIN attempt, got %d", fake.pinTries)
+	}
+
+	// expired session gets replaced transparently
+	fake.expireSession = true
+	result = modem.SendSms(context.Background(), "again", testRecipients[:1])
+	if !result.Success {
+		t.Fatalf("sending after session expiry failed: %s", result.Details)
+	}
+	if fake.sessionCount != 2 {
+		t.Errorf("expected a new session after expiry, got %d sessions", fake.sessionCount)
+	}
+}
+
+func TestHilinkReportsFailedRecipient(t *testing.T) {
+	fake, server := newFakeHilink(t, "")
+	fake.failing[testRecipients[1]] = true
+	modem := newHilinkTestModem(t, server, "", "")
+
+	result := modem.SendSms(context.Background(), "hello", testRecipients)
+	if result.Success {
+		t.Fatal("sending to failing recipient succeeded")
+	}
+	if len(result.CompletedRecipients) != 1 || result.CompletedRecipients[0] != testRecipients[0] {
+		t.Errorf("expected only first recipient to be completed, got %v", result.CompletedRecipients)
+	}
+	if result.IsPermanentFailure() {
+		t.Error("HiLink failures should be retried")
+	}
+}
+
+func TestHilinkDoesNotRetryRejectedPin(t *testing.T) {
+	fake, server := newFakeHilink(t, "")
+	fake.simState = hilinkSimStatePin
+	fake.pin = "4321"
+	modem := newHilinkTestModem(t, server, "", "")
+
+	if err := modem.Init(context.Background()); err == nil {
+		t.Fatal("wrong PIN got accepted")
+	}
+	if _, err := modem.GetConnectionStatus(context.Background()); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected rejected PIN not to be entered again, got %v", err)
+	}
+	if fake.pinTries != 1 || fake.pinTimes != 2 {
+		t.Errorf("expected a single PIN attempt, got %d", fake.pinTries)
+	}
+	status, err := modem.GetSimStatus(context.Background())
+	if err != nil || status.PinState != MODEM_PIN_REQUIRED || status.PinRetries != 2 || status.PukRetries != 10 {
+		t.Errorf("unexpected SIM status %+v (%v)", status, err)
+	}
+}
+
+func TestHilinkConnectionStatusAndDiagnostics(t *testing.T) {
+	fake, server := newFakeHilink(t, "")
+	modem := newHilinkTestModem(t, server, "", "")
+
+	tests := []struct {
+		serviceStatus int
+		roaming       int
+		expected      ConnectionStatus
+	}{
+		{2, 0, CON_STATUS_REGISTERED_HOME},
+		{2, 1, CON_STATUS_REGISTERED_ROAMING},
+		{0, 0, CON_STATUS_NOT_REGISTERED_SEARCHING},
+		{1, 0, CON_STATUS_UNKNOWN},
+	}
+	for _, test := range tests {
+		fake.serviceStatus = test.serviceStatus
+		fake.roaming = test.roaming
+		status, err := modem.GetConnectionStatus(context.Background())
+		if err != nil || status != test.expected {
+			t.Errorf("service status %d/roaming %d: expected %s, got %s (%v)", test.serviceStatus, test.roaming, test.expected, status, err)
+		}
+	}
+
+	diagnostics, err := modem.GetDiagnostics(context.Background())
+	if err != nil {
+		t.Fatalf("querying diagnostics failed: %s", err.Error())
+	}
+	if diagnostics.SignalBars == nil || *diagnostics.SignalBars != 4 || diagnostics.SystemMode != "LTE" {
+		t.Errorf("unexpected monitoring status %+v", diagnostics)
+	}
+	if diagnostics.SignalStrength == nil || *diagnostics.SignalStrength != -71 || diagnostics.Rsrq == nil || *diagnostics.Rsrq != -10.5 ||
+		diagnostics.Sinr == nil || *diagnostics.Sinr != 12 {
+		t.Errorf("unexpected signal quality %+v", diagnostics)
+	}
+	if diagnostics.Operator != "Telekom.de" || diagnostics.AccessTechnology != "E-UTRAN" || diagnostics.Model != "E3372h-320" ||
+		diagnostics.Imei != "861234567890123" || diagnostics.Iccid != "8949000000000000001" {
+		t.Errorf("unexpected identity %+v", diagnostics)
+	}
+}
+
+func TestHilinkReadsAndDeletesMessages(t *testing.T) {
+	fake, server := newFakeHilink(t, "secret")
+	for idx := 0; idx < 25; idx++ {
+		fake.inbox = append(fake.inbox, hilinkMessage{Index: 40001 + idx, Phone: "+491111111111", Content: "message " + strconv.Itoa(idx),
+			Date: "2024-03-01 12:30:00"})
+	}
+	modem := newHilinkTestModem(t, server, "hilinkPassword=secret", "")
+
+	messages, reports, err := modem.ReadMessages(context.Background())
+	if err != nil {
+		t.Fatalf("reading messages failed: %s", err.Error())
+	}
+	if len(messages) != 25 || len(reports) != 0 {
+		t.Fatalf("expected 25 messages from two pages, got %d", len(messages))
+	}
+	last := messages[24]
+	expectedTime := time.Date(2024, 3, 1, 12, 30, 0, 0, time.Local)
+	if last.StorageIndex != 40025 || last.Sender != "+491111111111" || last.Text != "message 24" || !last.Timestamp.Equal(expectedTime) {
+		t.Errorf("unexpected message %+v", last)
+	}
+
+	if err = modem.DeleteMessage(context.Background(), 40001); err != nil {
+		t.Fatalf("deleting message failed: %s", err.Error())
+	}
+	if len(fake.inbox) != 24 || fake.inbox[0].Index != 40002 {
+		t.Errorf("expected first message to be deleted, inbox holds %d messages", len(fake.inbox))
+	}
+	if err = modem.DeleteMessage(context.Background(), 40001); err == nil {
+		t.Error("deleting unknown message succeeded")
+	}
+}
+
+func TestHilinkUssd(t *testing.T) {
+	fake, server := newFakeHilink(t, "")
+	fake.ussdAnswer = "Your balance is 5.00 EUR"
+	modem := newHilinkTestModem(t, server, "", "")
+
+	response, err := modem.SendUssd(context.Background(), "*100#")
+	if err != nil {
+		t.Fatalf("USSD request failed: %s", err.Error())
+	}
+	if response.Status != USSD_STATUS_DONE || response.Text != fake.ussdAnswer {
+		t.Errorf("unexpected USSD response %+v", response)
+	}
+}
+
+func TestHilinkRejectsWrongPassword(t *testing.T) {
+	_, server := newFakeHilink(t, "secret")
+	modem := newHilinkTestModem(t, server, "hilinkPassword=wrong", "")
+
+	if _, err := modem.GetConnectionStatus(context.Background()); err == nil || !strings.Contains(err.Error(), "108006") {
+		t.Fatalf("expected login to fail, got %v", err)
+	}
+}
@@ -1,33 +1,75 @@
 package modem
 
 import (
-	"errors"
-	"fmt"
-	"regexp"
+	"context"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"code-sourcery.de/sms-gateway/config"
 	"code-sourcery.de/sms-gateway/logger"
 	"code-sourcery.de/sms-gateway/state"
-	"go.bug.st/serial"
 )
 
-/*
- *Huawei init according to modem manager:
- *
- *
- * AT^CURC=0
- *
- */
-
 var log = logger.GetLogger("modem")
 
-var appConfig *config.Config
-var appState *state.State
+// Modem is implemented by all modem drivers. Methods talking to the modem give up once the context is done,
+// every single AT command is bounded by a deadline of its own as well.
+type Modem interface {
+	// Name returns the name of the modem as configured
+	Name() string
+	GetConfig() config.ModemConfig
+	// Init prepares the modem for use, drivers re-initialize themselves on demand if Init() failed or after Close()
+	Init(ctx context.Context) error
+	Close()
+	// SendSms sends a message to the given recipients, one after another
+	SendSms(ctx context.Context, message string, recipients []string) SendResult
+	GetConnectionStatus(ctx context.Context) (ConnectionStatus, error)
+	// GetSimStatus returns whether the SIM card is locked and how many attempts to unlock it are left
+	GetSimStatus(ctx context.Context) (SimStatus, error)
+	// UnlockSimWithPuk unblocks a SIM card that got locked by too many wrong PINs, setting a new PIN
+	UnlockSimWithPuk(ctx context.Context, puk string, newPin string) error
+	// Probe checks that the modem still answers AT commands and returns its network registration
+	Probe(ctx context.Context) (ConnectionStatus, error)
+	// Recover tries to bring back a modem that stopped responding using a single recovery step
+	Recover(ctx context.Context, step config.RecoveryStep) error
+	// GetDiagnostics returns signal quality, operator and modem/SIM identity, cached for the modem's diagnosticsRefreshInterval
+	GetDiagnostics(ctx context.Context) (Diagnostics, error)
+	// SendUssd sends a USSD request (like "*100#") or, if the network expects further input, the next input of
+	// the current USSD session and waits for the network's answer
+	SendUssd(ctx context.Context, code string) (UssdResponse, error)
+	// CancelUssd terminates the current USSD session
+	CancelUssd(ctx context.Context) error
+	// ReadMessages lists all messages and delivery status reports stored on the SIM/modem.
+	// Messages are NOT deleted, use DeleteMessage() for that.
+	ReadMessages(ctx context.Context) ([]ReceivedSms, []ReceivedStatusReport, error)
+	// DeleteMessage deletes a message from the SIM/modem message storage
+	DeleteMessage(ctx context.Context, storageIndex int) error
+	// SendAtCommand sends an arbitrary AT command for debugging purposes and returns the modem's response lines
+	SendAtCommand(ctx context.Context, cmd string) (ModemResponse, error)
+}
 
-var mutex sync.Mutex
+// New creates the modem driver selected by the modem's driver setting
+func New(appConfig *config.Config, appState *state.State, modemConfig config.ModemConfig) Modem {
+	switch modemConfig.GetModemDriver() {
+	case config.MODEM_DRIVER_SERIAL:
+		return newSerialModem(appConfig, appState, modemConfig)
+	case config.MODEM_DRIVER_SIMULATOR:
+		return NewSimulator(appConfig, appState, modemConfig)
+	case config.MODEM_DRIVER_HILINK:
+		return newHilinkModem(appConfig, appState, modemConfig)
+	}
+	panic("Internal error, unhandled modem driver " + modemConfig.GetModemDriver().String())
+}
+
+// NewAll creates drivers for all configured modems, ordered ascending by priority
+func NewAll(appConfig *config.Config, appState *state.State) []Modem {
+	var result []Modem
+	for _, modemConfig := range appConfig.GetModems() {
+		result = append(result, New(appConfig, appState, modemConfig))
+	}
+	return result
+}
 
 type FailureReason int
 
@@ -50,10 +92,50 @@ func (failure FailureReason) String() string {
 	}
 }
 
+// Submission is a single SMS segment accepted by the network
+type Submission struct {
+	// name of the modem that sent the segment
+	Modem     string
+	Recipient string
+	// message reference returned by AT+CMGS, used to correlate delivery status reports
+	// (-1 if the modem did not return one)
+	Reference int
+}
+
 type SendResult struct {
 	Success bool
 	Reason  FailureReason
 	Details string
+	// number of SMS segments that were successfully sent (across all recipients)
+	SegmentsSent int
+	// segments that were successfully sent, in sending order
+	Submissions []Submission
+	// recipients that were sent the complete message, in sending order
+	CompletedRecipients []string
+	// the error the modem reported, nil if it did not report a +CME/+CMS error
+	Error *ModemError
+	// recipient sending failed for, "" if sending succeeded or failed before the first recipient
+	FailedRecipient string
+	// recipients that were skipped because sending to them failed permanently, in sending order
+	FailedRecipients []RecipientFailure
+}
+
+// RecipientFailure is a recipient a message was not sent to because the modem reported a permanent error
+// concerning the recipient, like an unassigned number
+type RecipientFailure struct {
+	Recipient string
+	Error     *ModemError
+}
+
+// IsPermanentFailure returns TRUE if sending failed for a reason that retrying will not fix
+func (r SendResult) IsPermanentFailure() bool {
+	return !r.Success && r.Error != nil && r.Error.Permanent
+}
+
+// IsRecipientFailure returns TRUE if sending failed permanently because of FailedRecipient, like an unassigned number,
+// and not because of the modem or its SIM card
+func (r SendResult) IsRecipientFailure() bool {
+	return r.IsPermanentFailure() && r.Error.RecipientFault && r.FailedRecipient != ""
 }
 
 type ModemPinState int
@@ -66,254 +148,20 @@ const (
 	MODEM_PIN_RESPONSE_NOT_RECOGNIZED
 )
 
-var serialPort *serial.Port
-
-type ModemResponse struct {
-	Lines []string
-}
-
-func (r *ModemResponse) String() string {
-	var sb strings.Builder
-	for i, line := range r.Lines {
-		sb.WriteString(line)
-		if i+1 < len(r.Lines) {
-			sb.WriteString("\n")
-		}
-	}
-	return sb.String()
-}
-
-func (r *ModemResponse) getLineByPrefix(prefix string) *string {
-	for _, line := range r.Lines {
-		trimmed := strings.TrimSpace(line)
-		if strings.HasPrefix(trimmed, prefix) {
-			return &trimmed
-		}
-	}
-	return nil
-}
-
-func (r *ModemResponse) getResponseLineFor(fullAtCmd string) *string {
-
-	// fullAtCmd: AT+stuff[?)....
-	// response: AT+stuff:......
-	// OR
-	// +CME....
-
-	re := regexp.MustCompile("^AT\\+([A-Z]+).*$")
-	atCmd := re.FindStringSubmatch(fullAtCmd)
-	if atCmd == nil || len(atCmd) != 2 {
-		panic("getResponseLineFor() function does not know how to handle AT command " + fullAtCmd)
-	}
-	var linePrefix = "+" + atCmd[1]
-	log.Debug("Looking for line with prefix '" + linePrefix + "'")
-	return r.getLineByPrefix(linePrefix)
-}
-
-func (r *ModemResponse) isError() bool {
-	return !r.isOK()
-}
-
-func (r *ModemResponse) isOK() bool {
-	if r.Lines == nil || len(r.Lines) == 0 {
-		return false
-	}
-	for _, line := range r.Lines {
-		if line == "OK" {
-			return true
-		}
-	}
-	return false
-}
-
-func (r *ModemResponse) IsEmpty() bool {
-	return r.Size() == 0
-}
-
-func (r *ModemResponse) Size() int {
-	if r.Lines == nil || len(r.Lines) == 0 {
-		return 0
-	}
-	return len(r.Lines)
-}
-
-func queryPinState() (ModemPinState, error) {
-
-	log.Debug("Querying SIM card PIN state...")
-	response, err := sendCmd("AT+CPIN?", false)
-	if err != nil {
-		return MODEM_PIN_SERIAL_ERROR, err
-	}
-
-	log.Debug("Querying SIM card PIN state yielded " + response.String())
-
-	/*
-		+CPIN: READY: The SIM card is ready for use, and no PIN is required. This means the card is either unlocked or has no PIN enabled.
-		+CPIN: SIM PIN: The SIM card is inserted, but it is locked and requires the PIN to be entered. You must send the AT+CPIN="<pin>" command to unlock it before you can use the modem for data services.
-		+CPIN: SIM PUK: The SIM card has been locked due to three consecutive incorrect PIN entries. It now requires the PIN Unblocking Key (PUK) to be entered.
-		+CME ERROR: 10: This indicates that the SIM card is not inserted or is not detected by the modem.
-	*/
-	line := response.getResponseLineFor("AT+CPIN")
-
-	if line != nil {
-		log.Debug("CPIN response:" + *line)
-		if strings.Contains(*line, "READY") {
-			log.Debug("SIM card PIN is unlocked")
-			return MODEM_PIN_NOT_REQUIRED, nil
-		}
-		if strings.Contains(*line, "SIM PIN") {
-			log.Info("SIM card needs PIN")
-			return MODEM_PIN_REQUIRED, nil
-		}
-		if strings.HasPrefix(*line, "SIM PUK") {
-			log.Warn("SIM card needs PUK")
-			return MODEM_PIN_PUK_REQUIRED, nil
-		}
-	} else {
-		log.Warn("Failed to find CPIN response, looking for +CME")
-		line = response.getLineByPrefix("+CME ERROR")
-		if line != nil {
-			return MODEM_PIN_RESPONSE_NOT_RECOGNIZED, errors.New("Modem sent an error in reply to AT+CPIN?:  " + response.String())
-		}
-	}
-	return MODEM_PIN_RESPONSE_NOT_RECOGNIZED, errors.New("Modem sent unexpected response to AT+CPIN?: " + response.String())
-}
-
-func sendPin(pin string) error {
-	resp, err := sendCmd("AT+CPIN=\""+pin+"\"", true)
-	if err != nil {
-		return errors.New("Failed to send PIN to modem: " + err.Error())
-	}
-	if resp.isError() {
-		return errors.New("Unlocking PIN returned error response: " + resp.String())
-	}
-	log.Info("Successfully unlocked modem using PIN")
-	return nil
-}
-
-func unlockSim() error {
-
-	pinState, err := queryPinState()
-	if err != nil {
-		return err
-	}
-	switch pinState {
+func (s ModemPinState) String() string {
+	switch s {
 	case MODEM_PIN_NOT_REQUIRED:
-		return nil
+		return "NOT_REQUIRED"
 	case MODEM_PIN_REQUIRED:
-		return sendPin(appConfig.GetSimPin())
+		return "PIN_REQUIRED"
 	case MODEM_PIN_PUK_REQUIRED:
-		return errors.New("Modem requires PUK, please unlock SIM card manually using AT+CPIN=\"<pin>\"")
+		return "PUK_REQUIRED"
 	case MODEM_PIN_SERIAL_ERROR:
-		return errors.New("Unlocking SIM card failed due to a serial error")
+		return "SERIAL_ERROR"
 	case MODEM_PIN_RESPONSE_NOT_RECOGNIZED:
-		return errors.New("Not sure whether SIM card unlocking succeeded, unexpected response to AT command.")
-	}
-	return nil
-}
-
-func sendBytes(bytes []byte, requiresOkOrError bool) ([]string, error) {
-	res, err := internalSendBytes(bytes, requiresOkOrError)
-	if err != nil {
-		log.Error("Closing serial port due to error " + err.Error())
-		internalClose()
-	}
-	return res, err
-}
-
-func internalSendBytes(bytes []byte, requiresOkOrError bool) ([]string, error) {
-
-	err := (*serialPort).ResetInputBuffer()
-	if err != nil {
-		log.Error("failed to drain serial input buffer: " + err.Error())
-		return []string{}, err
-	}
-
-	bytesWritten, err := (*serialPort).Write(bytes)
-	if err != nil {
-		log.Error("failed to write to serial port: " + err.Error())
-		return []string{}, err
-	}
-	if bytesWritten != len(bytes) {
-		log.Error("failed to write() to serial port: write came up short")
-		return []string{}, err
+		return "RESPONSE_NOT_RECOGNIZED"
 	}
-	err = (*serialPort).Drain()
-	if err != nil {
-		log.Error("failed to drain() serial port: " + err.Error())
-		return []string{}, err
-	}
-
-	var readResult = func() CharResult {
-		var receivedByte = make([]byte, 1)
-		bytesRead, err := (*serialPort).Read(receivedByte)
-		if err != nil {
-			return CharResult{char: 0x00, timeout: false, err: err}
-		}
-		if bytesRead == 0 {
-			log.Debug("*** timeout ***")
-			return CharResult{char: 0x00, timeout: true, err: nil}
-		}
-		if log.IsDebugEnabled() {
-			hexStringLower := fmt.Sprintf("%x", receivedByte[0])
-			log.Debug("Received character: " + string(rune(receivedByte[0])) + " (0x" + hexStringLower + ")")
-		}
-		return CharResult{char: receivedByte[0], timeout: false, err: nil}
-	}
-
-	lines, err := parseModemResponse(readResult, requiresOkOrError)
-	if err != nil {
-		log.Error("failed to read() to serial port: " + err.Error())
-		return []string{}, err
-	}
-	if log.IsDebugEnabled() {
-		log.Debug("sendBytes(): Modem response:\n" + strings.Join(lines, "\n"))
-	}
-	return lines, nil
-}
-
-func sendCmd(cmd string, requiresOkOrError bool) (ModemResponse, error) {
-
-	if serialPort == nil {
-		panic("Serial port not open?")
-	}
-
-	if strings.TrimSpace(cmd) == "" {
-		return ModemResponse{Lines: []string{}}, errors.New("Command string cannot be blank or empty")
-	}
-	log.Debug("Sending AT command: '" + cmd + "'")
-	if cmd[len(cmd)-1] != '\r' {
-		cmd = cmd + "\r"
-	}
-
-	lines, err := sendBytes([]byte(cmd), requiresOkOrError)
-	if err != nil {
-		return ModemResponse{Lines: []string{}}, errors.New("Failed to send bytes - " + err.Error())
-	}
-	return ModemResponse{Lines: lines}, nil
-}
-
-func switchToPlainText() error {
-	// switch modem to plain-text mode
-	// AT+CMGF=1
-	resp, err := sendCmd("AT+CMGF=1", true)
-	if err != nil {
-		return err
-	}
-	if resp.isError() {
-		return errors.New("Failed to switch modem to plain-text mode: " + resp.String())
-	}
-	return nil
-}
-
-func SendSms(message string) SendResult {
-	result := internalSendSms(message)
-	if !result.Success {
-		if result.Reason == MODEM_ERR_MODEM_ERROR {
-			Close()
-		}
-	}
-	return result
+	panic("Unhandled switch/case: " + strconv.Itoa(int(s)))
 }
 
 type ConnectionStatus int
@@ -345,238 +193,94 @@ func (s ConnectionStatus) String() string {
 	panic("Unhandled switch/case: " + strconv.Itoa(int(s)))
 }
 
-func GetConnectionStatus() (ConnectionStatus, error) {
-	if appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
-		return CON_STATUS_REGISTERED_HOME, nil
-	}
-	if appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
-		return CON_STATUS_UNKNOWN, errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
-	}
-	if needsInit() {
-		err := initModem()
-		if err != nil {
-			return CON_STATUS_UNKNOWN, err
-		}
-	}
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	err := unlockSim()
-	if err != nil {
-		return CON_STATUS_UNKNOWN, err
-	}
-
-	response, err := sendCmd("AT+CREG?", true)
-	if err != nil {
-		return CON_STATUS_UNKNOWN, err
-	}
-	/*
-			 * +CREG: <stat>[,<lac>,<ci>,<AcT>]
-			 *
-			 * <stat> (Status): A numeric value indicating the current network registration status.
-			 *
-		     * 0: Not registered. The modem isn't currently searching for a new operator.
-			 * 1: Registered to the home network.
-			 * 2: Not registered, but the modem is searching for an operator to register to.
-			 * 3: Registration denied.
-			 * 4: Unknown. For example, out of coverage.
-			 * 5: Registered and roaming.
-	*/
-	line := response.getLineByPrefix("+CREG:")
-	log.Debug("Modem response to CREG?: " + response.String())
-	if line == nil {
-		msg := "Unrecognized modem response (1)"
-		log.Error(msg)
-		return CON_STATUS_UNKNOWN, errors.New(msg)
-	}
-	parts := strings.Split(strings.TrimSpace((*line)[6:]), ",")
-	if len(parts) < 2 {
-		msg := "Unrecognized modem response (2)"
-		log.Error(msg)
-		return CON_STATUS_UNKNOWN, errors.New(msg)
-	}
-	code, err := strconv.Atoi(parts[1])
-	if err != nil {
-		msg := "Unrecognized modem response (3)"
-		log.Error(msg)
-		return CON_STATUS_UNKNOWN, errors.New(msg)
-	}
-	log.Debug("Modem response code: " + strconv.Itoa(code))
-
-	switch code {
-	case 0:
-		return CON_STATUS_NOT_REGISTERED_NOT_SEARCHING, nil
-	case 1:
-		return CON_STATUS_REGISTERED_HOME, nil
-	case 2:
-		return CON_STATUS_NOT_REGISTERED_SEARCHING, nil
-	case 3:
-		return CON_STATUS_NOT_REGISTERED_DENIED, nil
-	case 4:
-		return CON_STATUS_UNKNOWN, nil
-	case 5:
-		return CON_STATUS_REGISTERED_ROAMING, nil
-	default:
-		msg := "Modem returned unknown result code " + strconv.Itoa(code)
-		log.Error(msg)
-		return CON_STATUS_UNKNOWN, errors.New(msg)
-	}
+// IsRegistered returns TRUE if the modem is registered to its home network or roaming
+func (s ConnectionStatus) IsRegistered() bool {
+	return s == CON_STATUS_REGISTERED_HOME || s == CON_STATUS_REGISTERED_ROAMING
 }
 
-func internalSendSms(message string) SendResult {
-
-	if appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
-		log.Warn("Not actually sending SMS, DEBUG_FLAG_MODEM_ALWAYS_SUCCEED is set")
-		log.Warn("Message: >" + message + "<")
-		return SendResult{true, MODEM_ERR_NONE, "fake success (debug mode)"}
+// sleep waits for the given duration, returning the context's error if it is done earlier
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
+}
 
-	if appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
-		log.Warn("Not actually sending SMS, DEBUG_FLAG_MODEM_ALWAYS_FAIL is set")
-		log.Warn("Message: >" + message + "<")
-		return SendResult{false, MODEM_ERR_MODEM_ERROR, "fake modem failure (debug mode)"}
+// splitMessage splits a message into SMS segments according to the configured limits
+func splitMessage(appConfig *config.Config, smsMode config.SmsMode, message string) ([]string, DataCoding, bool) {
+	maxSegments := appConfig.GetMaxSegments()
+	if smsMode != config.SMS_MODE_PDU {
+		// concatenated SMS need a user data header which is only available in PDU mode
+		maxSegments = 1
 	}
+	return SplitMessage(message, appConfig.GetMaxMessageLength(), maxSegments, appConfig.GetConcatReferenceBits())
+}
 
-	if needsInit() {
-		err := initModem()
-		if err != nil {
-			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+// FitMessage truncates a message so that it can be sent without exceeding the configured
+// segment length and number of segments, returning TRUE if the message got truncated.
+// Modems in text mode send a single segment only and truncate messages further when sending them.
+func FitMessage(appConfig *config.Config, message string) (string, bool) {
+	smsMode := config.SMS_MODE_TEXT
+	for _, modemConfig := range appConfig.GetModems() {
+		if modemConfig.GetSmsMode() == config.SMS_MODE_PDU {
+			smsMode = config.SMS_MODE_PDU
 		}
 	}
+	segments, _, truncated := splitMessage(appConfig, smsMode, message)
+	return strings.Join(segments, ""), truncated
+}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+// segmentSender sends all segments of a message to a single recipient
+type segmentSender func(ctx context.Context, recipient string, segments []string, coding DataCoding, reference int) SendResult
 
-	err := unlockSim()
-	if err != nil {
-		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
-	}
+// sendToRecipients splits a message into segments and sends it to every recipient,
+// checking the global and the modem's own rate limits before each recipient
+func sendToRecipients(ctx context.Context, appConfig *config.Config, appState *state.State, modemConfig config.ModemConfig, message string,
+	recipients []string, send segmentSender) SendResult {
 
-	// switch modem to plain-text mode
-	// so AT+CMGS works
-	err = switchToPlainText()
-	if err != nil {
-		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+	segments, coding, _ := splitMessage(appConfig, modemConfig.GetSmsMode(), message)
+	reference := 0
+	if len(segments) > 1 {
+		reference = appState.NextConcatReference(appConfig.GetConcatReferenceBits())
+		log.Info("Message needs " + strconv.Itoa(len(segments)) + " segments, using concatenated SMS reference " + strconv.Itoa(reference))
 	}
 
-	for _, recipient := range appConfig.GetSmsRecipients() {
+	var submissions []Submission
+	var completed []string
+	for _, recipient := range recipients {
 
-		if appState.IsAnyRateLimitExceeded() {
-			log.Error("Rate limit exceeded (current recipient: " + recipient + ")")
-			return SendResult{false, MODEM_ERR_RATE_LIMIT_EXCEEDED, "Rate limit exceeded"}
+		if appState.IsAnyRateLimitExceeded() || appState.IsModemRateLimitExceeded(modemConfig) {
+			log.Error("Rate limit exceeded (current recipient: " + recipient + ", modem: " + modemConfig.GetName() + ")")
+			return SendResult{Success: false, Reason: MODEM_ERR_RATE_LIMIT_EXCEEDED, Details: "Rate limit exceeded",
+				SegmentsSent: len(submissions), Submissions: submissions, CompletedRecipients: completed}
 		}
 
-		log.Info("Sending sms to " + recipient)
-
-		response, err := sendCmd("AT+CMGS=\""+recipient+"\"", false)
-		if err != nil {
-			log.Error("Failed to send sms to " + recipient + ": " + err.Error())
-			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
-		}
-		if response.IsEmpty() || response.Size() != 1 || response.Lines[0] != "> " {
-			log.Error("Failed to send sms to " + recipient + ": Expected '>' but got '" + response.String() + "'")
-			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: "Unrecognized modem response, expected '>'"}
-		}
-		// send actual message
-		log.Debug("Sending actual message: '" + message + "'")
-		toSent := []byte(message)
-		toSent = append(toSent, 0x1a) // message needs to be terminated with CTRL-Z (0x1a)
-		responseLines, err := sendBytes(toSent, true)
-		if err != nil {
-			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
-		}
-		response = ModemResponse{Lines: responseLines}
-		log.Debug("Modem response: '" + response.String() + "'")
-		if !response.isOK() {
-			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: response.String()}
+		if ctx.Err() != nil {
+			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: "Sending aborted - " + ctx.Err().Error(),
+				SegmentsSent: len(submissions), Submissions: submissions, CompletedRecipients: completed}
 		}
-	}
-	return SendResult{true, MODEM_ERR_NONE, "success"}
-}
-
-func Init(config *config.Config, state *state.State) error {
-
-	appConfig = config
-	appState = state
-	return initModem()
-}
-
-func initModem() error {
-
-	if appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) || appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
-		log.Warn("Not initializing modem because of DEBUG_FLAG_MODEM_ALWAYS_FAIL / DEBUG_FLAG_MODEM_ALWAYS_SUCCEED")
-		return nil
-	}
 
-	mutex.Lock()
-	defer mutex.Unlock()
+		log.Info("Sending sms to " + recipient + " using modem '" + modemConfig.GetName() + "'")
 
-	mode := &serial.Mode{
-		BaudRate: appConfig.GetSerialSpeed(),
-		Parity:   serial.NoParity,
-		DataBits: 8,
-		StopBits: serial.OneStopBit,
-	}
-
-	serialDevName, err := appConfig.GetSerialPort()
-	log.Debug("Initializing modem on port " + serialDevName + ", baud rate " + strconv.Itoa(appConfig.GetSerialSpeed()))
-
-	// Open the serial port
-	port, err := serial.Open(serialDevName, mode)
-	if err != nil {
-		var msg = "failed to open serial port '" + serialDevName + "' - " + err.Error()
-		log.Error(msg)
-		return errors.New(msg)
-	}
-	err = port.SetReadTimeout(appConfig.GetSerialReadTimeout())
-	if err != nil {
-		var msg = "failed to set read timeout " + appConfig.GetSerialReadTimeout().String() + " on serial port '" + serialDevName + "' - " + err.Error()
-		log.Error(msg)
-		return errors.New(msg)
-	}
-
-	// need to already assign global variable here
-	// as sendCmd() uses it
-	serialPort = &port
-
-	cleanUp := func() {
-		_ = port.Close()
-		serialPort = nil
-	}
-
-	for _, cmd := range appConfig.GetModemInitCmds() {
-		log.Debug("Executing modem init cmd: '" + cmd + "'")
-		resp, err := sendCmd(cmd, false)
-		if err != nil {
-			cleanUp()
-			return err
+		result := send(ctx, recipient, segments, coding, reference)
+		for _, submission := range result.Submissions {
+			submission.Modem = modemConfig.GetName()
+			submissions = append(submissions, submission)
 		}
-		if resp.isError() {
-			cleanUp()
-			return errors.New("Running modem initialization cmd " + cmd + " returned an error: " + resp.String())
+		appState.RememberModemSend(modemConfig, len(result.Submissions))
+		if !result.Success {
+			result.SegmentsSent = len(submissions)
+			result.Submissions = submissions
+			result.CompletedRecipients = completed
+			result.FailedRecipient = recipient
+			return result
 		}
+		completed = append(completed, recipient)
 	}
-	return nil
-}
-
-func needsInit() bool {
-	mutex.Lock()
-	defer mutex.Unlock()
-	return serialPort == nil
-}
-
-func Close() {
-
-	mutex.Lock()
-	defer mutex.Unlock()
-	internalClose()
-}
-
-func internalClose() {
-
-	if serialPort != nil {
-		log.Info("Closing serial port")
-		_ = (*serialPort).Close()
-		serialPort = nil
-	}
+	return SendResult{Success: true, Reason: MODEM_ERR_NONE, Details: "success", SegmentsSent: len(submissions),
+		Submissions: submissions, CompletedRecipients: completed}
 }
@@ -0,0 +1,361 @@
+package modem
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+/*
+ * SMS-SUBMIT PDU encoding according to 3GPP TS 23.040, using either the
+ * GSM 03.38 7-bit default alphabet (including the escape/extension table)
+ * or UCS-2 if the text contains characters not representable in GSM-7.
+ */
+
+// how long the SMS service centre keeps trying to deliver a message
+const VALIDITY_PERIOD = 4 * 24 * time.Hour
+
+type DataCoding int
+
+const (
+	DATA_CODING_GSM7 DataCoding = iota
+	DATA_CODING_UCS2
+)
+
+func (d DataCoding) String() string {
+	switch d {
+	case DATA_CODING_GSM7:
+		return "GSM7"
+	case DATA_CODING_UCS2:
+		return "UCS2"
+	}
+	panic("Unhandled data coding")
+}
+
+// GSM 03.38 escape character, announces a character from the extension table
+const gsm7Escape = 0x1b
+
+// GSM 03.38 default alphabet, index == septet value
+var gsm7DefaultAlphabet = []rune("@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞ\x1bÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+	"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà")
+
+// GSM 03.38 extension table, characters need to be prefixed with gsm7Escape
+var gsm7ExtensionTable = map[rune]byte{
+	'\f': 0x0a,
+	'^':  0x14,
+	'{':  0x28,
+	'}':  0x29,
+	'\\': 0x2f,
+	'[':  0x3c,
+	'~':  0x3d,
+	']':  0x3e,
+	'|':  0x40,
+	'€':  0x65,
+}
+
+var gsm7ReverseLookup = func() map[rune]byte {
+	result := make(map[rune]byte)
+	for idx, r := range gsm7DefaultAlphabet {
+		if r != gsm7Escape {
+			result[r] = byte(idx)
+		}
+	}
+	return result
+}()
+
+// encodeGsm7 turns text into a sequence of (unpacked) GSM-7 septets, returning false if
+// the text contains characters that cannot be represented using GSM-7
+func encodeGsm7(text string) ([]byte, bool) {
+	var septets []byte
+	for _, r := range text {
+		if septet, ok := gsm7ReverseLookup[r]; ok {
+			septets = append(septets, septet)
+		} else if septet, ok := gsm7ExtensionTable[r]; ok {
+			septets = append(septets, gsm7Escape, septet)
+		} else {
+			return nil, false
+		}
+	}
+	return septets, true
+}
+
+// packSeptets packs 7-bit values into octets, optionally skipping paddingBits bits at
+// the start so that the septets start on a septet boundary after a user data header.
+func packSeptets(septets []byte, paddingBits int) []byte {
+	var result []byte
+	var accumulator uint32
+	bits := paddingBits
+	for _, septet := range septets {
+		accumulator |= uint32(septet&0x7f) << bits
+		bits += 7
+		for bits >= 8 {
+			result = append(result, byte(accumulator))
+			accumulator >>= 8
+			bits -= 8
+		}
+	}
+	if bits > 0 {
+		result = append(result, byte(accumulator))
+	}
+	return result
+}
+
+// encodeUcs2 encodes text as big-endian UTF-16 (characters outside the BMP become surrogate pairs)
+func encodeUcs2(text string) []byte {
+	var result []byte
+	for _, unit := range utf16.Encode([]rune(text)) {
+		result = append(result, byte(unit>>8), byte(unit))
+	}
+	return result
+}
+
+// encodeAddress encodes a phone number as TP-DA (length in digits, type-of-address, swapped BCD digits)
+func encodeAddress(number string) ([]byte, error) {
+	trimmed := strings.TrimSpace(number)
+	typeOfAddress := byte(0x81) // unknown/national numbering
+	if strings.HasPrefix(trimmed, "+") {
+		typeOfAddress = 0x91 // international numbering
+		trimmed = trimmed[1:]
+	}
+	if trimmed == "" {
+		return nil, errors.New("Recipient number must not be empty")
+	}
+	for _, c := range trimmed {
+		if c < '0' || c > '9' {
+			return nil, errors.New("Recipient number '" + number + "' contains invalid character '" + string(c) + "'")
+		}
+	}
+	digits := trimmed
+	if len(digits)%2 != 0 {
+		digits += "F"
+	}
+	result := []byte{byte(len(trimmed)), typeOfAddress}
+	for i := 0; i < len(digits); i += 2 {
+		low := digits[i] - '0'
+		var high byte
+		if digits[i+1] == 'F' {
+			high = 0x0f
+		} else {
+			high = digits[i+1] - '0'
+		}
+		result = append(result, high<<4|low)
+	}
+	return result, nil
+}
+
+// SmsSubmitPdu is a single, encoded SMS-SUBMIT PDU ready to be sent using AT+CMGS
+type SmsSubmitPdu struct {
+	// the full PDU including the (empty) SMSC address
+	Bytes []byte
+	// length of the TPDU (=PDU without SMSC address), as required by AT+CMGS=<length>
+	TpduLength int
+	Coding     DataCoding
+}
+
+func (p SmsSubmitPdu) Hex() string {
+	return strings.ToUpper(hex.EncodeToString(p.Bytes))
+}
+
+// chooseCoding returns GSM-7 if the text can be represented using it, UCS-2 otherwise
+func chooseCoding(text string) DataCoding {
+	if _, ok := encodeGsm7(text); ok {
+		return DATA_CODING_GSM7
+	}
+	return DATA_CODING_UCS2
+}
+
+// segmentCapacity returns how many septets (GSM-7) or UTF-16 code units (UCS-2) fit into a single SMS,
+// taking into account the space needed by the concatenation user data header
+func segmentCapacity(coding DataCoding, concatenated bool, referenceBits int) int {
+	headerOctets := 0
+	if concatenated {
+		headerOctets = concatHeaderLength(referenceBits)
+	}
+	if coding == DATA_CODING_GSM7 {
+		headerSeptets := (headerOctets*8 + 6) / 7
+		return 160 - headerSeptets
+	}
+	return (140 - headerOctets) / 2
+}
+
+// characterSize returns the number of septets (GSM-7) or UTF-16 code units (UCS-2) a character occupies
+func characterSize(r rune, coding DataCoding) int {
+	if coding == DATA_CODING_GSM7 {
+		if _, ok := gsm7ExtensionTable[r]; ok {
+			return 2
+		}
+		return 1
+	}
+	return len(utf16.Encode([]rune{r}))
+}
+
+// splitText splits text into chunks of at most capacity septets/code units, never
+// tearing apart escape sequences or surrogate pairs
+func splitText(text string, coding DataCoding, capacity int) []string {
+	var result []string
+	var current strings.Builder
+	currentSize := 0
+	for _, r := range text {
+		size := characterSize(r, coding)
+		if currentSize+size > capacity {
+			result = append(result, current.String())
+			current.Reset()
+			currentSize = 0
+		}
+		current.WriteRune(r)
+		currentSize += size
+	}
+	if current.Len() > 0 || len(result) == 0 {
+		result = append(result, current.String())
+	}
+	return result
+}
+
+// SplitMessage splits a message text into the segments that need to be sent as concatenated SMS.
+//
+// maxSegmentLength (if greater than zero) caps the number of characters per segment below what
+// the SMS encoding would allow, maxSegments limits the number of segments. Texts
+// that would need more segments get truncated and end with a '...' ellipsis.
+func SplitMessage(text string, maxSegmentLength int, maxSegments int, referenceBits int) ([]string, DataCoding, bool) {
+
+	coding := chooseCoding(text)
+	capacity := func(concatenated bool) int {
+		result := segmentCapacity(coding, concatenated, referenceBits)
+		if maxSegmentLength > 0 && maxSegmentLength < result {
+			return maxSegmentLength
+		}
+		return result
+	}
+
+	singleSegment := splitText(text, coding, capacity(false))
+	if len(singleSegment) == 1 {
+		return singleSegment, coding, false
+	}
+	if maxSegments <= 1 {
+		return []string{truncateToSegments(text, coding, capacity(false), 1)}, coding, true
+	}
+	segments := splitText(text, coding, capacity(true))
+	if len(segments) <= maxSegments {
+		return segments, coding, false
+	}
+	truncated := truncateToSegments(text, coding, capacity(true), maxSegments)
+	return splitText(truncated, coding, capacity(true)), coding, true
+}
+
+func truncateToSegments(text string, coding DataCoding, capacity int, maxSegments int) string {
+	runes := []rune(text)
+	if len(runes) > capacity*maxSegments {
+		// every character occupies at least one septet/code unit
+		runes = runes[:capacity*maxSegments]
+	}
+	for len(runes) > 0 {
+		candidate := string(runes) + "..."
+		if len(splitText(candidate, coding, capacity)) <= maxSegments {
+			return candidate
+		}
+		runes = runes[:len(runes)-1]
+	}
+	return "..."
+}
+
+func concatHeaderLength(referenceBits int) int {
+	if referenceBits == 16 {
+		return 7
+	}
+	return 6
+}
+
+// concatHeader creates the user data header for a segment of a concatenated SMS, sequence numbers start at 1
+func concatHeader(reference int, referenceBits int, totalSegments int, sequenceNumber int) []byte {
+	if referenceBits == 16 {
+		return []byte{0x06, 0x08, 0x04, byte(reference >> 8), byte(reference), byte(totalSegments), byte(sequenceNumber)}
+	}
+	return []byte{0x05, 0x00, 0x03, byte(reference), byte(totalSegments), byte(sequenceNumber)}
+}
+
+func encodeSmsSubmit(recipient string, text string, coding DataCoding, userDataHeader []byte, statusReport bool) (SmsSubmitPdu, error) {
+
+	address, err := encodeAddress(recipient)
+	if err != nil {
+		return SmsSubmitPdu{}, err
+	}
+
+	var userDataLength int
+	userData := append([]byte{}, userDataHeader...)
+	if coding == DATA_CODING_GSM7 {
+		septets, ok := encodeGsm7(text)
+		if !ok {
+			return SmsSubmitPdu{}, errors.New("Message text cannot be encoded using GSM-7")
+		}
+		headerSeptets := (len(userDataHeader)*8 + 6) / 7
+		paddingBits := headerSeptets*7 - len(userDataHeader)*8
+		if headerSeptets+len(septets) > 160 {
+			return SmsSubmitPdu{}, errors.New("Message text exceeds " + strconv.Itoa(160-headerSeptets) + " GSM-7 characters")
+		}
+		userDataLength = headerSeptets + len(septets)
+		userData = append(userData, packSeptets(septets, paddingBits)...)
+	} else {
+		userData = append(userData, encodeUcs2(text)...)
+		if len(userData) > 140 {
+			return SmsSubmitPdu{}, errors.New("Message text exceeds " + strconv.Itoa((140-len(userDataHeader))/2) + " UCS-2 characters")
+		}
+		userDataLength = len(userData)
+	}
+
+	var dcs byte = 0x00
+	if coding == DATA_CODING_UCS2 {
+		dcs = 0x08
+	}
+
+	var firstOctet byte = 0x11 // SMS-SUBMIT, relative validity period present
+	if len(userDataHeader) > 0 {
+		firstOctet |= 0x40 // user data header indicator
+	}
+	if statusReport {
+		firstOctet |= 0x20 // status report request
+	}
+
+	pdu := []byte{
+		0x00, // SMSC address length, zero = use SMSC stored on SIM
+		firstOctet,
+		0x00, // message reference, assigned by modem
+	}
+	pdu = append(pdu, address...)
+	pdu = append(pdu,
+		0x00, // protocol identifier
+		dcs,  // data coding scheme
+		0xaa, // validity period, 4 days (see VALIDITY_PERIOD)
+		byte(userDataLength))
+	pdu = append(pdu, userData...)
+	return SmsSubmitPdu{Bytes: pdu, TpduLength: len(pdu) - 1, Coding: coding}, nil
+}
+
+// EncodeSmsSubmit encodes a single SMS-SUBMIT PDU, using GSM-7 if possible and UCS-2 otherwise
+func EncodeSmsSubmit(recipient string, text string) (SmsSubmitPdu, error) {
+	return encodeSmsSubmit(recipient, text, chooseCoding(text), nil, false)
+}
+
+// EncodeConcatenatedSmsSubmit encodes message segments (as returned by SplitMessage) as SMS-SUBMIT PDUs,
+// adding a concatenation user data header with an 8- or 16-bit reference number if there is more than one segment.
+// If statusReport is set, a delivery status report is requested for every segment.
+func EncodeConcatenatedSmsSubmit(recipient string, segments []string, coding DataCoding, reference int, referenceBits int, statusReport bool) ([]SmsSubmitPdu, error) {
+	if len(segments) > 255 {
+		return nil, errors.New("Message needs " + strconv.Itoa(len(segments)) + " segments but at most 255 are supported")
+	}
+	var result []SmsSubmitPdu
+	for idx, segment := range segments {
+		var header []byte
+		if len(segments) > 1 {
+			header = concatHeader(reference, referenceBits, len(segments), idx+1)
+		}
+		pdu, err := encodeSmsSubmit(recipient, segment, coding, header, statusReport)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, pdu)
+	}
+	return result, nil
+}
@@ -0,0 +1,192 @@
+package modem
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func toHex(data []byte) string {
+	return strings.ToUpper(hex.EncodeToString(data))
+}
+
+func TestGsm7AlphabetSize(t *testing.T) {
+	if len(gsm7DefaultAlphabet) != 128 {
+		t.Errorf("GSM-7 default alphabet must have 128 entries, got %d", len(gsm7DefaultAlphabet))
+	}
+}
+
+func TestEncodeGsm7(t *testing.T) {
+	septets, ok := encodeGsm7("@Aä")
+	if !ok {
+		t.Fatalf("expected text to be GSM-7 encodable")
+	}
+	if toHex(septets) != "00417B" {
+		t.Errorf("wrong septets, got %s", toHex(septets))
+	}
+
+	septets, ok = encodeGsm7("€[]")
+	if !ok {
+		t.Fatalf("expected extension table characters to be GSM-7 encodable")
+	}
+	if toHex(septets) != "1B651B3C1B3E" {
+		t.Errorf("wrong septets for extension characters, got %s", toHex(septets))
+	}
+
+	_, ok = encodeGsm7("Grüße 😀")
+	if ok {
+		t.Errorf("emoji must not be GSM-7 encodable")
+	}
+}
+
+func TestPackSeptets(t *testing.T) {
+	septets, _ := encodeGsm7("hellohello")
+	packed := packSeptets(septets, 0)
+	if toHex(packed) != "E8329BFD4697D9EC37" {
+		t.Errorf("wrong packed septets, got %s", toHex(packed))
+	}
+}
+
+func TestEncodeUcs2(t *testing.T) {
+	if toHex(encodeUcs2("Пé")) != "041F00E9" {
+		t.Errorf("wrong UCS-2 encoding, got %s", toHex(encodeUcs2("Пé")))
+	}
+	if toHex(encodeUcs2("😀")) != "D83DDE00" {
+		t.Errorf("characters outside the BMP must be encoded as surrogate pairs, got %s", toHex(encodeUcs2("😀")))
+	}
+}
+
+func TestEncodeAddress(t *testing.T) {
+	address, err := encodeAddress("+46708251358")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if toHex(address) != "0B916407281553F8" {
+		t.Errorf("wrong international address, got %s", toHex(address))
+	}
+	address, err = encodeAddress("0170123456")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if toHex(address) != "0A811007214365" {
+		t.Errorf("wrong national address, got %s", toHex(address))
+	}
+	if _, err = encodeAddress("+49abc"); err == nil {
+		t.Errorf("expected error for non-numeric recipient")
+	}
+}
+
+func TestEncodeSmsSubmitGsm7(t *testing.T) {
+	pdu, err := EncodeSmsSubmit("+46708251358", "hellohello")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if pdu.Coding != DATA_CODING_GSM7 {
+		t.Errorf("expected GSM-7 coding, got %s", pdu.Coding.String())
+	}
+	if pdu.Hex() != "0011000B916407281553F80000AA0AE8329BFD4697D9EC37" {
+		t.Errorf("wrong PDU, got %s", pdu.Hex())
+	}
+	if pdu.TpduLength != 23 {
+		t.Errorf("wrong TPDU length, expected 23, got %d", pdu.TpduLength)
+	}
+}
+
+func TestEncodeSmsSubmitUcs2(t *testing.T) {
+	pdu, err := EncodeSmsSubmit("+46708251358", "😀")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if pdu.Coding != DATA_CODING_UCS2 {
+		t.Errorf("expected UCS-2 coding, got %s", pdu.Coding.String())
+	}
+	if pdu.Hex() != "0011000B916407281553F80008AA04D83DDE00" {
+		t.Errorf("wrong PDU, got %s", pdu.Hex())
+	}
+}
+
+func TestEncodeSmsSubmitTooLong(t *testing.T) {
+	if _, err := EncodeSmsSubmit("+46708251358", strings.Repeat("a", 161)); err == nil {
+		t.Errorf("expected error for GSM-7 text exceeding 160 characters")
+	}
+	if _, err := EncodeSmsSubmit("+46708251358", strings.Repeat("ж", 71)); err == nil {
+		t.Errorf("expected error for UCS-2 text exceeding 70 characters")
+	}
+}
+
+func TestSplitMessageSingleSegment(t *testing.T) {
+	segments, coding, truncated := SplitMessage(strings.Repeat("a", 160), -1, 3, 8)
+	if len(segments) != 1 || truncated || coding != DATA_CODING_GSM7 {
+		t.Errorf("expected a single, untruncated GSM-7 segment, got %d segments (truncated: %t)", len(segments), truncated)
+	}
+}
+
+func TestSplitMessageConcatenated(t *testing.T) {
+	segments, _, truncated := SplitMessage(strings.Repeat("a", 200), -1, 3, 8)
+	if len(segments) != 2 || truncated {
+		t.Fatalf("expected 2 untruncated segments, got %d (truncated: %t)", len(segments), truncated)
+	}
+	if len(segments[0]) != 153 || len(segments[1]) != 47 {
+		t.Errorf("wrong segment lengths %d/%d", len(segments[0]), len(segments[1]))
+	}
+
+	segments, _, _ = SplitMessage(strings.Repeat("a", 200), -1, 3, 16)
+	if len(segments[0]) != 152 {
+		t.Errorf("16-bit reference should leave 152 characters per segment, got %d", len(segments[0]))
+	}
+
+	segments, coding, _ := SplitMessage(strings.Repeat("ж", 100), -1, 3, 8)
+	if coding != DATA_CODING_UCS2 || len(segments) != 2 || len([]rune(segments[0])) != 67 {
+		t.Errorf("expected 2 UCS-2 segments with 67 characters in the first one")
+	}
+}
+
+func TestSplitMessageKeepsEscapeSequencesTogether(t *testing.T) {
+	segments, _, _ := SplitMessage(strings.Repeat("a", 152)+"€b"+strings.Repeat("a", 10), -1, 3, 8)
+	if !strings.HasSuffix(segments[0], "a") || !strings.HasPrefix(segments[1], "€") {
+		t.Errorf("escape sequence must not be split across segments")
+	}
+}
+
+func TestSplitMessageTruncates(t *testing.T) {
+	segments, _, truncated := SplitMessage(strings.Repeat("a", 400), -1, 2, 8)
+	if !truncated || len(segments) != 2 {
+		t.Fatalf("expected truncation to 2 segments, got %d (truncated: %t)", len(segments), truncated)
+	}
+	if !strings.HasSuffix(segments[1], "...") || len(segments[0])+len(segments[1]) != 306 {
+		t.Errorf("expected truncated text ending with '...' filling both segments")
+	}
+
+	segments, _, truncated = SplitMessage(strings.Repeat("a", 50), 20, 1, 8)
+	if !truncated || len(segments) != 1 || segments[0] != strings.Repeat("a", 17)+"..." {
+		t.Errorf("maxLength should cap a single segment, got %v", segments)
+	}
+}
+
+func TestEncodeConcatenatedSmsSubmit(t *testing.T) {
+	segments, coding, _ := SplitMessage(strings.Repeat("a", 200), -1, 3, 8)
+	pdus, err := EncodeConcatenatedSmsSubmit("+46708251358", segments, coding, 0x42, 8, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(pdus) != 2 {
+		t.Fatalf("expected 2 PDUs, got %d", len(pdus))
+	}
+	// UDHI set, UDL = 7 header septets + 153 septets = 160 (0xA0),
+	// UDH 05 00 03 <ref> <total> <seq>, followed by one padding bit
+	if !strings.HasPrefix(pdus[0].Hex(), "0051000B916407281553F80000AAA0050003420201C2") {
+		t.Errorf("wrong first PDU, got %s", pdus[0].Hex())
+	}
+	if !strings.HasPrefix(pdus[1].Hex(), "0051000B916407281553F80000AA36050003420202C2") {
+		t.Errorf("wrong second PDU, got %s", pdus[1].Hex())
+	}
+
+	segments, coding, _ = SplitMessage(strings.Repeat("ж", 100), -1, 3, 16)
+	pdus, err = EncodeConcatenatedSmsSubmit("+46708251358", segments, coding, 0x1234, 16, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if !strings.HasPrefix(pdus[0].Hex(), "0071000B916407281553F80008AA8B060804123402010436") {
+		t.Errorf("wrong first UCS-2 PDU, got %s", pdus[0].Hex())
+	}
+}
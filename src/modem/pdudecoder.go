@@ -0,0 +1,340 @@
+package modem
+
+import (
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+/*
+ * SMS-DELIVER and SMS-STATUS-REPORT PDU decoding according to 3GPP TS 23.040
+ */
+
+// message type indicator (lowest two bits of the first octet) of PDUs received from the network
+const (
+	MTI_SMS_DELIVER       = 0x00
+	MTI_SMS_STATUS_REPORT = 0x02
+)
+
+// SmsDeliver is a decoded SMS-DELIVER PDU
+type SmsDeliver struct {
+	Sender    string
+	Timestamp time.Time
+	Text      string
+	// concatenation information, all zero if the message is not part of a concatenated SMS
+	ConcatReference int
+	ConcatTotal     int
+	ConcatSequence  int
+}
+
+func (s *SmsDeliver) IsConcatenated() bool {
+	return s.ConcatTotal > 1
+}
+
+// pduReader reads consecutive fields from a PDU, remembering the first error encountered
+type pduReader struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (r *pduReader) next(count int) []byte {
+	if r.err != nil {
+		return make([]byte, count)
+	}
+	if r.offset+count > len(r.data) {
+		r.err = errors.New("PDU too short, expected at least " + strconv.Itoa(r.offset+count) + " bytes but got " + strconv.Itoa(len(r.data)))
+		return make([]byte, count)
+	}
+	result := r.data[r.offset : r.offset+count]
+	r.offset += count
+	return result
+}
+
+func (r *pduReader) nextByte() byte {
+	return r.next(1)[0]
+}
+
+func (r *pduReader) remaining() []byte {
+	if r.err != nil || r.offset >= len(r.data) {
+		return []byte{}
+	}
+	return r.data[r.offset:]
+}
+
+// unpackSeptets extracts septetCount 7-bit values from packed octets, skipping paddingBits bits at the start
+func unpackSeptets(data []byte, septetCount int, paddingBits int) []byte {
+	result := make([]byte, 0, septetCount)
+	for i := 0; i < septetCount; i++ {
+		bitOffset := paddingBits + i*7
+		byteIdx := bitOffset / 8
+		shift := bitOffset % 8
+		if byteIdx >= len(data) {
+			break
+		}
+		value := uint16(data[byteIdx]) >> shift
+		if shift > 1 && byteIdx+1 < len(data) {
+			value |= uint16(data[byteIdx+1]) << (8 - shift)
+		}
+		result = append(result, byte(value&0x7f))
+	}
+	return result
+}
+
+// decodeGsm7 turns unpacked GSM-7 septets into text, resolving escape sequences
+func decodeGsm7(septets []byte) string {
+	var sb strings.Builder
+	for i := 0; i < len(septets); i++ {
+		septet := septets[i]
+		if septet == gsm7Escape && i+1 < len(septets) {
+			i++
+			found := false
+			for r, value := range gsm7ExtensionTable {
+				if value == septets[i] {
+					sb.WriteRune(r)
+					found = true
+					break
+				}
+			}
+			if !found {
+				// unknown extension, 3GPP TS 23.038 says to display the default alphabet character instead
+				sb.WriteRune(gsm7DefaultAlphabet[septets[i]])
+			}
+			continue
+		}
+		sb.WriteRune(gsm7DefaultAlphabet[septet])
+	}
+	return sb.String()
+}
+
+func decodeUcs2(data []byte) string {
+	units := make([]uint16, 0, len(data)/2)
+	for i := 0; i+1 < len(data); i += 2 {
+		units = append(units, uint16(data[i])<<8|uint16(data[i+1]))
+	}
+	return string(utf16.Decode(units))
+}
+
+func decodeSemiOctets(data []byte) string {
+	var sb strings.Builder
+	for _, b := range data {
+		for _, digit := range []byte{b & 0x0f, b >> 4} {
+			switch {
+			case digit <= 9:
+				sb.WriteByte('0' + digit)
+			case digit == 0x0a:
+				sb.WriteByte('*')
+			case digit == 0x0b:
+				sb.WriteByte('#')
+			}
+		}
+	}
+	return sb.String()
+}
+
+// decodeAddress decodes an originating/recipient address given its length in semi-octets
+func (r *pduReader) decodeAddress() string {
+	digitCount := int(r.nextByte())
+	typeOfAddress := r.nextByte()
+	data := r.next((digitCount + 1) / 2)
+	if typeOfAddress&0x70 == 0x50 {
+		// alphanumeric sender like "Vodafone", GSM-7 packed
+		return decodeGsm7(unpackSeptets(data, digitCount*4/7, 0))
+	}
+	digits := decodeSemiOctets(data)
+	if len(digits) > digitCount {
+		digits = digits[:digitCount]
+	}
+	if typeOfAddress&0x70 == 0x10 {
+		return "+" + digits
+	}
+	return digits
+}
+
+func swappedBcd(b byte) int {
+	return int(b&0x0f)*10 + int(b>>4)
+}
+
+// decodeTimestamp decodes a 7-octet service centre timestamp
+func (r *pduReader) decodeTimestamp() time.Time {
+	data := r.next(7)
+	quarterHours := int(data[6]&0x07)*10 + int(data[6]>>4)
+	offsetSeconds := quarterHours * 15 * 60
+	if data[6]&0x08 != 0 {
+		offsetSeconds = -offsetSeconds
+	}
+	location := time.FixedZone("", offsetSeconds)
+	return time.Date(2000+swappedBcd(data[0]), time.Month(swappedBcd(data[1])), swappedBcd(data[2]),
+		swappedBcd(data[3]), swappedBcd(data[4]), swappedBcd(data[5]), 0, location)
+}
+
+// dataCodingAlphabet returns the alphabet used by a data coding scheme:
+// 0 = GSM-7, 1 = 8-bit data, 2 = UCS-2
+func dataCodingAlphabet(dcs byte) int {
+	switch {
+	case dcs&0xc0 == 0x00:
+		return int(dcs>>2) & 0x03
+	case dcs&0xf0 == 0xe0:
+		return 2
+	case dcs&0xf0 == 0xf0:
+		return int(dcs>>2) & 0x01
+	}
+	return 0
+}
+
+// decodeUserData decodes the user data (including an optional header) of an SMS-DELIVER PDU
+func decodeUserData(r *pduReader, dcs byte, hasHeader bool, result *SmsDeliver) {
+
+	userDataLength := int(r.nextByte())
+	userData := r.remaining()
+	if r.err != nil {
+		return
+	}
+
+	headerLength := 0
+	if hasHeader && len(userData) > 0 {
+		headerLength = int(userData[0]) + 1
+		if headerLength > len(userData) {
+			r.err = errors.New("User data header length exceeds user data")
+			return
+		}
+		parseConcatHeader(userData[1:headerLength], result)
+	}
+
+	switch dataCodingAlphabet(dcs) {
+	case 0:
+		headerSeptets := (headerLength*8 + 6) / 7
+		septets := unpackSeptets(userData, userDataLength, 0)
+		if headerSeptets < len(septets) {
+			result.Text = decodeGsm7(septets[headerSeptets:])
+		}
+	case 2:
+		result.Text = decodeUcs2(userData[headerLength:])
+	default:
+		result.Text = hex.EncodeToString(userData[headerLength:])
+	}
+}
+
+// parseConcatHeader looks for the concatenation information elements in a user data header
+func parseConcatHeader(header []byte, result *SmsDeliver) {
+	for i := 0; i+1 < len(header); {
+		ieId := header[i]
+		ieLength := int(header[i+1])
+		if i+2+ieLength > len(header) {
+			return
+		}
+		ie := header[i+2 : i+2+ieLength]
+		if ieId == 0x00 && ieLength == 3 {
+			result.ConcatReference = int(ie[0])
+			result.ConcatTotal = int(ie[1])
+			result.ConcatSequence = int(ie[2])
+		} else if ieId == 0x08 && ieLength == 4 {
+			result.ConcatReference = int(ie[0])<<8 | int(ie[1])
+			result.ConcatTotal = int(ie[2])
+			result.ConcatSequence = int(ie[3])
+		}
+		i += 2 + ieLength
+	}
+}
+
+// skipSmscAddress skips the SMSC address that precedes TPDUs received from the modem and
+// returns the TPDU's first octet
+func skipSmscAddress(r *pduReader) byte {
+	smscLength := int(r.nextByte())
+	r.next(smscLength)
+	return r.nextByte()
+}
+
+// pduMessageType returns the message type indicator of a PDU (including SMSC address) as received from the modem
+func pduMessageType(pduHex string) (int, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(pduHex))
+	if err != nil {
+		return 0, errors.New("PDU is not a valid hex string: " + err.Error())
+	}
+	r := &pduReader{data: data}
+	firstOctet := skipSmscAddress(r)
+	return int(firstOctet & 0x03), r.err
+}
+
+// DecodeSmsDeliver decodes an SMS-DELIVER PDU (including SMSC address) as returned by AT+CMGL in PDU mode
+func DecodeSmsDeliver(pduHex string) (SmsDeliver, error) {
+
+	data, err := hex.DecodeString(strings.TrimSpace(pduHex))
+	if err != nil {
+		return SmsDeliver{}, errors.New("PDU is not a valid hex string: " + err.Error())
+	}
+
+	r := &pduReader{data: data}
+	firstOctet := skipSmscAddress(r)
+	if r.err == nil && firstOctet&0x03 != MTI_SMS_DELIVER {
+		return SmsDeliver{}, errors.New("Not an SMS-DELIVER PDU, message type indicator is " + strconv.Itoa(int(firstOctet&0x03)))
+	}
+
+	var result SmsDeliver
+	result.Sender = r.decodeAddress()
+	r.nextByte() // protocol identifier
+	dcs := r.nextByte()
+	result.Timestamp = r.decodeTimestamp()
+	decodeUserData(r, dcs, firstOctet&0x40 != 0, &result)
+	if r.err != nil {
+		return SmsDeliver{}, r.err
+	}
+	return result, nil
+}
+
+// SmsStatusReport is a decoded SMS-STATUS-REPORT PDU
+type SmsStatusReport struct {
+	// message reference (TP-MR) of the SMS-SUBMIT this report refers to, as returned by AT+CMGS
+	Reference int
+	Recipient string
+	// when the SMS service centre received the SMS-SUBMIT
+	Timestamp time.Time
+	// when the SMS was delivered or when the SMS service centre gave up
+	DischargeTime time.Time
+	// TP-Status, see 3GPP TS 23.040 9.2.3.15
+	Status int
+}
+
+// IsDelivered returns TRUE if the status indicates successful delivery to the handset
+func (r *SmsStatusReport) IsDelivered() bool {
+	return r.Status < 0x20
+}
+
+// IsPending returns TRUE if the SMS service centre is still trying to deliver the message
+func (r *SmsStatusReport) IsPending() bool {
+	return r.Status >= 0x20 && r.Status < 0x40
+}
+
+// IsExpired returns TRUE if the SMS service centre gave up because the validity period expired
+func (r *SmsStatusReport) IsExpired() bool {
+	return r.Status == 0x46
+}
+
+// DecodeSmsStatusReport decodes an SMS-STATUS-REPORT PDU (including SMSC address) as returned by AT+CMGL in PDU mode
+func DecodeSmsStatusReport(pduHex string) (SmsStatusReport, error) {
+
+	data, err := hex.DecodeString(strings.TrimSpace(pduHex))
+	if err != nil {
+		return SmsStatusReport{}, errors.New("PDU is not a valid hex string: " + err.Error())
+	}
+
+	r := &pduReader{data: data}
+	firstOctet := skipSmscAddress(r)
+	if r.err == nil && firstOctet&0x03 != MTI_SMS_STATUS_REPORT {
+		return SmsStatusReport{}, errors.New("Not an SMS-STATUS-REPORT PDU, message type indicator is " + strconv.Itoa(int(firstOctet&0x03)))
+	}
+
+	var result SmsStatusReport
+	result.Reference = int(r.nextByte())
+	result.Recipient = r.decodeAddress()
+	result.Timestamp = r.decodeTimestamp()
+	result.DischargeTime = r.decodeTimestamp()
+	result.Status = int(r.nextByte())
+	if r.err != nil {
+		return SmsStatusReport{}, r.err
+	}
+	return result, nil
+}
@@ -0,0 +1,162 @@
+package modem
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeSmsDeliverGsm7(t *testing.T) {
+	sms, err := DecodeSmsDeliver("07911326040000F0040B911346610089F60000208062917314080CC8F71D14969741F977FD07")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if sms.Sender != "+31641600986" {
+		t.Errorf("wrong sender, got %s", sms.Sender)
+	}
+	if sms.Text != "How are you?" {
+		t.Errorf("wrong text, got %s", sms.Text)
+	}
+	if sms.Timestamp.Year() != 2002 || sms.Timestamp.Month() != 8 || sms.Timestamp.Day() != 26 || sms.Timestamp.Hour() != 19 {
+		t.Errorf("wrong timestamp, got %s", sms.Timestamp.String())
+	}
+	if sms.IsConcatenated() {
+		t.Errorf("message must not be concatenated")
+	}
+}
+
+// deliverPdu creates an SMS-DELIVER PDU without SMSC address, sent from +491234567890 at 2024-10-16 17:00:54 UTC+2
+func deliverPdu(firstOctet string, dcs string, userData []byte, userDataLength int) string {
+	return "00" + firstOctet + "0C91942143658709" + "00" + dcs + "42016171004580" + toHex([]byte{byte(userDataLength)}) + toHex(userData)
+}
+
+func TestDecodeSmsDeliverUcs2(t *testing.T) {
+	data := encodeUcs2("Grüße 😀")
+	sms, err := DecodeSmsDeliver(deliverPdu("04", "08", data, len(data)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if sms.Sender != "+491234567890" {
+		t.Errorf("wrong sender, got %s", sms.Sender)
+	}
+	if sms.Text != "Grüße 😀" {
+		t.Errorf("wrong text, got %s", sms.Text)
+	}
+	_, offset := sms.Timestamp.Zone()
+	if offset != 2*3600 || sms.Timestamp.Minute() != 0 || sms.Timestamp.Second() != 54 {
+		t.Errorf("wrong timestamp, got %s", sms.Timestamp.String())
+	}
+}
+
+func TestDecodeSmsDeliverConcatenated(t *testing.T) {
+	septets, _ := encodeGsm7("part [two]")
+	header := []byte{0x05, 0x00, 0x03, 0xaa, 0x02, 0x02}
+	data := append(header, packSeptets(septets, 1)...)
+	sms, err := DecodeSmsDeliver(deliverPdu("44", "00", data, 7+len(septets)))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if sms.Text != "part [two]" {
+		t.Errorf("wrong text, got %s", sms.Text)
+	}
+	if sms.ConcatReference != 0xaa || sms.ConcatTotal != 2 || sms.ConcatSequence != 2 {
+		t.Errorf("wrong concatenation info %d/%d/%d", sms.ConcatReference, sms.ConcatTotal, sms.ConcatSequence)
+	}
+}
+
+func TestDecodeSmsDeliverAlphanumericSender(t *testing.T) {
+	septets, _ := encodeGsm7("Vodafone")
+	sender := packSeptets(septets, 0)
+	text, _ := encodeGsm7("hi")
+	pdu := "0004" + toHex([]byte{byte(len(septets) * 7 / 4)}) + "D0" + toHex(sender) + "0000" + "42016171004580" + "02" + toHex(packSeptets(text, 0))
+	sms, err := DecodeSmsDeliver(pdu)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if sms.Sender != "Vodafone" || sms.Text != "hi" {
+		t.Errorf("wrong sender/text, got %s/%s", sms.Sender, sms.Text)
+	}
+}
+
+func TestDecodeSmsDeliverRejectsOtherTypes(t *testing.T) {
+	if _, err := DecodeSmsDeliver("0011000B916407281553F80000AA0AE8329BFD4697D9EC37"); err == nil {
+		t.Errorf("expected error when decoding an SMS-SUBMIT PDU")
+	}
+	if _, err := DecodeSmsDeliver("00040C9194"); err == nil {
+		t.Errorf("expected error when decoding a truncated PDU")
+	}
+}
+
+func TestParsePduModeListing(t *testing.T) {
+	response := ModemResponse{Lines: []string{
+		"+CMGL: 3,1,,37",
+		"07911326040000F0040B911346610089F60000208062917314080CC8F71D14969741F977FD07",
+		"+CMGL: 5,2,,24",
+		"0011000B916407281553F80000AA0AE8329BFD4697D9EC37",
+		"+CMGL: 6,0,,25",
+		statusReportPdu,
+		"OK"}}
+	messages, reports := parsePduModeListing(response)
+	if len(messages) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(messages))
+	}
+	if messages[0].StorageIndex != 3 || messages[0].Text != "How are you?" {
+		t.Errorf("wrong message, got #%d '%s'", messages[0].StorageIndex, messages[0].Text)
+	}
+	if len(reports) != 1 || reports[0].StorageIndex != 6 || reports[0].Reference != 42 {
+		t.Errorf("expected status report #6 for reference 42")
+	}
+}
+
+func TestParseTextModeListing(t *testing.T) {
+	response := ModemResponse{Lines: []string{
+		"+CMGL: 1,\"REC READ\",\"+491234567890\",,\"24/10/16,17:00:54+08\"",
+		"first line",
+		"second line",
+		"+CMGL: 2,\"STO SENT\",\"+491234567890\",,",
+		"outgoing",
+		"+CMGL: 4,\"REC UNREAD\",\"+4930123\",\"Bob\",\"24/10/16,17:01:00-04\"",
+		"hello",
+		"+CMGL: 7,\"REC UNREAD\",6,42,\"+491234567890\",145,\"24/10/16,17:00:54+08\",\"24/10/16,17:01:54+08\",70",
+		"OK"}}
+	messages, reports := parseTextModeListing(response)
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if messages[0].StorageIndex != 1 || messages[0].Sender != "+491234567890" || messages[0].Text != "first line\nsecond line" {
+		t.Errorf("wrong first message, got #%d %s '%s'", messages[0].StorageIndex, messages[0].Sender, strings.ReplaceAll(messages[0].Text, "\n", "<LF>"))
+	}
+	if _, offset := messages[0].Timestamp.Zone(); offset != 2*3600 || messages[0].Timestamp.Hour() != 17 {
+		t.Errorf("wrong timestamp, got %s", messages[0].Timestamp.String())
+	}
+	if messages[1].StorageIndex != 4 || messages[1].Text != "hello" {
+		t.Errorf("wrong second message, got #%d '%s'", messages[1].StorageIndex, messages[1].Text)
+	}
+	if _, offset := messages[1].Timestamp.Zone(); offset != -3600 {
+		t.Errorf("wrong timezone offset, got %d", offset)
+	}
+	if len(reports) != 1 || reports[0].StorageIndex != 7 || reports[0].Reference != 42 || !reports[0].IsExpired() {
+		t.Errorf("expected expired status report #7 for reference 42")
+	}
+}
+
+// status report for message reference 42 to +491234567890, delivered one minute after submission
+const statusReportPdu = "00062A0C91942143658709" + "42016171004580" + "42016171104580" + "00"
+
+func TestDecodeSmsStatusReport(t *testing.T) {
+	report, err := DecodeSmsStatusReport(statusReportPdu)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if report.Reference != 42 || report.Recipient != "+491234567890" {
+		t.Errorf("wrong reference/recipient, got %d/%s", report.Reference, report.Recipient)
+	}
+	if !report.IsDelivered() || report.IsPending() {
+		t.Errorf("status 0x00 must mean delivered")
+	}
+	if report.DischargeTime.Sub(report.Timestamp).Minutes() != 1 {
+		t.Errorf("wrong discharge time, got %s", report.DischargeTime.String())
+	}
+	if _, err = DecodeSmsStatusReport("07911326040000F0040B911346610089F60000208062917314080CC8F71D14969741F977FD07"); err == nil {
+		t.Errorf("expected error when decoding an SMS-DELIVER PDU as status report")
+	}
+}
@@ -0,0 +1,105 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/serialportdiscovery"
+	"go.bug.st/serial"
+)
+
+// creates the lock file of a local serial port, replaced by tests
+var lockPort = serialportdiscovery.LockPort
+
+// how long to wait before checking a busy serial port again with portBusy=wait
+var portBusyPollInterval = time.Second
+
+// initial delay between attempts with portBusy=retry, doubled after each attempt up to portBusyMaxBackoff
+var portBusyBackoff = time.Second
+
+const portBusyMaxBackoff = time.Minute
+
+// claimPort locks and opens a local serial port, returning a *serialportdiscovery.PortBusyError if another
+// process holds its lock file or has it open. The lock needs to be released after closing the port.
+// Connections to serial servers are not locked, the server decides whether to share its port.
+func claimPort(port string, baudRate int, readTimeout time.Duration) (transport, *serialportdiscovery.PortLock, error) {
+
+	if config.IsRemoteSerialPort(port) {
+		t, err := openTransport(port, baudRate, readTimeout)
+		return t, nil, err
+	}
+	lock, err := lockPort(port)
+	if err != nil {
+		return nil, nil, err
+	}
+	// ModemManager and most terminal programs do not create lock files
+	if users := serialportdiscovery.FindPortUsers(port); len(users) > 0 {
+		lock.Unlock()
+		return nil, nil, &serialportdiscovery.PortBusyError{Port: port, Pids: users}
+	}
+	// serial.Open() puts the port into exclusive mode (TIOCEXCL), so other processes not running as root fail
+	// to open it while the gateway uses it
+	t, err := openTransport(port, baudRate, readTimeout)
+	if err != nil {
+		lock.Unlock()
+		var portErr *serial.PortError
+		if errors.As(err, &portErr) && portErr.Code() == serial.PortBusy {
+			return nil, nil, &serialportdiscovery.PortBusyError{Port: port, Pids: serialportdiscovery.FindPortUsers(port)}
+		}
+		return nil, nil, err
+	}
+	return t, lock, nil
+}
+
+// returned by claimConfiguredPort() if another caller opened the modem's serial port while waiting for it
+var errPortOpenedMeanwhile = errors.New("serial port got opened while waiting for it")
+
+// claimConfiguredPort claims a serial port, waiting for or retrying a busy port as configured by
+// [modem] portBusy. Needs to be called with the mutex held. The mutex gets released while waiting
+// so that a busy port does not block callers like /status, errPortOpenedMeanwhile is returned
+// if another caller opened the serial port in the meantime.
+func (m *serialModem) claimConfiguredPort(ctx context.Context, port string) (transport, *serialportdiscovery.PortLock, error) {
+
+	action := m.modemConfig.GetPortBusyAction()
+	backoff := portBusyBackoff
+	deadline := time.Now().Add(m.modemConfig.GetPortBusyTimeout())
+	for attempt := 1; ; attempt++ {
+		t, lock, err := claimPort(port, m.modemConfig.GetSerialSpeed(), m.modemConfig.GetSerialReadTimeout())
+		var busyErr *serialportdiscovery.PortBusyError
+		if err == nil || !errors.As(err, &busyErr) || action == config.PORT_BUSY_FAIL {
+			return t, lock, err
+		}
+
+		var delay time.Duration
+		if action == config.PORT_BUSY_WAIT {
+			if time.Now().After(deadline) {
+				return nil, nil, errors.New(err.Error() + ", gave up waiting after " + m.modemConfig.GetPortBusyTimeout().String())
+			}
+			delay = portBusyPollInterval
+			if attempt == 1 {
+				log.Warn(err.Error() + ", modem '" + m.Name() + "' is waiting up to " + m.modemConfig.GetPortBusyTimeout().String() +
+					" for it to be released")
+			}
+		} else {
+			if attempt > m.modemConfig.GetPortBusyRetries() {
+				return nil, nil, err
+			}
+			delay = backoff
+			backoff = min(2*backoff, portBusyMaxBackoff)
+			log.Warn(err.Error() + ", modem '" + m.Name() + "' retries in " + delay.String() + " (" +
+				strconv.Itoa(attempt) + "/" + strconv.Itoa(m.modemConfig.GetPortBusyRetries()) + ")")
+		}
+		m.mutex.Unlock()
+		sleepErr := sleep(ctx, delay)
+		m.mutex.Lock()
+		if sleepErr != nil {
+			return nil, nil, err
+		}
+		if m.link != nil {
+			return nil, nil, errPortOpenedMeanwhile
+		}
+	}
+}
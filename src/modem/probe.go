@@ -0,0 +1,150 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/serialportdiscovery"
+)
+
+// how long a probed serial port may take to answer
+var probeTimeout = time.Second
+
+// returns the serial ports to probe if serialPort=auto, replaced by tests
+var serialPortCandidates = config.ModemConfig.GetSerialPortCandidates
+
+// ProbeResult tells whether a serial port answers AT commands
+type ProbeResult struct {
+	Port string
+	// TRUE if the port answered AT with OK
+	Ok bool
+	// what the modem answered to ATI, empty if unknown
+	Identity string
+	// vendor profile matching the modem's answer to ATI, nil if none does
+	Profile *Profile
+	// why the port was skipped or did not answer, empty if Ok
+	Error string
+}
+
+// serial ports opened by the modems of this process, mapped to the modem's name
+var openPortsMutex sync.Mutex
+var openPorts = make(map[string]string)
+
+func registerPort(port string, modemName string) {
+	openPortsMutex.Lock()
+	defer openPortsMutex.Unlock()
+	openPorts[port] = modemName
+}
+
+func unregisterPort(port string) {
+	openPortsMutex.Lock()
+	defer openPortsMutex.Unlock()
+	delete(openPorts, port)
+}
+
+// ProbePort sends AT to a serial port and, if it answers with OK, asks the modem to identify itself using ATI.
+// Ports opened by a modem of the gateway or by another process are skipped, as sending them commands would
+// interfere with whoever uses them.
+func ProbePort(ctx context.Context, port string, baudRate int) ProbeResult {
+
+	result := ProbeResult{Port: port}
+
+	openPortsMutex.Lock()
+	owner, used := openPorts[port]
+	openPortsMutex.Unlock()
+	if used {
+		result.Error = "in use by modem '" + owner + "'"
+		return result
+	}
+	t, lock, err := claimPort(port, baudRate, probeTimeout)
+	if err != nil {
+		var busyErr *serialportdiscovery.PortBusyError
+		if errors.As(err, &busyErr) {
+			result.Error = "in use by " + busyErr.Holders()
+		} else {
+			result.Error = "failed to open - " + err.Error()
+		}
+		return result
+	}
+	defer lock.Unlock()
+	link := newSerialLink(t, probeTimeout, port)
+	defer link.close()
+
+	lines, err := link.execute(ctx, []byte("AT\r"), "AT", false)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	response := ModemResponse{Lines: withoutEcho(lines, "AT")}
+	if !response.isOK() {
+		if response.IsEmpty() {
+			result.Error = "no answer to AT"
+		} else {
+			result.Error = "unexpected answer to AT: " + strings.Join(response.Lines, " ")
+		}
+		return result
+	}
+	result.Ok = true
+
+	// not every modem implements ATI
+	lines, err = link.execute(ctx, []byte("ATI\r"), "ATI", false)
+	if err == nil {
+		var identity []string
+		for _, line := range withoutEcho(lines, "ATI") {
+			if line != "OK" && line != "ERROR" {
+				identity = append(identity, line)
+			}
+		}
+		result.Identity = strings.Join(identity, ", ")
+		result.Profile = profileByIdentity(identity)
+	}
+	return result
+}
+
+// withoutEcho returns the non-blank lines of a response except the echoed command
+func withoutEcho(lines []string, cmd string) []string {
+	var result []string
+	for _, line := range lines {
+		if line = strings.TrimSpace(line); line != "" && line != cmd {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+// ProbePorts probes the serial ports one after the other, see ProbePort()
+func ProbePorts(ctx context.Context, ports []string, baudRate int) []ProbeResult {
+	var result []ProbeResult
+	for _, port := range ports {
+		result = append(result, ProbePort(ctx, port, baudRate))
+	}
+	return result
+}
+
+// resolveSerialPort returns the serial port to open: the configured one, the one found by USB interface
+// discovery or, if serialPort=auto, the first candidate answering AT. Needs to be called with the mutex held.
+func (m *serialModem) resolveSerialPort(ctx context.Context) (string, error) {
+
+	if !m.modemConfig.IsAutoSerialPort() {
+		return m.modemConfig.GetSerialPort()
+	}
+	candidates, err := serialPortCandidates(m.modemConfig)
+	if err != nil {
+		return "", err
+	}
+	var failures []string
+	for _, port := range candidates {
+		result := ProbePort(ctx, port, m.modemConfig.GetSerialSpeed())
+		if result.Ok {
+			log.Info("Going to use " + port + " for modem '" + m.Name() + "', it answered AT (" + result.Identity + ")")
+			return port, nil
+		}
+		log.Debug("Not using " + port + " for modem '" + m.Name() + "' - " + result.Error)
+		failures = append(failures, port+": "+result.Error)
+	}
+	return "", errors.New("Found no serial port answering AT for modem '" + m.Name() + "' (" + strings.Join(failures, ", ") + ")")
+}
@@ -0,0 +1,97 @@
+//go:build linux
+
+package modem
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/emulator"
+)
+
+func startEmulator(t *testing.T, options emulator.Options) *emulator.Emulator {
+	emu, err := emulator.New(options)
+	if err != nil {
+		t.Fatalf("failed to start emulator: %s", err.Error())
+	}
+	t.Cleanup(emu.Close)
+	return emu
+}
+
+func TestProbePort(t *testing.T) {
+	oldTimeout := probeTimeout
+	probeTimeout = 300 * time.Millisecond
+	defer func() {
+		probeTimeout = oldTimeout
+	}()
+
+	emu := startEmulator(t, emulator.Options{})
+	silent := startEmulator(t, emulator.Options{Delay: 2 * time.Second})
+
+	result := ProbePort(context.Background(), emu.Path(), 115200)
+	if !result.Ok || !strings.Contains(result.Identity, "Model: E3372") || result.Profile == nil ||
+		result.Profile.Id != config.MODEM_PROFILE_HUAWEI {
+		t.Errorf("expected emulator to answer as Huawei E3372, got %+v", result)
+	}
+	if result = ProbePort(context.Background(), silent.Path(), 115200); result.Ok || result.Error != "no answer to AT" {
+		t.Errorf("expected silent port to fail, got %+v", result)
+	}
+	if result = ProbePort(context.Background(), "/dev/does-not-exist", 115200); result.Ok || !strings.HasPrefix(result.Error, "failed to open") {
+		t.Errorf("expected missing port to fail, got %+v", result)
+	}
+
+	// a port another modem of the gateway uses must not receive any commands
+	registerPort(emu.Path(), "telekom")
+	commands := len(emu.Commands())
+	result = ProbePort(context.Background(), emu.Path(), 115200)
+	unregisterPort(emu.Path())
+	if result.Ok || result.Error != "in use by modem 'telekom'" || len(emu.Commands()) != commands {
+		t.Errorf("expected port in use to be skipped, got %+v", result)
+	}
+}
+
+func TestSerialModemAutoPort(t *testing.T) {
+	oldTimeout := probeTimeout
+	probeTimeout = 300 * time.Millisecond
+	defer func() {
+		probeTimeout = oldTimeout
+		serialPortCandidates = config.ModemConfig.GetSerialPortCandidates
+	}()
+
+	emu := startEmulator(t, emulator.Options{})
+	silent := startEmulator(t, emulator.Options{Delay: 2 * time.Second})
+	candidates := []string{silent.Path(), emu.Path()}
+	serialPortCandidates = func(config.ModemConfig) ([]string, error) {
+		return candidates, nil
+	}
+
+	settings := "serialPort=auto\nserialSpeed=115200\nserialReadTimeoutSeconds=1\ninitCmds=ATE0\n"
+	appConfig, appState := loadTestConfig(t, settings, "", "")
+	m := newSerialModem(appConfig, appState, appConfig.GetModems()[0])
+	t.Cleanup(m.Close)
+	if err := m.Init(context.Background()); err != nil {
+		t.Fatalf("init failed: %s", err.Error())
+	}
+	if m.portName != emu.Path() {
+		t.Errorf("expected port %s answering AT to be used, got %s", emu.Path(), m.portName)
+	}
+
+	// the port is taken now
+	appConfig, appState = loadTestConfig(t, settings, "", "")
+	other := newSerialModem(appConfig, appState, appConfig.GetModems()[0])
+	t.Cleanup(other.Close)
+	err := other.Init(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "in use by modem 'default'") {
+		t.Errorf("expected second modem to find no port, got %v", err)
+	}
+
+	// re-initializing probes again
+	m.Close()
+	candidates = []string{emu.Path()}
+	if err = m.Recover(context.Background(), config.RECOVERY_STEP_REDISCOVER); err != nil || m.portName != emu.Path() {
+		t.Errorf("expected modem to find its port again, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package modem
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"code-sourcery.de/sms-gateway/common"
+	"code-sourcery.de/sms-gateway/config"
+)
+
+// Profile bundles the commands and quirks of a family of modems
+type Profile struct {
+	Id config.ModemProfile
+	// matched case-insensitively against the manufacturer and model reported by ATI
+	keywords []string
+	// USB vendor IDs of the manufacturer
+	usbVendorIds []uint16
+	// commands sent after opening the serial port
+	InitCmds []string
+	// network registration queries, the first one reporting a registration wins
+	RegistrationCmds []string
+	// character sets supported by AT+CSCS, nil if the character set should be left alone
+	Charsets []string
+	// whether USSD strings are exchanged as hex-encoded, packed GSM-7
+	UssdPacked bool
+	// query that returns the ICCID of the SIM card
+	IccidCmd string
+	// whether the modem understands Huawei's AT^CPIN? (remaining PIN/PUK attempts) and AT^HCSQ? (LTE signal quality)
+	HuaweiCmds bool
+}
+
+// Huawei init according to ModemManager: AT^CURC=0 turns off the periodic ^RSSI, ^HCSQ, ^MODE, ... reports
+var huaweiProfile = Profile{
+	Id:               config.MODEM_PROFILE_HUAWEI,
+	keywords:         []string{"huawei", "e3351", "e3372"},
+	usbVendorIds:     []uint16{0x12d1},
+	InitCmds:         []string{"AT^CURC=0"},
+	RegistrationCmds: []string{"AT+CREG?"},
+	Charsets:         []string{"IRA", "GSM", "UCS2"},
+	UssdPacked:       true,
+	IccidCmd:         "AT^ICCID?",
+	HuaweiCmds:       true,
+}
+
+// Quectel modules report LTE registration via AT+CEREG? only, URCs need to go to the AT port the gateway is using
+var quectelProfile = Profile{
+	Id:               config.MODEM_PROFILE_QUECTEL,
+	keywords:         []string{"quectel", "ec25"},
+	usbVendorIds:     []uint16{0x2c7c},
+	InitCmds:         []string{"AT+QURCCFG=\"urcport\",\"usbat\""},
+	RegistrationCmds: []string{"AT+CREG?", "AT+CEREG?"},
+	Charsets:         []string{"GSM", "IRA", "UCS2"},
+	IccidCmd:         "AT+QCCID",
+}
+
+var simcomProfile = Profile{
+	Id:               config.MODEM_PROFILE_SIMCOM,
+	keywords:         []string{"simcom", "sim7600"},
+	usbVendorIds:     []uint16{0x1e0e},
+	RegistrationCmds: []string{"AT+CREG?", "AT+CEREG?"},
+	Charsets:         []string{"IRA", "GSM", "UCS2"},
+	IccidCmd:         "AT+CICCID",
+}
+
+// genericProfile only uses commands from 3GPP TS 27.005/27.007
+var genericProfile = Profile{
+	Id:               config.MODEM_PROFILE_GENERIC,
+	RegistrationCmds: []string{"AT+CREG?", "AT+CEREG?"},
+	IccidCmd:         "AT+CCID",
+}
+
+// vendor profiles in the order they are tried when detecting a modem's profile
+var vendorProfiles = []*Profile{&huaweiProfile, &quectelProfile, &simcomProfile}
+
+// GetProfile returns the profile with the given ID, the generic one for MODEM_PROFILE_AUTO
+func GetProfile(id config.ModemProfile) *Profile {
+	for _, profile := range vendorProfiles {
+		if profile.Id == id {
+			return profile
+		}
+	}
+	return &genericProfile
+}
+
+// profileByUsbId returns the profile of the manufacturer with the given USB vendor ID, nil if there is none
+func profileByUsbId(usbDeviceId *common.UsbDeviceId) *Profile {
+	if usbDeviceId == nil {
+		return nil
+	}
+	for _, profile := range vendorProfiles {
+		if slices.Contains(profile.usbVendorIds, usbDeviceId.VendorId) {
+			return profile
+		}
+	}
+	return nil
+}
+
+// profileByIdentity returns the profile matching the response to ATI or AT+CGMI/AT+CGMM, nil if there is none
+func profileByIdentity(lines []string) *Profile {
+	identity := strings.ToLower(strings.Join(lines, "\n"))
+	for _, profile := range vendorProfiles {
+		for _, keyword := range profile.keywords {
+			if strings.Contains(identity, keyword) {
+				return profile
+			}
+		}
+	}
+	return nil
+}
+
+// SupportsCharset returns TRUE if the profile lists the character set as supported by AT+CSCS
+func (p *Profile) SupportsCharset(charset string) bool {
+	return slices.Contains(p.Charsets, charset)
+}
+
+// detectProfile determines the profile of the modem: the configured one or, if set to auto, the one matching
+// the USB vendor ID or the modem's answer to ATI. Needs to be called with the mutex held.
+func (m *serialModem) detectProfile(ctx context.Context) (*Profile, error) {
+
+	if id := m.modemConfig.GetProfile(); id != config.MODEM_PROFILE_AUTO {
+		return GetProfile(id), nil
+	}
+	if profile := profileByUsbId(m.modemConfig.GetUsbDeviceId()); profile != nil {
+		log.Debug("Modem '" + m.Name() + "' has USB vendor ID of profile " + profile.Id.String())
+		return profile, nil
+	}
+	response, err := m.sendCmd(ctx, "ATI", true)
+	if err != nil {
+		return nil, err
+	}
+	if profile := profileByIdentity(response.Lines); profile != nil {
+		return profile, nil
+	}
+	// not every modem implements ATI
+	response, err = m.sendCmd(ctx, "AT+CGMI", true)
+	if err != nil {
+		return nil, err
+	}
+	if profile := profileByIdentity(response.Lines); profile != nil {
+		return profile, nil
+	}
+	log.Info("Modem '" + m.Name() + "' matches no vendor profile, using generic profile")
+	return &genericProfile, nil
+}
+
+// getInitCmds returns the profile's init commands, unless [modem] initCmds replaces them, plus [modem] extraInitCmds
+func (m *serialModem) getInitCmds() []string {
+	result := m.modemConfig.GetModemInitCmds()
+	if result == nil {
+		result = slices.Clone(m.profile.InitCmds)
+	}
+	return append(result, m.modemConfig.GetExtraInitCmds()...)
+}
+
+// getRegistrationCmds returns the profile's network registration queries unless [modem] registrationCmds replaces them
+func (m *serialModem) getRegistrationCmds() []string {
+	if result := m.modemConfig.GetRegistrationCmds(); result != nil {
+		return result
+	}
+	return m.profile.RegistrationCmds
+}
+
+// isUssdPacked returns [modem] ussdPacked if set, the profile's setting otherwise
+func (m *serialModem) isUssdPacked() bool {
+	if packed := m.modemConfig.GetUssdPacked(); packed != nil {
+		return *packed
+	}
+	return m.profile.UssdPacked
+}
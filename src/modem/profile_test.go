@@ -0,0 +1,32 @@
+package modem
+
+import (
+	"testing"
+
+	"code-sourcery.de/sms-gateway/common"
+	"code-sourcery.de/sms-gateway/config"
+)
+
+func TestProfileDetection(t *testing.T) {
+	if profile := profileByUsbId(&common.UsbDeviceId{VendorId: 0x12d1, ProductId: 0x155e}); profile == nil || profile.Id != config.MODEM_PROFILE_HUAWEI {
+		t.Errorf("expected Huawei profile for vendor ID 12d1, got %v", profile)
+	}
+	if profile := profileByUsbId(&common.UsbDeviceId{VendorId: 0x1e0e, ProductId: 0x9001}); profile == nil || profile.Id != config.MODEM_PROFILE_SIMCOM {
+		t.Errorf("expected SIMCom profile for vendor ID 1e0e, got %v", profile)
+	}
+	if profile := profileByUsbId(&common.UsbDeviceId{VendorId: 0x1234, ProductId: 0x5678}); profile != nil {
+		t.Errorf("expected no profile for unknown vendor ID, got %v", profile)
+	}
+	if profile := profileByIdentity([]string{"Manufacturer: SIMCOM INCORPORATED", "Model: SIMCOM_SIM7600E-H", "OK"}); profile == nil || profile.Id != config.MODEM_PROFILE_SIMCOM {
+		t.Errorf("expected SIMCom profile, got %v", profile)
+	}
+	if profile := profileByIdentity([]string{"Quectel", "EC25", "Revision: EC25EFAR06A06M4G", "OK"}); profile == nil || profile.Id != config.MODEM_PROFILE_QUECTEL {
+		t.Errorf("expected Quectel profile, got %v", profile)
+	}
+	if profile := profileByIdentity([]string{"ERROR"}); profile != nil {
+		t.Errorf("expected no profile, got %v", profile)
+	}
+	if GetProfile(config.MODEM_PROFILE_AUTO).Id != config.MODEM_PROFILE_GENERIC {
+		t.Errorf("expected generic profile until the modem got detected")
+	}
+}
@@ -0,0 +1,216 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+)
+
+// ReceivedSms is a message (or part of a concatenated message) read from the modem's message storage
+type ReceivedSms struct {
+	// index of the message inside the modem's message storage, needed for deleting it
+	StorageIndex int
+	SmsDeliver
+}
+
+// ReceivedStatusReport is a delivery status report read from the modem's message storage
+type ReceivedStatusReport struct {
+	// index of the report inside the modem's message storage, needed for deleting it
+	StorageIndex int
+	SmsStatusReport
+}
+
+// regex matching a status report in a text-mode AT+CMGL listing: +CMGL: <index>,<stat>,<fo>,<mr>,[<ra>],[<tora>],<scts>,<dt>,<st>
+var textModeStatusReportRegEx = regexp.MustCompile(`^\+CMGL:\s*(\d+),"[^"]*",\d+,(\d+),"([^"]*)",\d*,"([^"]*)","([^"]*)",(\d+)`)
+
+// regex matching the header line of a text-mode AT+CMGL listing: +CMGL: <index>,<stat>,<oa>,[<alpha>],[<scts>]
+var textModeListingRegEx = regexp.MustCompile(`^\+CMGL:\s*(\d+),"([^"]*)","([^"]*)",(?:"[^"]*")?,?(?:"([^"]*)")?`)
+
+// regex matching the header line of a PDU-mode AT+CMGL listing: +CMGL: <index>,<stat>,[<alpha>],<length>
+var pduModeListingRegEx = regexp.MustCompile(`^\+CMGL:\s*(\d+),(\d+),`)
+
+func (m *serialModem) ReadMessages(ctx context.Context) ([]ReceivedSms, []ReceivedStatusReport, error) {
+
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return []ReceivedSms{}, []ReceivedStatusReport{}, nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return nil, nil, errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := m.unlockSim(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if m.modemConfig.GetSmsMode() == config.SMS_MODE_PDU {
+		err = m.switchToPdu(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		// 4 = all messages, read and unread
+		response, err := m.sendCmd(ctx, "AT+CMGL=4", true)
+		if err != nil {
+			return nil, nil, err
+		}
+		if response.isError() {
+			return nil, nil, errors.New("Listing messages failed: " + response.String())
+		}
+		messages, reports := parsePduModeListing(response)
+		return messages, reports, nil
+	}
+
+	err = m.switchToPlainText(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := m.sendCmd(ctx, "AT+CMGL=\"ALL\"", true)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.isError() {
+		return nil, nil, errors.New("Listing messages failed: " + response.String())
+	}
+	messages, reports := parseTextModeListing(response)
+	return messages, reports, nil
+}
+
+func parsePduModeListing(response ModemResponse) ([]ReceivedSms, []ReceivedStatusReport) {
+	var result []ReceivedSms
+	var reports []ReceivedStatusReport
+	for i := 0; i < len(response.Lines); i++ {
+		match := pduModeListingRegEx.FindStringSubmatch(strings.TrimSpace(response.Lines[i]))
+		if match == nil || i+1 >= len(response.Lines) {
+			continue
+		}
+		i++
+		index, _ := strconv.Atoi(match[1])
+		pdu := strings.TrimSpace(response.Lines[i])
+		mti, err := pduMessageType(pdu)
+		if err != nil {
+			log.Warn("Ignoring malformed PDU at storage index " + match[1] + ": " + err.Error())
+			continue
+		}
+		switch mti {
+		case MTI_SMS_DELIVER:
+			deliver, err := DecodeSmsDeliver(pdu)
+			if err != nil {
+				log.Warn("Ignoring undecodable PDU at storage index " + match[1] + ": " + err.Error())
+				continue
+			}
+			result = append(result, ReceivedSms{StorageIndex: index, SmsDeliver: deliver})
+		case MTI_SMS_STATUS_REPORT:
+			report, err := DecodeSmsStatusReport(pdu)
+			if err != nil {
+				log.Warn("Ignoring undecodable status report at storage index " + match[1] + ": " + err.Error())
+				continue
+			}
+			reports = append(reports, ReceivedStatusReport{StorageIndex: index, SmsStatusReport: report})
+		default:
+			log.Debug("Ignoring PDU with message type " + strconv.Itoa(mti) + " at storage index " + match[1])
+		}
+	}
+	return result, reports
+}
+
+func parseTextModeListing(response ModemResponse) ([]ReceivedSms, []ReceivedStatusReport) {
+	var result []ReceivedSms
+	var reports []ReceivedStatusReport
+	for i := 0; i < len(response.Lines); i++ {
+		line := strings.TrimSpace(response.Lines[i])
+		if reportMatch := textModeStatusReportRegEx.FindStringSubmatch(line); reportMatch != nil {
+			index, _ := strconv.Atoi(reportMatch[1])
+			reference, _ := strconv.Atoi(reportMatch[2])
+			status, _ := strconv.Atoi(reportMatch[6])
+			reports = append(reports, ReceivedStatusReport{StorageIndex: index, SmsStatusReport: SmsStatusReport{
+				Reference:     reference,
+				Recipient:     reportMatch[3],
+				Timestamp:     parseTextModeTimestamp(reportMatch[4]),
+				DischargeTime: parseTextModeTimestamp(reportMatch[5]),
+				Status:        status,
+			}})
+			continue
+		}
+		match := textModeListingRegEx.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		index, _ := strconv.Atoi(match[1])
+		if !strings.HasPrefix(match[2], "REC") {
+			// stored outgoing message
+			continue
+		}
+		// message text may span multiple lines, up to the next +CMGL or the final OK
+		var text []string
+		for i+1 < len(response.Lines) && !strings.HasPrefix(response.Lines[i+1], "+CMGL:") && response.Lines[i+1] != "OK" {
+			i++
+			text = append(text, response.Lines[i])
+		}
+		result = append(result, ReceivedSms{StorageIndex: index, SmsDeliver: SmsDeliver{
+			Sender:    match[3],
+			Timestamp: parseTextModeTimestamp(match[4]),
+			Text:      strings.Join(text, "\n"),
+		}})
+	}
+	return result, reports
+}
+
+// parseTextModeTimestamp parses timestamps like "24/10/16,10:00:00+08" (timezone in quarter hours),
+// returning the current time if the timestamp is malformed
+func parseTextModeTimestamp(s string) time.Time {
+	if len(s) < 17 {
+		return time.Now()
+	}
+	parsed, err := time.Parse("06/01/02,15:04:05", s[:17])
+	if err != nil {
+		return time.Now()
+	}
+	quarterHours, err := strconv.Atoi(s[17:])
+	if err != nil {
+		return parsed
+	}
+	return time.Date(parsed.Year(), parsed.Month(), parsed.Day(), parsed.Hour(), parsed.Minute(), parsed.Second(), 0,
+		time.FixedZone("", quarterHours*15*60))
+}
+
+func (m *serialModem) DeleteMessage(ctx context.Context, storageIndex int) error {
+
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	response, err := m.sendCmd(ctx, "AT+CMGD="+strconv.Itoa(storageIndex), true)
+	if err != nil {
+		return err
+	}
+	if response.isError() {
+		return errors.New("Deleting message #" + strconv.Itoa(storageIndex) + " failed: " + response.String())
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/serialportdiscovery"
+)
+
+// how long to wait after a reset before trying to open the serial port again,
+// the old port may still be around for a moment before the modem drops off the bus
+var resetDelay = 5 * time.Second
+
+// how long a modem may take to come back after a reset
+var resetTimeout = 60 * time.Second
+
+func (m *serialModem) Recover(ctx context.Context, step config.RecoveryStep) error {
+
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	log.Info("Recovering modem '" + m.Name() + "' using step " + step.String())
+	switch step {
+	case config.RECOVERY_STEP_REOPEN:
+		portName := m.portName
+		m.internalClose()
+		if portName == "" {
+			return m.rediscover(ctx)
+		}
+		return m.open(ctx, portName)
+	case config.RECOVERY_STEP_SOFT_RESET:
+		if m.link == nil {
+			err := m.rediscover(ctx)
+			if err != nil {
+				return errors.New("Cannot reset modem, failed to open serial port - " + err.Error())
+			}
+		}
+		// the modem restarts right away, there might not even be a response
+		_, err := m.sendCmd(ctx, "AT+CFUN=1,1", false)
+		if err != nil {
+			log.Warn("Modem '" + m.Name() + "' did not acknowledge AT+CFUN=1,1 - " + err.Error())
+		}
+		m.internalClose()
+		return m.awaitRestart(ctx)
+	case config.RECOVERY_STEP_USB_RESET:
+		portName := m.portName
+		if portName == "" {
+			var err error
+			portName, err = m.resolveSerialPort(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		if config.IsRemoteSerialPort(portName) || config.IsReplaySerialPort(portName) {
+			return errors.New("Recovery step " + step.String() + " is not supported for serial port " + portName)
+		}
+		deviceDir, err := serialportdiscovery.FindUsbDevice(portName)
+		if err != nil {
+			return err
+		}
+		m.internalClose()
+		err = serialportdiscovery.ResetUsbDevice(deviceDir)
+		if err != nil {
+			return err
+		}
+		return m.awaitRestart(ctx)
+	case config.RECOVERY_STEP_REDISCOVER:
+		m.internalClose()
+		return m.rediscover(ctx)
+	}
+	panic("Internal error, unhandled recovery step " + step.String())
+}
+
+// rediscover determines the serial port (running USB interface discovery if configured) and opens it,
+// needs to be called with the mutex held
+func (m *serialModem) rediscover(ctx context.Context) error {
+	serialDevName, err := m.resolveSerialPort(ctx)
+	if err != nil {
+		return err
+	}
+	return m.open(ctx, serialDevName)
+}
+
+// awaitRestart waits for a modem that was reset to show up again, the serial port may have changed
+// as the modem re-enumerates on the USB bus. Needs to be called with the mutex held.
+func (m *serialModem) awaitRestart(ctx context.Context) error {
+	if err := sleep(ctx, resetDelay); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(resetTimeout)
+	for {
+		err := m.rediscover(ctx)
+		if err == nil {
+			log.Info("Modem '" + m.Name() + "' is back after reset")
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("Modem did not come back within " + resetTimeout.String() + " after reset - " + err.Error())
+		}
+		if err = sleep(ctx, time.Second); err != nil {
+			return err
+		}
+	}
+}
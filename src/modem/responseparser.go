@@ -1,37 +1,26 @@
 package modem
 
 import (
-	"regexp"
+	"bytes"
+	"slices"
 	"strings"
 )
 
-// regex matching a newline sent by the modem
-var lineFeedRegEx = regexp.MustCompile("\r\n")
-
-// CharResult represents a single byte received from the modem, an error if something
+// ChunkResult represents data received from the modem, an error if something
 // went wrong during serial communication or a flag indicating no more bytes could be
 // read within the configured serial timeout.
-type CharResult struct {
-	char    byte
+type ChunkResult struct {
+	data    []byte
 	timeout bool
 	err     error
 }
 
-func (c CharResult) String() string {
-	return string(rune(c.char))
-}
-
-var _ = CharResult{}.String
-
-type CharProvider func() CharResult
+type ChunkProvider func() ChunkResult
 
 // An expectedString the parser is currently trying to match
 type expectedString struct {
 	// the expected byte sequence to match
 	expected []byte
-	// the character we're currently trying to match
-	// (index into the expected byte sequence)
-	currentIndex int
 	// the next expected strings
 	// or an empty slice if the match should be considered complete after this string has been recognized.
 	next []*expectedString
@@ -40,16 +29,22 @@ type expectedString struct {
 /*
  * Byte sequences we're looking for
  */
-var terminatingNewline = &expectedString{expected: []byte("\r\n"), currentIndex: 0, next: []*expectedString{}}
-var okMsg = &expectedString{expected: []byte("OK"), currentIndex: 0, next: []*expectedString{terminatingNewline}}
-var errorMsg = &expectedString{expected: []byte("ERROR"), currentIndex: 0, next: []*expectedString{terminatingNewline}}
-var startingNewline = &expectedString{expected: []byte("\r\n"), currentIndex: 0, next: []*expectedString{okMsg, errorMsg}}
+var terminatingNewline = &expectedString{expected: []byte("\r\n"), next: []*expectedString{}}
+var okMsg = &expectedString{expected: []byte("OK"), next: []*expectedString{terminatingNewline}}
+var errorMsg = &expectedString{expected: []byte("ERROR"), next: []*expectedString{terminatingNewline}}
+var startingNewline = &expectedString{expected: []byte("\r\n"), next: []*expectedString{okMsg, errorMsg}}
 
 type responseMatcher struct {
 	matched           []*expectedString
 	currentlyMatching *expectedString
-	buffer            strings.Builder
-	lines             []string
+	// the character we're currently trying to match
+	// (index into the expected byte sequence), kept here so that
+	// multiple modems can parse responses concurrently
+	currentIndex int
+	buffer       strings.Builder
+	lines        []string
+	// picks unsolicited result codes interleaved with the response, nil to keep all lines
+	urcs *urcAssembler
 }
 
 func (r *responseMatcher) isEmpty() bool {
@@ -62,9 +57,16 @@ func (r *responseMatcher) lastLine() string {
 
 func (r *responseMatcher) resetStateMachine() {
 	r.currentlyMatching = startingNewline
+	r.currentIndex = 0
 	r.matched = r.matched[:0]
 }
 
+// isInsideLine returns TRUE if the matcher waits for the line break ending the current line,
+// every byte but CR just gets appended to the line then
+func (r *responseMatcher) isInsideLine() bool {
+	return r.currentlyMatching == startingNewline && r.currentIndex == 0
+}
+
 func (r *responseMatcher) wasMatched(match *expectedString) bool {
 	for _, elem := range r.matched {
 		if elem == match {
@@ -74,6 +76,19 @@ func (r *responseMatcher) wasMatched(match *expectedString) bool {
 	return false
 }
 
+// hasFinalErrorResult returns TRUE if the modem sent a '+CME ERROR: <err>' or '+CMS ERROR: <err>' line,
+// those end a response just like OK or ERROR do
+func (r *responseMatcher) hasFinalErrorResult() bool {
+	lines := append(slices.Clone(r.lines), strings.Split(r.buffer.String(), "\r\n")...)
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "+CME ERROR:") || strings.HasPrefix(trimmed, "+CMS ERROR:") {
+			return true
+		}
+	}
+	return false
+}
+
 type parseState int
 
 const (
@@ -85,7 +100,7 @@ const (
 // returns TRUE if end of response has been recognized
 func (r *responseMatcher) tryMatch(data byte) parseState {
 
-	if r.currentlyMatching.currentIndex == len(r.currentlyMatching.expected) {
+	if r.currentIndex == len(r.currentlyMatching.expected) {
 		// we're past the end of the string we're currently currentlyMatching.
 
 		// check next candidates and pick the currentlyMatching one
@@ -93,7 +108,7 @@ func (r *responseMatcher) tryMatch(data byte) parseState {
 			if candidate.expected[0] == data {
 				// first char of candidate got matched
 				r.currentlyMatching = candidate
-				r.currentlyMatching.currentIndex = 1
+				r.currentIndex = 1
 				// if candidate matched only a single character and
 				// has no follow-up candidate, persist the whole tryMatch
 				if len(r.currentlyMatching.expected) == 1 && len(r.currentlyMatching.next) == 0 {
@@ -106,10 +121,10 @@ func (r *responseMatcher) tryMatch(data byte) parseState {
 		return PARSE_STATE_MATCH_FAILED
 	}
 
-	if r.currentlyMatching.expected[r.currentlyMatching.currentIndex] == data {
+	if r.currentlyMatching.expected[r.currentIndex] == data {
 		// new character matched what we were already currentlyMatching
-		r.currentlyMatching.currentIndex++
-		if r.currentlyMatching.currentIndex == len(r.currentlyMatching.expected) {
+		r.currentIndex++
+		if r.currentIndex == len(r.currentlyMatching.expected) {
 			// we've done currentlyMatching the current expectedString,
 			// remember what we've matched
 			r.matched = append(r.matched, r.currentlyMatching)
@@ -129,60 +144,127 @@ func (r *responseMatcher) flushCharBuffer() {
 
 		bufAsString := r.buffer.String()
 		r.buffer.Reset()
-		for _, line := range lineFeedRegEx.Split(bufAsString, -1) {
+		for _, line := range strings.Split(bufAsString, "\r\n") {
 			if len(strings.TrimSpace(line)) > 0 {
+				if r.urcs != nil && r.urcs.offer(line) {
+					continue
+				}
 				r.lines = append(r.lines, line)
 			}
 		}
 	}
 }
 
-func parseModemResponse(byteFromModem CharProvider, requiresOkOrError bool) ([]string, error) {
+// responseParser recognizes the end of the modem's response to a command in the data fed to it
+type responseParser struct {
+	matcher           responseMatcher
+	requiresOkOrError bool
+	// TRUE once the end of the response has been recognized
+	done bool
+}
 
-	matcher := responseMatcher{}
-	matcher.resetStateMachine()
+func newResponseParser(requiresOkOrError bool, urcs *urcAssembler) *responseParser {
+	parser := &responseParser{matcher: responseMatcher{urcs: urcs}, requiresOkOrError: requiresOkOrError}
+	parser.matcher.resetStateMachine()
+	// the response starts at the beginning of a line, just like after a newline
+	parser.matcher.currentIndex = len(startingNewline.expected)
+	return parser
+}
 
-loop:
-	for {
-		var nextChar = byteFromModem()
-		if nextChar.err != nil {
-			return nil, nextChar.err
-		}
-		if nextChar.timeout {
-			if requiresOkOrError {
-				log.Debug("Timeout but still expecting OK or ERROR, keep waiting for response")
-				continue
+// feed parses data received from the modem, returning how many bytes of it belong to the response.
+// Anything after the end of the response is left alone.
+func (p *responseParser) feed(data []byte) int {
+	for idx := 0; idx < len(data); idx++ {
+		if p.matcher.isInsideLine() {
+			// no need to run the state machine for every byte of a line
+			end := bytes.IndexByte(data[idx:], '\r')
+			if end < 0 {
+				p.matcher.buffer.Write(data[idx:])
+				return len(data)
 			}
-			break
+			p.matcher.buffer.Write(data[idx : idx+end])
+			idx += end
 		}
-		var parserState = matcher.tryMatch(nextChar.char)
-		switch parserState {
-		case PARSE_STATE_MATCH_DONE:
-			matcher.buffer.WriteByte(nextChar.char)
-			definitiveResponseEndingDetected := matcher.wasMatched(okMsg) || matcher.wasMatched(errorMsg)
-			if definitiveResponseEndingDetected {
-				// we've reached the last line of the modem's response,
-				// either <cr><lf>OK<cr><lf> or <cr><lf>ERROR<cr><lf>
-				break loop
-			}
-			// not the last line of the modem's response yet
+		if p.parseByte(data[idx]) {
+			p.done = true
+			return idx + 1
+		}
+	}
+	return len(data)
+}
+
+// parseByte runs the state machine for a single byte, returns TRUE if the end of the response has been recognized
+func (p *responseParser) parseByte(char byte) bool {
+	matcher := &p.matcher
+	switch matcher.tryMatch(char) {
+	case PARSE_STATE_MATCH_DONE:
+		matcher.buffer.WriteByte(char)
+		definitiveResponseEndingDetected := matcher.wasMatched(okMsg) || matcher.wasMatched(errorMsg)
+		if definitiveResponseEndingDetected {
+			// we've reached the last line of the modem's response,
+			// either <cr><lf>OK<cr><lf> or <cr><lf>ERROR<cr><lf>
+			return true
+		}
+		// not the last line of the modem's response yet
+		matcher.flushCharBuffer()
+		if !matcher.isEmpty() && strings.Contains(matcher.lastLine(), "ERROR") {
+			return true
+		}
+		matcher.resetStateMachine()
+	case PARSE_STATE_MATCH_CONTINUE:
+		if matcher.currentlyMatching == startingNewline && matcher.currentIndex == 1 {
+			// we've just matched the first character of the starting newline, flush
+			// any characters we've already accumulated before continuing
 			matcher.flushCharBuffer()
-			if !matcher.isEmpty() && strings.Contains(matcher.lastLine(), "ERROR") {
-				break loop
-			}
-			matcher.resetStateMachine()
-		case PARSE_STATE_MATCH_CONTINUE:
-			if matcher.currentlyMatching == startingNewline && matcher.currentlyMatching.currentIndex == 1 {
-				// we've just matched the first character of the starting newline, flush
-				// any characters we've already accumulated before continuing
-				matcher.flushCharBuffer()
+		}
+		matcher.buffer.WriteByte(char)
+	case PARSE_STATE_MATCH_FAILED:
+		matcher.resetStateMachine()
+		if char == startingNewline.expected[0] {
+			// the character that broke the match may start the next newline
+			matcher.currentIndex = 1
+			matcher.flushCharBuffer()
+		}
+		matcher.buffer.WriteByte(char)
+	}
+	return false
+}
+
+// timedOut is called when the modem stayed silent for the read timeout, returns TRUE if the response is complete anyway
+func (p *responseParser) timedOut() bool {
+	if p.requiresOkOrError && !p.matcher.hasFinalErrorResult() {
+		log.Debug("Timeout but still expecting OK or ERROR, keep waiting for response")
+		return false
+	}
+	return true
+}
+
+func (p *responseParser) lines() []string {
+	p.matcher.flushCharBuffer()
+	return p.matcher.lines
+}
+
+// parseModemResponse reads the modem's response to a command until the final result code or,
+// if requiresOkOrError is FALSE, until the modem stays silent for the read timeout.
+// Unsolicited result codes the modem sends while responding are handed to urcs (if not nil) and left out of the response.
+// Returns the response lines and whatever the modem sent after the final result code.
+func parseModemResponse(chunkFromModem ChunkProvider, requiresOkOrError bool, urcs *urcAssembler) ([]string, []byte, error) {
+
+	parser := newResponseParser(requiresOkOrError, urcs)
+	for {
+		chunk := chunkFromModem()
+		if chunk.err != nil {
+			return nil, nil, chunk.err
+		}
+		if chunk.timeout {
+			if parser.timedOut() {
+				return parser.lines(), nil, nil
 			}
-			matcher.buffer.WriteByte(nextChar.char)
-		case PARSE_STATE_MATCH_FAILED:
-			matcher.buffer.WriteByte(nextChar.char)
-			matcher.resetStateMachine()
+			continue
+		}
+		consumed := parser.feed(chunk.data)
+		if parser.done {
+			return parser.lines(), chunk.data[consumed:], nil
 		}
 	}
-	matcher.flushCharBuffer()
-	return matcher.lines, nil
 }
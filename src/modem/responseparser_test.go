@@ -1,6 +1,9 @@
 package modem
 
 import (
+	"bytes"
+	"slices"
+	"strconv"
 	"strings"
 	"testing"
 )
@@ -13,31 +16,40 @@ func encode(s string) string {
 }
 
 func runTest(input string, expected []string, requiresOkOrError bool, t *testing.T) {
+	runTestWithUrcs(input, expected, requiresOkOrError, nil, t)
+}
+
+// chunkProvider hands out data in chunks of the given size, reporting a timeout once all data got handed out
+func chunkProvider(data []byte, chunkSize int) ChunkProvider {
+	return func() ChunkResult {
+		if len(data) == 0 {
+			return ChunkResult{data: nil, timeout: true, err: nil}
+		}
+		chunk := data[:min(chunkSize, len(data))]
+		data = data[len(chunk):]
+		return ChunkResult{data: chunk, timeout: false, err: nil}
+	}
+}
+
+func runTestWithUrcs(input string, expected []string, requiresOkOrError bool, urcs *urcAssembler, t *testing.T) {
 
 	println("Testing: " + encode(input))
 
 	testData := []byte(decode(input))
-	currentIndex := 0
-
-	var charProvider = func() CharResult {
-		if currentIndex == len(testData) {
-			return CharResult{char: 0x00, timeout: true, err: nil}
+	// the modem's response may get split anywhere
+	for _, chunkSize := range []int{1, 3, len(testData) + 1} {
+		lines, _, err := parseModemResponse(chunkProvider(testData, chunkSize), requiresOkOrError, urcs)
+		if err != nil {
+			t.Errorf("failed to parse response: %s", err.Error())
+			continue
 		}
-		c := testData[currentIndex]
-		currentIndex++
-		return CharResult{char: c, timeout: false, err: nil}
-	}
-	lines, err := parseModemResponse(charProvider, requiresOkOrError)
-	if err != nil {
-		t.Errorf("failed to parse response: %s", err.Error())
-	} else {
 		if len(lines) != len(expected) {
-			t.Errorf("wrong number of lines, expected %d, got %d", len(expected), len(lines))
+			t.Errorf("chunk size %d: wrong number of lines, expected %d, got %d", chunkSize, len(expected), len(lines))
+			continue
 		}
 		for i, line := range lines {
-			println("GOT: >" + line + "<")
 			if line != expected[i] {
-				t.Errorf("wrong line, expected : %s\n, got : %s", encode(expected[i]), encode(line))
+				t.Errorf("chunk size %d: wrong line, expected : %s\n, got : %s", chunkSize, encode(expected[i]), encode(line))
 			}
 		}
 	}
@@ -52,9 +64,92 @@ func TestParse(t *testing.T) {
 	runTest("test\r\ntest\r\n", []string{"test", "test"}, false, t)
 	runTest("OK\r\ntest\r\n", []string{"OK"}, true, t)
 	runTest("ERROR\r\ntest\r\n", []string{"ERROR"}, false, t)
+	runTest("\r\n+CME ERROR: 16\r\n", []string{"+CME ERROR: 16"}, true, t)
+	runTest("\r\n+CMS ERROR: 500\r\n", []string{"+CMS ERROR: 500"}, true, t)
 
 	s := "<CR><LF>+CGDCONT: (1-11),\"IP\",,,(0-2),(0-3),(0,1),(0,1)<CR><LF>+CGDCONT: (1-11),\"PPP\",,,(0-2),(0-3),(0,1),(0,1)<CR><LF><CR><LF><CR><LF>OK<CR><LF>"
 	runTest(s, []string{"+CGDCONT: (1-11),\"IP\",,,(0-2),(0-3),(0,1),(0,1)",
 		"+CGDCONT: (1-11),\"PPP\",,,(0-2),(0-3),(0,1),(0,1)",
 		"OK"}, true, t)
 }
+
+func TestParseLeavesDataAfterFinalResult(t *testing.T) {
+	urc := []byte("\r\n+CMTI: \"SM\",3\r\n")
+	input := append([]byte("\r\n+CSQ: 20,99\r\n\r\nOK\r\n"), urc...)
+	for _, chunkSize := range []int{1, 7, len(input)} {
+		var remaining []byte
+		next := chunkProvider(input, chunkSize)
+		lines, rest, err := parseModemResponse(func() ChunkResult {
+			chunk := next()
+			remaining = chunk.data
+			return chunk
+		}, true, nil)
+		if err != nil || !slices.Equal(lines, []string{"+CSQ: 20,99", "OK"}) {
+			t.Errorf("chunk size %d: unexpected response %q / %v", chunkSize, lines, err)
+		}
+		// the rest of the chunk containing the final result code is handed back
+		if !bytes.HasSuffix(remaining, rest) || !bytes.HasPrefix(urc, rest) {
+			t.Errorf("chunk size %d: unexpected remaining data %q", chunkSize, rest)
+		}
+		// reading everything at once must not lose any of the unsolicited result code
+		if chunkSize == len(input) && !bytes.Equal(rest, urc) {
+			t.Errorf("expected %q to be handed back, got %q", urc, rest)
+		}
+	}
+}
+
+// messageListing returns the response to AT+CMGL=4 listing the given number of messages
+func messageListing(count int) []byte {
+	var sb strings.Builder
+	for i := 0; i < count; i++ {
+		sb.WriteString("\r\n+CMGL: " + strconv.Itoa(i) + ",1,,37\r\n" +
+			"07911326040000F0040B911346610089F60000208062917314080CC8F71D14969741F977FD07\r\n")
+	}
+	sb.WriteString("\r\nOK\r\n")
+	return []byte(sb.String())
+}
+
+func BenchmarkParseMessageListing(b *testing.B) {
+	listing := messageListing(50)
+	b.SetBytes(int64(len(listing)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// the serial link's reader receives up to 256 bytes at once
+		lines, _, err := parseModemResponse(chunkProvider(listing, 256), true, nil)
+		if err != nil || len(lines) != 101 {
+			b.Fatalf("unexpected response with %d lines / %v", len(lines), err)
+		}
+	}
+}
+
+func TestParseSkipsUnsolicitedResultCodes(t *testing.T) {
+	subscription := SubscribeUrcs()
+	defer subscription.Close()
+
+	urcs := &urcAssembler{modemName: "test", cmd: "AT+CSQ"}
+	runTestWithUrcs("<CR><LF>+CMTI: \"SM\",3<CR><LF><CR><LF>+CSQ: 20,99<CR><LF>^RSSI: 20<CR><LF><CR><LF>OK<CR><LF>",
+		[]string{"+CSQ: 20,99", "OK"}, true, urcs, t)
+	runTestWithUrcs("<CR><LF>+CMT: ,24<CR><LF>07911326040000F0<CR><LF><CR><LF>OK<CR><LF>", []string{"OK"}, true, urcs, t)
+
+	var received []string
+	for len(subscription.C) > 0 {
+		urc := <-subscription.C
+		if urc.Modem == "test" {
+			received = append(received, urc.Line)
+		}
+	}
+	// runTestWithUrcs parses every response three times, split into chunks of different sizes
+	expected := append(slices.Repeat([]string{"+CMTI: \"SM\",3", "^RSSI: 20"}, 3), slices.Repeat([]string{"+CMT: ,24\r\n07911326040000F0"}, 3)...)
+	if !slices.Equal(received, expected) {
+		t.Errorf("expected URCs %q, got %q", expected, received)
+	}
+}
+
+func TestIsUrc(t *testing.T) {
+	if isUrc("+CREG: 0,1", "AT+CREG?") || !isUrc("+CREG: 1", "AT+CSQ") || !isUrc("RING", "") {
+		t.Errorf("+CREG must only be unsolicited while another command is running")
+	}
+	if isUrc("+CSQ: 20,99", "AT+CSQ") || isUrc("OK", "AT") {
+		t.Errorf("responses must not be unsolicited")
+	}
+}
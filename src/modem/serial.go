@@ -0,0 +1,820 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/serialportdiscovery"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+// serialModem talks to a modem using AT commands via a serial port
+type serialModem struct {
+	appConfig   *config.Config
+	appState    *state.State
+	modemConfig config.ModemConfig
+
+	mutex sync.Mutex
+	link  *serialLink
+	// serial port opened most recently, "" if the port was never opened
+	portName string
+	// lock file of the serial port while it is open, nil for remote ports or if it could not be created
+	portLock *serialportdiscovery.PortLock
+	// vendor profile, detected when opening the serial port
+	profile     *Profile
+	diagnostics diagnosticsCache
+	pins        pinGuard
+	// records everything sent to and received from the modem, nil if [modem] transcriptFile is not set
+	transcript *transcriptRecorder
+	// how many sessions of a replay://<file> serial port got replayed already
+	replayedSessions int
+}
+
+func newSerialModem(appConfig *config.Config, appState *state.State, modemConfig config.ModemConfig) *serialModem {
+	result := &serialModem{appConfig: appConfig, appState: appState, modemConfig: modemConfig, profile: GetProfile(modemConfig.GetProfile())}
+	if path := modemConfig.GetTranscriptFile(); path != "" {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(appConfig.GetDataDirectory(), path)
+		}
+		result.transcript = newTranscriptRecorder(path, modemConfig.GetTranscriptMaxSize())
+	}
+	return result
+}
+
+func (m *serialModem) Name() string {
+	return m.modemConfig.GetName()
+}
+
+func (m *serialModem) GetConfig() config.ModemConfig {
+	return m.modemConfig
+}
+
+type ModemResponse struct {
+	Lines []string
+}
+
+func (r *ModemResponse) String() string {
+	var sb strings.Builder
+	for i, line := range r.Lines {
+		sb.WriteString(line)
+		if i+1 < len(r.Lines) {
+			sb.WriteString("\n")
+		}
+	}
+	return sb.String()
+}
+
+func (r *ModemResponse) getLineByPrefix(prefix string) *string {
+	for _, line := range r.Lines {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, prefix) {
+			return &trimmed
+		}
+	}
+	return nil
+}
+
+// regex matching an extended AT command, capturing its name
+var atCmdRegEx = regexp.MustCompile("^AT\\+([A-Z]+).*$")
+
+func (r *ModemResponse) getResponseLineFor(fullAtCmd string) *string {
+
+	// fullAtCmd: AT+stuff[?)....
+	// response: AT+stuff:......
+	// OR
+	// +CME....
+
+	atCmd := atCmdRegEx.FindStringSubmatch(fullAtCmd)
+	if atCmd == nil || len(atCmd) != 2 {
+		panic("getResponseLineFor() function does not know how to handle AT command " + fullAtCmd)
+	}
+	var linePrefix = "+" + atCmd[1]
+	log.Debug("Looking for line with prefix '" + linePrefix + "'")
+	return r.getLineByPrefix(linePrefix)
+}
+
+func (r *ModemResponse) isError() bool {
+	return !r.isOK()
+}
+
+func (r *ModemResponse) isOK() bool {
+	if r.Lines == nil || len(r.Lines) == 0 {
+		return false
+	}
+	for _, line := range r.Lines {
+		if line == "OK" {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ModemResponse) IsEmpty() bool {
+	return r.Size() == 0
+}
+
+func (r *ModemResponse) Size() int {
+	if r.Lines == nil || len(r.Lines) == 0 {
+		return 0
+	}
+	return len(r.Lines)
+}
+
+func (m *serialModem) queryPinState(ctx context.Context) (ModemPinState, error) {
+
+	log.Debug("Querying SIM card PIN state...")
+	response, err := m.sendCmd(ctx, "AT+CPIN?", false)
+	if err != nil {
+		return MODEM_PIN_SERIAL_ERROR, err
+	}
+
+	log.Debug("Querying SIM card PIN state yielded " + response.String())
+
+	/*
+		+CPIN: READY: The SIM card is ready for use, and no PIN is required. This means the card is either unlocked or has no PIN enabled.
+		+CPIN: SIM PIN: The SIM card is inserted, but it is locked and requires the PIN to be entered. You must send the AT+CPIN="<pin>" command to unlock it before you can use the modem for data services.
+		+CPIN: SIM PUK: The SIM card has been locked due to three consecutive incorrect PIN entries. It now requires the PIN Unblocking Key (PUK) to be entered.
+		+CME ERROR: 10: This indicates that the SIM card is not inserted or is not detected by the modem.
+	*/
+	line := response.getResponseLineFor("AT+CPIN")
+
+	if line != nil {
+		log.Debug("CPIN response:" + *line)
+		if strings.Contains(*line, "READY") {
+			log.Debug("SIM card PIN is unlocked")
+			return MODEM_PIN_NOT_REQUIRED, nil
+		}
+		if strings.Contains(*line, "SIM PIN") {
+			log.Info("SIM card needs PIN")
+			return MODEM_PIN_REQUIRED, nil
+		}
+		if strings.Contains(*line, "SIM PUK") {
+			log.Warn("SIM card needs PUK")
+			return MODEM_PIN_PUK_REQUIRED, nil
+		}
+	} else {
+		log.Warn("Failed to find CPIN response, looking for +CME")
+		line = response.getLineByPrefix("+CME ERROR")
+		if line != nil {
+			return MODEM_PIN_RESPONSE_NOT_RECOGNIZED, errors.New("Modem sent an error in reply to AT+CPIN?:  " + response.String())
+		}
+	}
+	return MODEM_PIN_RESPONSE_NOT_RECOGNIZED, errors.New("Modem sent unexpected response to AT+CPIN?: " + response.String())
+}
+
+// queryRetries reads the remaining PIN and PUK attempts using AT+CPINR or, if the modem does not support it,
+// Huawei's AT^CPIN? (Huawei profile only). Attempts the modem does not report are -1. Needs to be called with the mutex held.
+func (m *serialModem) queryRetries(ctx context.Context) (int, int, error) {
+	response, err := m.sendCmd(ctx, "AT+CPINR", true)
+	if err != nil {
+		return -1, -1, err
+	}
+	if response.isOK() {
+		if pin, puk := parseCpinr(response.Lines); pin >= 0 || puk >= 0 {
+			return pin, puk, nil
+		}
+	}
+	if m.profile.HuaweiCmds {
+		response, err = m.sendCmd(ctx, "AT^CPIN?", true)
+		if err != nil {
+			return -1, -1, err
+		}
+		if response.isOK() {
+			pin, puk := parseHuaweiCpin(response.Lines)
+			return pin, puk, nil
+		}
+	}
+	log.Debug("Modem '" + m.Name() + "' does not report the remaining PIN/PUK attempts")
+	return -1, -1, nil
+}
+
+func (m *serialModem) sendPin(ctx context.Context, pin string) error {
+	resp, err := m.sendCmd(ctx, "AT+CPIN=\""+pin+"\"", true)
+	if err != nil {
+		return errors.New("Failed to send PIN to modem: " + err.Error())
+	}
+	if resp.isError() {
+		m.pins.rejectedPin = pin
+		return errors.New("Unlocking PIN returned error response: " + resp.String())
+	}
+	log.Info("Successfully unlocked modem using PIN")
+	return nil
+}
+
+func (m *serialModem) unlockSim(ctx context.Context) error {
+
+	pinState, err := m.queryPinState(ctx)
+	if err != nil {
+		return err
+	}
+	switch pinState {
+	case MODEM_PIN_NOT_REQUIRED:
+		return nil
+	case MODEM_PIN_REQUIRED:
+		pin := m.modemConfig.GetSimPin()
+		if err = m.pins.checkPin(pin); err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		pinRetries, _, err := m.queryRetries(ctx)
+		if err != nil {
+			return err
+		}
+		if err = checkRetries(pinRetries, "PIN"); err != nil {
+			log.Error(err.Error())
+			return err
+		}
+		return m.sendPin(ctx, pin)
+	case MODEM_PIN_PUK_REQUIRED:
+		log.Error("Modem requires PUK, please unlock SIM card using the /sim/unlock REST endpoint or manually using AT+CPIN=\"<puk>\",\"<new pin>\"")
+		return newPukRequiredError()
+	case MODEM_PIN_SERIAL_ERROR:
+		return errors.New("Unlocking SIM card failed due to a serial error")
+	case MODEM_PIN_RESPONSE_NOT_RECOGNIZED:
+		return errors.New("Not sure whether SIM card unlocking succeeded, unexpected response to AT command.")
+	}
+	return nil
+}
+
+func (m *serialModem) GetSimStatus(ctx context.Context) (SimStatus, error) {
+
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return SimStatus{PinState: MODEM_PIN_NOT_REQUIRED, PinRetries: -1, PukRetries: -1}, nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return SimStatus{}, errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return SimStatus{}, err
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	pinState, err := m.queryPinState(ctx)
+	if err != nil {
+		return SimStatus{}, err
+	}
+	pinRetries, pukRetries, err := m.queryRetries(ctx)
+	if err != nil {
+		return SimStatus{}, err
+	}
+	return SimStatus{PinState: pinState, PinRetries: pinRetries, PukRetries: pukRetries}, nil
+}
+
+func (m *serialModem) UnlockSimWithPuk(ctx context.Context, puk string, newPin string) error {
+
+	if err := ValidateSimCodes(puk, newPin); err != nil {
+		return err
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	pinState, err := m.queryPinState(ctx)
+	if err != nil {
+		return err
+	}
+	if pinState != MODEM_PIN_PUK_REQUIRED {
+		return errors.New("SIM card does not require the PUK, PIN state is " + pinState.String())
+	}
+	_, pukRetries, err := m.queryRetries(ctx)
+	if err != nil {
+		return err
+	}
+	if err = checkRetries(pukRetries, "PUK"); err != nil {
+		log.Error(err.Error())
+		return err
+	}
+	resp, err := m.sendCmd(ctx, "AT+CPIN=\""+puk+"\",\""+newPin+"\"", true)
+	if err != nil {
+		return errors.New("Failed to send PUK to modem: " + err.Error())
+	}
+	if resp.isError() {
+		return errors.New("Unlocking SIM card using PUK returned error response: " + resp.String())
+	}
+	m.pins.rejectedPin = ""
+	log.Info("Successfully unlocked SIM card of modem '" + m.Name() + "' using PUK")
+	if newPin != m.modemConfig.GetSimPin() {
+		log.Warn("New PIN of modem '" + m.Name() + "' differs from [modem] simPin, please update the configuration")
+	}
+	return nil
+}
+
+func (m *serialModem) sendBytes(ctx context.Context, bytes []byte, cmd string, requiresOkOrError bool) ([]string, error) {
+	res, err := m.link.execute(ctx, bytes, cmd, requiresOkOrError)
+	if err != nil {
+		log.Error("Closing serial port due to error " + err.Error())
+		m.internalClose()
+		return res, err
+	}
+	if log.IsDebugEnabled() {
+		log.Debug("sendBytes(): Modem response:\n" + strings.Join(res, "\n"))
+	}
+	return res, nil
+}
+
+func (m *serialModem) sendCmd(ctx context.Context, cmd string, requiresOkOrError bool) (ModemResponse, error) {
+
+	if m.link == nil {
+		panic("Serial port not open?")
+	}
+
+	if strings.TrimSpace(cmd) == "" {
+		return ModemResponse{Lines: []string{}}, errors.New("Command string cannot be blank or empty")
+	}
+	log.Debug("Sending AT command: '" + cmd + "'")
+	data := cmd
+	if data[len(data)-1] != '\r' {
+		data = data + "\r"
+	}
+
+	lines, err := m.sendBytes(ctx, []byte(data), strings.TrimSpace(cmd), requiresOkOrError)
+	if err != nil {
+		var timeoutErr *TimeoutError
+		if errors.As(err, &timeoutErr) || ctx.Err() != nil {
+			return ModemResponse{Lines: []string{}}, err
+		}
+		return ModemResponse{Lines: []string{}}, errors.New("Failed to send bytes - " + err.Error())
+	}
+	return ModemResponse{Lines: lines}, nil
+}
+
+func (m *serialModem) switchToPlainText(ctx context.Context) error {
+	// switch modem to plain-text mode
+	// AT+CMGF=1
+	resp, err := m.sendCmd(ctx, "AT+CMGF=1", true)
+	if err != nil {
+		return err
+	}
+	if resp.isError() {
+		return errors.New("Failed to switch modem to plain-text mode: " + resp.String())
+	}
+	return nil
+}
+
+func (m *serialModem) switchToPdu(ctx context.Context) error {
+	// switch modem to PDU mode
+	// AT+CMGF=0
+	resp, err := m.sendCmd(ctx, "AT+CMGF=0", true)
+	if err != nil {
+		return err
+	}
+	if resp.isError() {
+		return errors.New("Failed to switch modem to PDU mode: " + resp.String())
+	}
+	return nil
+}
+
+// sendMessageBody waits for the '>' prompt in response to AT+CMGS and then sends the message body,
+// terminated by CTRL-Z
+func (m *serialModem) sendMessageBody(ctx context.Context, recipient string, cmgsCmd string, body []byte) SendResult {
+
+	response, err := m.sendCmd(ctx, cmgsCmd, false)
+	if err != nil {
+		log.Error("Failed to send sms to " + recipient + ": " + err.Error())
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+	}
+	if response.IsEmpty() || response.Size() != 1 || response.Lines[0] != "> " {
+		log.Error("Failed to send sms to " + recipient + ": Expected '>' but got '" + response.String() + "'")
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: "Unrecognized modem response, expected '>'"}
+	}
+	toSent := append([]byte{}, body...)
+	toSent = append(toSent, 0x1a) // message needs to be terminated with CTRL-Z (0x1a)
+	responseLines, err := m.sendBytes(ctx, toSent, cmgsCmd, true)
+	if err != nil {
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+	}
+	response = ModemResponse{Lines: responseLines}
+	log.Debug("Modem response: '" + response.String() + "'")
+	if !response.isOK() {
+		if modemErr := response.getModemError(); modemErr != nil {
+			log.Error("Failed to send sms to " + recipient + ": " + modemErr.Error() + ", " + modemErr.Classification() + " failure")
+			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: modemErr.Error(), Error: modemErr}
+		}
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: response.String()}
+	}
+	submission := Submission{Recipient: recipient, Reference: parseMessageReference(response)}
+	return SendResult{Success: true, Reason: MODEM_ERR_NONE, Details: "success", SegmentsSent: 1, Submissions: []Submission{submission}}
+}
+
+// parseMessageReference extracts <mr> from a '+CMGS: <mr>' response, returning -1 if not found
+func parseMessageReference(response ModemResponse) int {
+	line := response.getLineByPrefix("+CMGS:")
+	if line == nil {
+		log.Warn("Modem did not return a message reference: " + response.String())
+		return -1
+	}
+	reference, err := strconv.Atoi(strings.TrimSpace((*line)[6:]))
+	if err != nil {
+		log.Warn("Modem returned a malformed message reference: " + *line)
+		return -1
+	}
+	return reference
+}
+
+// enableStatusReports makes the SMS service centre send delivery status reports and
+// the modem store them so that they can be listed using AT+CMGL
+func (m *serialModem) enableStatusReports(ctx context.Context, pduMode bool) error {
+	if !pduMode {
+		// first octet 49 = SMS-SUBMIT, relative validity period, status report requested; validity 170 = 4 days
+		resp, err := m.sendCmd(ctx, "AT+CSMP=49,170,0,0", true)
+		if err != nil {
+			return err
+		}
+		if resp.isError() {
+			return errors.New("Failed to request status reports: " + resp.String())
+		}
+	}
+	// indicate new messages (+CMTI) and status reports (+CDSI), store both in memory
+	resp, err := m.sendCmd(ctx, "AT+CNMI=2,1,0,2,0", true)
+	if err != nil {
+		return err
+	}
+	if resp.isError() {
+		return errors.New("Failed to configure status report storage: " + resp.String())
+	}
+	return nil
+}
+
+func (m *serialModem) sendTextModeSms(ctx context.Context, recipient string, message string) SendResult {
+	log.Debug("Sending actual message: '" + message + "'")
+	return m.sendMessageBody(ctx, recipient, "AT+CMGS=\""+recipient+"\"", []byte(message))
+}
+
+func (m *serialModem) sendPduModeSms(ctx context.Context, recipient string, segments []string, coding DataCoding, reference int) SendResult {
+	pdus, err := EncodeConcatenatedSmsSubmit(recipient, segments, coding, reference, m.appConfig.GetConcatReferenceBits(),
+		m.appConfig.IsDeliveryReports())
+	if err != nil {
+		log.Error("Failed to encode sms to " + recipient + ": " + err.Error())
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+	}
+	var submissions []Submission
+	for idx, pdu := range pdus {
+		log.Debug("Sending segment " + strconv.Itoa(idx+1) + "/" + strconv.Itoa(len(pdus)) + ": '" + segments[idx] +
+			"' as " + pdu.Coding.String() + " PDU " + pdu.Hex())
+		result := m.sendMessageBody(ctx, recipient, "AT+CMGS="+strconv.Itoa(pdu.TpduLength), []byte(pdu.Hex()))
+		submissions = append(submissions, result.Submissions...)
+		if !result.Success {
+			result.SegmentsSent = len(submissions)
+			result.Submissions = submissions
+			return result
+		}
+	}
+	return SendResult{Success: true, Reason: MODEM_ERR_NONE, Details: "success", SegmentsSent: len(submissions), Submissions: submissions}
+}
+
+func (m *serialModem) SendSms(ctx context.Context, message string, recipients []string) SendResult {
+	result := m.internalSendSms(ctx, message, recipients)
+	if !result.Success {
+		if result.Reason == MODEM_ERR_MODEM_ERROR {
+			m.Close()
+		}
+	}
+	return result
+}
+
+func (m *serialModem) GetConnectionStatus(ctx context.Context) (ConnectionStatus, error) {
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return CON_STATUS_REGISTERED_HOME, nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return CON_STATUS_UNKNOWN, errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return CON_STATUS_UNKNOWN, err
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.queryConnectionStatus(ctx)
+}
+
+func (m *serialModem) Probe(ctx context.Context) (ConnectionStatus, error) {
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return CON_STATUS_REGISTERED_HOME, nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return CON_STATUS_UNKNOWN, errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return CON_STATUS_UNKNOWN, err
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	response, err := m.sendCmd(ctx, "AT", true)
+	if err != nil {
+		return CON_STATUS_UNKNOWN, err
+	}
+	if response.isError() {
+		return CON_STATUS_UNKNOWN, errors.New("Modem did not answer AT with OK: '" + response.String() + "'")
+	}
+	return m.queryConnectionStatus(ctx)
+}
+
+// queryConnectionStatus unlocks the SIM card if necessary and queries the network registration using the profile's
+// registration commands, needs to be called with the mutex held
+func (m *serialModem) queryConnectionStatus(ctx context.Context) (ConnectionStatus, error) {
+
+	err := m.unlockSim(ctx)
+	if err != nil {
+		return CON_STATUS_UNKNOWN, err
+	}
+
+	// LTE-only modems may report a registration via AT+CEREG? but not via AT+CREG?
+	result := CON_STATUS_UNKNOWN
+	for idx, cmd := range m.getRegistrationCmds() {
+		response, err := m.sendCmd(ctx, cmd, true)
+		if err != nil {
+			return CON_STATUS_UNKNOWN, err
+		}
+		if idx > 0 && response.isError() {
+			log.Debug("Modem '" + m.Name() + "' does not support " + cmd + ": " + response.String())
+			continue
+		}
+		status, err := parseRegistration(response, cmd)
+		if err != nil {
+			return CON_STATUS_UNKNOWN, err
+		}
+		if status.IsRegistered() {
+			return status, nil
+		}
+		if idx == 0 {
+			result = status
+		}
+	}
+	return result, nil
+}
+
+// parseRegistration parses the response to AT+CREG?, AT+CGREG?, AT+CEREG? or AT+C5GREG?
+func parseRegistration(response ModemResponse, cmd string) (ConnectionStatus, error) {
+	/*
+			 * +CREG: <n>,<stat>[,<lac>,<ci>,<AcT>]
+			 *
+			 * <stat> (Status): A numeric value indicating the current network registration status.
+			 *
+		     * 0: Not registered. The modem isn't currently searching for a new operator.
+			 * 1: Registered to the home network.
+			 * 2: Not registered, but the modem is searching for an operator to register to.
+			 * 3: Registration denied.
+			 * 4: Unknown. For example, out of coverage.
+			 * 5: Registered and roaming.
+	*/
+	prefix := "+" + strings.TrimSuffix(strings.TrimPrefix(cmd, "AT+"), "?") + ":"
+	line := response.getLineByPrefix(prefix)
+	log.Debug("Modem response to " + cmd + ": " + response.String())
+	if line == nil {
+		msg := "Unrecognized modem response (1)"
+		log.Error(msg)
+		return CON_STATUS_UNKNOWN, errors.New(msg)
+	}
+	parts := strings.Split(strings.TrimSpace((*line)[len(prefix):]), ",")
+	if len(parts) < 2 {
+		msg := "Unrecognized modem response (2)"
+		log.Error(msg)
+		return CON_STATUS_UNKNOWN, errors.New(msg)
+	}
+	code, err := strconv.Atoi(parts[1])
+	if err != nil {
+		msg := "Unrecognized modem response (3)"
+		log.Error(msg)
+		return CON_STATUS_UNKNOWN, errors.New(msg)
+	}
+	log.Debug("Modem response code: " + strconv.Itoa(code))
+
+	switch code {
+	case 0:
+		return CON_STATUS_NOT_REGISTERED_NOT_SEARCHING, nil
+	case 1:
+		return CON_STATUS_REGISTERED_HOME, nil
+	case 2:
+		return CON_STATUS_NOT_REGISTERED_SEARCHING, nil
+	case 3:
+		return CON_STATUS_NOT_REGISTERED_DENIED, nil
+	case 4:
+		return CON_STATUS_UNKNOWN, nil
+	case 5:
+		return CON_STATUS_REGISTERED_ROAMING, nil
+	default:
+		msg := "Modem returned unknown result code " + strconv.Itoa(code)
+		log.Error(msg)
+		return CON_STATUS_UNKNOWN, errors.New(msg)
+	}
+}
+
+func (m *serialModem) internalSendSms(ctx context.Context, message string, recipients []string) SendResult {
+
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		log.Warn("Not actually sending SMS, DEBUG_FLAG_MODEM_ALWAYS_SUCCEED is set")
+		log.Warn("Message: >" + message + "<")
+		segments, _, _ := splitMessage(m.appConfig, m.modemConfig.GetSmsMode(), message)
+		segmentsSent := len(segments) * len(recipients)
+		return SendResult{Success: true, Reason: MODEM_ERR_NONE, Details: "fake success (debug mode)", SegmentsSent: segmentsSent,
+			CompletedRecipients: recipients}
+	}
+
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		log.Warn("Not actually sending SMS, DEBUG_FLAG_MODEM_ALWAYS_FAIL is set")
+		log.Warn("Message: >" + message + "<")
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: "fake modem failure (debug mode)"}
+	}
+
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := m.unlockSim(ctx)
+	if err != nil {
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error(), Error: asModemError(err)}
+	}
+
+	// switch modem to plain-text or PDU mode
+	// so AT+CMGS works
+	pduMode := m.modemConfig.GetSmsMode() == config.SMS_MODE_PDU
+	if pduMode {
+		err = m.switchToPdu(ctx)
+	} else {
+		err = m.switchToPlainText(ctx)
+	}
+	if err != nil {
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+	}
+
+	if m.appConfig.IsDeliveryReports() {
+		err = m.enableStatusReports(ctx, pduMode)
+		if err != nil {
+			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error()}
+		}
+	}
+
+	return sendToRecipients(ctx, m.appConfig, m.appState, m.modemConfig, message, recipients, func(ctx context.Context, recipient string, segments []string, coding DataCoding, reference int) SendResult {
+		if pduMode {
+			return m.sendPduModeSms(ctx, recipient, segments, coding, reference)
+		}
+		return m.sendTextModeSms(ctx, recipient, segments[0])
+	})
+}
+
+func (m *serialModem) Init(ctx context.Context) error {
+
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) || m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		log.Warn("Not initializing modem because of DEBUG_FLAG_MODEM_ALWAYS_FAIL / DEBUG_FLAG_MODEM_ALWAYS_SUCCEED")
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	serialDevName, err := m.resolveSerialPort(ctx)
+	if err != nil {
+		return err
+	}
+	return m.open(ctx, serialDevName)
+}
+
+// open opens the serial port and runs the init commands, needs to be called with the mutex held.
+// The mutex gets released while waiting for a busy serial port, see claimConfiguredPort().
+func (m *serialModem) open(ctx context.Context, serialDevName string) error {
+
+	log.Debug("Initializing modem '" + m.Name() + "' on port " + serialDevName + ", baud rate " + strconv.Itoa(m.modemConfig.GetSerialSpeed()))
+
+	// Open the serial port (or connect to the serial server, or replay a transcript)
+	var port transport
+	var err error
+	if config.IsReplaySerialPort(serialDevName) {
+		port, err = openReplayTransport(strings.TrimPrefix(serialDevName, config.SERIAL_PORT_REPLAY_PREFIX), m.replayedSessions)
+		m.replayedSessions++
+	} else {
+		var lock *serialportdiscovery.PortLock
+		port, lock, err = m.claimConfiguredPort(ctx, serialDevName)
+		if errors.Is(err, errPortOpenedMeanwhile) {
+			log.Debug("Serial port of modem '" + m.Name() + "' got opened while waiting for " + serialDevName)
+			return nil
+		}
+		m.portLock = lock
+	}
+	if err != nil {
+		var msg = "failed to open serial port '" + serialDevName + "' - " + err.Error()
+		log.Error(msg)
+		return errors.New(msg)
+	}
+	if m.transcript != nil {
+		m.transcript.record(TRANSCRIPT_OPEN, []byte(serialDevName))
+		port = recordingTransport{transport: port, recorder: m.transcript}
+	}
+
+	// need to already assign field here
+	// as sendCmd() uses it
+	m.link = newSerialLink(port, m.modemConfig.GetSerialReadTimeout(), m.Name())
+	m.portName = serialDevName
+	registerPort(serialDevName, m.Name())
+
+	cleanUp := func() {
+		m.link.close()
+		m.link = nil
+		m.portLock.Unlock()
+		m.portLock = nil
+		unregisterPort(serialDevName)
+	}
+
+	m.profile, err = m.detectProfile(ctx)
+	if err != nil {
+		cleanUp()
+		return err
+	}
+	log.Info("Using profile " + m.profile.Id.String() + " for modem '" + m.Name() + "'")
+
+	for _, cmd := range m.getInitCmds() {
+		log.Debug("Executing modem init cmd: '" + cmd + "'")
+		resp, err := m.sendCmd(ctx, cmd, false)
+		if err != nil {
+			cleanUp()
+			return err
+		}
+		if resp.isError() {
+			cleanUp()
+			return errors.New("Running modem initialization cmd " + cmd + " returned an error: " + resp.String())
+		}
+	}
+
+	// report errors as +CME ERROR/+CMS ERROR codes instead of a plain ERROR
+	cmd := "AT+CMEE=" + strconv.Itoa(m.modemConfig.GetCmeeMode())
+	resp, err := m.sendCmd(ctx, cmd, true)
+	if err != nil {
+		cleanUp()
+		return err
+	}
+	if resp.isError() {
+		log.Warn("Modem '" + m.Name() + "' does not support " + cmd + ", errors will not be classified: " + resp.String())
+	}
+
+	// text mode sends messages as-is, make sure the modem does not expect them in another character set
+	if m.modemConfig.GetSmsMode() == config.SMS_MODE_TEXT && m.profile.SupportsCharset("IRA") {
+		resp, err = m.sendCmd(ctx, "AT+CSCS=\"IRA\"", true)
+		if err != nil {
+			cleanUp()
+			return err
+		}
+		if resp.isError() {
+			log.Warn("Modem '" + m.Name() + "' failed to select character set IRA: " + resp.String())
+		}
+	}
+	return nil
+}
+
+func (m *serialModem) needsInit() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.link == nil
+}
+
+func (m *serialModem) Close() {
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.internalClose()
+}
+
+func (m *serialModem) internalClose() {
+
+	if m.link != nil {
+		log.Info("Closing serial port of modem '" + m.Name() + "'")
+		m.link.close()
+		m.link = nil
+		m.portLock.Unlock()
+		m.portLock = nil
+		unregisterPort(m.portName)
+	}
+}
@@ -0,0 +1,634 @@
+//go:build linux
+
+package modem
+
+import (
+	"context"
+	"errors"
+	"math"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/emulator"
+	"code-sourcery.de/sms-gateway/serialportdiscovery"
+)
+
+// newEmulatedModem starts an emulated modem and creates a serial modem driver talking to it
+func newEmulatedModem(t *testing.T, options emulator.Options, modemSettings string, smsSettings string) (*serialModem, *emulator.Emulator) {
+	emu, err := emulator.New(options)
+	if err != nil {
+		t.Fatalf("failed to start emulator: %s", err.Error())
+	}
+	t.Cleanup(emu.Close)
+
+	appConfig, appState := loadTestConfig(t, "serialPort="+emu.Path()+"\nserialSpeed=115200\nserialReadTimeoutSeconds=1\ninitCmds=ATE0\\rAT^CURC=0\n"+modemSettings,
+		smsSettings, "")
+	m := newSerialModem(appConfig, appState, appConfig.GetModems()[0])
+	t.Cleanup(m.Close)
+	return m, emu
+}
+
+func TestSerialModemInitAndConnectionStatus(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{Registration: 5}, "", "")
+
+	if err := m.Init(context.Background()); err != nil {
+		t.Fatalf("init failed: %s", err.Error())
+	}
+	status, err := m.GetConnectionStatus(context.Background())
+	if err != nil || status != CON_STATUS_REGISTERED_ROAMING {
+		t.Errorf("expected roaming, got %s / %v", status.String(), err)
+	}
+	commands := emu.Commands()
+	if !slices.Equal(commands, []string{"ATI", "ATE0", "AT^CURC=0", "AT+CMEE=1", "AT+CSCS=\"IRA\"", "AT+CPIN?", "AT+CREG?"}) {
+		t.Errorf("unexpected command sequence %v", commands)
+	}
+}
+
+func TestSerialModemSendsTextModeSms(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "smsMode=text", "")
+
+	result := m.SendSms(context.Background(), "Hello world", testRecipients)
+	if !result.Success {
+		t.Fatalf("sending failed: %s", result.Details)
+	}
+	if result.SegmentsSent != 2 || result.Submissions[1].Reference != 1 {
+		t.Errorf("expected two submissions with references 0 and 1, got %+v", result.Submissions)
+	}
+	submitted := emu.Submitted()
+	if len(submitted) != 2 || submitted[0].Recipient != "+491111111111" || submitted[1].Recipient != "+492222222222" {
+		t.Fatalf("wrong messages submitted %+v", submitted)
+	}
+	if submitted[0].Body != "Hello world" {
+		t.Errorf("wrong message text '%s'", submitted[0].Body)
+	}
+}
+
+func TestSerialModemSendsConcatenatedPduModeSms(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "smsMode=pdu", "maxSegments=2\nreceivePollInterval=1m\ndeliveryReports=true")
+
+	text := strings.Repeat("Grüße ", 30)
+	result := m.SendSms(context.Background(), text, testRecipients)
+	if !result.Success {
+		t.Fatalf("sending failed: %s", result.Details)
+	}
+	if result.SegmentsSent != 4 {
+		t.Fatalf("expected 2 segments to each of 2 recipients, got %d", result.SegmentsSent)
+	}
+	segments, coding, _ := SplitMessage(text, 0, 2, 8)
+	// a fresh state hands out concatenation reference 1 first
+	expected, _ := EncodeConcatenatedSmsSubmit("+491111111111", segments, coding, 1, 8, true)
+	submitted := emu.Submitted()
+	if submitted[1].Body != expected[1].Hex() || submitted[1].Length != expected[1].TpduLength {
+		t.Errorf("wrong PDU, expected %s but got %s", expected[1].Hex(), submitted[1].Body)
+	}
+	if !slices.Contains(emu.Commands(), "AT+CNMI=2,1,0,2,0") || !slices.Contains(emu.Commands(), "AT+CMGF=0") {
+		t.Errorf("modem not switched to PDU mode with status reports, got %v", emu.Commands())
+	}
+}
+
+func TestSerialModemUnlocksSim(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{PinState: emulator.PIN_STATE_PIN}, "", "")
+
+	if _, err := m.GetConnectionStatus(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if emu.PinState() != emulator.PIN_STATE_READY || !slices.Contains(emu.Commands(), "AT+CPIN=\"1234\"") {
+		t.Errorf("SIM card was not unlocked, commands: %v", emu.Commands())
+	}
+
+	m, emu = newEmulatedModem(t, emulator.Options{PinState: emulator.PIN_STATE_PIN, Pin: "0000"}, "", "")
+	_, err := m.GetConnectionStatus(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "+CME ERROR: 16") {
+		t.Errorf("expected wrong PIN error, got %v", err)
+	}
+	// a rejected PIN must not be tried again
+	_, err = m.GetConnectionStatus(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("expected rejected PIN not to be tried again, got %v", err)
+	}
+	if count := len(slices.DeleteFunc(emu.Commands(), func(cmd string) bool { return !strings.HasPrefix(cmd, "AT+CPIN=") })); count != 1 {
+		t.Errorf("expected PIN to be entered once, got %d times", count)
+	}
+}
+
+func TestSerialModemPinRetryProtection(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{PinState: emulator.PIN_STATE_PIN, PinRetries: 1}, "", "")
+
+	_, err := m.GetConnectionStatus(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "only 1 attempt(s) left") {
+		t.Errorf("expected PIN not to be entered with a single attempt left, got %v", err)
+	}
+	if emu.PinState() != emulator.PIN_STATE_PIN || slices.ContainsFunc(emu.Commands(), func(cmd string) bool { return strings.HasPrefix(cmd, "AT+CPIN=") }) {
+		t.Errorf("PIN must not have been entered, commands: %v", emu.Commands())
+	}
+	status, err := m.GetSimStatus(context.Background())
+	if err != nil || status.PinState != MODEM_PIN_REQUIRED || status.PinRetries != 1 || status.PukRetries != 10 {
+		t.Errorf("expected PIN required with 1 attempt left, got %+v / %v", status, err)
+	}
+}
+
+func TestSerialModemUnlocksSimWithPuk(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{PinState: emulator.PIN_STATE_PUK}, "", "")
+
+	_, err := m.GetConnectionStatus(context.Background())
+	if modemErr := asModemError(err); modemErr == nil || modemErr.Code != 12 || modemErr.Permanent {
+		t.Fatalf("expected SIM card to require PUK (which is transient), got %v", err)
+	}
+	if err = m.UnlockSimWithPuk(context.Background(), "87654321", "1234"); err == nil || !strings.Contains(err.Error(), "+CME ERROR: 16") {
+		t.Errorf("expected wrong PUK to fail, got %v", err)
+	}
+	status, err := m.GetSimStatus(context.Background())
+	if err != nil || status.PinState != MODEM_PIN_PUK_REQUIRED || status.PukRetries != 9 {
+		t.Errorf("expected PUK required with 9 attempts left, got %+v / %v", status, err)
+	}
+	if err = m.UnlockSimWithPuk(context.Background(), "12345678", "1234"); err != nil {
+		t.Fatalf("unlocking with PUK failed: %s", err.Error())
+	}
+	if emu.PinState() != emulator.PIN_STATE_READY || !slices.Contains(emu.Commands(), "AT+CPIN=\"12345678\",\"1234\"") {
+		t.Errorf("SIM card was not unlocked, commands: %v", emu.Commands())
+	}
+	if _, err = m.GetConnectionStatus(context.Background()); err != nil {
+		t.Errorf("unexpected error after unlocking: %s", err.Error())
+	}
+	if err = m.UnlockSimWithPuk(context.Background(), "12345678", "1234"); err == nil {
+		t.Errorf("expected unlocking a ready SIM card to fail")
+	}
+}
+
+func TestSerialModemCmsErrorOnSubmit(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "", "")
+	emu.AddRule(emulator.Rule{Pattern: regexp.MustCompile(`^AT\+CMGS=`), Response: []string{"> ", "+CMS ERROR: 500"}, Times: 1})
+
+	result := m.SendSms(context.Background(), "hello", testRecipients)
+	if result.Success || result.Reason != MODEM_ERR_MODEM_ERROR || !strings.Contains(result.Details, "+CMS ERROR: 500") {
+		t.Fatalf("expected modem error, got %+v", result)
+	}
+	if !m.needsInit() {
+		t.Errorf("serial port must get closed after a modem error")
+	}
+
+	result = m.SendSms(context.Background(), "hello", testRecipients)
+	if !result.Success {
+		t.Errorf("sending after re-initialization failed: %s", result.Details)
+	}
+}
+
+func TestSerialModemNoNetwork(t *testing.T) {
+	m, _ := newEmulatedModem(t, emulator.Options{Registration: -1}, "", "")
+
+	result := m.SendSms(context.Background(), "hello", testRecipients)
+	if result.Success || !strings.Contains(result.Details, "+CMS ERROR: 331") {
+		t.Errorf("expected 'no network service' error, got %+v", result)
+	}
+}
+
+func TestSerialModemReadsAndDeletesMessages(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "smsMode=pdu", "")
+	index := emu.StoreMessage(emulator.StoredMessage{Pdu: "07911326040000F0040B911346610089F60000208062917314080CC8F71D14969741F977FD07"})
+	emu.StoreMessage(emulator.StoredMessage{Status: 1, Pdu: statusReportPdu})
+
+	messages, reports, err := m.ReadMessages(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(messages) != 1 || messages[0].StorageIndex != index || messages[0].Text != "How are you?" {
+		t.Fatalf("wrong messages %+v", messages)
+	}
+	if len(reports) != 1 || reports[0].Reference != 42 {
+		t.Fatalf("wrong status reports %+v", reports)
+	}
+
+	if err = m.DeleteMessage(context.Background(), index); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if err = m.DeleteMessage(context.Background(), index); err == nil || !strings.Contains(err.Error(), "+CMS ERROR: 321") {
+		t.Errorf("expected 'invalid memory index' error, got %v", err)
+	}
+}
+
+func TestSerialModemPortClosed(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "", "")
+	if err := m.Init(context.Background()); err != nil {
+		t.Fatalf("init failed: %s", err.Error())
+	}
+
+	emu.Close()
+	if _, err := m.GetConnectionStatus(context.Background()); err == nil {
+		t.Fatalf("expected error after the modem went away")
+	}
+	if !m.needsInit() {
+		t.Errorf("serial port must get closed after an I/O error")
+	}
+	if err := m.Init(context.Background()); err == nil {
+		t.Errorf("re-opening a vanished serial port must fail")
+	}
+}
+
+func TestSerialModemDiagnostics(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "diagnosticsRefreshInterval=1h", "")
+
+	diagnostics, err := m.GetDiagnostics(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if diagnostics.Manufacturer != "huawei" || diagnostics.Model != "E3372" || diagnostics.Firmware != "22.200.15.00.00" ||
+		diagnostics.Imei != "860000000000000" || diagnostics.Imsi != "262011234567890" || diagnostics.Iccid != "89490200001234567890" {
+		t.Errorf("wrong modem/SIM identity %+v", diagnostics)
+	}
+	if diagnostics.Operator != "Telekom.de" || diagnostics.AccessTechnology != "E-UTRAN" || diagnostics.Smsc != "+491710760000" {
+		t.Errorf("wrong network information %+v", diagnostics)
+	}
+	if diagnostics.SignalStrength == nil || *diagnostics.SignalStrength != -73 || diagnostics.Rsrp == nil || *diagnostics.Rsrp != -101 {
+		t.Errorf("wrong signal quality %+v", diagnostics)
+	}
+
+	commandCount := len(emu.Commands())
+	if _, err = m.GetDiagnostics(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(emu.Commands()) != commandCount {
+		t.Errorf("cached diagnostics must not be queried again, got commands %v", emu.Commands()[commandCount:])
+	}
+}
+
+func TestSerialModemUssd(t *testing.T) {
+	m, _ := newEmulatedModem(t, emulator.Options{Balance: "4.20"}, "", "")
+
+	response, err := m.SendUssd(context.Background(), "*100#")
+	if err != nil || response.Status != USSD_STATUS_DONE || response.Text != "Your balance is 4.20 EUR." {
+		t.Fatalf("wrong balance answer %+v / %v", response, err)
+	}
+	response, err = m.SendUssd(context.Background(), "*102#")
+	if err != nil || response.Dcs != 72 || response.Text != "Guthaben: 4,20 €" {
+		t.Errorf("wrong UCS-2 answer %+v / %v", response, err)
+	}
+
+	response, _ = m.SendUssd(context.Background(), "*101#")
+	if !response.IsSessionOpen() || !strings.HasPrefix(response.Text, "1: Balance") {
+		t.Fatalf("expected menu, got %+v", response)
+	}
+	response, _ = m.SendUssd(context.Background(), "1")
+	if response.Status != USSD_STATUS_DONE || response.Text != "Your balance is 4.20 EUR." {
+		t.Errorf("wrong answer to menu choice %+v", response)
+	}
+
+	response, _ = m.SendUssd(context.Background(), "*101#")
+	if err = m.CancelUssd(context.Background()); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if response, _ = m.SendUssd(context.Background(), "1"); response.Status != USSD_STATUS_NOT_SUPPORTED {
+		t.Errorf("cancelled session must not accept menu choices, got %+v", response)
+	}
+}
+
+func TestSerialModemPackedUssd(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "ussdPacked=true", "")
+
+	response, err := m.SendUssd(context.Background(), "*100#")
+	if err != nil || response.Text != "Your balance is 10.00 EUR." {
+		t.Errorf("wrong balance answer %+v / %v", response, err)
+	}
+	if !slices.Contains(emu.Commands(), "AT+CUSD=1,\"AA180C3602\",15") {
+		t.Errorf("USSD request was not packed, commands: %v", emu.Commands())
+	}
+}
+
+// nextUrc waits for the next URC of the given modem
+func nextUrc(t *testing.T, subscription *UrcSubscription, modemName string) UnsolicitedResult {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case urc := <-subscription.C:
+			if urc.Modem == modemName {
+				return urc
+			}
+		case <-timeout:
+			t.Fatalf("no unsolicited result code received")
+		}
+	}
+}
+
+func TestSerialModemPublishesUnsolicitedResultCodes(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "", "")
+	subscription := SubscribeUrcs()
+	defer subscription.Close()
+	if err := m.Init(context.Background()); err != nil {
+		t.Fatalf("init failed: %s", err.Error())
+	}
+
+	emu.SendUnsolicited("^SIMST: 1")
+	if urc := nextUrc(t, subscription, m.Name()); urc.Line != "^SIMST: 1" || urc.Code() != "^SIMST" {
+		t.Errorf("wrong URC received while idle %+v", urc)
+	}
+
+	// URCs interleaved with a command's response
+	emu.AddRule(emulator.Rule{Pattern: regexp.MustCompile(`^AT\+CREG\?$`), Response: []string{"+CMTI: \"SM\",5", "+CREG: 0,5", "RING", "OK"}, Times: 1})
+	status, err := m.GetConnectionStatus(context.Background())
+	if err != nil || status != CON_STATUS_REGISTERED_ROAMING {
+		t.Errorf("URCs corrupted the response, got %s / %v", status.String(), err)
+	}
+	if urc := nextUrc(t, subscription, m.Name()); urc.Line != "+CMTI: \"SM\",5" {
+		t.Errorf("wrong first URC %+v", urc)
+	}
+	if urc := nextUrc(t, subscription, m.Name()); urc.Line != "RING" {
+		t.Errorf("wrong second URC %+v", urc)
+	}
+}
+
+func TestSerialModemClassifiesErrors(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "", "")
+	emu.AddRule(emulator.Rule{Pattern: regexp.MustCompile(`^AT\+CMGS=`), Response: []string{"> ", "+CMS ERROR: 1"}, Times: 1})
+
+	result := m.SendSms(context.Background(), "hello", testRecipients)
+	if !result.IsPermanentFailure() || result.Error.Code != 1 || !strings.Contains(result.Details, "unassigned") {
+		t.Errorf("expected permanent failure, got %+v", result)
+	}
+
+	emu.AddRule(emulator.Rule{Pattern: regexp.MustCompile(`^AT\+CMGS=`), Response: []string{"> ", "+CMS ERROR: 332"}, Times: 1})
+	result = m.SendSms(context.Background(), "hello", testRecipients)
+	if result.Success || result.Error == nil || result.IsPermanentFailure() {
+		t.Errorf("expected transient failure, got %+v", result)
+	}
+}
+
+func TestSerialModemErrorTexts(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{PinState: emulator.PIN_STATE_PIN, Pin: "0000"}, "cmeeMode=2", "")
+
+	result := m.SendSms(context.Background(), "hello", testRecipients)
+	if result.Success || !strings.Contains(result.Details, "+CME ERROR: incorrect password") {
+		t.Errorf("expected error text, got %+v", result)
+	}
+	if !slices.Contains(emu.Commands(), "AT+CMEE=2") {
+		t.Errorf("error texts not enabled, commands: %v", emu.Commands())
+	}
+}
+
+func TestSerialModemRecovery(t *testing.T) {
+	resetDelay = 0
+	m, emu := newEmulatedModem(t, emulator.Options{PinState: emulator.PIN_STATE_PIN}, "", "")
+
+	if status, err := m.Probe(context.Background()); err != nil || status != CON_STATUS_REGISTERED_HOME {
+		t.Fatalf("expected healthy modem, got %s / %v", status.String(), err)
+	}
+	for _, step := range []config.RecoveryStep{config.RECOVERY_STEP_REOPEN, config.RECOVERY_STEP_SOFT_RESET, config.RECOVERY_STEP_REDISCOVER} {
+		if err := m.Recover(context.Background(), step); err != nil {
+			t.Fatalf("recovery step %s failed: %s", step.String(), err.Error())
+		}
+		if _, err := m.Probe(context.Background()); err != nil {
+			t.Fatalf("probe after recovery step %s failed: %s", step.String(), err.Error())
+		}
+	}
+	commands := emu.Commands()
+	if count := len(slices.DeleteFunc(slices.Clone(commands), func(cmd string) bool { return cmd != "ATE0" })); count != 4 {
+		t.Errorf("expected modem to be initialized 4 times, got %d: %v", count, commands)
+	}
+	// the SIM card needs to be unlocked again after the modem restarted
+	idx := slices.Index(commands, "AT+CFUN=1,1")
+	if idx < 0 || !slices.Contains(commands[idx:], "AT+CPIN=\"1234\"") || emu.PinState() != emulator.PIN_STATE_READY {
+		t.Errorf("SIM card was not unlocked after soft reset, commands: %v", commands)
+	}
+
+	if err := m.Recover(context.Background(), config.RECOVERY_STEP_USB_RESET); err == nil || !strings.Contains(err.Error(), "not a USB device") {
+		t.Errorf("expected USB reset of a pseudo-terminal to fail, got %v", err)
+	}
+}
+
+func TestSerialModemAtConsole(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "", "")
+
+	response, err := m.SendAtCommand(context.Background(), "AT+CSQ")
+	if err != nil || !slices.Equal(response.Lines, []string{"+CSQ: 20,99", "OK"}) {
+		t.Errorf("unexpected response %v / %v", response.Lines, err)
+	}
+	response, err = m.SendAtCommand(context.Background(), "AT+NOSUCHCMD")
+	if err != nil || response.isOK() {
+		t.Errorf("expected error response, got %v / %v", response.Lines, err)
+	}
+	if _, err = m.SendAtCommand(context.Background(), "AT+CSQ\rAT+CPIN=\"0000\""); err == nil {
+		t.Errorf("expected command with line break to be rejected")
+	}
+	if slices.ContainsFunc(emu.Commands(), func(cmd string) bool { return strings.HasPrefix(cmd, "AT+CPIN=") }) {
+		t.Errorf("rejected command must not be sent, commands: %v", emu.Commands())
+	}
+}
+
+// newProfiledModem creates a serial modem talking to an emulator without overriding the profile's init commands
+func newProfiledModem(t *testing.T, modemSettings string, rules ...emulator.Rule) (*serialModem, *emulator.Emulator) {
+	emu, err := emulator.New(emulator.Options{})
+	if err != nil {
+		t.Fatalf("failed to start emulator: %s", err.Error())
+	}
+	t.Cleanup(emu.Close)
+	for _, rule := range rules {
+		emu.AddRule(rule)
+	}
+	appConfig, appState := loadTestConfig(t, "serialPort="+emu.Path()+"\nserialSpeed=115200\nserialReadTimeoutSeconds=1\n"+modemSettings, "", "")
+	m := newSerialModem(appConfig, appState, appConfig.GetModems()[0])
+	t.Cleanup(m.Close)
+	return m, emu
+}
+
+func TestSerialModemDetectsProfile(t *testing.T) {
+	m, emu := newProfiledModem(t, "smsMode=pdu")
+
+	if err := m.Init(context.Background()); err != nil {
+		t.Fatalf("init failed: %s", err.Error())
+	}
+	if m.profile.Id != config.MODEM_PROFILE_HUAWEI || !m.isUssdPacked() {
+		t.Errorf("expected Huawei profile with packed USSD, got %+v", m.profile)
+	}
+	if !slices.Equal(emu.Commands(), []string{"ATI", "AT^CURC=0", "AT+CMEE=1"}) {
+		t.Errorf("unexpected command sequence %v", emu.Commands())
+	}
+
+	m, emu = newProfiledModem(t, "",
+		emulator.Rule{Pattern: regexp.MustCompile(`^ATI$`), Response: []string{"Quectel", "EC25", "Revision: EC25EFAR06A06M4G", "OK"}},
+		emulator.Rule{Pattern: regexp.MustCompile(`^AT\+QURCCFG=`), Response: []string{"OK"}},
+		emulator.Rule{Pattern: regexp.MustCompile(`^AT\+QCCID$`), Response: []string{"+QCCID: 89860000000000000001", "OK"}},
+		// LTE-only registration
+		emulator.Rule{Pattern: regexp.MustCompile(`^AT\+CREG\?$`), Response: []string{"+CREG: 0,0", "OK"}})
+
+	status, err := m.GetConnectionStatus(context.Background())
+	if err != nil || status != CON_STATUS_REGISTERED_HOME || m.profile.Id != config.MODEM_PROFILE_QUECTEL {
+		t.Fatalf("expected registration via AT+CEREG?, got %s / %v with profile %s", status.String(), err, m.profile.Id.String())
+	}
+	diagnostics, err := m.GetDiagnostics(context.Background())
+	if err != nil || diagnostics.Iccid != "89860000000000000001" {
+		t.Errorf("expected ICCID from AT+QCCID, got %+v / %v", diagnostics, err)
+	}
+	commands := emu.Commands()
+	if !slices.Contains(commands, "AT+QURCCFG=\"urcport\",\"usbat\"") || !slices.Contains(commands, "AT+CSCS=\"IRA\"") ||
+		slices.Contains(commands, "AT^HCSQ?") || slices.Contains(commands, "AT^CPIN?") {
+		t.Errorf("unexpected commands for Quectel profile %v", commands)
+	}
+}
+
+func TestSerialModemProfileOverrides(t *testing.T) {
+	m, emu := newProfiledModem(t, "profile=generic\nextraInitCmds=ATE0\nregistrationCmds=AT+CEREG?\nussdPacked=true")
+
+	status, err := m.GetConnectionStatus(context.Background())
+	if err != nil || status != CON_STATUS_REGISTERED_HOME {
+		t.Fatalf("expected registered modem, got %s / %v", status.String(), err)
+	}
+	if m.profile.Id != config.MODEM_PROFILE_GENERIC || !m.isUssdPacked() {
+		t.Errorf("expected generic profile with packed USSD, got %+v", m.profile)
+	}
+	if !slices.Equal(emu.Commands(), []string{"ATE0", "AT+CMEE=1", "AT+CPIN?", "AT+CEREG?"}) {
+		t.Errorf("unexpected command sequence %v", emu.Commands())
+	}
+}
+
+func TestSerialModemCommandDeadline(t *testing.T) {
+	oldTimeout := defaultCommandTimeout
+	defaultCommandTimeout = 500 * time.Millisecond
+	defer func() {
+		defaultCommandTimeout = oldTimeout
+	}()
+	m, emu := newEmulatedModem(t, emulator.Options{}, "", "")
+	if err := m.Init(context.Background()); err != nil {
+		t.Fatalf("init failed: %s", err.Error())
+	}
+
+	// modem keeps talking but never sends the final result code
+	emu.AddRule(emulator.Rule{Pattern: regexp.MustCompile(`^AT\+CSQ$`), Response: []string{"+CSQ: 20,99"}, Times: 1})
+	start := time.Now()
+	_, err := m.SendAtCommand(context.Background(), "AT+CSQ")
+	var timeoutErr *TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Cmd != "AT+CSQ" || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("command took %s despite its deadline", elapsed)
+	}
+	if !m.needsInit() {
+		t.Errorf("serial port must get closed after a timeout")
+	}
+	status, err := m.GetConnectionStatus(context.Background())
+	if err != nil || status != CON_STATUS_REGISTERED_HOME {
+		t.Errorf("expected modem to work again after re-opening the port, got %s / %v", status, err)
+	}
+
+	// cancelled by the caller, like an HTTP client that went away
+	emu.AddRule(emulator.Rule{Pattern: regexp.MustCompile(`^AT\+CSQ$`), Response: []string{"+CSQ: 20,99", "OK"}, Delay: 3 * time.Second, Times: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err = m.SendAtCommand(ctx, "AT+CSQ"); !errors.Is(err, context.DeadlineExceeded) || errors.As(err, &timeoutErr) {
+		t.Errorf("expected the caller's deadline to abort the command, got %v", err)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	tests := map[string]time.Duration{
+		"AT":                   defaultCommandTimeout,
+		"AT+CMGS=\"+4911111\"": 2 * time.Minute,
+		"at+cops=?":            3 * time.Minute,
+		"AT+COPS?":             30 * time.Second,
+	}
+	for cmd, expected := range tests {
+		if actual := commandTimeout(cmd); actual != expected {
+			t.Errorf("%s: expected %s, got %s", cmd, expected, actual)
+		}
+	}
+}
+
+func TestSerialModemRecordsAndReplaysTranscript(t *testing.T) {
+	m, emu := newEmulatedModem(t, emulator.Options{}, "smsMode=text\ntranscriptFile=transcripts/modem.log", "")
+	// a message arriving while the modem confirms the submission
+	emu.AddRule(emulator.Rule{Pattern: regexp.MustCompile(`^AT\+CMGS=`), Response: []string{"> ", "+CMTI: \"SM\",3", "+CMGS: 42", "OK"}})
+	if result := m.SendSms(context.Background(), "Hello world", testRecipients[:1]); !result.Success {
+		t.Fatalf("sending failed: %s", result.Details)
+	}
+	m.Close()
+	recorded := filepath.Join(m.appConfig.GetDataDirectory(), "transcripts/modem.log")
+	sessions, err := readTranscript(recorded)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("expected a transcript with one session, got %d / %v", len(sessions), err)
+	}
+
+	// the replayed modem answers exactly like the emulator did
+	appConfig, appState := loadTestConfig(t, "serialPort="+config.SERIAL_PORT_REPLAY_PREFIX+recorded+
+		"\nserialSpeed=115200\nserialReadTimeoutSeconds=1\ninitCmds=ATE0\\rAT^CURC=0\nsmsMode=text", "", "")
+	replayed := newSerialModem(appConfig, appState, appConfig.GetModems()[0])
+	t.Cleanup(replayed.Close)
+	result := replayed.SendSms(context.Background(), "Hello world", testRecipients[:1])
+	if !result.Success || result.Submissions[0].Reference != 42 {
+		t.Fatalf("replaying failed: %+v", result)
+	}
+	// the replay is over, the next session would need another 'open' in the transcript
+	replayed.Close()
+	if result = replayed.SendSms(context.Background(), "Hello world", testRecipients[:1]); result.Success {
+		t.Errorf("expected sending to fail once the transcript is exhausted")
+	}
+}
+
+func TestSerialModemPortBusy(t *testing.T) {
+	oldPollInterval, oldBackoff := portBusyPollInterval, portBusyBackoff
+	portBusyPollInterval, portBusyBackoff = 10*time.Millisecond, 10*time.Millisecond
+	// the port is held by another process for the first busyAttempts attempts
+	var attempts, busyAttempts int
+	lockPort = func(port string) (*serialportdiscovery.PortLock, error) {
+		attempts++
+		if attempts <= busyAttempts {
+			return nil, &serialportdiscovery.PortBusyError{Port: port, Pids: []int{99999999}}
+		}
+		return serialportdiscovery.LockPort(port)
+	}
+	defer func() {
+		portBusyPollInterval, portBusyBackoff = oldPollInterval, oldBackoff
+		lockPort = serialportdiscovery.LockPort
+	}()
+
+	tests := []struct {
+		settings     string
+		busyAttempts int
+		success      bool
+		attempts     int
+	}{
+		{"", 1, false, 1},
+		{"portBusy=retry\nportBusyRetries=2", 5, false, 3},
+		{"portBusy=retry", 3, true, 4},
+		{"portBusy=wait", 10, true, 11},
+	}
+	for _, test := range tests {
+		attempts, busyAttempts = 0, test.busyAttempts
+		m, emu := newEmulatedModem(t, emulator.Options{}, test.settings, "")
+		err := m.Init(context.Background())
+		if test.success != (err == nil) || attempts != test.attempts {
+			t.Errorf("%q: expected success=%v after %d attempts, got %v after %d", test.settings, test.success, test.attempts, err, attempts)
+		}
+		if err != nil && (!strings.Contains(err.Error(), "is in use by 99999999") || len(emu.Commands()) != 0) {
+			t.Errorf("%q: expected busy port to be left alone, got %v / %v", test.settings, err, emu.Commands())
+		}
+		m.Close()
+	}
+
+	// waiting ends with the caller's deadline
+	attempts, busyAttempts = 0, math.MaxInt
+	m, _ := newEmulatedModem(t, emulator.Options{}, "portBusy=wait", "")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := m.Init(ctx); err == nil || !strings.Contains(err.Error(), "is in use by") || attempts < 2 {
+		t.Errorf("expected waiting for the port to give up, got %v after %d attempts", err, attempts)
+	}
+
+	// without a deadline of the caller, waiting ends after portBusyTimeoutSeconds and does not block other callers meanwhile
+	attempts = 0
+	m, _ = newEmulatedModem(t, emulator.Options{}, "portBusy=wait\nportBusyTimeoutSeconds=1", "")
+	done := make(chan error)
+	go func() {
+		done <- m.Init(context.Background())
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start := time.Now()
+	if !m.needsInit() || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("waiting for a busy port must not block other callers")
+	}
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "gave up waiting after 1s") {
+		t.Errorf("expected waiting for the port to give up after 1s, got %v", err)
+	}
+}
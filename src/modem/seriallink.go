@@ -0,0 +1,228 @@
+package modem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"code-sourcery.de/sms-gateway/logger"
+)
+
+// logs everything sent to and received from the modems at TRACE level
+var wireLog = logger.GetLogger("wire")
+
+// serialLink owns the serial port of a modem. A reader goroutine receives everything the modem sends,
+// data received while no command is running gets scanned for unsolicited result codes right away,
+// everything else is handed to the command waiting for its response.
+type serialLink struct {
+	port transport
+	// how long to wait for more data before assuming the modem has finished responding
+	readTimeout time.Duration
+	urcs        urcAssembler
+
+	mutex sync.Mutex
+	// data received but not consumed yet
+	received []byte
+	// TRUE while a command waits for its response
+	busy bool
+	// error that made the reader goroutine give up, nil while the port is fine
+	err error
+	// signals the command side that more data arrived
+	dataAvailable chan struct{}
+	readerDone    chan struct{}
+}
+
+func newSerialLink(port transport, readTimeout time.Duration, modemName string) *serialLink {
+	link := &serialLink{
+		port:          port,
+		readTimeout:   readTimeout,
+		urcs:          urcAssembler{modemName: modemName},
+		dataAvailable: make(chan struct{}, 1),
+		readerDone:    make(chan struct{}),
+	}
+	go link.reader()
+	return link
+}
+
+func (l *serialLink) reader() {
+	defer close(l.readerDone)
+
+	buffer := make([]byte, 256)
+	for {
+		count, err := l.port.Read(buffer)
+
+		l.mutex.Lock()
+		if err != nil {
+			l.err = err
+			l.mutex.Unlock()
+			l.notify()
+			return
+		}
+		if count > 0 {
+			if wireLog.IsTraceEnabled() {
+				wireLog.Trace("Modem '" + l.urcs.modemName + "' <- " + fmt.Sprintf("%q", buffer[:count]))
+			}
+			l.received = append(l.received, buffer[:count]...)
+			if !l.busy {
+				l.scanIdle()
+			}
+		}
+		l.mutex.Unlock()
+		l.notify()
+	}
+}
+
+func (l *serialLink) notify() {
+	select {
+	case l.dataAvailable <- struct{}{}:
+	default:
+	}
+}
+
+// scanIdle consumes the complete lines received while no command is running. Those are unsolicited
+// result codes or late responses to commands that gave up waiting. Needs to be called with the mutex held.
+func (l *serialLink) scanIdle() {
+	for {
+		idx := bytes.Index(l.received, []byte("\r\n"))
+		if idx < 0 {
+			return
+		}
+		line := string(l.received[:idx])
+		l.received = l.received[idx+2:]
+		if strings.TrimSpace(line) != "" && !l.urcs.offer(line) {
+			log.Debug("Discarding unexpected line '" + line + "' from modem '" + l.urcs.modemName + "'")
+		}
+	}
+}
+
+// how long the modem may take to answer a command on top of the read timeout, as a response is only complete
+// once the modem stayed silent for that long. Commands not listed get defaultCommandTimeout.
+var commandTimeouts = []struct {
+	prefix  string
+	timeout time.Duration
+}{
+	// the network needs to accept the message
+	{"AT+CMGS", 2 * time.Minute},
+	// scanning for networks
+	{"AT+COPS=?", 3 * time.Minute},
+	{"AT+COPS", 30 * time.Second},
+	{"AT+CFUN", 30 * time.Second},
+	{"AT+CUSD", 30 * time.Second},
+	{"AT+CMGL", 30 * time.Second},
+	{"AT+CPIN=", 30 * time.Second},
+}
+
+var defaultCommandTimeout = 10 * time.Second
+
+// commandTimeout returns how long the modem may take to answer a command
+func commandTimeout(cmd string) time.Duration {
+	upper := strings.ToUpper(cmd)
+	for _, entry := range commandTimeouts {
+		if strings.HasPrefix(upper, entry.prefix) {
+			return entry.timeout
+		}
+	}
+	return defaultCommandTimeout
+}
+
+// nextChunk waits for the next data of a command's response and takes everything received so far, reporting a timeout
+// if the modem stays silent for longer than the read timeout and the context's error once it is done
+func (l *serialLink) nextChunk(ctx context.Context) ChunkResult {
+	timeout := time.NewTimer(l.readTimeout)
+	defer timeout.Stop()
+	for {
+		l.mutex.Lock()
+		if len(l.received) > 0 {
+			data := l.received
+			l.received = nil
+			l.mutex.Unlock()
+			return ChunkResult{data: data, timeout: false, err: nil}
+		}
+		err := l.err
+		l.mutex.Unlock()
+		if err != nil {
+			return ChunkResult{data: nil, timeout: false, err: err}
+		}
+		select {
+		case <-l.dataAvailable:
+		case <-ctx.Done():
+			return ChunkResult{data: nil, timeout: false, err: ctx.Err()}
+		case <-timeout.C:
+			log.Debug("*** timeout ***")
+			return ChunkResult{data: nil, timeout: true, err: nil}
+		}
+	}
+}
+
+// execute writes a command (or an SMS body) to the modem and parses the response,
+// unsolicited result codes the modem sends in between get published instead of being returned as part of the response.
+// Returns a *TimeoutError if the modem did not answer before the command's deadline, the modem is in an
+// unknown state then and the link should be closed.
+func (l *serialLink) execute(ctx context.Context, data []byte, cmd string, requiresOkOrError bool) ([]string, error) {
+	l.mutex.Lock()
+	if l.err != nil {
+		l.mutex.Unlock()
+		return []string{}, l.err
+	}
+	l.busy = true
+	l.urcs.cmd = cmd
+	l.mutex.Unlock()
+
+	defer func() {
+		l.mutex.Lock()
+		l.busy = false
+		l.urcs.cmd = ""
+		// whatever the modem sent after the final result code
+		l.scanIdle()
+		l.mutex.Unlock()
+	}()
+
+	if wireLog.IsTraceEnabled() {
+		wireLog.Trace("Modem '" + l.urcs.modemName + "' -> " + fmt.Sprintf("%q", data))
+	}
+	bytesWritten, err := l.port.Write(data)
+	if err != nil {
+		log.Error("failed to write to serial port: " + err.Error())
+		return []string{}, err
+	}
+	if bytesWritten != len(data) {
+		log.Error("failed to write() to serial port: write came up short")
+		return []string{}, errors.New("write to serial port came up short")
+	}
+	err = l.port.Drain()
+	if err != nil {
+		log.Error("failed to drain() serial port: " + err.Error())
+		return []string{}, err
+	}
+
+	timeout := commandTimeout(cmd) + l.readTimeout
+	cmdCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	lines, remaining, err := parseModemResponse(func() ChunkResult {
+		return l.nextChunk(cmdCtx)
+	}, requiresOkOrError, &l.urcs)
+	if len(remaining) > 0 {
+		// sent after the final result code, gets scanned for unsolicited result codes
+		l.mutex.Lock()
+		l.received = append(remaining, l.received...)
+		l.mutex.Unlock()
+	}
+	if err != nil && cmdCtx.Err() != nil {
+		// ESC makes a modem waiting for the body of an SMS discard it
+		_, _ = l.port.Write([]byte{0x1b})
+		if ctx.Err() == nil {
+			return nil, &TimeoutError{Cmd: cmd, Timeout: timeout}
+		}
+	}
+	return lines, err
+}
+
+// close closes the serial port and waits for the reader goroutine to terminate
+func (l *serialLink) close() {
+	_ = l.port.Close()
+	<-l.readerDone
+}
@@ -0,0 +1,84 @@
+package modem
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// pipeTransport is one end of an in-memory connection standing in for a serial port
+type pipeTransport struct {
+	net.Conn
+}
+
+func (p pipeTransport) Drain() error {
+	return nil
+}
+
+// newScriptedLink creates a serial link to a fake modem answering every command with the response returned by answer,
+// written in pieces of writeSize bytes
+func newScriptedLink(tb testing.TB, writeSize int, answer func(cmd string) []byte) *serialLink {
+	local, remote := net.Pipe()
+	link := newSerialLink(pipeTransport{local}, 100*time.Millisecond, "test")
+	tb.Cleanup(link.close)
+	go func() {
+		defer func() {
+			_ = remote.Close()
+		}()
+		reader := bufio.NewReader(remote)
+		for {
+			cmd, err := reader.ReadString('\r')
+			if err != nil {
+				return
+			}
+			response := answer(cmd[:len(cmd)-1])
+			for len(response) > 0 {
+				piece := response[:min(writeSize, len(response))]
+				if _, err = remote.Write(piece); err != nil {
+					return
+				}
+				response = response[len(piece):]
+			}
+		}
+	}()
+	return link
+}
+
+func TestSerialLinkPublishesUrcsAfterFinalResult(t *testing.T) {
+	subscription := SubscribeUrcs()
+	defer subscription.Close()
+
+	link := newScriptedLink(t, 1024, func(cmd string) []byte {
+		return []byte("\r\n+CSQ: 20,99\r\n\r\nOK\r\n\r\n+CMTI: \"SM\",3\r\n")
+	})
+	lines, err := link.execute(context.Background(), []byte("AT+CSQ\r"), "AT+CSQ", true)
+	if err != nil || !slices.Equal(lines, []string{"+CSQ: 20,99", "OK"}) {
+		t.Fatalf("unexpected response %q / %v", lines, err)
+	}
+	select {
+	case urc := <-subscription.C:
+		if urc.Modem != "test" || urc.Line != "+CMTI: \"SM\",3" {
+			t.Errorf("unexpected URC %+v", urc)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("expected the URC sent along with the response to be published")
+	}
+}
+
+func BenchmarkSerialLinkMessageListing(b *testing.B) {
+	listing := messageListing(50)
+	link := newScriptedLink(b, 64, func(cmd string) []byte {
+		return listing
+	})
+	b.SetBytes(int64(len(listing)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lines, err := link.execute(context.Background(), []byte("AT+CMGL=4\r"), "AT+CMGL=4", true)
+		if err != nil || len(lines) != 101 {
+			b.Fatalf("unexpected response with %d lines / %v", len(lines), err)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package modem
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// how many attempts need to be left for the gateway to enter the PIN (or PUK) on its own.
+// The last attempt is left to a human, entering a wrong PIN would lock the SIM card.
+const minSimRetries = 2
+
+// SimStatus tells whether the SIM card is locked and how many attempts to unlock it are left
+type SimStatus struct {
+	PinState ModemPinState
+	// remaining PIN and PUK attempts, -1 if the modem does not report them
+	PinRetries int
+	PukRetries int
+}
+
+var pinRegEx = regexp.MustCompile(`^[0-9]{4,8}$`)
+var pukRegEx = regexp.MustCompile(`^[0-9]{8}$`)
+
+// ValidateSimCodes checks that a PUK has 8 digits and a PIN has 4 to 8 digits
+func ValidateSimCodes(puk string, newPin string) error {
+	if !pukRegEx.MatchString(puk) {
+		return errors.New("PUK needs to consist of 8 digits")
+	}
+	if !pinRegEx.MatchString(newPin) {
+		return errors.New("PIN needs to consist of 4 to 8 digits")
+	}
+	return nil
+}
+
+// pinGuard keeps a modem from locking its SIM card by entering a wrong PIN over and over again
+type pinGuard struct {
+	// PIN the SIM card rejected, "" if none
+	rejectedPin string
+}
+
+// checkPin returns an error if the SIM card rejected the PIN before
+func (g *pinGuard) checkPin(pin string) error {
+	if g.rejectedPin != "" && g.rejectedPin == pin {
+		return errors.New("SIM card rejected the configured PIN before, not trying it again - please fix [modem] simPin")
+	}
+	return nil
+}
+
+// newPukRequiredError returns the error reported while the SIM card is PUK-locked. Unlike a '+CME ERROR: 12' a command
+// fails with, it is transient: the SIM card can be unlocked using the /sim/unlock REST endpoint, so messages need to
+// stay queued until then instead of being given up on.
+func newPukRequiredError() *ModemError {
+	result := newCmeError(12)
+	result.Permanent = false
+	return result
+}
+
+// checkRetries returns an error if too few attempts to enter the PIN or PUK are left, retries < 0 means unknown
+func checkRetries(retries int, code string) error {
+	if retries >= 0 && retries < minSimRetries {
+		return errors.New("Refusing to enter " + code + ", only " + strconv.Itoa(retries) + " attempt(s) left - " +
+			"please unlock the SIM card manually")
+	}
+	return nil
+}
+
+// +CPINR: <code>,<retries>[,<default retries>] (3GPP TS 27.007 section 8.65)
+var cpinrRegEx = regexp.MustCompile(`^\+CPINR:\s*"?([^",]+)"?\s*,\s*(\d+)`)
+
+// parseCpinr extracts the remaining PIN and PUK attempts from the response to AT+CPINR, -1 if not reported
+func parseCpinr(lines []string) (int, int) {
+	pin, puk := -1, -1
+	for _, line := range lines {
+		match := cpinrRegEx.FindStringSubmatch(strings.TrimSpace(line))
+		if match == nil {
+			continue
+		}
+		retries, _ := strconv.Atoi(match[2])
+		switch strings.TrimSpace(match[1]) {
+		case "SIM PIN":
+			pin = retries
+		case "SIM PUK":
+			puk = retries
+		}
+	}
+	return pin, puk
+}
+
+// ^CPIN: <code>,[<times>],<puk_times>,<pin_times>,<puk2_times>,<pin2_times> (Huawei)
+var huaweiCpinRegEx = regexp.MustCompile(`^\^CPIN:\s*[^,]*,\s*\d*\s*,\s*(\d+)\s*,\s*(\d+)`)
+
+// parseHuaweiCpin extracts the remaining PIN and PUK attempts from the response to AT^CPIN?, -1 if not reported
+func parseHuaweiCpin(lines []string) (int, int) {
+	for _, line := range lines {
+		match := huaweiCpinRegEx.FindStringSubmatch(strings.TrimSpace(line))
+		if match != nil {
+			puk, _ := strconv.Atoi(match[1])
+			pin, _ := strconv.Atoi(match[2])
+			return pin, puk
+		}
+	}
+	return -1, -1
+}
@@ -0,0 +1,41 @@
+package modem
+
+import (
+	"testing"
+)
+
+func TestParseRetries(t *testing.T) {
+	pin, puk := parseCpinr([]string{"+CPINR: SIM PIN,2,3", "+CPINR: SIM PUK,10,10", "+CPINR: SIM PIN2,3,3", "OK"})
+	if pin != 2 || puk != 10 {
+		t.Errorf("expected 2 PIN and 10 PUK attempts, got %d / %d", pin, puk)
+	}
+	if pin, puk = parseCpinr([]string{"+CPINR: \"SIM PUK\",7,10", "OK"}); pin != -1 || puk != 7 {
+		t.Errorf("expected unknown PIN and 7 PUK attempts, got %d / %d", pin, puk)
+	}
+	if pin, puk = parseHuaweiCpin([]string{"^CPIN: SIM PIN,3,10,3,10,3", "OK"}); pin != 3 || puk != 10 {
+		t.Errorf("expected 3 PIN and 10 PUK attempts, got %d / %d", pin, puk)
+	}
+	if pin, puk = parseHuaweiCpin([]string{"^CPIN: READY,,9,1,10,3", "OK"}); pin != 1 || puk != 9 {
+		t.Errorf("expected 1 PIN and 9 PUK attempts, got %d / %d", pin, puk)
+	}
+	if pin, puk = parseHuaweiCpin([]string{"ERROR"}); pin != -1 || puk != -1 {
+		t.Errorf("expected unknown attempts, got %d / %d", pin, puk)
+	}
+}
+
+func TestPinGuard(t *testing.T) {
+	guard := pinGuard{}
+	if guard.checkPin("1234") != nil || checkRetries(-1, "PIN") != nil || checkRetries(2, "PIN") != nil {
+		t.Errorf("entering the PIN must be allowed")
+	}
+	if checkRetries(1, "PIN") == nil || checkRetries(0, "PUK") == nil {
+		t.Errorf("the last attempt must be left to a human")
+	}
+	guard.rejectedPin = "1234"
+	if guard.checkPin("1234") == nil || guard.checkPin("4321") != nil {
+		t.Errorf("only the rejected PIN must not be tried again")
+	}
+	if ValidateSimCodes("12345678", "0000") != nil || ValidateSimCodes("1234", "0000") == nil || ValidateSimCodes("12345678", "12\"") == nil {
+		t.Errorf("PUK needs 8 digits, PIN needs 4 to 8 digits")
+	}
+}
@@ -0,0 +1,512 @@
+package modem
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+// how many wrong PINs the simulated SIM card accepts before requiring the PUK
+const simulatorPinAttempts = 3
+
+// how many wrong PUKs the simulated SIM card accepts
+const simulatorPukAttempts = 10
+
+// Simulator is an in-process modem driver that needs no hardware. It models network registration,
+// SIM card PIN state, random failures and latency as configured in the [simulator] section
+// (or the [simulator.<name>] section of a named modem) and keeps
+// every message sent in a virtual handset inbox per recipient.
+type Simulator struct {
+	appConfig   *config.Config
+	appState    *state.State
+	modemConfig config.ModemConfig
+	simConfig   config.SimulatorConfig
+
+	mutex            sync.Mutex
+	initialized      bool
+	registration     ConnectionStatus
+	pinState         ModemPinState
+	pinAttemptsLeft  int
+	pukAttemptsLeft  int
+	pins             pinGuard
+	nextReference    int
+	nextStorageIndex int
+	nextConcatRef    int
+	storedMessages   []ReceivedSms
+	storedReports    []ReceivedStatusReport
+	handsets         map[string][]string
+	ussdSession      bool
+}
+
+func parseSimulatorRegistration(s string) ConnectionStatus {
+	switch s {
+	case "home":
+		return CON_STATUS_REGISTERED_HOME
+	case "roaming":
+		return CON_STATUS_REGISTERED_ROAMING
+	case "searching":
+		return CON_STATUS_NOT_REGISTERED_SEARCHING
+	case "denied":
+		return CON_STATUS_NOT_REGISTERED_DENIED
+	case "not_searching":
+		return CON_STATUS_NOT_REGISTERED_NOT_SEARCHING
+	}
+	return CON_STATUS_UNKNOWN
+}
+
+func parseSimulatorPinState(s string) ModemPinState {
+	switch s {
+	case "pin":
+		return MODEM_PIN_REQUIRED
+	case "puk":
+		return MODEM_PIN_PUK_REQUIRED
+	}
+	return MODEM_PIN_NOT_REQUIRED
+}
+
+func NewSimulator(appConfig *config.Config, appState *state.State, modemConfig config.ModemConfig) *Simulator {
+	simConfig := modemConfig.GetSimulatorConfig()
+	if simConfig == nil {
+		// modem driver is not 'simulator', use defaults
+		simConfig = &config.SimulatorConfig{Registration: "home", PinState: "ready", Pin: "1234", Puk: "12345678", Balance: "10.00"}
+	}
+	return &Simulator{
+		appConfig:       appConfig,
+		appState:        appState,
+		modemConfig:     modemConfig,
+		simConfig:       *simConfig,
+		registration:    parseSimulatorRegistration(simConfig.Registration),
+		pinState:        parseSimulatorPinState(simConfig.PinState),
+		pinAttemptsLeft: simulatorPinAttempts,
+		pukAttemptsLeft: simulatorPukAttempts,
+		handsets:        make(map[string][]string),
+	}
+}
+
+func (s *Simulator) Name() string {
+	return s.modemConfig.GetName()
+}
+
+func (s *Simulator) GetConfig() config.ModemConfig {
+	return s.modemConfig
+}
+
+// simulateLatency waits for the configured latency, needs to be called with the mutex held
+func (s *Simulator) simulateLatency(ctx context.Context) {
+	if s.simConfig.Latency > 0 {
+		_ = sleep(ctx, s.simConfig.Latency)
+	}
+}
+
+// simulateFailure returns TRUE if the current operation should fail according to the configured failure rate
+func (s *Simulator) simulateFailure() bool {
+	return s.simConfig.FailureRate > 0 && rand.Float64() < s.simConfig.FailureRate
+}
+
+func (s *Simulator) Init(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.internalInit(ctx)
+}
+
+func (s *Simulator) internalInit(ctx context.Context) error {
+	s.simulateLatency(ctx)
+	if s.simulateFailure() {
+		return errors.New("Simulated modem failure during initialization")
+	}
+	if !s.initialized {
+		log.Info("Simulated modem '" + s.Name() + "' initialized, registration " + s.registration.String())
+		s.initialized = true
+	}
+	return nil
+}
+
+func (s *Simulator) Close() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.initialized = false
+}
+
+// prepare initializes the simulated modem if necessary and unlocks the SIM card, needs to be called with the mutex held
+func (s *Simulator) prepare(ctx context.Context) error {
+	if !s.initialized {
+		err := s.internalInit(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	switch s.pinState {
+	case MODEM_PIN_REQUIRED:
+		pin := s.modemConfig.GetSimPin()
+		if err := s.pins.checkPin(pin); err != nil {
+			return err
+		}
+		if err := checkRetries(s.pinAttemptsLeft, "PIN"); err != nil {
+			return err
+		}
+		if pin != s.simConfig.Pin {
+			s.pins.rejectedPin = pin
+			s.pinAttemptsLeft--
+			if s.pinAttemptsLeft <= 0 {
+				log.Warn("Simulated SIM card is now PUK-locked after " + strconv.Itoa(simulatorPinAttempts) + " wrong PINs")
+				s.pinState = MODEM_PIN_PUK_REQUIRED
+			}
+			return errors.New("Unlocking PIN returned error response: +CME ERROR: 16")
+		}
+		log.Info("Successfully unlocked simulated modem using PIN")
+		s.pinState = MODEM_PIN_NOT_REQUIRED
+		s.pinAttemptsLeft = simulatorPinAttempts
+	case MODEM_PIN_PUK_REQUIRED:
+		log.Error("Modem requires PUK, please unlock SIM card using the /sim/unlock REST endpoint")
+		return newPukRequiredError()
+	}
+	return nil
+}
+
+func (s *Simulator) SendSms(ctx context.Context, message string, recipients []string) SendResult {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.prepare(ctx)
+	if err != nil {
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: err.Error(), Error: asModemError(err)}
+	}
+	if !s.registration.IsRegistered() {
+		modemErr := newCmsError(331)
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: modemErr.Error(), Error: modemErr}
+	}
+	return sendToRecipients(ctx, s.appConfig, s.appState, s.modemConfig, message, recipients, s.sendSegments)
+}
+
+// numbers the simulated network knows, sending to other numbers fails with '+CMS ERROR: 1' (unassigned number)
+var simulatorNumberRegEx = regexp.MustCompile(`^\+?[0-9]{3,15}$`)
+
+func (s *Simulator) sendSegments(ctx context.Context, recipient string, segments []string, coding DataCoding, reference int) SendResult {
+	if !simulatorNumberRegEx.MatchString(recipient) {
+		modemErr := newCmsError(1)
+		log.Warn("Simulated network does not know recipient " + recipient)
+		return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: modemErr.Error(), Error: modemErr}
+	}
+	var submissions []Submission
+	for idx := range segments {
+		s.simulateLatency(ctx)
+		if s.simulateFailure() {
+			log.Warn("Simulating failure while sending segment " + strconv.Itoa(idx+1) + "/" + strconv.Itoa(len(segments)) + " to " + recipient)
+			return SendResult{Success: false, Reason: MODEM_ERR_MODEM_ERROR, Details: "Simulated modem failure",
+				SegmentsSent: len(submissions), Submissions: submissions}
+		}
+		submission := Submission{Recipient: recipient, Reference: s.nextReference}
+		s.nextReference = (s.nextReference + 1) % 256
+		submissions = append(submissions, submission)
+		if s.appConfig.IsDeliveryReports() {
+			now := time.Now()
+			s.storedReports = append(s.storedReports, ReceivedStatusReport{StorageIndex: s.newStorageIndex(),
+				SmsStatusReport: SmsStatusReport{Reference: submission.Reference, Recipient: recipient, Timestamp: now, DischargeTime: now}})
+		}
+	}
+	text := strings.Join(segments, "")
+	log.Info("Simulated handset " + recipient + " received " + coding.String() + " message: " + text)
+	s.handsets[recipient] = append(s.handsets[recipient], text)
+	return SendResult{Success: true, Reason: MODEM_ERR_NONE, Details: "success", SegmentsSent: len(submissions), Submissions: submissions}
+}
+
+func (s *Simulator) newStorageIndex() int {
+	result := s.nextStorageIndex
+	s.nextStorageIndex++
+	return result
+}
+
+func (s *Simulator) GetConnectionStatus(ctx context.Context) (ConnectionStatus, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.prepare(ctx)
+	if err != nil {
+		return CON_STATUS_UNKNOWN, err
+	}
+	s.simulateLatency(ctx)
+	if s.simulateFailure() {
+		return CON_STATUS_UNKNOWN, errors.New("Simulated modem failure while querying network registration")
+	}
+	return s.registration, nil
+}
+
+func (s *Simulator) GetSimStatus(ctx context.Context) (SimStatus, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.initialized {
+		err := s.internalInit(ctx)
+		if err != nil {
+			return SimStatus{}, err
+		}
+	}
+	s.simulateLatency(ctx)
+	return SimStatus{PinState: s.pinState, PinRetries: s.pinAttemptsLeft, PukRetries: s.pukAttemptsLeft}, nil
+}
+
+func (s *Simulator) UnlockSimWithPuk(ctx context.Context, puk string, newPin string) error {
+
+	if err := ValidateSimCodes(puk, newPin); err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.simulateLatency(ctx)
+	if s.pinState != MODEM_PIN_PUK_REQUIRED {
+		return errors.New("SIM card does not require the PUK, PIN state is " + s.pinState.String())
+	}
+	if err := checkRetries(s.pukAttemptsLeft, "PUK"); err != nil {
+		return err
+	}
+	if puk != s.simConfig.Puk {
+		s.pukAttemptsLeft--
+		return errors.New("Unlocking SIM card using PUK returned error response: +CME ERROR: 16")
+	}
+	log.Info("Successfully unlocked simulated SIM card using PUK")
+	s.simConfig.Pin = newPin
+	s.pinState = MODEM_PIN_NOT_REQUIRED
+	s.pinAttemptsLeft = simulatorPinAttempts
+	s.pukAttemptsLeft = simulatorPukAttempts
+	s.pins.rejectedPin = ""
+	return nil
+}
+
+// Probe is the same as GetConnectionStatus(), a simulated modem never stops responding
+func (s *Simulator) Probe(ctx context.Context) (ConnectionStatus, error) {
+	return s.GetConnectionStatus(ctx)
+}
+
+// Recover re-initializes the simulated modem, resets make the SIM card require its PIN again
+func (s *Simulator) Recover(ctx context.Context, step config.RecoveryStep) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	log.Info("Recovering simulated modem '" + s.Name() + "' using step " + step.String())
+	if step != config.RECOVERY_STEP_REOPEN && step != config.RECOVERY_STEP_REDISCOVER &&
+		s.pinState == MODEM_PIN_NOT_REQUIRED && s.simConfig.PinState == "pin" {
+		s.pinState = MODEM_PIN_REQUIRED
+	}
+	s.initialized = false
+	s.ussdSession = false
+	return s.internalInit(ctx)
+}
+
+// GetDiagnostics returns made-up but plausible values, there is no need to cache them
+func (s *Simulator) GetDiagnostics(ctx context.Context) (Diagnostics, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.prepare(ctx)
+	if err != nil {
+		return Diagnostics{}, err
+	}
+	s.simulateLatency(ctx)
+	result := Diagnostics{
+		SystemMode:   "NOSERVICE",
+		Imei:         "860000000000000",
+		Imsi:         "001010123456789",
+		Iccid:        "89000000000000000000",
+		Manufacturer: "sms-gateway",
+		Model:        "simulator",
+		Smsc:         "+490000000000",
+		Updated:      time.Now(),
+	}
+	if s.registration.IsRegistered() {
+		signalStrength, bitErrorRate := -73, 0
+		rsrp, rsrq, sinr := -95.0, -10.0, 12.0
+		result.SignalStrength = &signalStrength
+		result.BitErrorRate = &bitErrorRate
+		result.SystemMode = "LTE"
+		result.Rsrp, result.Rsrq, result.Sinr = &rsrp, &rsrq, &sinr
+		result.Operator = "Simulated Network"
+		result.AccessTechnology = accessTechnologies[7]
+	}
+	return result, nil
+}
+
+const simulatorUssdMenu = "1: Balance\n2: Exit"
+
+// SendUssd answers "*100#" with the configured balance and "*101#" with a menu that needs another input
+func (s *Simulator) SendUssd(ctx context.Context, code string) (UssdResponse, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.prepare(ctx)
+	if err != nil {
+		return UssdResponse{}, err
+	}
+	if !s.registration.IsRegistered() {
+		// +CME ERROR: 30 = no network service
+		return UssdResponse{}, errors.New("USSD request returned error response: +CME ERROR: 30")
+	}
+	s.simulateLatency(ctx)
+	if s.simulateFailure() {
+		return UssdResponse{Status: USSD_STATUS_TIMEOUT}, nil
+	}
+
+	balance := UssdResponse{Status: USSD_STATUS_DONE, Text: "Your balance is " + s.simConfig.Balance + " EUR.", Dcs: ussdRequestDcs}
+	if s.ussdSession {
+		switch code {
+		case "1":
+			s.ussdSession = false
+			return balance, nil
+		case "2":
+			s.ussdSession = false
+			return UssdResponse{Status: USSD_STATUS_TERMINATED, Dcs: ussdRequestDcs}, nil
+		}
+		return UssdResponse{Status: USSD_STATUS_ACTION_REQUIRED, Text: "Invalid choice\n" + simulatorUssdMenu, Dcs: ussdRequestDcs}, nil
+	}
+	switch code {
+	case "*100#":
+		return balance, nil
+	case "*101#":
+		s.ussdSession = true
+		return UssdResponse{Status: USSD_STATUS_ACTION_REQUIRED, Text: simulatorUssdMenu, Dcs: ussdRequestDcs}, nil
+	}
+	return UssdResponse{Status: USSD_STATUS_NOT_SUPPORTED, Dcs: ussdRequestDcs}, nil
+}
+
+func (s *Simulator) CancelUssd(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ussdSession = false
+	return nil
+}
+
+// SendAtCommand answers a few status queries (AT, ATI, AT+CPIN?, AT+CREG?, AT+CSQ) and everything else with ERROR
+func (s *Simulator) SendAtCommand(ctx context.Context, cmd string) (ModemResponse, error) {
+
+	if err := ValidateAtCommand(cmd); err != nil {
+		return ModemResponse{}, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.initialized {
+		err := s.internalInit(ctx)
+		if err != nil {
+			return ModemResponse{}, err
+		}
+	}
+	s.simulateLatency(ctx)
+	switch strings.ToUpper(strings.TrimSpace(cmd)) {
+	case "AT":
+		return ModemResponse{Lines: []string{"OK"}}, nil
+	case "ATI":
+		return ModemResponse{Lines: []string{"Manufacturer: sms-gateway", "Model: simulator", "OK"}}, nil
+	case "AT+CPIN?":
+		switch s.pinState {
+		case MODEM_PIN_REQUIRED:
+			return ModemResponse{Lines: []string{"+CPIN: SIM PIN", "OK"}}, nil
+		case MODEM_PIN_PUK_REQUIRED:
+			return ModemResponse{Lines: []string{"+CPIN: SIM PUK", "OK"}}, nil
+		}
+		return ModemResponse{Lines: []string{"+CPIN: READY", "OK"}}, nil
+	case "AT+CREG?":
+		// the connection states are numbered like the <stat> values of +CREG
+		return ModemResponse{Lines: []string{"+CREG: 0," + strconv.Itoa(int(s.registration)), "OK"}}, nil
+	case "AT+CSQ":
+		if s.registration.IsRegistered() {
+			return ModemResponse{Lines: []string{"+CSQ: 20,0", "OK"}}, nil
+		}
+		return ModemResponse{Lines: []string{"+CSQ: 99,99", "OK"}}, nil
+	}
+	return ModemResponse{Lines: []string{"ERROR"}}, nil
+}
+
+func (s *Simulator) ReadMessages(ctx context.Context) ([]ReceivedSms, []ReceivedStatusReport, error) {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.prepare(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.simulateLatency(ctx)
+	if s.simulateFailure() {
+		return nil, nil, errors.New("Simulated modem failure while listing messages")
+	}
+	return slices.Clone(s.storedMessages), slices.Clone(s.storedReports), nil
+}
+
+func (s *Simulator) DeleteMessage(ctx context.Context, storageIndex int) error {
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := s.prepare(ctx)
+	if err != nil {
+		return err
+	}
+	s.simulateLatency(ctx)
+	for idx, msg := range s.storedMessages {
+		if msg.StorageIndex == storageIndex {
+			s.storedMessages = slices.Delete(s.storedMessages, idx, idx+1)
+			return nil
+		}
+	}
+	for idx, report := range s.storedReports {
+		if report.StorageIndex == storageIndex {
+			s.storedReports = slices.Delete(s.storedReports, idx, idx+1)
+			return nil
+		}
+	}
+	// +CMS ERROR: 321 = invalid memory index
+	return errors.New("Deleting message #" + strconv.Itoa(storageIndex) + " failed: +CMS ERROR: 321")
+}
+
+// HandsetInbox returns all messages the simulated handset of a recipient received, oldest first
+func (s *Simulator) HandsetInbox(recipient string) []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return slices.Clone(s.handsets[recipient])
+}
+
+// ReceiveSms simulates an incoming message, storing it in the modem's message storage.
+// Texts too long for a single SMS are stored as the parts of a concatenated SMS.
+func (s *Simulator) ReceiveSms(sender string, text string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	segments, _, _ := SplitMessage(text, 0, 255, 8)
+	reference := 0
+	if len(segments) > 1 {
+		reference = s.nextConcatRef
+		s.nextConcatRef = (s.nextConcatRef + 1) % 256
+	}
+	now := time.Now()
+	for idx, segment := range segments {
+		deliver := SmsDeliver{Sender: sender, Timestamp: now, Text: segment}
+		if len(segments) > 1 {
+			deliver.ConcatReference = reference
+			deliver.ConcatTotal = len(segments)
+			deliver.ConcatSequence = idx + 1
+		}
+		s.storedMessages = append(s.storedMessages, ReceivedSms{StorageIndex: s.newStorageIndex(), SmsDeliver: deliver})
+	}
+}
+
+// SetRegistration changes the simulated network registration state
+func (s *Simulator) SetRegistration(status ConnectionStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.registration = status
+}
@@ -0,0 +1,248 @@
+package modem
+
+import (
+	"context"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+// recipients configured by loadTestConfig
+var testRecipients = []string{"+491111111111", "+492222222222"}
+
+// loadTestConfig creates config and state using a minimal configuration plus extra [modem] and [sms] settings and sections
+func loadTestConfig(t *testing.T, modemSettings string, smsSettings string, extraSections string) (*config.Config, *state.State) {
+	dataDir := t.TempDir()
+	content := "[common]\ndataDirectory=" + dataDir + "\n" +
+		"[restapi]\nbindIp=127.0.0.1\nport=9999\nuser=user\npassword=password\n" +
+		"[modem]\nsimPin=1234\n" + modemSettings + "\n" +
+		"[sms]\nrecipients=" + strings.Join(testRecipients, ",") + "\n" + smsSettings + "\n" +
+		extraSections + "\n"
+	configFile := dataDir + "/test.conf"
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %s", err.Error())
+	}
+	appConfig, err := config.LoadConfig(configFile, false)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err.Error())
+	}
+	appState, err := state.Init(appConfig)
+	if err != nil {
+		t.Fatalf("failed to initialize state: %s", err.Error())
+	}
+	return appConfig, appState
+}
+
+// newTestSimulator creates a simulator in PDU mode with extra [sms] and [simulator] settings
+func newTestSimulator(t *testing.T, smsSettings string, simulatorSettings string) *Simulator {
+	appConfig, appState := loadTestConfig(t, "driver=simulator\nsmsMode=pdu", smsSettings, "[simulator]\n"+simulatorSettings)
+	return New(appConfig, appState, appConfig.GetModems()[0]).(*Simulator)
+}
+
+func TestSimulatorSendsToAllRecipients(t *testing.T) {
+	sim := newTestSimulator(t, "maxSegments=3\nreceivePollInterval=1m\ndeliveryReports=true", "")
+	text := strings.Repeat("0123456789", 20)
+
+	result := sim.SendSms(context.Background(), text, testRecipients)
+	if !result.Success {
+		t.Fatalf("sending failed: %s", result.Details)
+	}
+	if result.SegmentsSent != 4 || len(result.Submissions) != 4 {
+		t.Fatalf("expected 2 segments to each of 2 recipients, got %d", result.SegmentsSent)
+	}
+	if result.Submissions[2].Recipient != "+492222222222" || result.Submissions[2].Reference != 2 {
+		t.Errorf("wrong third submission %+v", result.Submissions[2])
+	}
+	for _, recipient := range []string{"+491111111111", "+492222222222"} {
+		inbox := sim.HandsetInbox(recipient)
+		if len(inbox) != 1 || inbox[0] != text {
+			t.Errorf("handset %s did not receive the message, inbox: %v", recipient, inbox)
+		}
+	}
+
+	messages, reports, err := sim.ReadMessages(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(messages) != 0 || len(reports) != 4 {
+		t.Fatalf("expected 4 status reports and no messages, got %d/%d", len(reports), len(messages))
+	}
+	if reports[3].Reference != 3 || reports[3].Recipient != "+492222222222" || !reports[3].IsDelivered() {
+		t.Errorf("wrong status report %+v", reports[3])
+	}
+}
+
+func TestSimulatorPinHandling(t *testing.T) {
+	sim := newTestSimulator(t, "", "pinState=pin\npin=0000")
+
+	if _, err := sim.GetConnectionStatus(context.Background()); err == nil || !strings.Contains(err.Error(), "+CME ERROR: 16") {
+		t.Fatalf("expected wrong PIN error, got %v", err)
+	}
+	// the wrong PIN must not be entered again, which would lock the SIM card eventually
+	_, err := sim.GetConnectionStatus(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "rejected") || sim.pinAttemptsLeft != simulatorPinAttempts-1 {
+		t.Fatalf("expected rejected PIN not to be tried again, got %v", err)
+	}
+
+	sim = newTestSimulator(t, "", "pinState=puk")
+	_, err = sim.GetConnectionStatus(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "PUK") {
+		t.Fatalf("expected SIM card to require PUK, got %v", err)
+	}
+	// messages need to stay queued until the SIM card gets unlocked
+	if result := sim.SendSms(context.Background(), "hello", testRecipients); result.Success || result.Error == nil || result.IsPermanentFailure() {
+		t.Errorf("expected sending to fail transiently while the SIM card requires the PUK, got %+v", result)
+	}
+	if err = sim.UnlockSimWithPuk(context.Background(), "87654321", "4321"); err == nil {
+		t.Errorf("expected wrong PUK to fail")
+	}
+	if err = sim.UnlockSimWithPuk(context.Background(), "12345678", "4321"); err != nil {
+		t.Fatalf("unlocking with PUK failed: %s", err.Error())
+	}
+	simStatus, err := sim.GetSimStatus(context.Background())
+	if err != nil || simStatus.PinState != MODEM_PIN_NOT_REQUIRED || simStatus.PinRetries != simulatorPinAttempts || simStatus.PukRetries != simulatorPukAttempts {
+		t.Errorf("expected unlocked SIM card with all attempts left, got %+v / %v", simStatus, err)
+	}
+
+	sim = newTestSimulator(t, "", "pinState=pin\npin=1234")
+	status, err := sim.GetConnectionStatus(context.Background())
+	if err != nil || status != CON_STATUS_REGISTERED_HOME {
+		t.Errorf("expected registered modem after unlocking, got %s / %v", status.String(), err)
+	}
+}
+
+func TestSimulatorRegistrationAndFailures(t *testing.T) {
+	sim := newTestSimulator(t, "", "registration=denied")
+	status, err := sim.GetConnectionStatus(context.Background())
+	if err != nil || status != CON_STATUS_NOT_REGISTERED_DENIED {
+		t.Errorf("expected registration denied, got %s / %v", status.String(), err)
+	}
+	if result := sim.SendSms(context.Background(), "hello", testRecipients); result.Success || result.Reason != MODEM_ERR_MODEM_ERROR {
+		t.Errorf("sending must fail without network registration")
+	}
+	sim.SetRegistration(CON_STATUS_REGISTERED_ROAMING)
+	if result := sim.SendSms(context.Background(), "hello", testRecipients); !result.Success {
+		t.Errorf("sending failed while roaming: %s", result.Details)
+	}
+
+	sim = newTestSimulator(t, "", "failureRate=1")
+	if result := sim.SendSms(context.Background(), "hello", testRecipients); result.Success {
+		t.Errorf("sending must fail with failure rate 1")
+	}
+	if len(sim.HandsetInbox("+491111111111")) != 0 {
+		t.Errorf("handset must not receive failed messages")
+	}
+}
+
+func TestSimulatorReceiveSms(t *testing.T) {
+	sim := newTestSimulator(t, "", "")
+	sim.ReceiveSms("+493333333333", "short")
+	sim.ReceiveSms("+494444444444", strings.Repeat("x", 200))
+
+	messages, _, err := sim.ReadMessages(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err.Error())
+	}
+	if len(messages) != 3 {
+		t.Fatalf("expected 1 single and 2 concatenated parts, got %d messages", len(messages))
+	}
+	if messages[0].Text != "short" || messages[0].IsConcatenated() {
+		t.Errorf("wrong first message %+v", messages[0])
+	}
+	if !messages[2].IsConcatenated() || messages[2].ConcatSequence != 2 || messages[2].ConcatTotal != 2 {
+		t.Errorf("wrong concatenation info %+v", messages[2])
+	}
+
+	if err = sim.DeleteMessage(context.Background(), messages[0].StorageIndex); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+	if err = sim.DeleteMessage(context.Background(), messages[0].StorageIndex); err == nil {
+		t.Errorf("deleting a message twice must fail")
+	}
+	messages, _, _ = sim.ReadMessages(context.Background())
+	if len(messages) != 2 {
+		t.Errorf("expected 2 messages after deletion, got %d", len(messages))
+	}
+}
+
+func TestSimulatorUssd(t *testing.T) {
+	sim := newTestSimulator(t, "", "balance=4.20")
+
+	response, err := sim.SendUssd(context.Background(), "*100#")
+	if err != nil || response.Status != USSD_STATUS_DONE || response.Text != "Your balance is 4.20 EUR." {
+		t.Errorf("wrong balance answer %+v / %v", response, err)
+	}
+	response, _ = sim.SendUssd(context.Background(), "*101#")
+	if !response.IsSessionOpen() {
+		t.Fatalf("expected menu, got %+v", response)
+	}
+	response, _ = sim.SendUssd(context.Background(), "2")
+	if response.Status != USSD_STATUS_TERMINATED {
+		t.Errorf("expected session to get terminated, got %+v", response)
+	}
+	if response, _ = sim.SendUssd(context.Background(), "*999#"); response.Status != USSD_STATUS_NOT_SUPPORTED {
+		t.Errorf("expected unknown code to be not supported, got %+v", response)
+	}
+}
+
+func TestSimulatorUnknownRecipient(t *testing.T) {
+	sim := newTestSimulator(t, "", "")
+
+	result := sim.SendSms(context.Background(), "hello", []string{"+491111111111", "not a number"})
+	if !result.IsPermanentFailure() || result.Error.Code != 1 || len(result.CompletedRecipients) != 1 {
+		t.Errorf("expected permanent failure after the first recipient, got %+v", result)
+	}
+}
+
+func TestSimulatorRecovery(t *testing.T) {
+	sim := newTestSimulator(t, "", "pinState=pin\npin=1234")
+
+	if status, err := sim.Probe(context.Background()); err != nil || status != CON_STATUS_REGISTERED_HOME {
+		t.Fatalf("expected healthy modem, got %s / %v", status.String(), err)
+	}
+	if err := sim.Recover(context.Background(), config.RECOVERY_STEP_REOPEN); err != nil || sim.pinState != MODEM_PIN_NOT_REQUIRED {
+		t.Errorf("re-opening must not lock the SIM card, got %v", err)
+	}
+	if err := sim.Recover(context.Background(), config.RECOVERY_STEP_SOFT_RESET); err != nil || sim.pinState != MODEM_PIN_REQUIRED {
+		t.Errorf("reset must lock the SIM card again, got %v", err)
+	}
+	if _, err := sim.Probe(context.Background()); err != nil || sim.pinState != MODEM_PIN_NOT_REQUIRED {
+		t.Errorf("SIM card was not unlocked after reset, got %v", err)
+	}
+}
+
+func TestSimulatorAtConsole(t *testing.T) {
+	appConfig, appState := loadTestConfig(t, "driver=simulator", "", "[admin]\nuser=admin\npassword=secret\nallowedCommands=AT+C,ATI")
+	sim := New(appConfig, appState, appConfig.GetModems()[0])
+
+	response, err := sim.SendAtCommand(context.Background(), "at+creg?")
+	if err != nil || !slices.Equal(response.Lines, []string{"+CREG: 0,1", "OK"}) {
+		t.Errorf("unexpected response %v / %v", response.Lines, err)
+	}
+	if _, err = sim.SendAtCommand(context.Background(), "+CREG?"); err == nil {
+		t.Errorf("expected command without 'AT' to be rejected")
+	}
+	// the default denied commands apply on top of the allowed ones
+	for cmd, allowed := range map[string]bool{"AT+CSQ": true, "ati": true, "ATZ": false, "AT+CPIN?": true, "AT+CPIN=\"1234\"": false, "at+clck=\"SC\",0": false,
+		// modems ignore whitespace, so must the denied commands
+		"AT+CFUN =0": false, "AT+CPIN = \"1234\"": false, "AT + CFUN=0": false, "AT+CMGS=\"+491111111111\"": false} {
+		if appConfig.IsAtCommandAllowed(cmd) != allowed {
+			t.Errorf("expected %s to be allowed: %t", cmd, allowed)
+		}
+	}
+	// chained commands would get past the denied commands as only the first one is matched
+	for _, cmd := range []string{"AT+CSQ;+CLCK=\"SC\",0,\"1234\"", "ATE0+CPIN=\"1234\"", "AT&F^SYSCFG=2", "ATI;"} {
+		if _, err = sim.SendAtCommand(context.Background(), cmd); err == nil {
+			t.Errorf("expected chained command %s to be rejected", cmd)
+		}
+	}
+	for _, cmd := range []string{"AT+CMGS=\"+491111111111\"", "AT&F", "AT^SYSINFO", "AT+CUSD=1,\"*100#;+\",15", "AT +CSQ"} {
+		if err = ValidateAtCommand(cmd); err != nil {
+			t.Errorf("expected %s to be accepted, got %s", cmd, err.Error())
+		}
+	}
+}
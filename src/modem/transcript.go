@@ -0,0 +1,303 @@
+package modem
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A transcript records everything sent to and received from a modem, one line per read or write:
+//
+//	2026-10-16T10:00:00.123456+02:00 > "AT+CSQ\r"
+//	2026-10-16T10:00:00.150012+02:00 < "\r\n+CSQ: 20,99\r\n\r\nOK\r\n"
+//
+// '>' lines were sent to the modem and '<' lines received from it, 'open' and 'close' lines mark the serial port
+// getting opened and closed. Lines starting with '#' are comments. Replaying a transcript via serialPort=replay://<file>
+// plays the modem's part of it, timestamps are informational only.
+const (
+	TRANSCRIPT_SENT     = ">"
+	TRANSCRIPT_RECEIVED = "<"
+	TRANSCRIPT_OPEN     = "open"
+	TRANSCRIPT_CLOSE    = "close"
+)
+
+const transcriptTimestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// how many rotated transcript files to keep, named <file>.1 (most recent) to <file>.3
+const transcriptBackups = 3
+
+// transcriptRecorder appends to a modem's transcript file, rotating it once it exceeds its maximum size
+type transcriptRecorder struct {
+	path    string
+	maxSize int64
+
+	mutex sync.Mutex
+	// nil until the first entry gets recorded or after writing failed
+	file *os.File
+	size int64
+}
+
+func newTranscriptRecorder(path string, maxSize int64) *transcriptRecorder {
+	return &transcriptRecorder{path: path, maxSize: maxSize}
+}
+
+// record appends an entry to the transcript, data is left out if nil
+func (r *transcriptRecorder) record(kind string, data []byte) {
+	line := time.Now().Format(transcriptTimestampFormat) + " " + kind
+	if data != nil {
+		line += " " + strconv.Quote(string(data))
+	}
+	line += "\n"
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.file != nil && r.size+int64(len(line)) > r.maxSize {
+		r.rotate()
+	}
+	if r.file == nil {
+		if err := r.open(); err != nil {
+			log.Error("Failed to open transcript file '" + r.path + "' - " + err.Error())
+			return
+		}
+	}
+	count, err := r.file.WriteString(line)
+	r.size += int64(count)
+	if err != nil {
+		log.Error("Failed to write transcript file '" + r.path + "' - " + err.Error())
+		_ = r.file.Close()
+		r.file = nil
+	}
+}
+
+// open opens the transcript file for appending, needs to be called with the mutex held
+func (r *transcriptRecorder) open() error {
+	if err := os.MkdirAll(filepath.Dir(r.path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// rotate renames the transcript file to <file>.1, shifting older ones and dropping the oldest,
+// needs to be called with the mutex held
+func (r *transcriptRecorder) rotate() {
+	_ = r.file.Close()
+	r.file = nil
+	for idx := transcriptBackups - 1; idx >= 1; idx-- {
+		_ = os.Rename(r.path+"."+strconv.Itoa(idx), r.path+"."+strconv.Itoa(idx+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		log.Warn("Failed to rotate transcript file '" + r.path + "' - " + err.Error())
+	}
+}
+
+// recordingTransport records everything read from and written to a transport in a transcript
+type recordingTransport struct {
+	transport
+	recorder *transcriptRecorder
+}
+
+func (t recordingTransport) Read(data []byte) (int, error) {
+	count, err := t.transport.Read(data)
+	if count > 0 {
+		t.recorder.record(TRANSCRIPT_RECEIVED, data[:count])
+	}
+	return count, err
+}
+
+func (t recordingTransport) Write(data []byte) (int, error) {
+	// recorded before writing as the modem's response may already get read before Write() returns,
+	// which would break replaying the transcript
+	if len(data) > 0 {
+		t.recorder.record(TRANSCRIPT_SENT, data)
+	}
+	return t.transport.Write(data)
+}
+
+func (t recordingTransport) Close() error {
+	t.recorder.record(TRANSCRIPT_CLOSE, nil)
+	return t.transport.Close()
+}
+
+type transcriptEntry struct {
+	kind string
+	data []byte
+}
+
+// readTranscript reads a transcript file and splits it into sessions, each starting with the serial port
+// getting opened. Entries before the first 'open' line make up a session of their own.
+func readTranscript(path string) ([][]transcriptEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	var sessions [][]transcriptEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 2 {
+			return nil, errors.New("Transcript " + path + ", line " + strconv.Itoa(lineNo) + ": expected <timestamp> <kind> [data]")
+		}
+		kind := fields[1]
+		switch kind {
+		case TRANSCRIPT_OPEN:
+			sessions = append(sessions, []transcriptEntry{})
+			continue
+		case TRANSCRIPT_CLOSE:
+			continue
+		case TRANSCRIPT_SENT, TRANSCRIPT_RECEIVED:
+		default:
+			return nil, errors.New("Transcript " + path + ", line " + strconv.Itoa(lineNo) + ": unknown kind '" + kind + "'")
+		}
+		if len(fields) < 3 {
+			return nil, errors.New("Transcript " + path + ", line " + strconv.Itoa(lineNo) + ": data is missing")
+		}
+		data, err := strconv.Unquote(fields[2])
+		if err != nil {
+			return nil, errors.New("Transcript " + path + ", line " + strconv.Itoa(lineNo) + ": invalid data - " + err.Error())
+		}
+		if len(sessions) == 0 {
+			sessions = append(sessions, []transcriptEntry{})
+		}
+		sessions[len(sessions)-1] = append(sessions[len(sessions)-1], transcriptEntry{kind: kind, data: []byte(data)})
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// openReplayTransport replays a session of a transcript file, index 0 being the first one
+func openReplayTransport(path string, session int) (transport, error) {
+	sessions, err := readTranscript(path)
+	if err != nil {
+		return nil, err
+	}
+	if session >= len(sessions) {
+		return nil, errors.New("Transcript " + path + " has no session #" + strconv.Itoa(session+1) + " to replay, it contains " +
+			strconv.Itoa(len(sessions)))
+	}
+	return newReplayTransport(sessions[session]), nil
+}
+
+// replayTransport plays the modem's part of a recorded session: whatever the modem sent before the next command
+// can be read right away, writing that command makes the modem's response available. Writing anything else fails.
+type replayTransport struct {
+	mutex sync.Mutex
+	// signals readers that data became available or the transport got closed
+	cond    *sync.Cond
+	entries []transcriptEntry
+	// data the modem sent that was not read yet, split like it was received when recording
+	pending [][]byte
+	// remaining bytes of the command that is being written
+	expected []byte
+	closed   bool
+}
+
+func newReplayTransport(entries []transcriptEntry) *replayTransport {
+	result := &replayTransport{entries: entries}
+	result.cond = sync.NewCond(&result.mutex)
+	result.advance()
+	return result
+}
+
+// advance makes everything the modem sent up to the next command available for reading,
+// needs to be called with the mutex held
+func (t *replayTransport) advance() {
+	for len(t.entries) > 0 && t.entries[0].kind == TRANSCRIPT_RECEIVED {
+		t.pending = append(t.pending, t.entries[0].data)
+		t.entries = t.entries[1:]
+	}
+	t.cond.Broadcast()
+}
+
+func (t *replayTransport) Read(data []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for len(t.pending) == 0 && !t.closed {
+		t.cond.Wait()
+	}
+	if t.closed {
+		return 0, os.ErrClosed
+	}
+	count := copy(data, t.pending[0])
+	t.pending[0] = t.pending[0][count:]
+	if len(t.pending[0]) == 0 {
+		t.pending = t.pending[1:]
+	}
+	return count, nil
+}
+
+func (t *replayTransport) Write(data []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.closed {
+		return 0, os.ErrClosed
+	}
+	remaining := data
+	for len(remaining) > 0 {
+		if len(t.expected) == 0 {
+			t.advance()
+			if len(t.entries) == 0 {
+				return 0, errors.New("Transcript ended, did not expect " + strconv.Quote(string(remaining)) + " to be sent")
+			}
+			t.expected = t.entries[0].data
+			t.entries = t.entries[1:]
+		}
+		count := min(len(remaining), len(t.expected))
+		if !bytes.Equal(remaining[:count], t.expected[:count]) {
+			return 0, errors.New("Transcript expected " + strconv.Quote(string(t.expected)) + " to be sent, got " +
+				strconv.Quote(string(remaining)))
+		}
+		remaining = remaining[count:]
+		t.expected = t.expected[count:]
+	}
+	if len(t.expected) == 0 {
+		t.advance()
+	}
+	return len(data), nil
+}
+
+// Drain does nothing, written data is checked right away
+func (t *replayTransport) Drain() error {
+	return nil
+}
+
+func (t *replayTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.closed = true
+	t.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,130 @@
+package modem
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"code-sourcery.de/sms-gateway/config"
+)
+
+func TestTranscriptRecorderRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcripts", "modem.log")
+	recorder := newTranscriptRecorder(path, 200)
+	for i := 0; i < 20; i++ {
+		recorder.record(TRANSCRIPT_SENT, []byte("AT+CSQ\r"))
+		recorder.record(TRANSCRIPT_RECEIVED, []byte("\r\n+CSQ: 20,99\r\n\r\nOK\r\n"))
+	}
+	for _, name := range []string{path, path + ".1", path + ".2", path + ".3"} {
+		info, err := os.Stat(name)
+		if err != nil || info.Size() > 200 {
+			t.Errorf("expected %s to exist and be smaller than 200 bytes, got %v / %v", name, info, err)
+		}
+	}
+	if _, err := os.Stat(path + ".4"); err == nil {
+		t.Errorf("expected only %d rotated files to be kept", transcriptBackups)
+	}
+
+	sessions, err := readTranscript(path + ".1")
+	if err != nil || len(sessions) != 1 || len(sessions[0]) == 0 {
+		t.Fatalf("failed to read rotated transcript: %v / %v", sessions, err)
+	}
+	for _, entry := range sessions[0] {
+		if (entry.kind == TRANSCRIPT_SENT && string(entry.data) != "AT+CSQ\r") ||
+			(entry.kind == TRANSCRIPT_RECEIVED && string(entry.data) != "\r\n+CSQ: 20,99\r\n\r\nOK\r\n") {
+			t.Errorf("unexpected entry %s %q", entry.kind, entry.data)
+		}
+	}
+}
+
+func TestReadTranscriptRejectsInvalidLines(t *testing.T) {
+	tests := map[string]string{
+		"2026-10-16T13:11:55.759684Z\n":             "expected <timestamp> <kind>",
+		"2026-10-16T13:11:55.759684Z ! \"AT\\r\"\n": "unknown kind",
+		"2026-10-16T13:11:55.759684Z >\n":           "data is missing",
+		"2026-10-16T13:11:55.759684Z > AT\n":        "invalid data",
+	}
+	for content, expected := range tests {
+		path := filepath.Join(t.TempDir(), "modem.log")
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readTranscript(path); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%q: expected error containing '%s', got %v", content, expected, err)
+		}
+	}
+}
+
+func TestReplayTransport(t *testing.T) {
+	port := newReplayTransport([]transcriptEntry{
+		{TRANSCRIPT_RECEIVED, []byte("\r\nRING\r\n")},
+		{TRANSCRIPT_SENT, []byte("AT+CSQ\r")},
+		{TRANSCRIPT_RECEIVED, []byte("\r\n+CSQ: 20,99\r\n")},
+		{TRANSCRIPT_RECEIVED, []byte("\r\nOK\r\n")},
+	})
+	buffer := make([]byte, 64)
+	if count, err := port.Read(buffer); err != nil || string(buffer[:count]) != "\r\nRING\r\n" {
+		t.Errorf("expected data received before the first command, got %q / %v", buffer[:count], err)
+	}
+	if _, err := port.Write([]byte("AT+CREG?\r")); err == nil || !strings.Contains(err.Error(), "expected \"AT+CSQ\\r\"") {
+		t.Errorf("expected unexpected command to be refused, got %v", err)
+	}
+
+	// commands may be written in pieces, the response arrives in the recorded chunks
+	if _, err := port.Write([]byte("AT+")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := port.Write([]byte("CSQ\r")); err != nil {
+		t.Fatal(err)
+	}
+	var chunks []string
+	for len(chunks) < 2 {
+		count, err := port.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, string(buffer[:count]))
+	}
+	if !slices.Equal(chunks, []string{"\r\n+CSQ: 20,99\r\n", "\r\nOK\r\n"}) {
+		t.Errorf("unexpected response %q", chunks)
+	}
+	if _, err := port.Write([]byte("AT\r")); err == nil || !strings.Contains(err.Error(), "Transcript ended") {
+		t.Errorf("expected writing past the end of the transcript to fail, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := port.Read(buffer)
+		done <- err
+	}()
+	_ = port.Close()
+	if err := <-done; err == nil {
+		t.Errorf("expected closing to interrupt a pending read")
+	}
+}
+
+func TestReplayedSubmissionWithInterleavedUrcs(t *testing.T) {
+	subscription := SubscribeUrcs()
+	defer subscription.Close()
+
+	appConfig, appState := loadTestConfig(t, "serialPort="+config.SERIAL_PORT_REPLAY_PREFIX+"testdata/cmgs-interleaved-urcs.transcript"+
+		"\nserialSpeed=115200\nserialReadTimeoutSeconds=1\ninitCmds=ATE0\\rAT^CURC=0\nsmsMode=text", "", "")
+	m := newSerialModem(appConfig, appState, appConfig.GetModems()[0])
+	t.Cleanup(m.Close)
+
+	result := m.SendSms(context.Background(), "Hello world", testRecipients[:1])
+	if !result.Success || result.Submissions[0].Reference != 42 {
+		t.Fatalf("replaying failed: %+v", result)
+	}
+	var urcs []string
+	for len(subscription.C) > 0 {
+		urc := <-subscription.C
+		urcs = append(urcs, urc.Line)
+	}
+	if !slices.Equal(urcs, []string{"+CMTI: \"SM\",3", "^RSSI: 17"}) {
+		t.Errorf("expected the URCs to be published, got %q", urcs)
+	}
+}
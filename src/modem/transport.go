@@ -0,0 +1,312 @@
+package modem
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"go.bug.st/serial"
+)
+
+// transport is the byte stream to a modem: a local serial port or a TCP connection to a serial server like ser2net
+type transport interface {
+	io.ReadWriteCloser
+	// Drain waits until all data written got transmitted
+	Drain() error
+}
+
+// how long to wait for a serial server to accept the connection and to acknowledge the RFC 2217 port settings
+var remoteConnectTimeout = 10 * time.Second
+
+// openTransport opens a local serial device or connects to the serial server at a tcp://<host>:<port>
+// or rfc2217://<host>:<port> address
+func openTransport(portName string, baudRate int, readTimeout time.Duration) (transport, error) {
+
+	if strings.HasPrefix(portName, config.SERIAL_PORT_TCP_PREFIX) {
+		conn, err := net.DialTimeout("tcp", strings.TrimPrefix(portName, config.SERIAL_PORT_TCP_PREFIX), remoteConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return tcpTransport{conn}, nil
+	}
+	if strings.HasPrefix(portName, config.SERIAL_PORT_RFC2217_PREFIX) {
+		conn, err := net.DialTimeout("tcp", strings.TrimPrefix(portName, config.SERIAL_PORT_RFC2217_PREFIX), remoteConnectTimeout)
+		if err != nil {
+			return nil, err
+		}
+		return newRfc2217Transport(conn, baudRate)
+	}
+
+	mode := &serial.Mode{
+		BaudRate: baudRate,
+		Parity:   serial.NoParity,
+		DataBits: 8,
+		StopBits: serial.OneStopBit,
+	}
+	port, err := serial.Open(portName, mode)
+	if err != nil {
+		return nil, err
+	}
+	err = port.SetReadTimeout(readTimeout)
+	if err != nil {
+		_ = port.Close()
+		return nil, errors.New("failed to set read timeout " + readTimeout.String() + " - " + err.Error())
+	}
+	return port, nil
+}
+
+// tcpTransport is a raw TCP connection to a serial server, the server's port settings apply
+type tcpTransport struct {
+	net.Conn
+}
+
+// Drain does nothing, there is no way to tell when the serial server has transmitted the data
+func (t tcpTransport) Drain() error {
+	return nil
+}
+
+// telnet commands and options, see RFC 854 and RFC 2217
+const (
+	telnetSe   = 240
+	telnetSb   = 250
+	telnetWill = 251
+	telnetWont = 252
+	telnetDo   = 253
+	telnetDont = 254
+	telnetIac  = 255
+
+	telnetOptionBinary          = 0
+	telnetOptionSuppressGoAhead = 3
+	telnetOptionComPort         = 44
+)
+
+// RFC 2217 COM-PORT-OPTION commands, the server acknowledges each one with the command + 100
+const (
+	comPortSetBaudRate = 1
+	comPortSetDataSize = 2
+	comPortSetParity   = 3
+	comPortSetStopSize = 4
+	comPortServerReply = 100
+
+	comPortParityNone    = 1
+	comPortOneStopBit    = 1
+	comPortEightDataBits = 8
+)
+
+// options the client asks for, both directions
+var rfc2217Options = []byte{telnetOptionBinary, telnetOptionSuppressGoAhead, telnetOptionComPort}
+
+type telnetState int
+
+const (
+	telnetStateData telnetState = iota
+	telnetStateIac
+	telnetStateOption
+	telnetStateSb
+	telnetStateSbIac
+)
+
+// rfc2217Transport talks telnet with RFC 2217 COM port control to a serial server, setting the baud rate
+// when connecting and stripping telnet negotiation from the data received
+type rfc2217Transport struct {
+	conn       net.Conn
+	writeMutex sync.Mutex
+
+	// telnet decoder, only used by Read()
+	state   telnetState
+	command byte
+	subneg  []byte
+	// data received while negotiating the port settings
+	pending []byte
+	// TRUE if the server refused the COM-PORT-OPTION
+	refused bool
+	// baud rate acknowledged by the server, 0 until then
+	baudRate int
+}
+
+// newRfc2217Transport negotiates binary mode and the port settings, closing the connection if the server
+// does not acknowledge the baud rate in time
+func newRfc2217Transport(conn net.Conn, baudRate int) (*rfc2217Transport, error) {
+
+	t := &rfc2217Transport{conn: conn}
+	var negotiation []byte
+	for _, option := range rfc2217Options {
+		negotiation = append(negotiation, telnetIac, telnetWill, option, telnetIac, telnetDo, option)
+	}
+	baud := binary.BigEndian.AppendUint32(nil, uint32(baudRate))
+	negotiation = append(negotiation, comPortCommand(comPortSetBaudRate, baud...)...)
+	negotiation = append(negotiation, comPortCommand(comPortSetDataSize, comPortEightDataBits)...)
+	negotiation = append(negotiation, comPortCommand(comPortSetParity, comPortParityNone)...)
+	negotiation = append(negotiation, comPortCommand(comPortSetStopSize, comPortOneStopBit)...)
+
+	fail := func(msg string) (*rfc2217Transport, error) {
+		_ = conn.Close()
+		return nil, errors.New(msg)
+	}
+	if err := t.writeRaw(negotiation); err != nil {
+		return fail("RFC 2217 negotiation failed - " + err.Error())
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(remoteConnectTimeout)); err != nil {
+		return fail("RFC 2217 negotiation failed - " + err.Error())
+	}
+	buffer := make([]byte, 256)
+	var pending []byte
+	for t.baudRate == 0 {
+		count, err := t.Read(buffer)
+		pending = append(pending, buffer[:count]...)
+		if t.refused {
+			return fail("Serial server does not support RFC 2217 COM port control")
+		}
+		if err != nil {
+			return fail("Serial server did not acknowledge baud rate " + strconv.Itoa(baudRate) + " - " + err.Error())
+		}
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return fail("RFC 2217 negotiation failed - " + err.Error())
+	}
+	if t.baudRate != baudRate {
+		log.Warn("Serial server uses baud rate " + strconv.Itoa(t.baudRate) + " instead of " + strconv.Itoa(baudRate))
+	}
+	t.pending = pending
+	return t, nil
+}
+
+// comPortCommand returns the sub-negotiation sending a COM-PORT-OPTION command, escaping IAC bytes in the value
+func comPortCommand(cmd byte, value ...byte) []byte {
+	result := []byte{telnetIac, telnetSb, telnetOptionComPort, cmd}
+	result = append(result, bytes.ReplaceAll(value, []byte{telnetIac}, []byte{telnetIac, telnetIac})...)
+	return append(result, telnetIac, telnetSe)
+}
+
+func (t *rfc2217Transport) writeRaw(data []byte) error {
+	t.writeMutex.Lock()
+	defer t.writeMutex.Unlock()
+	_, err := t.conn.Write(data)
+	return err
+}
+
+// Write sends data to the modem, escaping IAC bytes
+func (t *rfc2217Transport) Write(data []byte) (int, error) {
+	err := t.writeRaw(bytes.ReplaceAll(data, []byte{telnetIac}, []byte{telnetIac, telnetIac}))
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Read returns the data the modem sent, answering telnet negotiation along the way.
+// Returns no data if only telnet commands were received.
+func (t *rfc2217Transport) Read(data []byte) (int, error) {
+	if len(t.pending) > 0 {
+		count := copy(data, t.pending)
+		t.pending = t.pending[count:]
+		return count, nil
+	}
+	raw := make([]byte, len(data))
+	count, err := t.conn.Read(raw)
+	return t.decode(raw[:count], data), err
+}
+
+// decode strips telnet commands from raw, writing the remaining data to out and returning its length
+func (t *rfc2217Transport) decode(raw []byte, out []byte) int {
+	count := 0
+	for _, b := range raw {
+		switch t.state {
+		case telnetStateData:
+			if b == telnetIac {
+				t.state = telnetStateIac
+			} else {
+				out[count] = b
+				count++
+			}
+		case telnetStateIac:
+			switch b {
+			case telnetIac:
+				out[count] = b
+				count++
+				t.state = telnetStateData
+			case telnetWill, telnetWont, telnetDo, telnetDont:
+				t.command = b
+				t.state = telnetStateOption
+			case telnetSb:
+				t.subneg = t.subneg[:0]
+				t.state = telnetStateSb
+			default:
+				// NOP, GA, ... carry no meaning for a serial link
+				t.state = telnetStateData
+			}
+		case telnetStateOption:
+			t.handleOption(t.command, b)
+			t.state = telnetStateData
+		case telnetStateSb:
+			if b == telnetIac {
+				t.state = telnetStateSbIac
+			} else {
+				t.subneg = append(t.subneg, b)
+			}
+		case telnetStateSbIac:
+			switch b {
+			case telnetIac:
+				t.subneg = append(t.subneg, b)
+				t.state = telnetStateSb
+			case telnetSe:
+				t.handleSubnegotiation()
+				t.state = telnetStateData
+			default:
+				t.state = telnetStateData
+			}
+		}
+	}
+	return count
+}
+
+// handleOption refuses all options except the ones the client asked for itself, acknowledgements of those need no answer
+func (t *rfc2217Transport) handleOption(command byte, option byte) {
+	requested := slices.Contains(rfc2217Options, option)
+	var err error
+	switch command {
+	case telnetWill:
+		if !requested {
+			err = t.writeRaw([]byte{telnetIac, telnetDont, option})
+		}
+	case telnetDo:
+		if !requested {
+			err = t.writeRaw([]byte{telnetIac, telnetWont, option})
+		}
+	case telnetDont:
+		if option == telnetOptionComPort {
+			t.refused = true
+		}
+	}
+	if err != nil {
+		log.Debug("Failed to answer telnet negotiation - " + err.Error())
+	}
+}
+
+// handleSubnegotiation picks the baud rate from the server's acknowledgement, line and modem state
+// notifications are ignored
+func (t *rfc2217Transport) handleSubnegotiation() {
+	if len(t.subneg) < 2 || t.subneg[0] != telnetOptionComPort {
+		return
+	}
+	if t.subneg[1] == comPortServerReply+comPortSetBaudRate && len(t.subneg) == 6 {
+		t.baudRate = int(binary.BigEndian.Uint32(t.subneg[2:]))
+	}
+}
+
+// Drain does nothing, there is no way to tell when the serial server has transmitted the data
+func (t *rfc2217Transport) Drain() error {
+	return nil
+}
+
+func (t *rfc2217Transport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,361 @@
+//go:build linux
+
+package modem
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/emulator"
+)
+
+// fakeSerialServer bridges TCP connections to an emulated modem like ser2net does, optionally speaking RFC 2217
+type fakeSerialServer struct {
+	t        *testing.T
+	listener net.Listener
+	rfc2217  bool
+
+	mutex    sync.Mutex
+	conns    []net.Conn
+	accepted int
+	baudRate int
+}
+
+func newFakeSerialServer(t *testing.T, devicePath string, rfc2217 bool) *fakeSerialServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	server := &fakeSerialServer{t: t, listener: listener, rfc2217: rfc2217}
+	go server.accept(devicePath)
+	t.Cleanup(func() {
+		_ = listener.Close()
+		server.dropConnections()
+	})
+	return server
+}
+
+func (s *fakeSerialServer) address() string {
+	if s.rfc2217 {
+		return config.SERIAL_PORT_RFC2217_PREFIX + s.listener.Addr().String()
+	}
+	return config.SERIAL_PORT_TCP_PREFIX + s.listener.Addr().String()
+}
+
+func (s *fakeSerialServer) getAccepted() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.accepted
+}
+
+func (s *fakeSerialServer) getBaudRate() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.baudRate
+}
+
+// dropConnections closes all client connections, like a serial server that got restarted
+func (s *fakeSerialServer) dropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *fakeSerialServer) accept(devicePath string) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		device, err := os.OpenFile(devicePath, os.O_RDWR, 0)
+		if err != nil {
+			s.t.Errorf("failed to open %s: %s", devicePath, err.Error())
+			_ = conn.Close()
+			continue
+		}
+		s.mutex.Lock()
+		s.conns = append(s.conns, conn)
+		s.accepted++
+		s.mutex.Unlock()
+
+		go s.forwardToClient(device, conn)
+		go func() {
+			s.forwardToModem(conn, device)
+			_ = conn.Close()
+			_ = device.Close()
+		}()
+	}
+}
+
+func (s *fakeSerialServer) forwardToClient(device io.Reader, conn net.Conn) {
+	buffer := make([]byte, 256)
+	for {
+		count, err := device.Read(buffer)
+		if err != nil {
+			return
+		}
+		data := buffer[:count]
+		if s.rfc2217 {
+			// modem state notifications in between the modem's output need to be stripped by the client
+			notification := []byte{telnetIac, telnetSb, telnetOptionComPort, 107, 0x30, telnetIac, telnetSe}
+			data = append(notification, bytes.ReplaceAll(data, []byte{telnetIac}, []byte{telnetIac, telnetIac})...)
+		}
+		if _, err = conn.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeSerialServer) forwardToModem(conn net.Conn, device io.Writer) {
+	buffer := make([]byte, 256)
+	state := telnetStateData
+	var subneg []byte
+	for {
+		count, err := conn.Read(buffer)
+		if err != nil {
+			return
+		}
+		if !s.rfc2217 {
+			if _, err = device.Write(buffer[:count]); err != nil {
+				return
+			}
+			continue
+		}
+		var data []byte
+		for _, b := range buffer[:count] {
+			switch state {
+			case telnetStateData:
+				if b == telnetIac {
+					state = telnetStateIac
+				} else {
+					data = append(data, b)
+				}
+			case telnetStateIac:
+				switch b {
+				case telnetIac:
+					data = append(data, b)
+					state = telnetStateData
+				case telnetSb:
+					subneg = nil
+					state = telnetStateSb
+				default:
+					state = telnetStateOption
+				}
+			case telnetStateOption:
+				state = telnetStateData
+			case telnetStateSb:
+				if b == telnetIac {
+					state = telnetStateSbIac
+				} else {
+					subneg = append(subneg, b)
+				}
+			case telnetStateSbIac:
+				state = telnetStateData
+				if len(subneg) < 2 || subneg[0] != telnetOptionComPort {
+					continue
+				}
+				if subneg[1] == comPortSetBaudRate {
+					s.mutex.Lock()
+					s.baudRate = int(binary.BigEndian.Uint32(subneg[2:]))
+					s.mutex.Unlock()
+				}
+				_, _ = conn.Write(comPortCommand(subneg[1]+comPortServerReply, subneg[2:]...))
+			}
+		}
+		if _, err = device.Write(data); err != nil {
+			return
+		}
+	}
+}
+
+// newRemoteModem creates a serial modem driver talking to an emulated modem via a serial server
+func newRemoteModem(t *testing.T, rfc2217 bool) (*serialModem, *emulator.Emulator, *fakeSerialServer) {
+	emu, err := emulator.New(emulator.Options{})
+	if err != nil {
+		t.Fatalf("failed to start emulator: %s", err.Error())
+	}
+	t.Cleanup(emu.Close)
+	server := newFakeSerialServer(t, emu.Path(), rfc2217)
+
+	appConfig, appState := loadTestConfig(t, "serialPort="+server.address()+"\nserialSpeed=115200\nserialReadTimeoutSeconds=1\n"+
+		"initCmds=ATE0\\rAT^CURC=0\n", "", "")
+	m := newSerialModem(appConfig, appState, appConfig.GetModems()[0])
+	t.Cleanup(m.Close)
+	return m, emu, server
+}
+
+func TestSerialModemOverTcpReconnects(t *testing.T) {
+	m, emu, server := newRemoteModem(t, false)
+
+	status, err := m.GetConnectionStatus(context.Background())
+	if err != nil || status != CON_STATUS_REGISTERED_HOME {
+		t.Fatalf("expected home network, got %s / %v", status, err)
+	}
+	if result := m.SendSms(context.Background(), "Hello", testRecipients[:1]); !result.Success {
+		t.Fatalf("sending failed: %s", result.Details)
+	}
+	if len(emu.Submitted()) != 1 {
+		t.Errorf("expected one message to reach the modem, got %d", len(emu.Submitted()))
+	}
+
+	// like a local serial port that vanished, the failing command closes the link and the next one reconnects
+	server.dropConnections()
+	time.Sleep(100 * time.Millisecond)
+	if _, err = m.GetConnectionStatus(context.Background()); err == nil {
+		t.Fatal("expected dropped connection to fail the command")
+	}
+	status, err = m.GetConnectionStatus(context.Background())
+	if err != nil || status != CON_STATUS_REGISTERED_HOME {
+		t.Fatalf("reconnecting failed: %s / %v", status, err)
+	}
+	if server.getAccepted() != 2 {
+		t.Errorf("expected two connections, got %d", server.getAccepted())
+	}
+}
+
+func TestSerialModemOverRfc2217(t *testing.T) {
+	m, emu, server := newRemoteModem(t, true)
+
+	if err := m.Init(context.Background()); err != nil {
+		t.Fatalf("init failed: %s", err.Error())
+	}
+	if server.getBaudRate() != 115200 {
+		t.Errorf("expected baud rate 115200 to be negotiated, got %d", server.getBaudRate())
+	}
+	if result := m.SendSms(context.Background(), "Hello", testRecipients[:1]); !result.Success {
+		t.Fatalf("sending failed: %s", result.Details)
+	}
+	// no telnet negotiation may leak into the commands the modem receives
+	commands := emu.Commands()
+	if len(commands) < 4 || !slices.Equal(commands[:4], []string{"ATI", "ATE0", "AT^CURC=0", "AT+CMEE=1"}) {
+		t.Errorf("unexpected command sequence %v", commands)
+	}
+}
+
+// startTelnetScript accepts a single connection and hands it to the script
+func startTelnetScript(t *testing.T, script func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() {
+			_ = conn.Close()
+		}()
+		script(conn)
+	}()
+	return listener.Addr().String()
+}
+
+func TestRfc2217Transport(t *testing.T) {
+	expectedNegotiation := []byte{
+		telnetIac, telnetWill, 0, telnetIac, telnetDo, 0, telnetIac, telnetWill, 3, telnetIac, telnetDo, 3,
+		telnetIac, telnetWill, 44, telnetIac, telnetDo, 44,
+		telnetIac, telnetSb, 44, 1, 0x00, 0x00, 0x25, 0x80, telnetIac, telnetSe,
+		telnetIac, telnetSb, 44, 2, 8, telnetIac, telnetSe,
+		telnetIac, telnetSb, 44, 3, 1, telnetIac, telnetSe,
+		telnetIac, telnetSb, 44, 4, 1, telnetIac, telnetSe,
+	}
+	serverDone := make(chan struct{})
+	address := startTelnetScript(t, func(conn net.Conn) {
+		defer close(serverDone)
+		negotiation := make([]byte, len(expectedNegotiation))
+		if _, err := io.ReadFull(conn, negotiation); err != nil || !bytes.Equal(negotiation, expectedNegotiation) {
+			t.Errorf("unexpected negotiation %v (%v)", negotiation, err)
+			return
+		}
+		// unknown options get refused, the baud rate acknowledged, IAC IAC is a data byte, NOP (241) gets ignored
+		_, _ = conn.Write([]byte{telnetIac, telnetDo, 24, telnetIac, telnetWill, 1,
+			telnetIac, telnetSb, 44, 101, 0x00, 0x00, 0x25, 0x80, telnetIac, telnetSe,
+			'A', telnetIac, telnetIac, 'B', telnetIac, 241, 'C'})
+		refusals := make([]byte, 6)
+		if _, err := io.ReadFull(conn, refusals); err != nil ||
+			!bytes.Equal(refusals, []byte{telnetIac, telnetWont, 24, telnetIac, telnetDont, 1}) {
+			t.Errorf("expected unknown options to be refused, got %v (%v)", refusals, err)
+		}
+		written := make([]byte, 3)
+		if _, err := io.ReadFull(conn, written); err != nil || !bytes.Equal(written, []byte{'x', telnetIac, telnetIac}) {
+			t.Errorf("expected IAC to be escaped, got %v (%v)", written, err)
+		}
+	})
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("failed to connect: %s", err.Error())
+	}
+	port, err := newRfc2217Transport(conn, 9600)
+	if err != nil {
+		t.Fatalf("negotiation failed: %s", err.Error())
+	}
+	defer func() {
+		_ = port.Close()
+	}()
+
+	var received []byte
+	buffer := make([]byte, 16)
+	for len(received) < 4 {
+		count, err := port.Read(buffer)
+		if err != nil {
+			t.Fatalf("reading failed: %s", err.Error())
+		}
+		received = append(received, buffer[:count]...)
+	}
+	if !bytes.Equal(received, []byte{'A', telnetIac, 'B', 'C'}) {
+		t.Errorf("unexpected data %v", received)
+	}
+	if _, err = port.Write([]byte{'x', telnetIac}); err != nil {
+		t.Fatalf("writing failed: %s", err.Error())
+	}
+	<-serverDone
+}
+
+func TestRfc2217TransportRefused(t *testing.T) {
+	oldTimeout := remoteConnectTimeout
+	remoteConnectTimeout = 500 * time.Millisecond
+	defer func() {
+		remoteConnectTimeout = oldTimeout
+	}()
+
+	tests := []struct {
+		reply    []byte
+		expected string
+	}{
+		// plain telnet server without COM port control
+		{[]byte{telnetIac, telnetDont, 44}, "does not support"},
+		// raw TCP server ignoring the negotiation
+		{nil, "did not acknowledge"},
+	}
+	for _, test := range tests {
+		address := startTelnetScript(t, func(conn net.Conn) {
+			_, _ = conn.Write(test.reply)
+			_, _ = io.Copy(io.Discard, conn)
+		})
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			t.Fatalf("failed to connect: %s", err.Error())
+		}
+		if _, err = newRfc2217Transport(conn, 115200); err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("expected error containing '%s', got %v", test.expected, err)
+		}
+	}
+}
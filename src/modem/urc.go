@@ -0,0 +1,147 @@
+package modem
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many URCs a subscriber may lag behind before further URCs get dropped
+const urcSubscriptionBuffer = 32
+
+// UnsolicitedResult is an unsolicited result code (URC) a modem sent on its own, like '+CMTI: "SM",3'
+type UnsolicitedResult struct {
+	// name of the modem that sent the URC
+	Modem string
+	// the URC, lines of URCs spanning multiple lines (like +CMT or +CUSD) are separated by CR LF
+	Line     string
+	Received time.Time
+}
+
+// Code returns the result code without its value, like "+CMTI" or "RING"
+func (u UnsolicitedResult) Code() string {
+	code, _, _ := strings.Cut(u.Line, ":")
+	return strings.TrimSpace(code)
+}
+
+// urcPrefixes lists the unsolicited result codes we know about, including Huawei's '^' ones
+var urcPrefixes = []string{
+	"+CMTI:", "+CDSI:", "+CMT:", "+CDS:", "+CBM:", "+CUSD:", "+CREG:", "+CGREG:", "+CEREG:", "+CRING:", "RING", "NO CARRIER",
+	"^RSSI:", "^HCSQ:", "^SIMST:", "^MODE:", "^SYSSTART", "^BOOT:", "^SRVST:", "^CEND:", "^ORIG:", "^CONF:", "^CONN:",
+	"^DSFLOWRPT:", "^NDISSTAT:", "^STIN:", "^RFSWITCH:", "^CSNR:", "^NWTIME:", "+PACSP",
+}
+
+// unsolicited result codes followed by a second line holding the PDU
+var twoLineUrcPrefixes = []string{"+CMT:", "+CDS:", "+CBM:"}
+
+var commandNameRegEx = regexp.MustCompile(`^AT([+^][A-Z]+)`)
+
+// isUrc returns TRUE if a line is an unsolicited result code and not part of the response to the given AT command,
+// '+CREG: 0,1' is the response to AT+CREG? but unsolicited while any other command is running
+func isUrc(line string, cmd string) bool {
+	trimmed := strings.TrimSpace(line)
+	for _, prefix := range urcPrefixes {
+		if strings.HasPrefix(trimmed, prefix) {
+			match := commandNameRegEx.FindStringSubmatch(strings.ToUpper(cmd))
+			return match == nil || strings.TrimSuffix(prefix, ":") != match[1]
+		}
+	}
+	return false
+}
+
+// urcAssembler picks the unsolicited result codes from the lines received from a modem,
+// collecting the continuation lines of URCs that span multiple lines
+type urcAssembler struct {
+	modemName string
+	// AT command the modem is currently answering, "" if none
+	cmd string
+	// lines of a multi-line URC received so far
+	partial []string
+}
+
+// isComplete returns TRUE if all lines of a (multi-line) URC have been received
+func (a *urcAssembler) isComplete() bool {
+	first := strings.TrimSpace(a.partial[0])
+	for _, prefix := range twoLineUrcPrefixes {
+		if strings.HasPrefix(first, prefix) {
+			return len(a.partial) == 2
+		}
+	}
+	if strings.HasPrefix(first, "+CUSD:") {
+		// the text of a USSD answer may contain line breaks
+		return strings.Count(strings.Join(a.partial, "\r\n"), "\"")%2 == 0
+	}
+	return true
+}
+
+// offer returns TRUE if the line is (part of) an unsolicited result code, publishing the URC once it is complete
+func (a *urcAssembler) offer(line string) bool {
+	if a.partial == nil {
+		if !isUrc(line, a.cmd) {
+			return false
+		}
+	}
+	a.partial = append(a.partial, strings.TrimSpace(line))
+	if a.isComplete() {
+		urc := UnsolicitedResult{Modem: a.modemName, Line: strings.Join(a.partial, "\r\n"), Received: time.Now()}
+		a.partial = nil
+		log.Debug("Modem '" + a.modemName + "' sent unsolicited result code " + urc.Line)
+		urcBus.publish(urc)
+	}
+	return true
+}
+
+// UrcSubscription receives the unsolicited result codes of all modems until it gets closed
+type UrcSubscription struct {
+	C       <-chan UnsolicitedResult
+	channel chan UnsolicitedResult
+}
+
+// Close stops the subscription, C does not receive any more URCs afterwards
+func (s *UrcSubscription) Close() {
+	urcBus.unsubscribe(s)
+}
+
+// eventBus hands unsolicited result codes to all subscribers
+type eventBus struct {
+	mutex       sync.Mutex
+	subscribers []*UrcSubscription
+}
+
+var urcBus = &eventBus{}
+
+// SubscribeUrcs subscribes to the unsolicited result codes of all modems. URCs are dropped for
+// subscribers that do not keep up, subscribers need to Close() the subscription when done.
+func SubscribeUrcs() *UrcSubscription {
+	channel := make(chan UnsolicitedResult, urcSubscriptionBuffer)
+	subscription := &UrcSubscription{C: channel, channel: channel}
+
+	urcBus.mutex.Lock()
+	defer urcBus.mutex.Unlock()
+	urcBus.subscribers = append(urcBus.subscribers, subscription)
+	return subscription
+}
+
+func (b *eventBus) unsubscribe(subscription *UrcSubscription) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for idx, candidate := range b.subscribers {
+		if candidate == subscription {
+			b.subscribers = append(b.subscribers[:idx], b.subscribers[idx+1:]...)
+			return
+		}
+	}
+}
+
+func (b *eventBus) publish(urc UnsolicitedResult) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, subscriber := range b.subscribers {
+		select {
+		case subscriber.channel <- urc:
+		default:
+			log.Warn("Dropping unsolicited result code " + urc.Line + " of modem '" + urc.Modem + "', subscriber does not keep up")
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package modem
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+)
+
+// how long to wait for the network's answer to a USSD request
+const ussdTimeout = 30 * time.Second
+
+// data coding scheme used for USSD requests (GSM-7, language unspecified)
+const ussdRequestDcs = 15
+
+type UssdStatus int
+
+const (
+	USSD_STATUS_DONE            UssdStatus = iota // no further user action required
+	USSD_STATUS_ACTION_REQUIRED                   // the network expects another input within the same session
+	USSD_STATUS_TERMINATED                        // session terminated by the network
+	USSD_STATUS_OTHER_CLIENT                      // other local client has responded
+	USSD_STATUS_NOT_SUPPORTED                     // operation not supported
+	USSD_STATUS_TIMEOUT                           // network did not answer in time
+)
+
+func (s UssdStatus) String() string {
+	switch s {
+	case USSD_STATUS_DONE:
+		return "done"
+	case USSD_STATUS_ACTION_REQUIRED:
+		return "action_required"
+	case USSD_STATUS_TERMINATED:
+		return "terminated"
+	case USSD_STATUS_OTHER_CLIENT:
+		return "other_client"
+	case USSD_STATUS_NOT_SUPPORTED:
+		return "not_supported"
+	case USSD_STATUS_TIMEOUT:
+		return "timeout"
+	}
+	panic("Unhandled USSD status " + strconv.Itoa(int(s)))
+}
+
+// UssdResponse is the network's answer to a USSD request
+type UssdResponse struct {
+	Status UssdStatus
+	// decoded text of the answer, empty if the network sent none
+	Text string
+	// data coding scheme of the answer
+	Dcs int
+}
+
+// IsSessionOpen returns TRUE if the network expects another input
+func (r UssdResponse) IsSessionOpen() bool {
+	return r.Status == USSD_STATUS_ACTION_REQUIRED
+}
+
+// +CUSD: <m>[,"<str>"[,<dcs>]], the text may span multiple lines
+var cusdRegEx = regexp.MustCompile(`(?s)\+CUSD:\s*(\d+)(?:\s*,\s*"(.*?)"(?:\s*,\s*(\d+))?)?\s*\r\n`)
+
+// parseCusd looks for a complete +CUSD unsolicited result code in the data received from the modem,
+// returning FALSE if there is none (yet)
+func parseCusd(data string, packed bool) (UssdResponse, bool) {
+	match := cusdRegEx.FindStringSubmatch(data)
+	if match == nil {
+		return UssdResponse{}, false
+	}
+	status, _ := strconv.Atoi(match[1])
+	dcs := ussdRequestDcs
+	if match[3] != "" {
+		dcs, _ = strconv.Atoi(match[3])
+	}
+	return UssdResponse{Status: UssdStatus(status), Text: decodeUssdText(match[2], dcs, packed), Dcs: dcs}, true
+}
+
+// ussdAlphabet returns the alphabet used by a cell broadcast data coding scheme (3GPP TS 23.038 section 5),
+// which USSD uses as well: 0 = GSM-7, 1 = 8-bit data, 2 = UCS-2
+func ussdAlphabet(dcs int) int {
+	switch {
+	case dcs&0xf0 == 0x00:
+		return 0
+	case dcs == 0x10:
+		return 0
+	case dcs == 0x11:
+		return 2
+	case dcs&0xc0 == 0x40 || dcs&0xf0 == 0x90:
+		return (dcs >> 2) & 0x03
+	case dcs&0xf0 == 0xf0:
+		return (dcs >> 2) & 0x01
+	}
+	return 0
+}
+
+// decodeUssdText decodes the text of a USSD answer. UCS-2 answers are always hex-encoded,
+// GSM-7 answers only if the modem uses packed USSD strings. Text that is not valid hex is returned as-is.
+func decodeUssdText(text string, dcs int, packed bool) string {
+	switch ussdAlphabet(dcs) {
+	case 0:
+		if !packed {
+			return text
+		}
+		data, err := hex.DecodeString(text)
+		if err != nil {
+			return text
+		}
+		septets := unpackSeptets(data, len(data)*8/7, 0)
+		// a CR fills the last octet if it had 7 spare bits
+		if len(septets)%8 == 0 && len(septets) > 0 && septets[len(septets)-1] == 0x0d {
+			septets = septets[:len(septets)-1]
+		}
+		return decodeGsm7(septets)
+	case 2:
+		data, err := hex.DecodeString(text)
+		if err != nil || len(data)%2 != 0 {
+			return text
+		}
+		return decodeUcs2(data)
+	}
+	return text
+}
+
+// encodeUssdRequest packs a USSD string as hex-encoded GSM-7 for modems that expect packed USSD strings
+func encodeUssdRequest(code string) (string, error) {
+	septets, ok := encodeGsm7(code)
+	if !ok {
+		return "", errors.New("USSD string '" + code + "' contains characters not available in the GSM-7 alphabet")
+	}
+	if len(septets)%8 == 7 {
+		// avoid the receiver mistaking 7 spare bits for an '@'
+		septets = append(septets, 0x0d)
+	}
+	return strings.ToUpper(hex.EncodeToString(packSeptets(septets, 0))), nil
+}
+
+// waitForCusd waits for the +CUSD unsolicited result code of this modem, until the timeout elapsed or the context is done
+func (m *serialModem) waitForCusd(ctx context.Context, subscription *UrcSubscription, timeout time.Duration) UssdResponse {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case urc := <-subscription.C:
+			if urc.Modem != m.Name() || urc.Code() != "+CUSD" {
+				continue
+			}
+			if response, found := parseCusd(urc.Line+"\r\n", m.isUssdPacked()); found {
+				return response
+			}
+			log.Warn("Ignoring malformed USSD answer " + urc.Line)
+		case <-deadline.C:
+			return UssdResponse{Status: USSD_STATUS_TIMEOUT}
+		case <-ctx.Done():
+			return UssdResponse{Status: USSD_STATUS_TIMEOUT}
+		}
+	}
+}
+
+func (m *serialModem) SendUssd(ctx context.Context, code string) (UssdResponse, error) {
+
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return UssdResponse{Status: USSD_STATUS_DONE, Text: "fake answer (debug mode)"}, nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return UssdResponse{}, errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return UssdResponse{}, err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	err := m.unlockSim(ctx)
+	if err != nil {
+		return UssdResponse{}, err
+	}
+
+	encoded := code
+	if m.isUssdPacked() {
+		encoded, err = encodeUssdRequest(code)
+		if err != nil {
+			return UssdResponse{}, err
+		}
+	}
+	// the answer arrives as unsolicited result code, subscribe before the modem gets a chance to send it
+	subscription := SubscribeUrcs()
+	defer subscription.Close()
+
+	log.Info("Sending USSD request '" + code + "' using modem '" + m.Name() + "'")
+	response, err := m.sendCmd(ctx, "AT+CUSD=1,\""+encoded+"\","+strconv.Itoa(ussdRequestDcs), true)
+	if err != nil {
+		return UssdResponse{}, err
+	}
+	// some modems send the answer before the final result code
+	received := strings.Join(response.Lines, "\r\n") + "\r\n"
+	if result, found := parseCusd(received, m.isUssdPacked()); found {
+		return result, nil
+	}
+	if response.isError() {
+		return UssdResponse{}, errors.New("USSD request returned error response: " + response.String())
+	}
+	result := m.waitForCusd(ctx, subscription, ussdTimeout)
+	if result.Status == USSD_STATUS_TIMEOUT {
+		if ctx.Err() != nil {
+			log.Warn("Gave up waiting for answer to USSD request '" + code + "', cancelling session")
+		} else {
+			log.Warn("No answer to USSD request '" + code + "' within " + ussdTimeout.String() + ", cancelling session")
+		}
+		// the session needs to be closed even though the caller is gone
+		_, _ = m.sendCmd(context.WithoutCancel(ctx), "AT+CUSD=2", true)
+		if ctx.Err() != nil {
+			return UssdResponse{}, ctx.Err()
+		}
+	}
+	return result, nil
+}
+
+func (m *serialModem) CancelUssd(ctx context.Context) error {
+
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_SUCCEED) {
+		return nil
+	}
+	if m.appConfig.IsSet(config.DEBUG_FLAG_MODEM_ALWAYS_FAIL) {
+		return errors.New("Failed because of DEBUG_FLAG_MODEM_ALWAYS_FAIL flag")
+	}
+	if m.needsInit() {
+		err := m.Init(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	response, err := m.sendCmd(ctx, "AT+CUSD=2", true)
+	if err != nil {
+		return err
+	}
+	if response.isError() {
+		return errors.New("Cancelling USSD session returned error response: " + response.String())
+	}
+	return nil
+}
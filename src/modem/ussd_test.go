@@ -0,0 +1,46 @@
+package modem
+
+import (
+	"testing"
+)
+
+func TestParseCusd(t *testing.T) {
+	if _, found := parseCusd("+CUSD: 0,\"Your bal", false); found {
+		t.Errorf("incomplete answer must not be parsed")
+	}
+	response, found := parseCusd("\r\n+CUSD: 1,\"1: Balance\r\n2: Exit\",15\r\n", false)
+	if !found || response.Status != USSD_STATUS_ACTION_REQUIRED || response.Text != "1: Balance\r\n2: Exit" || !response.IsSessionOpen() {
+		t.Errorf("wrong multi-line answer %+v", response)
+	}
+	response, found = parseCusd("+CUSD: 2\r\n", false)
+	if !found || response.Status != USSD_STATUS_TERMINATED || response.Text != "" {
+		t.Errorf("wrong answer without text %+v", response)
+	}
+}
+
+func TestDecodeUssdText(t *testing.T) {
+	if text := decodeUssdText("0047007500740068006100620065006E003A002000310030002020AC", 72, false); text != "Guthaben: 10 €" {
+		t.Errorf("wrong UCS-2 text '%s'", text)
+	}
+	if text := decodeUssdText("AA180C3602", 15, true); text != "*100#" {
+		t.Errorf("wrong packed GSM-7 text '%s'", text)
+	}
+	if text := decodeUssdText("Plain text", 15, false); text != "Plain text" {
+		t.Errorf("wrong GSM-7 text '%s'", text)
+	}
+}
+
+func TestEncodeUssdRequest(t *testing.T) {
+	encoded, err := encodeUssdRequest("*100#")
+	if err != nil || encoded != "AA180C3602" {
+		t.Errorf("wrong packed request '%s' / %v", encoded, err)
+	}
+	// 7 characters need a CR pad that gets stripped again
+	encoded, _ = encodeUssdRequest("*123*1#")
+	if text := decodeUssdText(encoded, 15, true); text != "*123*1#" {
+		t.Errorf("round trip failed, got '%s'", text)
+	}
+	if _, err = encodeUssdRequest("日本"); err == nil {
+		t.Errorf("expected error for characters outside the GSM-7 alphabet")
+	}
+}
@@ -0,0 +1,153 @@
+package msgqueue
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+// how long a modem that failed is only used after all other modems
+const failoverBackoff = 1 * time.Minute
+
+// Dispatcher picks the modem to send a message with, either in priority order or round-robin,
+// and fails over to the next modem when one reports a modem error or is not registered to a network
+type Dispatcher struct {
+	modems    []modem.Modem
+	selection config.ModemSelection
+	appState  *state.State
+
+	mutex sync.Mutex
+	// index of the modem to start with for the next message, only used with round-robin selection
+	nextIndex int
+	// when each modem failed most recently, by modem name
+	failedAt map[string]time.Time
+}
+
+// NewDispatcher creates a dispatcher for the given modems, which need to be ordered ascending by priority
+func NewDispatcher(modems []modem.Modem, selection config.ModemSelection, appState *state.State) *Dispatcher {
+	return &Dispatcher{modems: modems, selection: selection, appState: appState, failedAt: make(map[string]time.Time)}
+}
+
+// candidates returns the modems to try for the next message, in the order they should be tried.
+// Modems that failed within the failover backoff period go last.
+func (d *Dispatcher) candidates() []modem.Modem {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	ordered := slices.Clone(d.modems)
+	if d.selection == config.MODEM_SELECTION_ROUND_ROBIN && len(ordered) > 0 {
+		start := d.nextIndex % len(ordered)
+		ordered = append(ordered[start:], ordered[:start]...)
+		d.nextIndex = start + 1
+	}
+
+	var healthy, failed []modem.Modem
+	for _, m := range ordered {
+		if failedAt, found := d.failedAt[m.Name()]; found && time.Since(failedAt) < failoverBackoff {
+			failed = append(failed, m)
+		} else {
+			healthy = append(healthy, m)
+		}
+	}
+	return append(healthy, failed...)
+}
+
+func (d *Dispatcher) markFailed(m modem.Modem) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.failedAt[m.Name()] = time.Now()
+}
+
+func (d *Dispatcher) markHealthy(m modem.Modem) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.failedAt, m.Name())
+}
+
+// IsFailedOver returns TRUE if the modem failed recently and is currently only used as a last resort
+func (d *Dispatcher) IsFailedOver(m modem.Modem) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	failedAt, found := d.failedAt[m.Name()]
+	return found && time.Since(failedAt) < failoverBackoff
+}
+
+// SendSms sends a message to all recipients. Recipients a modem failed to send the message to
+// are handed to the next modem, so a message fails only if no modem was able to send it.
+// Recipients the modem reports a permanent error concerning the recipient for (like an unassigned number) are
+// skipped instead, the message succeeds if it reached all other recipients. Other permanent errors (like a missing
+// SIM card) concern the modem and make the dispatcher fail over just like transient ones.
+func (d *Dispatcher) SendSms(ctx context.Context, message string, recipients []string) modem.SendResult {
+
+	result := modem.SendResult{Success: false, Reason: modem.MODEM_ERR_MODEM_ERROR, Details: "No modem available"}
+	remaining := recipients
+	var submissions []modem.Submission
+	var completed []string
+	var failures []modem.RecipientFailure
+	for _, m := range d.candidates() {
+
+		if d.appState.IsModemRateLimitExceeded(m.GetConfig()) {
+			log.Info("Skipping modem '" + m.Name() + "', its rate limit is exceeded")
+			result = modem.SendResult{Success: false, Reason: modem.MODEM_ERR_RATE_LIMIT_EXCEEDED, Details: "Rate limit exceeded"}
+			continue
+		}
+
+		status, err := m.GetConnectionStatus(ctx)
+		if err != nil || !status.IsRegistered() {
+			details := "Modem '" + m.Name() + "' is not registered to a network, status " + status.String()
+			if err != nil {
+				details = "Modem '" + m.Name() + "' failed to report its network registration: " + err.Error()
+			}
+			log.Warn(details)
+			d.markFailed(m)
+			result = modem.SendResult{Success: false, Reason: modem.MODEM_ERR_MODEM_ERROR, Details: details}
+			continue
+		}
+
+		result = m.SendSms(ctx, message, remaining)
+		for {
+			submissions = append(submissions, result.Submissions...)
+			completed = append(completed, result.CompletedRecipients...)
+			remaining = remaining[len(result.CompletedRecipients):]
+			if !result.IsRecipientFailure() {
+				break
+			}
+			// the recipient is at fault and not the modem, other modems would fail just the same
+			log.Error("Skipping recipient " + result.FailedRecipient + " after permanent failure: " + result.Error.Error())
+			failures = append(failures, modem.RecipientFailure{Recipient: result.FailedRecipient, Error: result.Error})
+			remaining = remaining[1:]
+			if len(remaining) == 0 {
+				break
+			}
+			result = m.SendSms(ctx, message, remaining)
+		}
+		if result.Success || len(remaining) == 0 {
+			d.markHealthy(m)
+			break
+		}
+		if result.Reason == modem.MODEM_ERR_RATE_LIMIT_EXCEEDED {
+			if d.appState.IsAnyRateLimitExceeded() {
+				// global rate limit, no other modem may send either
+				break
+			}
+			continue
+		}
+		log.Warn("Modem '" + m.Name() + "' failed to send message (" + result.Details + "), failing over to the next modem")
+		d.markFailed(m)
+	}
+	if len(remaining) == 0 && len(completed) > 0 && len(failures) > 0 {
+		result = modem.SendResult{Success: true, Reason: modem.MODEM_ERR_NONE,
+			Details: "success, " + strconv.Itoa(len(failures)) + " recipient(s) failed permanently"}
+	}
+	result.Submissions = submissions
+	result.SegmentsSent = len(submissions)
+	result.CompletedRecipients = completed
+	result.FailedRecipients = failures
+	return result
+}
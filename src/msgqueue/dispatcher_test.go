@@ -0,0 +1,166 @@
+package msgqueue
+
+import (
+	"context"
+	"os"
+	"slices"
+	"testing"
+
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+var testRecipients = []string{"+491111111111", "+492222222222"}
+
+// loadTestConfig loads a configuration with simulated 'primary' and 'backup' modems, extra [sms] settings and extra sections
+func loadTestConfig(t *testing.T, smsSettings string, extraSections string) (*config.Config, *state.State) {
+	dataDir := t.TempDir()
+	// 'backup' is declared first so that ordering by priority gets tested
+	content := "[common]\ndataDirectory=" + dataDir + "\n" +
+		"[restapi]\nbindIp=127.0.0.1\nport=9999\nuser=user\npassword=password\n" +
+		"[modem]\ndriver=simulator\nsimPin=1234\nsmsMode=pdu\n" +
+		"[modem.backup]\npriority=2\n" +
+		"[modem.primary]\npriority=1\n" +
+		"[sms]\nrecipients=+491111111111,+492222222222\n" + smsSettings + "\n" +
+		extraSections + "\n"
+	configFile := dataDir + "/test.conf"
+	if err := os.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatalf("failed to write config: %s", err.Error())
+	}
+	appConfig, err := config.LoadConfig(configFile, false)
+	if err != nil {
+		t.Fatalf("failed to load config: %s", err.Error())
+	}
+	appState, err := state.Init(appConfig)
+	if err != nil {
+		t.Fatalf("failed to initialize state: %s", err.Error())
+	}
+	return appConfig, appState
+}
+
+// newTestDispatcher creates a dispatcher for the simulated 'primary' and 'backup' modems, see loadTestConfig()
+func newTestDispatcher(t *testing.T, smsSettings string, extraSections string) (*Dispatcher, *modem.Simulator, *modem.Simulator, *state.State) {
+	appConfig, appState := loadTestConfig(t, smsSettings, extraSections)
+	modems := modem.NewAll(appConfig, appState)
+	if len(modems) != 2 || modems[0].Name() != "primary" || modems[1].Name() != "backup" {
+		t.Fatalf("expected modems 'primary' and 'backup' ordered by priority")
+	}
+	return NewDispatcher(modems, appConfig.GetModemSelection(), appState), modems[0].(*modem.Simulator), modems[1].(*modem.Simulator), appState
+}
+
+func TestDispatcherFailsOverWithoutRegistration(t *testing.T) {
+	dispatcher, primary, backup, _ := newTestDispatcher(t, "", "")
+
+	if result := dispatcher.SendSms(context.Background(), "first", testRecipients); !result.Success {
+		t.Fatalf("sending failed: %s", result.Details)
+	}
+	primary.SetRegistration(modem.CON_STATUS_NOT_REGISTERED_DENIED)
+	result := dispatcher.SendSms(context.Background(), "second", testRecipients)
+	if !result.Success || result.Submissions[0].Modem != "backup" {
+		t.Fatalf("expected message to be sent by backup modem, got %+v", result)
+	}
+	if !slices.Equal(primary.HandsetInbox(testRecipients[0]), []string{"first"}) ||
+		!slices.Equal(backup.HandsetInbox(testRecipients[0]), []string{"second"}) {
+		t.Errorf("messages sent by the wrong modems")
+	}
+	if !dispatcher.IsFailedOver(primary) || dispatcher.IsFailedOver(backup) {
+		t.Errorf("primary modem must be marked as failed")
+	}
+
+	backup.SetRegistration(modem.CON_STATUS_NOT_REGISTERED_SEARCHING)
+	result = dispatcher.SendSms(context.Background(), "third", testRecipients)
+	if result.Success || result.Reason != modem.MODEM_ERR_MODEM_ERROR {
+		t.Errorf("sending must fail without any registered modem, got %+v", result)
+	}
+}
+
+func TestDispatcherHandsRemainingRecipientsToNextModem(t *testing.T) {
+	// the primary modem may only send a single SMS
+	dispatcher, primary, backup, _ := newTestDispatcher(t, "", "[modem.primary]\nrateLimit1=0/1h")
+
+	result := dispatcher.SendSms(context.Background(), "hello", testRecipients)
+	if !result.Success || !slices.Equal(result.CompletedRecipients, testRecipients) {
+		t.Fatalf("sending failed: %+v", result)
+	}
+	if result.Submissions[0].Modem != "primary" || result.Submissions[1].Modem != "backup" {
+		t.Errorf("expected recipients to be split among modems, got %+v", result.Submissions)
+	}
+	if len(primary.HandsetInbox(testRecipients[1])) != 0 || len(backup.HandsetInbox(testRecipients[0])) != 0 {
+		t.Errorf("recipients must receive the message only once")
+	}
+
+	result = dispatcher.SendSms(context.Background(), "again", testRecipients)
+	if !result.Success || result.Submissions[0].Modem != "backup" {
+		t.Errorf("expected rate-limited primary modem to get skipped, got %+v", result)
+	}
+	if dispatcher.IsFailedOver(primary) {
+		t.Errorf("exceeding a rate limit must not mark the modem as failed")
+	}
+}
+
+func TestDispatcherRoundRobin(t *testing.T) {
+	dispatcher, primary, backup, _ := newTestDispatcher(t, "modemSelection=roundrobin", "")
+
+	for _, text := range []string{"one", "two", "three"} {
+		if result := dispatcher.SendSms(context.Background(), text, testRecipients[:1]); !result.Success {
+			t.Fatalf("sending failed: %s", result.Details)
+		}
+	}
+	if !slices.Equal(primary.HandsetInbox(testRecipients[0]), []string{"one", "three"}) ||
+		!slices.Equal(backup.HandsetInbox(testRecipients[0]), []string{"two"}) {
+		t.Errorf("modems did not take turns")
+	}
+}
+
+func TestDispatcherSkipsRecipientFailingPermanently(t *testing.T) {
+	dispatcher, primary, backup, _ := newTestDispatcher(t, "", "")
+
+	// the simulated network does not know 'typo', sending to it fails with '+CMS ERROR: 1'
+	recipients := []string{testRecipients[0], "typo", testRecipients[1]}
+	result := dispatcher.SendSms(context.Background(), "hello", recipients)
+	if !result.Success || !slices.Equal(result.CompletedRecipients, testRecipients) {
+		t.Fatalf("expected message to reach the other recipients, got %+v", result)
+	}
+	if len(result.FailedRecipients) != 1 || result.FailedRecipients[0].Recipient != "typo" || result.FailedRecipients[0].Error.Code != 1 {
+		t.Errorf("expected 'typo' to be reported as failed recipient, got %+v", result.FailedRecipients)
+	}
+	if dispatcher.IsFailedOver(primary) || len(backup.HandsetInbox(testRecipients[1])) != 0 {
+		t.Errorf("a recipient failing permanently must not make the dispatcher fail over")
+	}
+
+	result = dispatcher.SendSms(context.Background(), "hello", []string{"typo"})
+	if !result.IsPermanentFailure() || len(result.FailedRecipients) != 1 || dispatcher.IsFailedOver(primary) {
+		t.Errorf("expected message to fail permanently without any valid recipient, got %+v", result)
+	}
+}
+
+// simLessModem answers AT+CMGS with '+CMS ERROR: 310' like a modem whose SIM card got pulled
+type simLessModem struct {
+	*modem.Simulator
+}
+
+func (m simLessModem) SendSms(_ context.Context, _ string, recipients []string) modem.SendResult {
+	modemErr := &modem.ModemError{Prefix: "+CMS ERROR", Code: 310, Description: "SIM not inserted", Permanent: true}
+	return modem.SendResult{Reason: modem.MODEM_ERR_MODEM_ERROR, Details: modemErr.Error(), Error: modemErr, FailedRecipient: recipients[0]}
+}
+
+func TestDispatcherFailsOverOnPermanentModemError(t *testing.T) {
+	appConfig, appState := loadTestConfig(t, "", "")
+	modems := modem.NewAll(appConfig, appState)
+	primary, backup := simLessModem{modems[0].(*modem.Simulator)}, modems[1].(*modem.Simulator)
+	dispatcher := NewDispatcher([]modem.Modem{primary, backup}, appConfig.GetModemSelection(), appState)
+
+	result := dispatcher.SendSms(context.Background(), "hello", testRecipients)
+	if !result.Success || !slices.Equal(result.CompletedRecipients, testRecipients) || len(result.FailedRecipients) != 0 {
+		t.Fatalf("expected backup modem to send the message to all recipients, got %+v", result)
+	}
+	for _, recipient := range testRecipients {
+		if !slices.Equal(backup.HandsetInbox(recipient), []string{"hello"}) {
+			t.Errorf("expected %s to receive the message from the backup modem", recipient)
+		}
+	}
+	if !dispatcher.IsFailedOver(primary) {
+		t.Errorf("a modem without SIM card must be marked as failed")
+	}
+}
@@ -1,10 +1,11 @@
 package msgqueue
 
 import (
+	"context"
 	"errors"
 	"os"
+	"slices"
 	"strconv"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -24,31 +25,17 @@ var dataDir string
 
 var inboxDir string
 var sentDir string
+var failedDir string
 
 var appState *state.State
 var appConfig *config.Config
+var dispatcher *Dispatcher
 
 var inboxWatcherMutex sync.Mutex
 var shutdownTriggered atomic.Bool
 var inboxWatcherRunning atomic.Bool
 var inboxWatcherShutdownLatch sync.WaitGroup
 
-func createDir(parentDir string, childName string) (string, error) {
-	dataDir := parentDir
-	if !strings.HasSuffix(dataDir, "/") {
-		dataDir += "/"
-	}
-	dir := dataDir + childName
-	if !common.FileExist(dir) {
-		err := os.Mkdir(dir, 0755)
-		if err != nil {
-			log.Error("Failed to create directory '" + dir + "' - " + err.Error())
-			return "", err
-		}
-	}
-	return dir, nil
-}
-
 func listFilesInInbox() ([]string, error) {
 
 	// Read the contents of the directory
@@ -73,16 +60,12 @@ func StoreMessage(id message.MessageId, text string) error {
 
 	creationTime := time.Now()
 
-	maxLen := appConfig.GetMaxMessageLength()
-	if maxLen > 0 && len(text) > maxLen {
-		log.Warn("Message " + id.String() + " has length " + strconv.Itoa(len(text)) +
-			" which exceeds configured maxLen " + strconv.Itoa(maxLen) + ", will truncate message")
+	fitted, truncated := modem.FitMessage(appConfig, text)
+	if truncated {
+		log.Warn("Message " + id.String() + " exceeds configured maximum of " + strconv.Itoa(appConfig.GetMaxSegments()) +
+			" segment(s), will truncate message")
 		log.Warn("Original message: " + text)
-		text = text[:maxLen]
-		if len(text) > 3 {
-			text = text[:len(text)-3]
-			text = text + "..."
-		}
+		text = fitted
 	}
 
 	msg := message.Message{Id: id, CreationTimestamp: creationTime}
@@ -137,7 +120,10 @@ func inboxWatcher() {
 
 					if deliveryfailure.IsDue(msg.Id) {
 						rateLimitExceeded, err := sendMessage(msg)
-						if err != nil {
+						var permanent *permanentFailure
+						if errors.As(err, &permanent) {
+							deliveryfailure.DeliveryAborted(msg.Id)
+						} else if err != nil {
 							if rateLimitExceeded && appConfig.IsDropOnRateLimit() {
 								deliveryfailure.DeliveryAborted(msg.Id)
 							} else {
@@ -156,6 +142,56 @@ func inboxWatcher() {
 	log.Info("Stopping to watch inbox")
 }
 
+// permanentFailure is returned by sendMessage() if a message failed for a reason that retrying will not fix
+type permanentFailure struct {
+	reason *modem.ModemError
+}
+
+func (f *permanentFailure) Error() string {
+	return "Permanent failure: " + f.reason.Error()
+}
+
+// giveUp moves a message that failed permanently to the "failed" folder and remembers why it failed
+func giveUp(msg *message.Message, reason *modem.ModemError) error {
+	log.Error("Giving up on message " + msg.String() + " after permanent failure: " + reason.Error())
+	appState.RememberFailedMessage(msg.Id, reason.Error())
+	_ = appState.WriteState()
+
+	newFile := failedDir + "/" + msg.FileName
+	err := os.Rename(msg.AbsPath, newFile)
+	if err != nil {
+		log.Error("Failed to rename file '" + msg.AbsPath + "' -> " + newFile + " : " + err.Error())
+	} else {
+		log.Debug("Moved file '" + msg.AbsPath + "' -> " + newFile)
+	}
+	return &permanentFailure{reason: reason}
+}
+
+// rememberSubmissions remembers the SMS segments the network accepted for a message so that their status reports
+// can be matched, if delivery reports are enabled
+func rememberSubmissions(msg *message.Message, result modem.SendResult) {
+	if appConfig.IsDeliveryReports() {
+		for _, submission := range result.Submissions {
+			appState.RememberPendingDelivery(msg.Id, submission.Modem, submission.Recipient, submission.Reference)
+		}
+	}
+}
+
+// unsentRecipients returns the configured recipients a message neither reached nor failed permanently for yet
+func unsentRecipients(msgId message.MessageId, reachedEarlier []string) []string {
+	failed := appState.GetFailedRecipients(msgId)
+	var result []string
+	for _, recipient := range appConfig.GetSmsRecipients() {
+		isFailed := slices.ContainsFunc(failed, func(f state.FailedRecipient) bool {
+			return f.Recipient == recipient
+		})
+		if !isFailed && !slices.Contains(reachedEarlier, recipient) {
+			result = append(result, recipient)
+		}
+	}
+	return result
+}
+
 func sendMessage(msg *message.Message) (bool, error) {
 
 	if !appState.WasSentAlready(msg.Id) {
@@ -172,23 +208,49 @@ func sendMessage(msg *message.Message) (bool, error) {
 			}
 			return false, nil
 		}
-		result := modem.SendSms(string(*rawBytes))
-		if !result.Success {
+		// recipients reached by an earlier attempt must not receive the message twice
+		reachedEarlier := appState.GetCompletedRecipients(msg.Id)
+		recipients := unsentRecipients(msg.Id, reachedEarlier)
+		result := modem.SendResult{Success: true, Reason: modem.MODEM_ERR_NONE}
+		if len(recipients) > 0 {
+			result = dispatcher.SendSms(context.Background(), string(*rawBytes), recipients)
+		}
+		for _, failure := range result.FailedRecipients {
+			appState.RememberFailedRecipient(msg.Id, failure.Recipient, failure.Error.Error())
+		}
+		// all recipients not reached earlier failing permanently does not make the message fail
+		handled := len(result.CompletedRecipients)+len(result.FailedRecipients) == len(recipients)
+		if !result.Success && !(handled && len(reachedEarlier) > 0) {
+			// recipients that got the message before sending failed still count against the rate limits
+			// and may still get a delivery report
+			rememberSubmissions(msg, result)
+			appState.RememberCompletedRecipients(msg.Id, result.CompletedRecipients)
+			appState.RememberSegmentsSent(result.SegmentsSent)
+
 			if result.Reason == modem.MODEM_ERR_RATE_LIMIT_EXCEEDED {
 				if appConfig.IsDropOnRateLimit() {
 					err = os.Remove(msg.AbsPath)
 					if err != nil {
 						log.Warn("Failed to delete file '" + msg.AbsPath + "' after rate limit got exceeded - " + err.Error())
 					}
+					appState.DiscardMessageId(msg.Id)
 					log.Warn("DISCARDED message '" + msg.AbsPath + "' after rate limit got exceeded")
 				}
 				return true, errors.New("Rate limit exceeded")
 			}
+			if result.IsPermanentFailure() {
+				return false, giveUp(msg, result.Error)
+			}
 			return false, errors.New("Failed to send SMS: " + result.Reason.String() + ", details: " + result.Details)
 		}
-		log.Info("Message sent successfully: " + msg.String())
+		if len(result.FailedRecipients) > 0 {
+			log.Warn("Message " + msg.String() + " was not sent to " + strconv.Itoa(len(result.FailedRecipients)) +
+				" recipient(s) because of permanent errors")
+		}
+		log.Info("Message sent successfully (" + strconv.Itoa(result.SegmentsSent) + " segment(s)): " + msg.String())
 
-		appState.RememberSmsSend(*msg)
+		rememberSubmissions(msg, result)
+		appState.RememberSmsSend(*msg, result.SegmentsSent)
 	}
 
 	// move message to "sent" folder
@@ -202,32 +264,47 @@ func sendMessage(msg *message.Message) (bool, error) {
 	return false, nil
 }
 
-func Init(c *config.Config, state *state.State) error {
+func Init(c *config.Config, state *state.State, modems []modem.Modem) error {
 
 	var err error
-	err = modem.Init(c, state)
-	if err != nil {
+	initialized := 0
+	for _, m := range modems {
+		err = m.Init(context.Background())
+		if err != nil {
+			log.Error("Failed to initialize modem '" + m.Name() + "' - " + err.Error())
+			continue
+		}
+		m.Close()
+		initialized++
+	}
+	if initialized == 0 {
 		return err
 	}
-	defer modem.Close()
 
 	appState = state
 	appConfig = c
+	dispatcher = NewDispatcher(modems, c.GetModemSelection(), state)
 
 	// create top-level directory
-	dataDir, err = createDir(c.GetDataDirectory(), "messages")
+	dataDir, err = common.CreateDirIfMissing(c.GetDataDirectory(), "messages")
 	if err != nil {
 		return err
 	}
 
 	// create inbox directory
-	inboxDir, err = createDir(dataDir, "inbox")
+	inboxDir, err = common.CreateDirIfMissing(dataDir, "inbox")
 	if err != nil {
 		return err
 	}
 
 	// create sent directory
-	sentDir, err = createDir(dataDir, "sent")
+	sentDir, err = common.CreateDirIfMissing(dataDir, "sent")
+	if err != nil {
+		return err
+	}
+
+	// create directory for messages that failed permanently
+	failedDir, err = common.CreateDirIfMissing(dataDir, "failed")
 	if err != nil {
 		return err
 	}
@@ -236,6 +313,11 @@ func Init(c *config.Config, state *state.State) error {
 	return nil
 }
 
+// GetDispatcher returns the dispatcher used for sending messages
+func GetDispatcher() *Dispatcher {
+	return dispatcher
+}
+
 func Shutdown() {
 
 	log.Debug("Shutting down message queue")
@@ -0,0 +1,184 @@
+package msgqueue
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"code-sourcery.de/sms-gateway/common"
+	"code-sourcery.de/sms-gateway/message"
+	"code-sourcery.de/sms-gateway/modem"
+)
+
+// newTestQueue sets up the message queue with simulated 'primary' and 'backup' modems, see loadTestConfig()
+func newTestQueue(t *testing.T, smsSettings string, extraSections string) (*modem.Simulator, *modem.Simulator) {
+	appConfig, appState = loadTestConfig(t, smsSettings, extraSections)
+	modems := modem.NewAll(appConfig, appState)
+	dispatcher = NewDispatcher(modems, appConfig.GetModemSelection(), appState)
+
+	var err error
+	if dataDir, err = common.CreateDirIfMissing(appConfig.GetDataDirectory(), "messages"); err != nil {
+		t.Fatal(err)
+	}
+	if inboxDir, err = common.CreateDirIfMissing(dataDir, "inbox"); err != nil {
+		t.Fatal(err)
+	}
+	if sentDir, err = common.CreateDirIfMissing(dataDir, "sent"); err != nil {
+		t.Fatal(err)
+	}
+	if failedDir, err = common.CreateDirIfMissing(dataDir, "failed"); err != nil {
+		t.Fatal(err)
+	}
+	return modems[0].(*modem.Simulator), modems[1].(*modem.Simulator)
+}
+
+// enqueue stores a message in the inbox, returning it like the inbox watcher would find it
+func enqueue(t *testing.T, text string) *message.Message {
+	id := appState.NewMessageId()
+	if err := StoreMessage(id, text); err != nil {
+		t.Fatal(err)
+	}
+	files, err := listFilesInInbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if msg, err := message.MsgFromFileName(file); err == nil && msg.Id == id {
+			return msg
+		}
+	}
+	t.Fatalf("message %s not found in inbox", id.String())
+	return nil
+}
+
+// folderOf returns "inbox", "sent" or "failed" depending on where a message's file is
+func folderOf(t *testing.T, msg *message.Message) string {
+	for name, dir := range map[string]string{"inbox": inboxDir, "sent": sentDir, "failed": failedDir} {
+		if _, err := os.Stat(filepath.Join(dir, msg.FileName)); err == nil {
+			return name
+		}
+	}
+	t.Fatalf("message %s is gone", msg.String())
+	return ""
+}
+
+func TestPukLockedSimKeepsMessageQueued(t *testing.T) {
+	newTestQueue(t, "", "[simulator.primary]\npinState=puk\n[simulator.backup]\npinState=puk")
+
+	msg := enqueue(t, "hello")
+	if _, err := sendMessage(msg); err == nil {
+		t.Fatal("expected sending to fail while the SIM card requires the PUK")
+	}
+	if folder := folderOf(t, msg); folder != "inbox" {
+		t.Errorf("expected message to stay in the inbox until the SIM card gets unlocked, found it in %s", folder)
+	}
+	if appState.GetFailedMessage(msg.Id) != nil {
+		t.Errorf("message must not be given up on")
+	}
+}
+
+func TestRecipientFailingPermanentlyIsSkipped(t *testing.T) {
+	newTestQueue(t, "recipients=+491111111111,typo,+492222222222", "")
+
+	msg := enqueue(t, "hello")
+	if _, err := sendMessage(msg); err != nil {
+		t.Fatalf("expected message to be sent to the other recipients, got %v", err)
+	}
+	if folder := folderOf(t, msg); folder != "sent" {
+		t.Errorf("expected message to be moved to the sent folder, found it in %s", folder)
+	}
+	failed := appState.GetFailedRecipients(msg.Id)
+	if len(failed) != 1 || failed[0].Recipient != "typo" || !strings.Contains(failed[0].Reason, "+CMS ERROR: 1") {
+		t.Errorf("expected 'typo' to be recorded as failed recipient, got %+v", failed)
+	}
+}
+
+// failingModem fails permanently after the network accepted the message for the first recipient
+type failingModem struct {
+	*modem.Simulator
+}
+
+func (m failingModem) SendSms(_ context.Context, _ string, recipients []string) modem.SendResult {
+	return modem.SendResult{
+		Reason:              modem.MODEM_ERR_MODEM_ERROR,
+		Details:             "SMSC address unknown",
+		SegmentsSent:        1,
+		Submissions:         []modem.Submission{{Modem: m.Name(), Recipient: recipients[0], Reference: 7}},
+		CompletedRecipients: recipients[:1],
+		Error:               &modem.ModemError{Prefix: "+CMS ERROR", Code: 330, Description: "SMSC address unknown", Permanent: true},
+	}
+}
+
+func TestPermanentFailureRemembersAcceptedSegments(t *testing.T) {
+	primary, _ := newTestQueue(t, "deliveryReports=true\nreceivePollInterval=1m\nrateLimit1=0/1h\nrateLimit2=100/1d", "")
+	dispatcher = NewDispatcher([]modem.Modem{failingModem{primary}}, appConfig.GetModemSelection(), appState)
+
+	msg := enqueue(t, "hello")
+	if _, err := sendMessage(msg); err == nil {
+		t.Fatal("expected sending to fail permanently")
+	}
+	if folder := folderOf(t, msg); folder != "failed" {
+		t.Errorf("expected message to be moved to the failed folder, found it in %s", folder)
+	}
+	if deliveries := appState.GetDeliveries(msg.Id); len(deliveries) != 1 || deliveries[0].Reference != 7 {
+		t.Errorf("expected delivery of the accepted segment to be tracked, got %+v", deliveries)
+	}
+	if !appState.IsAnyRateLimitExceeded() {
+		t.Errorf("accepted segment must count against the rate limit")
+	}
+}
+
+// flakyModem reaches only the first recipient it gets handed, like a modem losing its connection while sending
+type flakyModem struct {
+	*modem.Simulator
+}
+
+func (m flakyModem) SendSms(ctx context.Context, text string, recipients []string) modem.SendResult {
+	result := m.Simulator.SendSms(ctx, text, recipients[:1])
+	if len(recipients) > 1 {
+		result.Success = false
+		result.Reason = modem.MODEM_ERR_MODEM_ERROR
+		result.Details = "connection lost"
+	}
+	return result
+}
+
+func TestRetryOnlySendsToRemainingRecipients(t *testing.T) {
+	primary, _ := newTestQueue(t, "deliveryReports=true\nreceivePollInterval=1m\nrateLimit1=1/1h\nrateLimit2=100/1d", "")
+	dispatcher = NewDispatcher([]modem.Modem{flakyModem{primary}}, appConfig.GetModemSelection(), appState)
+
+	msg := enqueue(t, "hello")
+	if _, err := sendMessage(msg); err == nil {
+		t.Fatal("expected sending to fail after the first recipient")
+	}
+	if folder := folderOf(t, msg); folder != "inbox" {
+		t.Fatalf("expected message to stay in the inbox, found it in %s", folder)
+	}
+	if completed := appState.GetCompletedRecipients(msg.Id); !slices.Equal(completed, testRecipients[:1]) {
+		t.Errorf("expected first recipient to be remembered, got %v", completed)
+	}
+	if len(appState.GetDeliveries(msg.Id)) != 1 || appState.IsAnyRateLimitExceeded() {
+		t.Errorf("expected the segment sent to the first recipient to be remembered")
+	}
+
+	if _, err := sendMessage(msg); err != nil {
+		t.Fatalf("expected retry to succeed, got %v", err)
+	}
+	if folder := folderOf(t, msg); folder != "sent" {
+		t.Errorf("expected message to be moved to the sent folder, found it in %s", folder)
+	}
+	for _, recipient := range testRecipients {
+		if inbox := primary.HandsetInbox(recipient); len(inbox) != 1 {
+			t.Errorf("expected %s to receive the message exactly once, got %v", recipient, inbox)
+		}
+	}
+	if len(appState.GetDeliveries(msg.Id)) != 2 || !appState.IsAnyRateLimitExceeded() {
+		t.Errorf("expected segments of both attempts to be remembered")
+	}
+	if completed := appState.GetCompletedRecipients(msg.Id); completed != nil {
+		t.Errorf("completed recipients must be forgotten once the message was sent, got %v", completed)
+	}
+}
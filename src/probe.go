@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/serialportdiscovery"
+)
+
+func printProbeUsage() {
+	println("Usage: probe [--speed <baud rate>] [<serial port> ...]")
+	println()
+	println("Sends AT to every serial port of every USB device (or to the serial ports given) and reports which ones")
+	println("answer, along with how the modem identifies itself. Ports opened by other processes (like a running gateway")
+	println("or ModemManager) are skipped.")
+	println()
+	println("--speed <baud rate> => Baud rate to use, default is 115200")
+}
+
+func printProbeResult(result modem.ProbeResult) {
+	if !result.Ok {
+		println("    " + result.Port + ": " + result.Error)
+		return
+	}
+	line := "    " + result.Port + ": answers AT"
+	if result.Identity != "" {
+		line += " (" + result.Identity + ")"
+	}
+	if result.Profile != nil {
+		line += ", profile " + result.Profile.Id.String()
+	}
+	println(line)
+}
+
+// runProbe implements the 'probe' sub-command
+func runProbe(args []string) {
+
+	speed := 115200
+	var ports []string
+
+	for idx := 0; idx < len(args); idx = idx + 1 {
+		arg := args[idx]
+		switch arg {
+		case "-h", "-help", "--help":
+			printProbeUsage()
+			return
+		case "--speed":
+			if idx+1 >= len(args) {
+				panic("'" + arg + "' option requires an argument")
+			}
+			value, err := strconv.Atoi(args[idx+1])
+			if err != nil || value <= 0 {
+				panic("Invalid baud rate '" + args[idx+1] + "'")
+			}
+			speed = value
+			idx = idx + 1
+		default:
+			if strings.HasPrefix(arg, "--") {
+				panic("Invalid command line - unknown option '" + arg + "'")
+			}
+			ports = append(ports, arg)
+		}
+	}
+
+	if len(ports) > 0 {
+		println("Probing " + strconv.Itoa(len(ports)) + " serial port(s)")
+		for _, result := range modem.ProbePorts(context.Background(), ports, speed) {
+			printProbeResult(result)
+			if result.Ok {
+				println("Recommended: serialPort=" + result.Port)
+				return
+			}
+		}
+		os.Exit(1)
+	}
+
+	devices, err := serialportdiscovery.ListUsbDevices()
+	if err != nil {
+		println("Failed to list USB devices: " + err.Error())
+		os.Exit(1)
+	}
+	found := false
+	for _, device := range devices {
+		if len(device.Interfaces) == 0 {
+			continue
+		}
+		println(device.String() + " " + strings.TrimSpace(device.Manufacturer+" "+device.Product))
+		recommended := ""
+		for _, iface := range device.Interfaces {
+			result := modem.ProbePort(context.Background(), iface.Port, speed)
+			printProbeResult(result)
+			if result.Ok && recommended == "" {
+				vendorProduct := strings.Split(device.DeviceId.String(), ":")
+				recommended = "usbVendorId=" + vendorProduct[0] + " usbProductId=" + vendorProduct[1] +
+					" usbInterface=" + strconv.Itoa(iface.Number)
+			}
+		}
+		if recommended != "" {
+			println("    Recommended: " + recommended + " (or serialPort=auto)")
+			found = true
+		}
+	}
+	if !found {
+		println("Found no serial port answering AT")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,329 @@
+package received
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"code-sourcery.de/sms-gateway/common"
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/logger"
+	"code-sourcery.de/sms-gateway/message"
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+var log = logger.GetLogger("received")
+
+// how long to wait for missing parts of a concatenated SMS before storing what we've got
+const concatTimeout = 24 * time.Hour
+
+var receivedDir string
+
+var appState *state.State
+var appConfig *config.Config
+var appModems []modem.Modem
+
+// protects the files inside receivedDir
+var storageMutex sync.Mutex
+
+var initialized atomic.Bool
+var threadLock sync.Mutex
+var threadRunning atomic.Bool
+var shutdown atomic.Bool
+
+var threadAlive sync.WaitGroup
+var shutdownLatch sync.WaitGroup
+
+// ReceivedMessage is a message received from the network, as persisted in the 'received' folder
+type ReceivedMessage struct {
+	Id message.MessageId `json:"id"`
+	// name of the modem that received the message
+	Modem string `json:"modem"`
+	// phone number or alphanumeric name of the sender
+	Sender string `json:"sender"`
+	// timestamp assigned by the SMS service centre
+	SentTimestamp string `json:"sent_timestamp"`
+	// timestamp when the gateway fetched the message from the modem
+	ReceivedTimestamp string `json:"received_timestamp"`
+	Text              string `json:"text"`
+}
+
+func fileName(id message.MessageId, receivedTime time.Time) string {
+	msg := message.Message{Id: id, CreationTimestamp: receivedTime}
+	return msg.ToFileName() + ".json"
+}
+
+func store(modemName string, sms modem.SmsDeliver, text string) error {
+
+	now := time.Now()
+	msg := ReceivedMessage{
+		Id:                appState.NewReceivedMessageId(),
+		Modem:             modemName,
+		Sender:            sms.Sender,
+		SentTimestamp:     common.TimeToString(sms.Timestamp),
+		ReceivedTimestamp: common.TimeToString(now),
+		Text:              text,
+	}
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		panic("Error marshaling to JSON: " + err.Error())
+	}
+
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	absPath := receivedDir + "/" + fileName(msg.Id, now)
+	tmpPath := absPath + ".tmp"
+	err = os.WriteFile(tmpPath, jsonData, 0644)
+	if err != nil {
+		return errors.New("Failed to write file " + tmpPath + " : " + err.Error())
+	}
+	err = os.Rename(tmpPath, absPath)
+	if err != nil {
+		return errors.New("Failed to rename file " + tmpPath + " -> " + absPath + " : " + err.Error())
+	}
+	log.Info("Stored message " + msg.Id.String() + " received from " + msg.Sender + " by modem '" + modemName + "'")
+	_ = appState.WriteState()
+	return nil
+}
+
+// listFiles returns all stored messages, ordered ascending by ID
+func listFiles() ([]*message.Message, error) {
+	entries, err := os.ReadDir(receivedDir)
+	if err != nil {
+		log.Error("Failed to list files in received directory - " + err.Error())
+		return nil, err
+	}
+	var result []*message.Message
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		msg, err := message.MsgFromFileName(receivedDir + "/" + entry.Name())
+		if err != nil {
+			log.Warn("Ignoring file with malformed name: " + err.Error())
+			continue
+		}
+		result = append(result, msg)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result, nil
+}
+
+// List returns received messages with an ID greater than sinceId, skipping the first offset
+// messages and returning at most limit messages. Also returns the total number of messages matching sinceId.
+func List(sinceId message.MessageId, offset int, limit int) ([]ReceivedMessage, int, error) {
+
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	files, err := listFiles()
+	if err != nil {
+		return nil, 0, err
+	}
+	var matching []*message.Message
+	for _, file := range files {
+		if file.Id > sinceId {
+			matching = append(matching, file)
+		}
+	}
+
+	result := []ReceivedMessage{}
+	for idx := offset; idx < len(matching) && len(result) < limit; idx++ {
+		content, err := os.ReadFile(matching[idx].AbsPath)
+		if err != nil {
+			return nil, 0, errors.New("Failed to read " + matching[idx].AbsPath + " - " + err.Error())
+		}
+		var msg ReceivedMessage
+		err = json.Unmarshal(content, &msg)
+		if err != nil {
+			return nil, 0, errors.New("Failed to deserialize " + matching[idx].AbsPath + " - " + err.Error())
+		}
+		result = append(result, msg)
+	}
+	return result, len(matching), nil
+}
+
+// Delete removes a received message, returning FALSE if no message with the given ID exists
+func Delete(id message.MessageId) (bool, error) {
+
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	files, err := listFiles()
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if file.Id == id {
+			err = os.Remove(file.AbsPath)
+			if err != nil {
+				return true, errors.New("Failed to delete " + file.AbsPath + " - " + err.Error())
+			}
+			log.Info("Deleted received message " + id.String())
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// concatKey identifies all parts belonging to the same concatenated SMS
+type concatKey struct {
+	sender    string
+	reference int
+	total     int
+}
+
+func deleteFromModem(m modem.Modem, parts []modem.ReceivedSms) {
+	for _, part := range parts {
+		err := m.DeleteMessage(context.Background(), part.StorageIndex)
+		if err != nil {
+			log.Error("Failed to delete message #" + strconv.Itoa(part.StorageIndex) + " from modem '" + m.Name() + "': " + err.Error())
+		}
+	}
+}
+
+func fetchMessages(m modem.Modem) {
+
+	messages, reports, err := m.ReadMessages(context.Background())
+	if err != nil {
+		log.Error("Failed to read messages from modem '" + m.Name() + "': " + err.Error())
+		return
+	}
+	log.Trace("Modem '" + m.Name() + "' has " + strconv.Itoa(len(messages)) + " stored messages and " + strconv.Itoa(len(reports)) + " status reports")
+
+	processStatusReports(m, reports)
+
+	concatenated := make(map[concatKey][]modem.ReceivedSms)
+	for _, sms := range messages {
+		if sms.IsConcatenated() {
+			key := concatKey{sender: sms.Sender, reference: sms.ConcatReference, total: sms.ConcatTotal}
+			concatenated[key] = append(concatenated[key], sms)
+			continue
+		}
+		err = store(m.Name(), sms.SmsDeliver, sms.Text)
+		if err != nil {
+			log.Error("Failed to store received message: " + err.Error())
+			continue
+		}
+		deleteFromModem(m, []modem.ReceivedSms{sms})
+	}
+
+	for key, parts := range concatenated {
+		sort.Slice(parts, func(i, j int) bool {
+			return parts[i].ConcatSequence < parts[j].ConcatSequence
+		})
+		complete := len(parts) >= key.total
+		if !complete && time.Since(parts[0].Timestamp) < concatTimeout {
+			log.Debug("Waiting for missing parts of message from " + key.sender + ", got " +
+				strconv.Itoa(len(parts)) + " of " + strconv.Itoa(key.total))
+			continue
+		}
+		if !complete {
+			log.Warn("Giving up waiting for missing parts of message from " + key.sender + ", got only " +
+				strconv.Itoa(len(parts)) + " of " + strconv.Itoa(key.total))
+		}
+		var text strings.Builder
+		for _, part := range parts {
+			text.WriteString(part.Text)
+		}
+		err = store(m.Name(), parts[0].SmsDeliver, text.String())
+		if err != nil {
+			log.Error("Failed to store received message: " + err.Error())
+			continue
+		}
+		deleteFromModem(m, parts)
+	}
+}
+
+func receiveThread() {
+	threadRunning.Store(true)
+	threadAlive.Done()
+
+	defer func() {
+		shutdownLatch.Done()
+		log.Info("Receive thread terminated.")
+		threadRunning.Store(false)
+	}()
+
+	log.Info("Receive thread started")
+
+	// modems announce new messages (+CMTI) and status reports (+CDSI), fetch those right away instead of waiting for the next poll
+	subscription := modem.SubscribeUrcs()
+	defer subscription.Close()
+
+	var lastPoll time.Time
+	for !shutdown.Load() {
+		if appConfig.GetReceivePollInterval().IsShorterThan(time.Since(lastPoll)) {
+			for _, m := range appModems {
+				fetchMessages(m)
+			}
+			lastPoll = time.Now()
+		}
+		select {
+		case urc := <-subscription.C:
+			if urc.Code() == "+CMTI" || urc.Code() == "+CDSI" {
+				for _, m := range appModems {
+					if m.Name() == urc.Modem {
+						log.Debug("Modem '" + m.Name() + "' announced a new message: " + urc.Line)
+						fetchMessages(m)
+					}
+				}
+			}
+		case <-time.After(1 * time.Second):
+		}
+	}
+	log.Info("Receive thread was asked to shut down")
+}
+
+func Init(config *config.Config, state *state.State, modems []modem.Modem) error {
+
+	appState = state
+	appConfig = config
+	appModems = modems
+
+	messagesDir, err := common.CreateDirIfMissing(config.GetDataDirectory(), "messages")
+	if err != nil {
+		return err
+	}
+	receivedDir, err = common.CreateDirIfMissing(messagesDir, "received")
+	if err != nil {
+		return err
+	}
+
+	if config.GetReceivePollInterval() == nil {
+		log.Info("No receive poll interval configured, won't check for incoming messages.")
+		return nil
+	}
+
+	threadLock.Lock()
+	defer threadLock.Unlock()
+
+	if !initialized.CompareAndSwap(false, true) {
+		panic("Already initialized")
+	}
+	shutdownLatch.Add(1)
+	threadAlive.Add(1)
+	go receiveThread()
+	threadAlive.Wait()
+	return nil
+}
+
+func Shutdown() {
+	threadLock.Lock()
+	defer threadLock.Unlock()
+	shutdown.Store(true)
+	if threadRunning.Load() {
+		shutdownLatch.Wait()
+	}
+}
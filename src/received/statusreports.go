@@ -0,0 +1,56 @@
+package received
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"code-sourcery.de/sms-gateway/modem"
+	"code-sourcery.de/sms-gateway/state"
+)
+
+// grace period on top of the validity period before giving up on a status report
+const statusReportGracePeriod = 24 * time.Hour
+
+func deliveryStateOf(report modem.SmsStatusReport) state.DeliveryState {
+	switch {
+	case report.IsDelivered():
+		return state.DELIVERY_STATE_DELIVERED
+	case report.IsPending():
+		return state.DELIVERY_STATE_PENDING
+	case report.IsExpired():
+		return state.DELIVERY_STATE_EXPIRED
+	}
+	return state.DELIVERY_STATE_FAILED
+}
+
+func processStatusReports(m modem.Modem, reports []modem.ReceivedStatusReport) {
+
+	for _, report := range reports {
+		newState := deliveryStateOf(report.SmsStatusReport)
+		if newState == state.DELIVERY_STATE_PENDING {
+			log.Debug("Status report for reference " + strconv.Itoa(report.Reference) + " to " + report.Recipient +
+				": service centre is still trying, status 0x" + strconv.FormatInt(int64(report.Status), 16))
+		} else {
+			record := appState.UpdateDelivery(m.Name(), report.Recipient, report.Reference, newState, report.Status)
+			if record == nil {
+				log.Warn("Received status report for unknown message reference " + strconv.Itoa(report.Reference) + " to " + report.Recipient)
+			} else {
+				log.Info("Message " + record.MessageId.String() + " to " + record.Recipient + " is " + newState.String() +
+					" (status 0x" + strconv.FormatInt(int64(report.Status), 16) + ")")
+			}
+		}
+		err := m.DeleteMessage(context.Background(), report.StorageIndex)
+		if err != nil {
+			log.Error("Failed to delete status report #" + strconv.Itoa(report.StorageIndex) + " from modem '" + m.Name() + "': " + err.Error())
+		}
+	}
+
+	expired := appState.ExpireDeliveries(modem.VALIDITY_PERIOD + statusReportGracePeriod)
+	if expired > 0 {
+		log.Warn(strconv.Itoa(expired) + " message(s) expired without a delivery status report")
+	}
+	if len(reports) > 0 || expired > 0 {
+		_ = appState.WriteState()
+	}
+}
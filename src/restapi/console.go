@@ -0,0 +1,112 @@
+package restapi
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"code-sourcery.de/sms-gateway/common"
+	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/logger"
+	"code-sourcery.de/sms-gateway/modem"
+	"github.com/gin-gonic/gin"
+)
+
+var auditLog = logger.GetLogger("audit")
+
+// name of the file in the data directory every AT console command gets appended to
+const AUDIT_LOG_FILE = "audit.log"
+
+// protects the audit log file
+var auditMutex sync.Mutex
+
+type AtCommandRequest struct {
+	// name of the modem to use, defaults to the modem with the highest priority
+	Modem   string `json:"modem"`
+	Command string `json:"command"`
+}
+
+type AtCommandResponse struct {
+	Modem   string   `json:"modem"`
+	Command string   `json:"command"`
+	Lines   []string `json:"lines"`
+	// TRUE if the modem answered with OK
+	Ok bool `json:"ok"`
+}
+
+// audit records an AT console command both in the log and in the audit log file
+func audit(c *gin.Context, modemName string, cmd string, outcome string) {
+
+	user, _, _ := c.Request.BasicAuth()
+	entry := "user='" + user + "' remote=" + c.ClientIP() + " modem='" + modemName + "' command=" + strconv.Quote(cmd) +
+		" result=" + outcome
+	auditLog.Info(entry)
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	file, err := os.OpenFile(filepath.Join(appConfig.GetDataDirectory(), AUDIT_LOG_FILE), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Error("Failed to open audit log: " + err.Error())
+		return
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	if _, err = file.WriteString(common.TimeToString(time.Now()) + " " + entry + "\n"); err != nil {
+		log.Error("Failed to write audit log: " + err.Error())
+	}
+}
+
+func sendAtCommand(c *gin.Context) {
+
+	var req AtCommandRequest
+	if err := c.BindJSON(&req); err != nil {
+		_ = c.AbortWithError(400, errors.New("Failed to bind request to object"))
+		return
+	}
+	m := findModem(req.Modem)
+	if m == nil {
+		_ = c.AbortWithError(404, errors.New("Unknown modem '"+req.Modem+"'"))
+		return
+	}
+	cmd := strings.TrimSpace(req.Command)
+	if err := modem.ValidateAtCommand(cmd); err != nil {
+		audit(c, m.Name(), cmd, "rejected ("+err.Error()+")")
+		_ = c.AbortWithError(400, err)
+		return
+	}
+	if !appConfig.IsAtCommandAllowed(cmd) {
+		audit(c, m.Name(), cmd, "denied")
+		_ = c.AbortWithError(403, errors.New("AT command '"+cmd+"' is not allowed by [admin] allowedCommands/deniedCommands"))
+		return
+	}
+	response, err := m.SendAtCommand(c.Request.Context(), cmd)
+	if err != nil {
+		audit(c, m.Name(), cmd, "failed ("+err.Error()+")")
+		_ = c.AbortWithError(modemErrorStatus(err), errors.New("Failed to send AT command: "+err.Error()))
+		return
+	}
+	audit(c, m.Name(), cmd, "sent, response "+strconv.Quote(strings.Join(response.Lines, " | ")))
+	c.JSON(http.StatusOK, AtCommandResponse{Modem: m.Name(), Command: cmd, Lines: response.Lines, Ok: slices.Contains(response.Lines, "OK")})
+}
+
+// initAdminEndpoints registers the /admin endpoints if [admin] user is configured
+func initAdminEndpoints(config *config.Config, router *gin.Engine) {
+
+	if config.GetAdminUser() == "" {
+		log.Info("No [admin] user configured, admin endpoints are disabled")
+		return
+	}
+	accounts := gin.Accounts{}
+	accounts[config.GetAdminUser()] = config.GetAdminPassword()
+	admin := router.Group("/admin", gin.BasicAuth(accounts))
+
+	admin.POST("/at", sendAtCommand)
+}
@@ -3,9 +3,13 @@ package restapi
 import (
 	"code-sourcery.de/sms-gateway/common"
 	"code-sourcery.de/sms-gateway/config"
+	"code-sourcery.de/sms-gateway/health"
+	"code-sourcery.de/sms-gateway/hotplug"
 	"code-sourcery.de/sms-gateway/logger"
+	"code-sourcery.de/sms-gateway/message"
 	"code-sourcery.de/sms-gateway/modem"
 	"code-sourcery.de/sms-gateway/msgqueue"
+	"code-sourcery.de/sms-gateway/received"
 	"code-sourcery.de/sms-gateway/state"
 	"context"
 	"errors"
@@ -19,44 +23,178 @@ import (
 
 var log = logger.GetLogger("rest-api")
 
+var appConfig *config.Config
 var appState *state.State
+var appModems []modem.Modem
 
 type SendSmsRequest struct {
 	Message string `json:"message"`
 }
 
+type SendSmsResponse struct {
+	MessageId message.MessageId `json:"message_id"`
+}
+
 var httpServer *http.Server
 var startupTime time.Time
 
+type ModemStatus struct {
+	Name          string `json:"name"`
+	Driver        string `json:"driver"`
+	Priority      int    `json:"priority"`
+	Operational   bool   `json:"operational"`
+	NetworkStatus string `json:"network_status"`
+	// TRUE if the modem failed recently and is only used when no other modem is available
+	FailedOver bool `json:"failed_over"`
+	// error returned when querying the modem, empty if none
+	Error string `json:"error,omitempty"`
+	// signal quality, operator and SIM identity, cached for [modem] diagnosticsRefreshInterval
+	Diagnostics        *modem.Diagnostics `json:"diagnostics,omitempty"`
+	DiagnosticsUpdated string             `json:"diagnostics_updated,omitempty"`
+	// prepaid balance checks, oldest first, only present if [modem] balanceCheckInterval is set
+	Balance        *float64              `json:"balance,omitempty"`
+	BalanceHistory []state.BalanceRecord `json:"balance_history,omitempty"`
+	// health probes that failed in a row and recovery attempts, oldest first, only present if [modem] watchdogInterval is set
+	ProbeFailures    int                     `json:"probe_failures,omitempty"`
+	RecoveryAttempts []state.RecoveryAttempt `json:"recovery_attempts,omitempty"`
+	// whether the USB device is plugged in and its hotplug events, oldest first, only present if [modem] usbHotplug applies
+	UsbDevicePresent *bool           `json:"usb_device_present,omitempty"`
+	UsbEvents        []hotplug.Event `json:"usb_events,omitempty"`
+}
+
 type StatusResponse struct {
-	Operational     bool   `json:"operational"`
-	NetworkStatus   string `json:"network_status"`
-	StartupTime     string `json:"startup_time"`
-	UptimeInSeconds int64  `json:"uptime_in_seconds"`
+	// TRUE if at least one modem is operational
+	Operational bool `json:"operational"`
+	// network status of the modem with the highest priority
+	NetworkStatus   string        `json:"network_status"`
+	StartupTime     string        `json:"startup_time"`
+	UptimeInSeconds int64         `json:"uptime_in_seconds"`
+	Modems          []ModemStatus `json:"modems"`
 }
 
-func getStatus(c *gin.Context) {
+func getModemStatus(ctx context.Context, m modem.Modem) ModemStatus {
 
-	operational := false
-	conStatus, err := modem.GetConnectionStatus()
+	result := ModemStatus{
+		Name:     m.Name(),
+		Driver:   m.GetConfig().GetModemDriver().String(),
+		Priority: m.GetConfig().GetPriority(),
+	}
+	conStatus, err := m.GetConnectionStatus(ctx)
 	if err == nil {
-		log.Info("Modem is in status " + conStatus.String())
-		if conStatus == modem.CON_STATUS_REGISTERED_HOME || conStatus == modem.CON_STATUS_REGISTERED_ROAMING {
-			operational = true
-		}
+		log.Info("Modem '" + m.Name() + "' is in status " + conStatus.String())
+		result.Operational = conStatus.IsRegistered()
+	} else {
+		log.Debug("Modem '" + m.Name() + "' error. " + err.Error())
+		result.Error = err.Error()
+	}
+	result.NetworkStatus = conStatus.String()
+
+	diagnostics, err := m.GetDiagnostics(ctx)
+	if err == nil {
+		result.Diagnostics = &diagnostics
+		result.DiagnosticsUpdated = common.TimeToString(diagnostics.Updated)
 	} else {
-		log.Debug("Modem error. " + err.Error())
+		log.Debug("Failed to query diagnostics of modem '" + m.Name() + "'. " + err.Error())
+		if result.Error == "" {
+			result.Error = err.Error()
+		}
+	}
+	result.BalanceHistory = appState.GetBalanceHistory(m.Name())
+	if len(result.BalanceHistory) > 0 {
+		result.Balance = &result.BalanceHistory[len(result.BalanceHistory)-1].Balance
+	}
+	result.ProbeFailures = health.GetConsecutiveFailures(m.Name())
+	result.RecoveryAttempts = appState.GetRecoveryAttempts(m.Name())
+	result.UsbDevicePresent = hotplug.IsPresent(m.Name())
+	result.UsbEvents = hotplug.GetEvents(m.Name())
+	if msgqueue.GetDispatcher() != nil {
+		result.FailedOver = msgqueue.GetDispatcher().IsFailedOver(m)
 	}
+	return result
+}
+
+func getStatus(c *gin.Context) {
 
-	uptimeInSeconds := time.Now().Unix() - startupTime.Unix()
 	response := StatusResponse{
-		Operational:     operational,
-		NetworkStatus:   conStatus.String(),
-		StartupTime:     common.TimeToString(startupTime),
-		UptimeInSeconds: uptimeInSeconds}
+		NetworkStatus: modem.CON_STATUS_UNKNOWN.String(),
+		StartupTime:   common.TimeToString(startupTime),
+		Modems:        []ModemStatus{},
+	}
+	for idx, m := range appModems {
+		status := getModemStatus(c.Request.Context(), m)
+		if idx == 0 {
+			response.NetworkStatus = status.NetworkStatus
+		}
+		response.Operational = response.Operational || status.Operational
+		response.Modems = append(response.Modems, status)
+	}
+	response.UptimeInSeconds = time.Now().Unix() - startupTime.Unix()
 	c.JSON(http.StatusOK, response)
 }
 
+type ReceivedMessagesResponse struct {
+	Messages []received.ReceivedMessage `json:"messages"`
+	// total number of messages matching the 'since' filter
+	Total int `json:"total"`
+}
+
+func parseIntQueryParam(c *gin.Context, name string, defaultValue int64) (int64, error) {
+	value := c.Query(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	result, err := common.AToInt64(value)
+	if err != nil || result < 0 {
+		return 0, errors.New("Query parameter '" + name + "' must be a non-negative integer")
+	}
+	return result, nil
+}
+
+func getReceived(c *gin.Context) {
+
+	since, err := parseIntQueryParam(c, "since", 0)
+	if err != nil {
+		_ = c.AbortWithError(400, err)
+		return
+	}
+	offset, err := parseIntQueryParam(c, "offset", 0)
+	if err != nil {
+		_ = c.AbortWithError(400, err)
+		return
+	}
+	limit, err := parseIntQueryParam(c, "limit", 100)
+	if err != nil {
+		_ = c.AbortWithError(400, err)
+		return
+	}
+
+	messages, total, err := received.List(message.MessageId(since), int(offset), int(limit))
+	if err != nil {
+		_ = c.AbortWithError(500, errors.New("Failed to list received messages: "+err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, ReceivedMessagesResponse{Messages: messages, Total: total})
+}
+
+func deleteReceived(c *gin.Context) {
+
+	id, err := common.AToInt64(c.Param("id"))
+	if err != nil {
+		_ = c.AbortWithError(400, errors.New("Invalid message ID '"+c.Param("id")+"'"))
+		return
+	}
+	found, err := received.Delete(message.MessageId(id))
+	if err != nil {
+		_ = c.AbortWithError(500, errors.New("Failed to delete received message: "+err.Error()))
+		return
+	}
+	if !found {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
 func sendSms(c *gin.Context) {
 
 	log.Debug("Incoming HTTP request")
@@ -80,6 +218,218 @@ func sendSms(c *gin.Context) {
 		_ = c.AbortWithError(500, errors.New("Failed to store message for sending: "+err.Error()))
 		return
 	}
+	c.JSON(http.StatusOK, SendSmsResponse{MessageId: msgId})
+}
+
+type UssdRequest struct {
+	// name of the modem to use, defaults to the modem with the highest priority
+	Modem string `json:"modem"`
+	// USSD code like "*100#" or the reply to a menu of an open session
+	Code string `json:"code"`
+	// TRUE to cancel an open USSD session instead of sending a code
+	Cancel bool `json:"cancel"`
+}
+
+type UssdResponse struct {
+	Modem  string `json:"modem"`
+	Status string `json:"status"`
+	Text   string `json:"text"`
+	Dcs    int    `json:"dcs"`
+}
+
+// modemErrorStatus returns the HTTP status for a failed modem command, 504 if the modem did not answer in time
+func modemErrorStatus(err error) int {
+	var timeout *modem.TimeoutError
+	if errors.As(err, &timeout) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+func findModem(name string) modem.Modem {
+	for _, m := range appModems {
+		if name == "" || m.Name() == name {
+			return m
+		}
+	}
+	return nil
+}
+
+func sendUssd(c *gin.Context) {
+
+	var req UssdRequest
+	if err := c.BindJSON(&req); err != nil {
+		_ = c.AbortWithError(400, errors.New("Failed to bind request to object"))
+		return
+	}
+	m := findModem(req.Modem)
+	if m == nil {
+		_ = c.AbortWithError(404, errors.New("Unknown modem '"+req.Modem+"'"))
+		return
+	}
+
+	if req.Cancel {
+		log.Info("Incoming HTTP request to cancel USSD session on modem '" + m.Name() + "'")
+		if err := m.CancelUssd(c.Request.Context()); err != nil {
+			_ = c.AbortWithError(modemErrorStatus(err), errors.New("Failed to cancel USSD session: "+err.Error()))
+			return
+		}
+		c.JSON(http.StatusOK, UssdResponse{Modem: m.Name(), Status: modem.USSD_STATUS_TERMINATED.String()})
+		return
+	}
+
+	code := strings.TrimSpace(req.Code)
+	if code == "" {
+		_ = c.AbortWithError(400, errors.New("USSD code cannot be empty or blank"))
+		return
+	}
+	log.Info("Incoming HTTP request with USSD code '" + code + "' for modem '" + m.Name() + "'")
+	response, err := m.SendUssd(c.Request.Context(), code)
+	if err != nil {
+		_ = c.AbortWithError(modemErrorStatus(err), errors.New("Failed to send USSD request: "+err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, UssdResponse{Modem: m.Name(), Status: response.Status.String(), Text: response.Text, Dcs: response.Dcs})
+}
+
+type SimStatusResponse struct {
+	Modem    string `json:"modem"`
+	PinState string `json:"pin_state"`
+	// remaining PIN and PUK attempts, left out if the modem does not report them
+	PinRetries *int `json:"pin_retries,omitempty"`
+	PukRetries *int `json:"puk_retries,omitempty"`
+}
+
+type SimUnlockRequest struct {
+	// name of the modem to use, defaults to the modem with the highest priority
+	Modem string `json:"modem"`
+	Puk   string `json:"puk"`
+	// new PIN, defaults to [modem] simPin
+	Pin string `json:"pin"`
+}
+
+func toSimStatusResponse(m modem.Modem, status modem.SimStatus) SimStatusResponse {
+	result := SimStatusResponse{Modem: m.Name(), PinState: status.PinState.String()}
+	if status.PinRetries >= 0 {
+		result.PinRetries = &status.PinRetries
+	}
+	if status.PukRetries >= 0 {
+		result.PukRetries = &status.PukRetries
+	}
+	return result
+}
+
+func getSimStatus(c *gin.Context) {
+
+	m := findModem(c.Query("modem"))
+	if m == nil {
+		_ = c.AbortWithError(404, errors.New("Unknown modem '"+c.Query("modem")+"'"))
+		return
+	}
+	status, err := m.GetSimStatus(c.Request.Context())
+	if err != nil {
+		_ = c.AbortWithError(modemErrorStatus(err), errors.New("Failed to query SIM card status: "+err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, toSimStatusResponse(m, status))
+}
+
+func unlockSim(c *gin.Context) {
+
+	var req SimUnlockRequest
+	if err := c.BindJSON(&req); err != nil {
+		_ = c.AbortWithError(400, errors.New("Failed to bind request to object"))
+		return
+	}
+	m := findModem(req.Modem)
+	if m == nil {
+		_ = c.AbortWithError(404, errors.New("Unknown modem '"+req.Modem+"'"))
+		return
+	}
+	newPin := strings.TrimSpace(req.Pin)
+	if newPin == "" {
+		newPin = m.GetConfig().GetSimPin()
+	}
+	puk := strings.TrimSpace(req.Puk)
+	if err := modem.ValidateSimCodes(puk, newPin); err != nil {
+		_ = c.AbortWithError(400, err)
+		return
+	}
+
+	log.Info("Incoming HTTP request to unlock SIM card of modem '" + m.Name() + "' using PUK")
+	if err := m.UnlockSimWithPuk(c.Request.Context(), puk, newPin); err != nil {
+		_ = c.AbortWithError(modemErrorStatus(err), errors.New("Failed to unlock SIM card: "+err.Error()))
+		return
+	}
+	status, err := m.GetSimStatus(c.Request.Context())
+	if err != nil {
+		_ = c.AbortWithError(modemErrorStatus(err), errors.New("Failed to query SIM card status: "+err.Error()))
+		return
+	}
+	c.JSON(http.StatusOK, toSimStatusResponse(m, status))
+}
+
+type DeliveryResponse struct {
+	MessageId message.MessageId `json:"message_id"`
+	// overall state, 'delivered' only if all segments reached all recipients
+	State      string                 `json:"state"`
+	Recipients []state.DeliveryRecord `json:"recipients"`
+	// why the gateway gave up on sending the message, only set if the modem reported a permanent error
+	Error string `json:"error,omitempty"`
+	// recipients the message was not sent to because the modem reported a permanent error for them
+	FailedRecipients []state.FailedRecipient `json:"failed_recipients,omitempty"`
+}
+
+// aggregateDeliveryState combines the delivery states of all segments/recipients of a message
+func aggregateDeliveryState(records []state.DeliveryRecord) state.DeliveryState {
+	result := state.DELIVERY_STATE_DELIVERED
+	for _, record := range records {
+		switch record.State {
+		case state.DELIVERY_STATE_FAILED:
+			return state.DELIVERY_STATE_FAILED
+		case state.DELIVERY_STATE_EXPIRED:
+			result = state.DELIVERY_STATE_EXPIRED
+		case state.DELIVERY_STATE_PENDING:
+			if result != state.DELIVERY_STATE_EXPIRED {
+				result = state.DELIVERY_STATE_PENDING
+			}
+		}
+	}
+	return result
+}
+
+func getDelivery(c *gin.Context) {
+
+	id, err := common.AToInt64(c.Param("id"))
+	if err != nil {
+		_ = c.AbortWithError(400, errors.New("Invalid message ID '"+c.Param("id")+"'"))
+		return
+	}
+	records := appState.GetDeliveries(message.MessageId(id))
+	failedRecipients := appState.GetFailedRecipients(message.MessageId(id))
+	failed := appState.GetFailedMessage(message.MessageId(id))
+	if failed != nil {
+		c.JSON(http.StatusOK, DeliveryResponse{
+			MessageId:        message.MessageId(id),
+			State:            state.DELIVERY_STATE_FAILED.String(),
+			Recipients:       records,
+			Error:            failed.Reason,
+			FailedRecipients: failedRecipients})
+		return
+	}
+	if len(records) == 0 && len(failedRecipients) == 0 {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	overall := aggregateDeliveryState(records)
+	if len(failedRecipients) > 0 {
+		overall = state.DELIVERY_STATE_FAILED
+	}
+	c.JSON(http.StatusOK, DeliveryResponse{
+		MessageId:        message.MessageId(id),
+		State:            overall.String(),
+		Recipients:       records,
+		FailedRecipients: failedRecipients})
 }
 
 func Shutdown() error {
@@ -95,13 +445,15 @@ func Shutdown() error {
 	return result
 }
 
-func Init(config *config.Config, state *state.State) error {
+func Init(config *config.Config, state *state.State, modems []modem.Modem) error {
 
 	startupTime = time.Now()
 
+	appConfig = config
 	appState = state
+	appModems = modems
 
-	err := msgqueue.Init(config, appState)
+	err := msgqueue.Init(config, appState, appModems)
 	if err != nil {
 		panic(err)
 	}
@@ -133,6 +485,14 @@ func Init(config *config.Config, state *state.State) error {
 
 	authorized.POST("/sendsms", sendSms)
 	authorized.GET("/status", getStatus)
+	authorized.GET("/delivery/:id", getDelivery)
+	authorized.GET("/received", getReceived)
+	authorized.DELETE("/received/:id", deleteReceived)
+	authorized.POST("/ussd", sendUssd)
+	authorized.GET("/sim", getSimStatus)
+	authorized.POST("/sim/unlock", unlockSim)
+
+	initAdminEndpoints(config, router)
 
 	httpServer = &http.Server{
 		Addr:    host + ":" + strconv.Itoa(port),
@@ -4,71 +4,211 @@ import (
 	"code-sourcery.de/sms-gateway/common"
 	"code-sourcery.de/sms-gateway/logger"
 	"errors"
-	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
 )
 
 var log = logger.GetLogger("portdiscovery")
 
-func DiscoverUsbInterfaces(deviceId common.UsbDeviceId) ([]string, error) {
-	var ifaces []string
+// where sysfs is mounted, tests point this to a fake directory tree
+var sysfsRoot = "/sys"
 
-	// Iterate through all USB ifaces
-	matches, err := filepath.Glob("/sys/bus/usb/devices/*")
+// UsbInterface is a serial port provided by a USB device
+type UsbInterface struct {
+	// bInterfaceNumber of the USB interface the serial port belongs to
+	Number int
+	// device node, like /dev/ttyUSB2
+	Port string
+}
+
+// UsbDevice is a USB device along with the serial ports it provides
+type UsbDevice struct {
+	// bus path like 1-2 or 1-1.4, stays the same as long as the device is plugged into the same USB port
+	Path     string
+	DeviceId common.UsbDeviceId
+	// USB serial number, empty if the device does not report one
+	Serial       string
+	Manufacturer string
+	Product      string
+	// serial ports ordered by interface number
+	Interfaces []UsbInterface
+}
+
+// Ports returns the device's serial ports ordered by interface number
+func (d UsbDevice) Ports() []string {
+	var result []string
+	for _, iface := range d.Interfaces {
+		result = append(result, iface.Port)
+	}
+	return result
+}
+
+// PortOfInterface returns the serial port belonging to the USB interface with the given bInterfaceNumber
+func (d UsbDevice) PortOfInterface(number int) (string, error) {
+	var available []string
+	for _, iface := range d.Interfaces {
+		if iface.Number == number {
+			return iface.Port, nil
+		}
+		available = append(available, strconv.Itoa(iface.Number))
+	}
+	return "", errors.New("USB device " + d.Path + " has no serial port on interface " + strconv.Itoa(number) +
+		", available interfaces: " + strings.Join(available, ", "))
+}
+
+func (d UsbDevice) String() string {
+	result := d.Path + " " + d.DeviceId.String()
+	if d.Serial != "" {
+		result += " serial " + d.Serial
+	}
+	return result
+}
+
+// UsbSelector picks a USB device by vendor and product ID, optionally narrowed down by serial number and bus path
+// for telling apart multiple identical devices
+type UsbSelector struct {
+	DeviceId common.UsbDeviceId
+	// USB serial number, empty to accept any
+	Serial string
+	// bus path, empty to accept any
+	Path string
+}
+
+func (s UsbSelector) matches(device UsbDevice) bool {
+	return device.DeviceId == s.DeviceId && (s.Serial == "" || s.Serial == device.Serial) && (s.Path == "" || s.Path == device.Path)
+}
+
+func (s UsbSelector) String() string {
+	result := s.DeviceId.String()
+	if s.Serial != "" {
+		result += " with serial " + s.Serial
+	}
+	if s.Path != "" {
+		result += " at " + s.Path
+	}
+	return result
+}
+
+func readAttribute(dir string, name string) string {
+	data, err := os.ReadFile(filepath.Join(dir, name))
 	if err != nil {
-		log.Error("Error globbing USB interfaces: " + err.Error())
-		return []string{}, err
+		return ""
 	}
-	log.Debug("Checking " + strconv.Itoa(len(matches)) + " USB devices")
+	return strings.TrimSpace(string(data))
+}
 
-	vendorId := fmt.Sprintf("%04x", deviceId.VendorId)
-	productId := fmt.Sprintf("%04x", deviceId.ProductId)
+// discoverInterfaces returns the serial ports of a USB device, usb-serial drivers (like option) create them right
+// inside the interface directory, cdc_acm below a 'tty' directory
+func discoverInterfaces(deviceDir string) []UsbInterface {
+	var result []UsbInterface
+	ifaceDirs, _ := filepath.Glob(filepath.Join(deviceDir, filepath.Base(deviceDir)+":*"))
+	for _, ifaceDir := range ifaceDirs {
+		number, err := strconv.ParseUint(readAttribute(ifaceDir, "bInterfaceNumber"), 16, 8)
+		if err != nil {
+			log.Debug("Ignoring USB interface " + ifaceDir + " without bInterfaceNumber")
+			continue
+		}
+		var ttys []string
+		for _, pattern := range []string{"ttyUSB*", "tty/ttyACM*"} {
+			matches, _ := filepath.Glob(filepath.Join(ifaceDir, pattern))
+			ttys = append(ttys, matches...)
+		}
+		for _, tty := range ttys {
+			result = append(result, UsbInterface{Number: int(number), Port: "/dev/" + filepath.Base(tty)})
+		}
+	}
+	slices.SortFunc(result, func(a, b UsbInterface) int {
+		if a.Number != b.Number {
+			return a.Number - b.Number
+		}
+		return strings.Compare(a.Port, b.Port)
+	})
+	return result
+}
 
-	deviceFound := false
+// ListUsbDevices returns all USB devices except root hubs, ordered by bus path
+func ListUsbDevices() ([]UsbDevice, error) {
+	// interfaces show up in this directory as well, they have no vendor ID
+	matches, err := filepath.Glob(filepath.Join(sysfsRoot, "bus/usb/devices/*"))
+	if err != nil {
+		log.Error("Error globbing USB devices: " + err.Error())
+		return nil, err
+	}
+	log.Debug("Checking " + strconv.Itoa(len(matches)) + " USB devices")
 
+	var result []UsbDevice
 	for _, deviceDir := range matches {
-		vendorID, err := os.ReadFile(filepath.Join(deviceDir, "idVendor"))
+		name := filepath.Base(deviceDir)
+		if strings.HasPrefix(name, "usb") {
+			continue
+		}
+		vendorId, err := parseHex16Bit(readAttribute(deviceDir, "idVendor"))
 		if err != nil {
 			continue
 		}
-		productID, err := os.ReadFile(filepath.Join(deviceDir, "idProduct"))
+		productId, err := parseHex16Bit(readAttribute(deviceDir, "idProduct"))
 		if err != nil {
 			continue
 		}
+		device := UsbDevice{
+			Path:         name,
+			DeviceId:     common.UsbDeviceId{VendorId: vendorId, ProductId: productId},
+			Serial:       readAttribute(deviceDir, "serial"),
+			Manufacturer: readAttribute(deviceDir, "manufacturer"),
+			Product:      readAttribute(deviceDir, "product"),
+			Interfaces:   discoverInterfaces(deviceDir),
+		}
+		log.Debug("Found USB device " + device.String() + " with serial ports " + strings.Join(device.Ports(), ", "))
+		result = append(result, device)
+	}
+	slices.SortFunc(result, func(a, b UsbDevice) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	return result, nil
+}
 
-		vID := strings.TrimSpace(string(vendorID))
-		pID := strings.TrimSpace(string(productID))
-
-		log.Debug("Checking USB device '" + vID + "', '" + pID + "'")
-
-		if vID == vendorId && pID == productId {
-			deviceFound = true
-			// Found the device, now look for the ttyUSB node
-			ttyGlob := filepath.Join(deviceDir, "*/ttyUSB*")
-			ttyMatches, err := filepath.Glob(ttyGlob)
-			if err != nil {
-				fmt.Printf("Error globbing ttyUSB interfaces: %v\n", err)
-				continue
-			}
-
-			for _, ttyPath := range ttyMatches {
-				deviceName := filepath.Base(ttyPath)
-				ifaces = append(ifaces, "/dev/"+deviceName)
-			}
+// parseHex16Bit parses a 4-digit hexadecimal number like the vendor and product IDs in sysfs
+func parseHex16Bit(value string) (uint16, error) {
+	parsed, err := strconv.ParseUint(value, 16, 16)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(parsed), nil
+}
+
+// SelectUsbDevice returns the one USB device matching the selector, failing if there is none or more than one
+func SelectUsbDevice(selector UsbSelector) (UsbDevice, error) {
+	devices, err := ListUsbDevices()
+	if err != nil {
+		return UsbDevice{}, err
+	}
+	var found []UsbDevice
+	for _, device := range devices {
+		if selector.matches(device) {
+			found = append(found, device)
 		}
 	}
-	if !deviceFound {
-		return []string{}, errors.New("Found no USB device with ID " + deviceId.String())
+	if len(found) == 0 {
+		return UsbDevice{}, errors.New("Found no USB device with ID " + selector.String())
 	}
-	// sort alphabetically to have a stable interface order
-	// as config.getSerialPort() will index into the returned []string slice
-	sort.Strings(ifaces)
-	for i, iface := range ifaces {
-		log.Debug("Discovered interface #" + strconv.Itoa(i) + " : " + iface)
+	if len(found) > 1 {
+		return UsbDevice{}, errors.New("Found " + strconv.Itoa(len(found)) + " USB devices with ID " + selector.String() +
+			" (" + common.Join(found, ", ", func(d UsbDevice) string { return d.String() }) + "), use usbSerial or usbPath to pick one")
+	}
+	for _, iface := range found[0].Interfaces {
+		log.Debug("Discovered interface #" + strconv.Itoa(iface.Number) + " : " + iface.Port)
+	}
+	return found[0], nil
+}
+
+// DiscoverUsbInterfaces returns the serial ports of the USB device matching the selector, ordered by interface number
+func DiscoverUsbInterfaces(selector UsbSelector) ([]string, error) {
+	device, err := SelectUsbDevice(selector)
+	if err != nil {
+		return []string{}, err
 	}
-	return ifaces, nil
+	return device.Ports(), nil
 }
@@ -0,0 +1,113 @@
+package serialportdiscovery
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"code-sourcery.de/sms-gateway/common"
+)
+
+var e3372 = common.UsbDeviceId{VendorId: 0x12d1, ProductId: 0x1506}
+
+// fakeUsbDevice adds a USB device to the fake sysfs tree, ttys maps interface numbers to the serial ports
+// created by a usb-serial driver ("ttyUSB...") or cdc_acm ("ttyACM...")
+func fakeUsbDevice(t *testing.T, path string, vendorProduct string, serial string, ttys map[int]string) {
+	device := filepath.Join(sysfsRoot, "devices/pci0000:00/0000:00:14.0/usb1", path)
+	mkdir(t, device)
+	writeFile(t, filepath.Join(device, "idVendor"), vendorProduct[:4]+"\n")
+	writeFile(t, filepath.Join(device, "idProduct"), vendorProduct[5:]+"\n")
+	if serial != "" {
+		writeFile(t, filepath.Join(device, "serial"), serial+"\n")
+	}
+	writeFile(t, filepath.Join(device, "manufacturer"), "HUAWEI_MOBILE\n")
+	for number, tty := range ttys {
+		ifaceDir := filepath.Join(device, path+":1."+strconv.Itoa(number))
+		mkdir(t, ifaceDir)
+		writeFile(t, filepath.Join(ifaceDir, "bInterfaceNumber"), "0"+strconv.FormatInt(int64(number), 16)+"\n")
+		if strings.HasPrefix(tty, "ttyACM") {
+			mkdir(t, filepath.Join(ifaceDir, "tty", tty))
+		} else {
+			mkdir(t, filepath.Join(ifaceDir, tty))
+		}
+	}
+	symlink(t, device, filepath.Join(sysfsRoot, "bus/usb/devices", path))
+}
+
+// fakeUsbBus creates a sysfs tree with a root hub, two identical sticks whose serial ports got numbered
+// out of interface order and a cdc_acm device
+func fakeUsbBus(t *testing.T) {
+	sysfsRoot = t.TempDir()
+	mkdir(t, filepath.Join(sysfsRoot, "bus/usb/devices"))
+	fakeUsbDevice(t, "usb1", "1d6b:0002", "0000:00:14.0", nil)
+	fakeUsbDevice(t, "1-2", "12d1:1506", "0123456789ABCDEF", map[int]string{0: "ttyUSB10", 2: "ttyUSB11", 4: "ttyUSB9"})
+	fakeUsbDevice(t, "1-1.4", "12d1:1506", "", map[int]string{0: "ttyUSB0", 2: "ttyUSB1", 4: "ttyUSB2"})
+	fakeUsbDevice(t, "1-3", "1e0e:9001", "", map[int]string{2: "ttyACM0", 3: "ttyACM1"})
+	// interfaces show up next to the devices
+	symlink(t, filepath.Join(sysfsRoot, "devices/pci0000:00/0000:00:14.0/usb1/1-2/1-2:1.0"),
+		filepath.Join(sysfsRoot, "bus/usb/devices/1-2:1.0"))
+}
+
+func TestListUsbDevices(t *testing.T) {
+	fakeUsbBus(t)
+
+	devices, err := ListUsbDevices()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, device := range devices {
+		paths = append(paths, device.Path)
+	}
+	if !slices.Equal(paths, []string{"1-1.4", "1-2", "1-3"}) {
+		t.Fatalf("expected devices 1-1.4, 1-2 and 1-3, got %v", paths)
+	}
+	stick := devices[1]
+	if stick.DeviceId != e3372 || stick.Serial != "0123456789ABCDEF" || stick.Manufacturer != "HUAWEI_MOBILE" {
+		t.Errorf("unexpected device %+v", stick)
+	}
+	expected := []UsbInterface{{0, "/dev/ttyUSB10"}, {2, "/dev/ttyUSB11"}, {4, "/dev/ttyUSB9"}}
+	if !slices.Equal(stick.Interfaces, expected) {
+		t.Errorf("expected interfaces %v, got %v", expected, stick.Interfaces)
+	}
+	if !slices.Equal(devices[2].Ports(), []string{"/dev/ttyACM0", "/dev/ttyACM1"}) {
+		t.Errorf("expected cdc_acm ports, got %v", devices[2].Ports())
+	}
+}
+
+func TestSelectUsbDevice(t *testing.T) {
+	fakeUsbBus(t)
+
+	_, err := SelectUsbDevice(UsbSelector{DeviceId: e3372})
+	if err == nil || !strings.Contains(err.Error(), "Found 2 USB devices") || !strings.Contains(err.Error(), "1-1.4") {
+		t.Errorf("expected identical sticks to be ambiguous, got %v", err)
+	}
+
+	tests := []struct {
+		selector UsbSelector
+		path     string
+	}{
+		{UsbSelector{DeviceId: e3372, Serial: "0123456789ABCDEF"}, "1-2"},
+		{UsbSelector{DeviceId: e3372, Path: "1-1.4"}, "1-1.4"},
+		{UsbSelector{DeviceId: common.UsbDeviceId{VendorId: 0x1e0e, ProductId: 0x9001}}, "1-3"},
+	}
+	for _, test := range tests {
+		device, err := SelectUsbDevice(test.selector)
+		if err != nil || device.Path != test.path {
+			t.Errorf("%s: expected device %s, got %+v / %v", test.selector.String(), test.path, device, err)
+		}
+	}
+	if _, err = SelectUsbDevice(UsbSelector{DeviceId: e3372, Serial: "0123456789ABCDEF", Path: "1-1.4"}); err == nil {
+		t.Error("expected no device to match serial number and bus path of different devices")
+	}
+
+	device, _ := SelectUsbDevice(UsbSelector{DeviceId: e3372, Serial: "0123456789ABCDEF"})
+	if port, err := device.PortOfInterface(4); err != nil || port != "/dev/ttyUSB9" {
+		t.Errorf("expected interface 4 to be ttyUSB9, got %s / %v", port, err)
+	}
+	if _, err = device.PortOfInterface(1); err == nil || !strings.Contains(err.Error(), "available interfaces: 0, 2, 4") {
+		t.Errorf("expected missing interface to fail, got %v", err)
+	}
+}
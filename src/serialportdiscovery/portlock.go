@@ -0,0 +1,162 @@
+package serialportdiscovery
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"code-sourcery.de/sms-gateway/common"
+)
+
+// where UUCP-style lock files are kept, tests point this to a temporary directory
+var lockDir = "/var/lock"
+
+// lock files without a valid PID are considered stale once they are older than this,
+// younger ones may still be written by the process that created them
+const lockFileGracePeriod = 5 * time.Second
+
+// PortBusyError is returned if another process holds the lock file of a serial port or has the port open
+type PortBusyError struct {
+	Port string
+	// IDs of the processes holding the port, empty if they are unknown
+	Pids []int
+}
+
+func (e *PortBusyError) Error() string {
+	return "Serial port " + e.Port + " is in use by " + e.Holders()
+}
+
+// Holders describes the processes holding the port, like "ModemManager (812)"
+func (e *PortBusyError) Holders() string {
+	if len(e.Pids) == 0 {
+		return "another process"
+	}
+	return common.Join(e.Pids, ", ", DescribeProcess)
+}
+
+// PortLock is the lock file claiming a serial port for the current process, like /var/lock/LCK..ttyUSB2
+type PortLock struct {
+	path string
+}
+
+// Unlock removes the lock file, does nothing for a nil lock
+func (l *PortLock) Unlock() {
+	if l == nil {
+		return
+	}
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Warn("Failed to remove lock file " + l.path + " - " + err.Error())
+	}
+}
+
+// lockFileName returns the lock file of a serial port, named after the device's path below /dev like
+// minicom and lockdev do: LCK..ttyUSB2 for /dev/ttyUSB2, LCK..pts_3 for /dev/pts/3
+func lockFileName(port string) string {
+	if resolved, err := filepath.EvalSymlinks(port); err == nil {
+		port = resolved
+	}
+	name, found := strings.CutPrefix(port, "/dev/")
+	if !found {
+		name = filepath.Base(port)
+	}
+	return filepath.Join(lockDir, "LCK.."+strings.ReplaceAll(name, "/", "_"))
+}
+
+// LockPort creates the lock file of a serial port, removing stale ones left behind by processes that are gone.
+// Returns a *PortBusyError naming the holder if another process has locked the port. If no lock file can be
+// created (because the lock directory is missing or not writable), the port is used without locking it and
+// a nil lock is returned.
+func LockPort(port string) (*PortLock, error) {
+	path := lockFileName(port)
+	ownPid := os.Getpid()
+	for {
+		err := createLockFile(path, ownPid)
+		if err == nil {
+			return &PortLock{path: path}, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			log.Warn("Not locking serial port " + port + ", failed to create " + path + " - " + err.Error())
+			return nil, nil
+		}
+
+		pid, age, err := readLockFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// got unlocked in the meantime
+			continue
+		}
+		switch {
+		case err == nil && pid == ownPid:
+			log.Warn("Taking over lock file " + path + " left behind by the current process")
+			return &PortLock{path: path}, nil
+		case err == nil && isProcessAlive(pid):
+			return nil, &PortBusyError{Port: port, Pids: []int{pid}}
+		case err != nil && age < lockFileGracePeriod:
+			return nil, &PortBusyError{Port: port}
+		}
+		log.Warn("Removing stale lock file " + path)
+		if err = os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Warn("Failed to remove stale lock file " + path + " - " + err.Error())
+			return nil, &PortBusyError{Port: port}
+		}
+	}
+}
+
+// createLockFile atomically creates a lock file containing a PID in the HDB UUCP format (ten digits, right-aligned)
+func createLockFile(path string, pid int) error {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), ".LCK")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name())
+	}()
+	_, err = tmpFile.WriteString(strings.Repeat(" ", max(0, 10-len(strconv.Itoa(pid)))) + strconv.Itoa(pid) + "\n")
+	if closeErr := tmpFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return err
+	}
+	// unlike renaming, linking fails if the lock file exists already
+	return os.Link(tmpFile.Name(), path)
+}
+
+// readLockFile returns the PID stored in a lock file (ASCII or binary as written by ancient UUCP) and its age
+func readLockFile(path string) (int, time.Duration, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	age := time.Since(info.ModTime())
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, age, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil && len(data) == 4 {
+		pid = int(data[0]) | int(data[1])<<8 | int(data[2])<<16 | int(data[3])<<24
+		err = nil
+	}
+	if err == nil && pid <= 0 {
+		err = errors.New("invalid PID " + strconv.Itoa(pid))
+	}
+	return pid, age, err
+}
+
+// isProcessAlive returns TRUE if a process exists, even if the current user may not send it signals
+func isProcessAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,91 @@
+package serialportdiscovery
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeLockDir(t *testing.T) {
+	lockDir = t.TempDir()
+	t.Cleanup(func() {
+		lockDir = "/var/lock"
+	})
+}
+
+func TestLockPort(t *testing.T) {
+	fakeLockDir(t)
+	lockFile := filepath.Join(lockDir, "LCK..ttyUSB2")
+
+	lock, err := LockPort("/dev/ttyUSB2")
+	if err != nil || lock == nil {
+		t.Fatalf("expected port to get locked, got %v", err)
+	}
+	if data, _ := os.ReadFile(lockFile); string(data) != strings.Repeat(" ", 10-len(strconv.Itoa(os.Getpid())))+strconv.Itoa(os.Getpid())+"\n" {
+		t.Errorf("unexpected lock file content %q", data)
+	}
+	// the lock belongs to this process already
+	if again, err := LockPort("/dev/ttyUSB2"); err != nil || again == nil {
+		t.Errorf("expected own lock to be taken over, got %v", err)
+	}
+	lock.Unlock()
+	if _, err = os.Stat(lockFile); err == nil {
+		t.Error("expected lock file to be removed")
+	}
+	var noLock *PortLock
+	noLock.Unlock()
+
+	if name := lockFileName("/dev/pts/3"); name != filepath.Join(lockDir, "LCK..pts_3") {
+		t.Errorf("unexpected lock file name '%s'", name)
+	}
+}
+
+func TestLockPortHeldByOtherProcess(t *testing.T) {
+	fakeLockDir(t)
+	lockFile := filepath.Join(lockDir, "LCK..ttyUSB2")
+
+	// init is always alive
+	writeFile(t, lockFile, "         1\n")
+	_, err := LockPort("/dev/ttyUSB2")
+	var busyErr *PortBusyError
+	if !errors.As(err, &busyErr) || !slices.Equal(busyErr.Pids, []int{1}) || !strings.Contains(err.Error(), "/dev/ttyUSB2 is in use by") {
+		t.Errorf("expected port to be busy, got %v", err)
+	}
+
+	// lock files of processes that are gone are stale
+	writeFile(t, lockFile, "  99999999\n")
+	lock, err := LockPort("/dev/ttyUSB2")
+	if err != nil || lock == nil {
+		t.Fatalf("expected stale lock file to be replaced, got %v", err)
+	}
+	lock.Unlock()
+
+	// lock files without a PID may still be getting written
+	writeFile(t, lockFile, "")
+	if _, err = LockPort("/dev/ttyUSB2"); err == nil || err.Error() != "Serial port /dev/ttyUSB2 is in use by another process" {
+		t.Errorf("expected fresh lock file without PID to count, got %v", err)
+	}
+	old := time.Now().Add(-time.Minute)
+	if err = os.Chtimes(lockFile, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if lock, err = LockPort("/dev/ttyUSB2"); err != nil || lock == nil {
+		t.Errorf("expected old lock file without PID to be replaced, got %v", err)
+	}
+}
+
+func TestLockPortWithoutLockDirectory(t *testing.T) {
+	lockDir = filepath.Join(t.TempDir(), "missing")
+	defer func() {
+		lockDir = "/var/lock"
+	}()
+
+	if lock, err := LockPort("/dev/ttyUSB2"); err != nil || lock != nil {
+		t.Errorf("expected port to be used without lock file, got %v / %v", lock, err)
+	}
+}
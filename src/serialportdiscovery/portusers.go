@@ -0,0 +1,48 @@
+package serialportdiscovery
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// where procfs is mounted, tests point this to a fake directory tree
+var procRoot = "/proc"
+
+// FindPortUsers returns the IDs of other processes that have a serial port open, like fuser does.
+// Only processes whose file descriptors the current user may inspect are found, all of them when running as root.
+func FindPortUsers(port string) []int {
+	targets := []string{port}
+	if resolved, err := filepath.EvalSymlinks(port); err == nil && resolved != port {
+		targets = append(targets, resolved)
+	}
+	fds, err := filepath.Glob(filepath.Join(procRoot, "[0-9]*", "fd", "*"))
+	if err != nil {
+		return nil
+	}
+	ownPid := os.Getpid()
+	var result []int
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || !slices.Contains(targets, link) {
+			continue
+		}
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(filepath.Dir(fd))))
+		if err != nil || pid == ownPid || slices.Contains(result, pid) {
+			continue
+		}
+		result = append(result, pid)
+	}
+	return result
+}
+
+// DescribeProcess returns the command name of a process followed by its ID, like "ModemManager (812)"
+func DescribeProcess(pid int) string {
+	name, err := os.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "comm"))
+	if err != nil {
+		return strconv.Itoa(pid)
+	}
+	return strings.TrimSpace(string(name)) + " (" + strconv.Itoa(pid) + ")"
+}
@@ -0,0 +1,43 @@
+package serialportdiscovery
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestFindPortUsers(t *testing.T) {
+	procRoot = t.TempDir()
+	defer func() {
+		procRoot = "/proc"
+	}()
+
+	fakeProcess := func(pid int, name string, files ...string) {
+		fdDir := filepath.Join(procRoot, strconv.Itoa(pid), "fd")
+		mkdir(t, fdDir)
+		writeFile(t, filepath.Join(procRoot, strconv.Itoa(pid), "comm"), name+"\n")
+		for idx, file := range files {
+			symlink(t, file, filepath.Join(fdDir, strconv.Itoa(idx)))
+		}
+	}
+	fakeProcess(812, "ModemManager", "/dev/null", "/dev/ttyUSB2", "socket:[4711]")
+	fakeProcess(1234, "minicom", "/dev/ttyUSB2", "/dev/ttyUSB2")
+	fakeProcess(1500, "bash", "/dev/pts/0")
+	// the current process does not count
+	fakeProcess(os.Getpid(), "sms-gateway", "/dev/ttyUSB0")
+
+	if users := FindPortUsers("/dev/ttyUSB2"); !slices.Equal(users, []int{1234, 812}) && !slices.Equal(users, []int{812, 1234}) {
+		t.Errorf("expected ModemManager and minicom to use ttyUSB2, got %v", users)
+	}
+	if users := FindPortUsers("/dev/ttyUSB0"); len(users) != 0 {
+		t.Errorf("expected ttyUSB0 not to be used by other processes, got %v", users)
+	}
+	if name := DescribeProcess(812); name != "ModemManager (812)" {
+		t.Errorf("unexpected process description '%s'", name)
+	}
+	if name := DescribeProcess(999); name != "999" {
+		t.Errorf("unexpected description of vanished process '%s'", name)
+	}
+}
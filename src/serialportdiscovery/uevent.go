@@ -0,0 +1,46 @@
+package serialportdiscovery
+
+import (
+	"slices"
+	"strings"
+)
+
+// Uevent is a kernel notification about a device that was added, removed, bound to or unbound from a driver
+type Uevent struct {
+	Action    string
+	DevPath   string
+	Subsystem string
+	// all KEY=VALUE pairs of the event
+	Properties map[string]string
+}
+
+// subsystems whose events may change the serial ports of a USB modem
+var usbSubsystems = []string{"usb", "usb-serial", "tty"}
+
+// ParseUevent parses a message received on a NETLINK_KOBJECT_UEVENT socket: a header like "add@/devices/..."
+// followed by NUL-separated KEY=VALUE pairs. Returns FALSE for messages that are no kernel uevents
+// (like the ones udev re-broadcasts).
+func ParseUevent(data []byte) (Uevent, bool) {
+	fields := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+	action, devPath, found := strings.Cut(fields[0], "@")
+	if !found {
+		return Uevent{}, false
+	}
+	result := Uevent{Action: action, DevPath: devPath, Properties: make(map[string]string)}
+	for _, field := range fields[1:] {
+		if key, value, found := strings.Cut(field, "="); found {
+			result.Properties[key] = value
+		}
+	}
+	result.Subsystem = result.Properties["SUBSYSTEM"]
+	return result, true
+}
+
+// IsUsbChange returns TRUE if the event is about a USB device or serial port appearing or going away
+func (e Uevent) IsUsbChange() bool {
+	switch e.Action {
+	case "add", "remove", "bind", "unbind":
+		return slices.Contains(usbSubsystems, e.Subsystem)
+	}
+	return false
+}
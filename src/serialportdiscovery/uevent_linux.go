@@ -0,0 +1,49 @@
+//go:build linux
+
+package serialportdiscovery
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// UeventListener receives the kernel's uevents via netlink
+type UeventListener struct {
+	file *os.File
+}
+
+// ListenUevents subscribes to the kernel's uevents
+func ListenUevents() (*UeventListener, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK,
+		syscall.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, errors.New("Failed to create netlink socket - " + err.Error())
+	}
+	// group 1 = events sent by the kernel
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Pid: 0, Groups: 1})
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, errors.New("Failed to bind netlink socket - " + err.Error())
+	}
+	// a non-blocking file uses the runtime's poller, so Close() interrupts a pending Read()
+	return &UeventListener{file: os.NewFile(uintptr(fd), "uevent")}, nil
+}
+
+// Next waits for the next kernel uevent
+func (l *UeventListener) Next() (Uevent, error) {
+	buffer := make([]byte, 64*1024)
+	for {
+		count, err := l.file.Read(buffer)
+		if err != nil {
+			return Uevent{}, err
+		}
+		if event, ok := ParseUevent(buffer[:count]); ok {
+			return event, nil
+		}
+	}
+}
+
+func (l *UeventListener) Close() {
+	_ = l.file.Close()
+}
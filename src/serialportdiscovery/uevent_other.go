@@ -0,0 +1,19 @@
+//go:build !linux
+
+package serialportdiscovery
+
+import "errors"
+
+// UeventListener receives the kernel's uevents, only available on Linux
+type UeventListener struct{}
+
+func ListenUevents() (*UeventListener, error) {
+	return nil, errors.New("Kernel uevents are only available on Linux")
+}
+
+func (l *UeventListener) Next() (Uevent, error) {
+	return Uevent{}, errors.New("Kernel uevents are only available on Linux")
+}
+
+func (l *UeventListener) Close() {
+}
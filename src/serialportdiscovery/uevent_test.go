@@ -0,0 +1,40 @@
+package serialportdiscovery
+
+import "testing"
+
+func TestParseUevent(t *testing.T) {
+	data := "add@/devices/pci0000:00/0000:00:14.0/usb1/1-2\x00ACTION=add\x00DEVPATH=/devices/pci0000:00/0000:00:14.0/usb1/1-2\x00" +
+		"SUBSYSTEM=usb\x00DEVTYPE=usb_device\x00PRODUCT=12d1/1506/102\x00SEQNUM=4711\x00"
+	event, ok := ParseUevent([]byte(data))
+	if !ok {
+		t.Fatal("failed to parse uevent")
+	}
+	if event.Action != "add" || event.DevPath != "/devices/pci0000:00/0000:00:14.0/usb1/1-2" || event.Subsystem != "usb" ||
+		event.Properties["PRODUCT"] != "12d1/1506/102" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if !event.IsUsbChange() {
+		t.Error("USB device addition must count as change")
+	}
+
+	tests := []struct {
+		data   string
+		change bool
+	}{
+		{"remove@/devices/virtual/tty/ttyUSB2\x00ACTION=remove\x00SUBSYSTEM=tty\x00", true},
+		{"bind@/devices/usb1/1-2/1-2:1.0\x00ACTION=bind\x00SUBSYSTEM=usb\x00", true},
+		{"change@/devices/virtual/net/wlan0\x00ACTION=change\x00SUBSYSTEM=net\x00", false},
+		{"add@/devices/virtual/block/loop0\x00ACTION=add\x00SUBSYSTEM=block\x00", false},
+	}
+	for _, test := range tests {
+		event, ok = ParseUevent([]byte(test.data))
+		if !ok || event.IsUsbChange() != test.change {
+			t.Errorf("%q: expected change=%v, got %+v", test.data, test.change, event)
+		}
+	}
+
+	// udev re-broadcasts events with a binary header
+	if _, ok = ParseUevent([]byte("libudev\x00\xfe\xed\xca\xfe")); ok {
+		t.Error("udev message must be ignored")
+	}
+}
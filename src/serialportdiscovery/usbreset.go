@@ -0,0 +1,62 @@
+package serialportdiscovery
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code-sourcery.de/sms-gateway/common"
+)
+
+// how long a USB device stays de-authorized/unbound during a reset
+var usbResetDelay = 2 * time.Second
+
+// FindUsbDevice returns the sysfs directory of the USB device a serial port (like /dev/ttyUSB0) belongs to
+func FindUsbDevice(serialPort string) (string, error) {
+	link := filepath.Join(sysfsRoot, "class/tty", filepath.Base(serialPort), "device")
+	dir, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return "", errors.New("Serial port " + serialPort + " is not a USB device - " + err.Error())
+	}
+	// the tty belongs to a USB interface, the device is the closest parent directory with a vendor ID
+	for ; dir != "/" && dir != "."; dir = filepath.Dir(dir) {
+		if common.FileExist(filepath.Join(dir, "idVendor")) {
+			return dir, nil
+		}
+	}
+	return "", errors.New("Found no USB device for serial port " + serialPort)
+}
+
+// ResetUsbDevice makes the kernel drop and re-enumerate a USB device by de-authorizing and re-authorizing it,
+// falling back to unbinding and re-binding the device from the usb driver. Needs root privileges.
+func ResetUsbDevice(deviceDir string) error {
+	authorized := filepath.Join(deviceDir, "authorized")
+	err := os.WriteFile(authorized, []byte("0"), 0644)
+	if err == nil {
+		log.Info("De-authorized USB device " + deviceDir)
+		time.Sleep(usbResetDelay)
+		err = os.WriteFile(authorized, []byte("1"), 0644)
+		if err != nil {
+			return errors.New("Failed to re-authorize USB device " + deviceDir + " - " + err.Error())
+		}
+		log.Info("Re-authorized USB device " + deviceDir)
+		return nil
+	}
+	log.Warn("Failed to de-authorize USB device " + deviceDir + ", trying to unbind it instead - " + err.Error())
+
+	name := filepath.Base(deviceDir)
+	driverDir := filepath.Join(sysfsRoot, "bus/usb/drivers/usb")
+	err = os.WriteFile(filepath.Join(driverDir, "unbind"), []byte(name), 0200)
+	if err != nil {
+		return errors.New("Failed to unbind USB device " + name + " - " + err.Error())
+	}
+	log.Info("Unbound USB device " + name)
+	time.Sleep(usbResetDelay)
+	err = os.WriteFile(filepath.Join(driverDir, "bind"), []byte(name), 0200)
+	if err != nil {
+		return errors.New("Failed to bind USB device " + name + " - " + err.Error())
+	}
+	log.Info("Bound USB device " + name)
+	return nil
+}
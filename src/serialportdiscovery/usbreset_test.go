@@ -0,0 +1,112 @@
+package serialportdiscovery
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"code-sourcery.de/sms-gateway/common"
+)
+
+// fakeSysfs creates a sysfs tree with a single USB modem (12d1:1506) providing ttyUSB0 and ttyUSB1,
+// returning the directory of the USB device
+func fakeSysfs(t *testing.T) string {
+	sysfsRoot = t.TempDir()
+	usbResetDelay = 0
+
+	device := filepath.Join(sysfsRoot, "devices/pci0000:00/0000:00:14.0/usb1/1-2")
+	for idx, tty := range []string{"ttyUSB0", "ttyUSB1"} {
+		ifaceDir := filepath.Join(device, "1-2:1."+string(rune('0'+idx)))
+		ttyDir := filepath.Join(ifaceDir, tty)
+		mkdir(t, ttyDir)
+		writeFile(t, filepath.Join(ifaceDir, "bInterfaceNumber"), "0"+string(rune('0'+idx))+"\n")
+		mkdir(t, filepath.Join(sysfsRoot, "class/tty", tty))
+		symlink(t, ttyDir, filepath.Join(sysfsRoot, "class/tty", tty, "device"))
+	}
+	writeFile(t, filepath.Join(device, "idVendor"), "12d1\n")
+	writeFile(t, filepath.Join(device, "idProduct"), "1506\n")
+	writeFile(t, filepath.Join(device, "authorized"), "1\n")
+	mkdir(t, filepath.Join(sysfsRoot, "bus/usb/devices"))
+	symlink(t, device, filepath.Join(sysfsRoot, "bus/usb/devices/1-2"))
+	mkdir(t, filepath.Join(sysfsRoot, "bus/usb/drivers/usb"))
+	return device
+}
+
+func mkdir(t *testing.T, dir string) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func symlink(t *testing.T, target string, link string) {
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFile(t *testing.T, file string, content string) {
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, file string) string {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestDiscoverUsbInterfaces(t *testing.T) {
+	fakeSysfs(t)
+
+	ifaces, err := DiscoverUsbInterfaces(UsbSelector{DeviceId: common.UsbDeviceId{VendorId: 0x12d1, ProductId: 0x1506}})
+	if err != nil || !slices.Equal(ifaces, []string{"/dev/ttyUSB0", "/dev/ttyUSB1"}) {
+		t.Errorf("expected ttyUSB0 and ttyUSB1, got %v / %v", ifaces, err)
+	}
+	if _, err = DiscoverUsbInterfaces(UsbSelector{DeviceId: common.UsbDeviceId{VendorId: 0x12d1, ProductId: 0x1001}}); err == nil {
+		t.Errorf("expected unknown device to fail")
+	}
+}
+
+func TestFindUsbDevice(t *testing.T) {
+	device := fakeSysfs(t)
+
+	for _, port := range []string{"/dev/ttyUSB0", "/dev/ttyUSB1"} {
+		found, err := FindUsbDevice(port)
+		if err != nil {
+			t.Fatalf("%s: %s", port, err.Error())
+		}
+		expected, _ := filepath.EvalSymlinks(device)
+		if found != expected {
+			t.Errorf("%s: expected %s, got %s", port, expected, found)
+		}
+	}
+	if _, err := FindUsbDevice("/dev/pts/3"); err == nil {
+		t.Errorf("expected pseudo-terminal not to be a USB device")
+	}
+}
+
+func TestResetUsbDevice(t *testing.T) {
+	device := fakeSysfs(t)
+
+	if err := ResetUsbDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	if content := readFile(t, filepath.Join(device, "authorized")); content != "1" {
+		t.Errorf("expected device to be re-authorized, got '%s'", content)
+	}
+
+	// kernels without the 'authorized' attribute need the device to be unbound from the usb driver
+	_ = os.Remove(filepath.Join(device, "authorized"))
+	mkdir(t, filepath.Join(device, "authorized"))
+	if err := ResetUsbDevice(device); err != nil {
+		t.Fatal(err)
+	}
+	driverDir := filepath.Join(sysfsRoot, "bus/usb/drivers/usb")
+	if readFile(t, filepath.Join(driverDir, "unbind")) != "1-2" || readFile(t, filepath.Join(driverDir, "bind")) != "1-2" {
+		t.Errorf("expected device 1-2 to be unbound and bound again")
+	}
+}
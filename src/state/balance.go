@@ -0,0 +1,70 @@
+package state
+
+// how many balance checks to keep per modem
+const maxBalanceHistory = 100
+
+// BalanceRecord is the result of a single prepaid balance check
+type BalanceRecord struct {
+	Timestamp UnixTimestamp `json:"timestamp"`
+	Balance   float64       `json:"balance"`
+}
+
+// RememberBalance adds a balance to the history of a modem, dropping the oldest records
+// once more than maxBalanceHistory have been recorded
+func (c *State) RememberBalance(modemName string, balance float64, ts UnixTimestamp) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if c.data.Balances == nil {
+		c.data.Balances = make(map[string][]BalanceRecord)
+	}
+	history := append(c.data.Balances[modemName], BalanceRecord{Timestamp: ts, Balance: balance})
+	if len(history) > maxBalanceHistory {
+		history = history[len(history)-maxBalanceHistory:]
+	}
+	c.data.Balances[modemName] = history
+}
+
+// GetBalanceHistory returns a copy of the balance history of a modem, oldest record first
+func (c *State) GetBalanceHistory(modemName string) []BalanceRecord {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return append([]BalanceRecord{}, c.data.Balances[modemName]...)
+}
+
+// GetLatestBalance returns the most recent balance of a modem, nil if the balance was never checked
+func (c *State) GetLatestBalance(modemName string) *BalanceRecord {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	history := c.data.Balances[modemName]
+	if len(history) == 0 {
+		return nil
+	}
+	latest := history[len(history)-1]
+	return &latest
+}
+
+// SetLowBalanceAlerted remembers whether a low balance alert was sent for a modem,
+// so that only a single alert gets sent while the balance stays low
+func (c *State) SetLowBalanceAlerted(modemName string, alerted bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if c.data.LowBalanceAlerts == nil {
+		c.data.LowBalanceAlerts = make(map[string]bool)
+	}
+	if alerted {
+		c.data.LowBalanceAlerts[modemName] = true
+	} else {
+		delete(c.data.LowBalanceAlerts, modemName)
+	}
+}
+
+func (c *State) IsLowBalanceAlerted(modemName string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return c.data.LowBalanceAlerts[modemName]
+}
@@ -0,0 +1,307 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"code-sourcery.de/sms-gateway/message"
+)
+
+// how long to keep delivery records around after the message was submitted
+const deliveryRecordRetention = 30 * 24 * time.Hour
+
+type DeliveryState int
+
+const (
+	DELIVERY_STATE_PENDING DeliveryState = iota
+	DELIVERY_STATE_DELIVERED
+	DELIVERY_STATE_FAILED
+	DELIVERY_STATE_EXPIRED
+)
+
+func (s DeliveryState) String() string {
+	switch s {
+	case DELIVERY_STATE_PENDING:
+		return "pending"
+	case DELIVERY_STATE_DELIVERED:
+		return "delivered"
+	case DELIVERY_STATE_FAILED:
+		return "failed"
+	case DELIVERY_STATE_EXPIRED:
+		return "expired"
+	}
+	panic("Unhandled delivery state")
+}
+
+func (s DeliveryState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s *DeliveryState) UnmarshalJSON(data []byte) error {
+	var str string
+	err := json.Unmarshal(data, &str)
+	if err != nil {
+		return err
+	}
+	for _, candidate := range []DeliveryState{DELIVERY_STATE_PENDING, DELIVERY_STATE_DELIVERED, DELIVERY_STATE_FAILED, DELIVERY_STATE_EXPIRED} {
+		if candidate.String() == str {
+			*s = candidate
+			return nil
+		}
+	}
+	return errors.New("Unknown delivery state '" + str + "'")
+}
+
+// DeliveryRecord tracks the delivery of a single SMS segment to a single recipient
+type DeliveryRecord struct {
+	MessageId message.MessageId `json:"message_id"`
+	// name of the modem that sent the SMS, message references are only unique per modem
+	Modem     string `json:"modem"`
+	Recipient string `json:"recipient"`
+	// message reference returned by the modem when submitting the SMS
+	Reference int           `json:"reference"`
+	State     DeliveryState `json:"state"`
+	// TP-Status from the most recent status report, -1 if no report was received yet
+	Status    int            `json:"status"`
+	Submitted UnixTimestamp  `json:"submitted"`
+	Updated   *UnixTimestamp `json:"updated"`
+}
+
+// digitsOnly strips everything but digits so that numbers in national
+// and international format can be compared
+func digitsOnly(number string) string {
+	var sb strings.Builder
+	for _, c := range number {
+		if c >= '0' && c <= '9' {
+			sb.WriteRune(c)
+		}
+	}
+	return sb.String()
+}
+
+// isSameRecipient compares two phone numbers, ignoring differences in national/international format
+func isSameRecipient(a string, b string) bool {
+	digitsA := digitsOnly(a)
+	digitsB := digitsOnly(b)
+	if digitsA == "" || digitsB == "" {
+		return false
+	}
+	// compare the subscriber part, leaving out country codes/leading zeros
+	const significantDigits = 8
+	if len(digitsA) > significantDigits {
+		digitsA = digitsA[len(digitsA)-significantDigits:]
+	}
+	if len(digitsB) > significantDigits {
+		digitsB = digitsB[len(digitsB)-significantDigits:]
+	}
+	return digitsA == digitsB
+}
+
+// RememberPendingDelivery records an SMS segment that was submitted with a delivery status report requested
+func (c *State) RememberPendingDelivery(msgId message.MessageId, modemName string, recipient string, reference int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	c.data.Deliveries = append(c.data.Deliveries, DeliveryRecord{
+		MessageId: msgId,
+		Modem:     modemName,
+		Recipient: recipient,
+		Reference: reference,
+		State:     DELIVERY_STATE_PENDING,
+		Status:    -1,
+		Submitted: UnixTimestamp(time.Now().Unix()),
+	})
+}
+
+// UpdateDelivery applies a delivery status report received by a modem to the most recent pending record with a matching
+// recipient and message reference, returning a copy of the updated record or nil if no record matched.
+func (c *State) UpdateDelivery(modemName string, recipient string, reference int, newState DeliveryState, status int) *DeliveryRecord {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// message references wrap around after 256 messages, so prefer the most recent record
+	for i := len(c.data.Deliveries) - 1; i >= 0; i-- {
+		record := &c.data.Deliveries[i]
+		// records written by older versions have no modem name
+		sameModem := record.Modem == "" || record.Modem == modemName
+		if record.State == DELIVERY_STATE_PENDING && sameModem && record.Reference == reference && isSameRecipient(record.Recipient, recipient) {
+			now := UnixTimestamp(time.Now().Unix())
+			record.State = newState
+			record.Status = status
+			record.Updated = &now
+			clone := *record
+			return &clone
+		}
+	}
+	return nil
+}
+
+// ExpireDeliveries marks pending deliveries older than maxAge as expired and forgets about
+// records older than the retention period. Returns the number of records that expired.
+func (c *State) ExpireDeliveries(maxAge time.Duration) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := time.Now()
+	expired := 0
+	var retained []DeliveryRecord
+	for _, record := range c.data.Deliveries {
+		age := now.Sub(record.Submitted.ToTime())
+		if age > deliveryRecordRetention {
+			continue
+		}
+		if record.State == DELIVERY_STATE_PENDING && age > maxAge {
+			ts := UnixTimestamp(now.Unix())
+			record.State = DELIVERY_STATE_EXPIRED
+			record.Updated = &ts
+			expired++
+		}
+		retained = append(retained, record)
+	}
+	c.data.Deliveries = retained
+	return expired
+}
+
+// GetDeliveries returns all delivery records of a message
+func (c *State) GetDeliveries(msgId message.MessageId) []DeliveryRecord {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	result := []DeliveryRecord{}
+	for _, record := range c.data.Deliveries {
+		if record.MessageId == msgId {
+			result = append(result, record)
+		}
+	}
+	return result
+}
+
+// FailedMessage records a message that was given up on because the modem reported a permanent error
+type FailedMessage struct {
+	MessageId message.MessageId `json:"message_id"`
+	// the modem's error, like '+CMS ERROR: 1 (unassigned (unallocated) number)'
+	Reason string        `json:"reason"`
+	Failed UnixTimestamp `json:"failed"`
+}
+
+// RememberFailedMessage records a message that will not be retried and removes it from the pending messages,
+// forgetting about failed messages older than the retention period
+func (c *State) RememberFailedMessage(msgId message.MessageId, reason string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	c.deletePendingMessageId(msgId)
+	c.deleteCompletedRecipients(msgId)
+
+	now := time.Now()
+	var retained []FailedMessage
+	for _, failed := range c.data.FailedMessages {
+		if now.Sub(failed.Failed.ToTime()) <= deliveryRecordRetention {
+			retained = append(retained, failed)
+		}
+	}
+	c.data.FailedMessages = append(retained, FailedMessage{MessageId: msgId, Reason: reason, Failed: UnixTimestamp(now.Unix())})
+}
+
+// GetFailedMessage returns why a message was given up on, nil if it was not
+func (c *State) GetFailedMessage(msgId message.MessageId) *FailedMessage {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, failed := range c.data.FailedMessages {
+		if failed.MessageId == msgId {
+			clone := failed
+			return &clone
+		}
+	}
+	return nil
+}
+
+// FailedRecipient records a recipient a message was not sent to because the modem reported a permanent error
+type FailedRecipient struct {
+	MessageId message.MessageId `json:"message_id"`
+	Recipient string            `json:"recipient"`
+	// the modem's error, like '+CMS ERROR: 1 (unassigned (unallocated) number)'
+	Reason string        `json:"reason"`
+	Failed UnixTimestamp `json:"failed"`
+}
+
+// RememberFailedRecipient records a recipient a message will not be sent to,
+// forgetting about failed recipients older than the retention period
+func (c *State) RememberFailedRecipient(msgId message.MessageId, recipient string, reason string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	now := time.Now()
+	var retained []FailedRecipient
+	for _, failed := range c.data.FailedRecipients {
+		if now.Sub(failed.Failed.ToTime()) <= deliveryRecordRetention {
+			retained = append(retained, failed)
+		}
+	}
+	c.data.FailedRecipients = append(retained, FailedRecipient{MessageId: msgId, Recipient: recipient, Reason: reason,
+		Failed: UnixTimestamp(now.Unix())})
+}
+
+// GetFailedRecipients returns the recipients a message will not be sent to because of permanent errors
+func (c *State) GetFailedRecipients(msgId message.MessageId) []FailedRecipient {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var result []FailedRecipient
+	for _, failed := range c.data.FailedRecipients {
+		if failed.MessageId == msgId {
+			result = append(result, failed)
+		}
+	}
+	return result
+}
+
+// CompletedRecipients records the recipients a message reached before sending it failed,
+// so that retrying only sends the message to the recipients it did not reach yet
+type CompletedRecipients struct {
+	MessageId  message.MessageId `json:"message_id"`
+	Recipients []string          `json:"recipients"`
+}
+
+// RememberCompletedRecipients records recipients a message reached while sending it to the other recipients failed
+func (c *State) RememberCompletedRecipients(msgId message.MessageId, recipients []string) {
+	if len(recipients) == 0 {
+		return
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for idx := range c.data.CompletedRecipients {
+		if c.data.CompletedRecipients[idx].MessageId == msgId {
+			c.data.CompletedRecipients[idx].Recipients = append(c.data.CompletedRecipients[idx].Recipients, recipients...)
+			return
+		}
+	}
+	c.data.CompletedRecipients = append(c.data.CompletedRecipients, CompletedRecipients{MessageId: msgId,
+		Recipients: slices.Clone(recipients)})
+}
+
+// GetCompletedRecipients returns the recipients a message reached before sending it failed
+func (c *State) GetCompletedRecipients(msgId message.MessageId) []string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for _, completed := range c.data.CompletedRecipients {
+		if completed.MessageId == msgId {
+			return slices.Clone(completed.Recipients)
+		}
+	}
+	return nil
+}
+
+// deleteCompletedRecipients forgets about the recipients a message reached once it is not going to be retried anymore.
+// Needs to be called with the mutex held.
+func (c *State) deleteCompletedRecipients(msgId message.MessageId) {
+	c.data.CompletedRecipients = slices.DeleteFunc(c.data.CompletedRecipients, func(completed CompletedRecipients) bool {
+		return completed.MessageId == msgId
+	})
+}
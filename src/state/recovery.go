@@ -0,0 +1,39 @@
+package state
+
+// how many recovery attempts to keep per modem
+const maxRecoveryAttempts = 50
+
+// RecoveryAttempt is a single step the health watchdog took to bring back an unresponsive modem
+type RecoveryAttempt struct {
+	Timestamp UnixTimestamp `json:"timestamp"`
+	// recovery step, like "reopen" or "soft_reset"
+	Step string `json:"step"`
+	// TRUE if the modem passed the health probe after the step
+	Success bool `json:"success"`
+	// why the step failed, empty on success
+	Error string `json:"error,omitempty"`
+}
+
+// RememberRecoveryAttempt adds a recovery attempt to the history of a modem, dropping the oldest attempts
+// once more than maxRecoveryAttempts have been recorded
+func (c *State) RememberRecoveryAttempt(modemName string, attempt RecoveryAttempt) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if c.data.RecoveryAttempts == nil {
+		c.data.RecoveryAttempts = make(map[string][]RecoveryAttempt)
+	}
+	history := append(c.data.RecoveryAttempts[modemName], attempt)
+	if len(history) > maxRecoveryAttempts {
+		history = history[len(history)-maxRecoveryAttempts:]
+	}
+	c.data.RecoveryAttempts[modemName] = history
+}
+
+// GetRecoveryAttempts returns a copy of the recovery attempts of a modem, oldest first
+func (c *State) GetRecoveryAttempts(modemName string) []RecoveryAttempt {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return append([]RecoveryAttempt{}, c.data.RecoveryAttempts[modemName]...)
+}
@@ -27,8 +27,19 @@ func (t UnixTimestamp) ToTime() time.Time {
 type internalState struct {
 
 	// !!! Make sure to adjust createCopy() when changing this structure
+
+	// send timestamps, one per SMS segment sent
 	Timestamps []UnixTimestamp `json:"msg_timestamps"`
 
+	// send timestamps per modem name, one per SMS segment sent, only tracked for modems with rate limits of their own
+	ModemTimestamps map[string][]UnixTimestamp `json:"modem_timestamps"`
+
+	// total number of SMS segments sent so far
+	TotalSegmentsSent int64 `json:"total_segments_sent"`
+
+	// reference number used for the most recent concatenated SMS
+	ConcatReference int `json:"concat_reference"`
+
 	// ID of last message that was successfully sent
 	LastSuccessfulMessageId *message.MessageId `json:"last_successful_message_id"`
 
@@ -40,6 +51,30 @@ type internalState struct {
 	NextMessageId message.MessageId `json:"next_message_id"`
 
 	LastKeepAliveMsgEnqueued *UnixTimestamp `json:"last_keepalive_msg_enqueued"`
+
+	// next ID to be used for a message received from the network
+	NextReceivedMessageId message.MessageId `json:"next_received_message_id"`
+
+	// delivery state of sent SMS segments, only tracked if delivery reports are enabled
+	Deliveries []DeliveryRecord `json:"deliveries"`
+
+	// messages given up on because of permanent errors
+	FailedMessages []FailedMessage `json:"failed_messages"`
+
+	// recipients skipped because of permanent errors, like an unassigned number
+	FailedRecipients []FailedRecipient `json:"failed_recipients"`
+
+	// recipients reached by messages that still need to be sent to other recipients
+	CompletedRecipients []CompletedRecipients `json:"completed_recipients"`
+
+	// prepaid balance history per modem name, oldest first
+	Balances map[string][]BalanceRecord `json:"balances"`
+
+	// names of modems a low balance alert was sent for, cleared once the balance is above the threshold again
+	LowBalanceAlerts map[string]bool `json:"low_balance_alerts"`
+
+	// recovery attempts of the health watchdog per modem name, oldest first
+	RecoveryAttempts map[string][]RecoveryAttempt `json:"recovery_attempts"`
 }
 
 type State struct {
@@ -52,18 +87,18 @@ var appConfig config.Config
 var mutex sync.Mutex
 
 func newInternalState() internalState {
-	return internalState{NextMessageId: message.FirstMessageId()}
+	return internalState{NextMessageId: message.FirstMessageId(), NextReceivedMessageId: message.FirstMessageId()}
 }
 
 /**
  * Count SMS within the time frame of [now()-interval,now()]
  */
-func (c *State) countSms(iv util.TimeInterval) int {
+func countSms(timestamps []UnixTimestamp, iv util.TimeInterval) int {
 	now := UnixTimestamp(time.Now().Unix())
 	maxTs := iv.ToSeconds()
 	smsCount := 0
-	for i := len(c.data.Timestamps) - 1; i >= 0; i-- {
-		ageInSeconds := int(now - c.data.Timestamps[i])
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		ageInSeconds := int(now - timestamps[i])
 		if ageInSeconds > maxTs {
 			break
 		}
@@ -81,7 +116,7 @@ func (c *State) IsAnyRateLimitExceeded() bool {
 		return false
 	}
 	if appConfig.GetRateLimit1() != nil {
-		var cnt = c.countSms(appConfig.GetRateLimit1().Interval)
+		var cnt = countSms(c.data.Timestamps, appConfig.GetRateLimit1().Interval)
 		if appConfig.GetRateLimit1().IsThresholdExceeded(cnt) {
 			log.Error("Rate limit #1 (" + appConfig.GetRateLimit1().String() + ") exceeded , count = " + strconv.Itoa(cnt))
 			return true
@@ -92,7 +127,7 @@ func (c *State) IsAnyRateLimitExceeded() bool {
 		log.Debug("Rate limit #1 not configured")
 	}
 	if appConfig.GetRateLimit2() != nil {
-		var cnt = c.countSms(appConfig.GetRateLimit2().Interval)
+		var cnt = countSms(c.data.Timestamps, appConfig.GetRateLimit2().Interval)
 		if appConfig.GetRateLimit2().IsThresholdExceeded(cnt) {
 			log.Error("Rate limit #2 (" + appConfig.GetRateLimit2().String() + ") exceeded , count = " + strconv.Itoa(cnt))
 			return true
@@ -105,6 +140,60 @@ func (c *State) IsAnyRateLimitExceeded() bool {
 	return false
 }
 
+// IsModemRateLimitExceeded checks the rate limits configured for a single modem
+func (c *State) IsModemRateLimitExceeded(modem config.ModemConfig) bool {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	timestamps := c.data.ModemTimestamps[modem.GetName()]
+	for idx, limit := range []*util.RateLimit{modem.GetRateLimit1(), modem.GetRateLimit2()} {
+		if limit == nil {
+			continue
+		}
+		cnt := countSms(timestamps, limit.Interval)
+		if limit.IsThresholdExceeded(cnt) {
+			log.Error("Rate limit #" + strconv.Itoa(idx+1) + " (" + limit.String() + ") of modem '" + modem.GetName() +
+				"' exceeded , count = " + strconv.Itoa(cnt))
+			return true
+		}
+	}
+	return false
+}
+
+// RememberModemSend records SMS segments sent by a modem, so that the modem's own rate limits can be checked
+func (c *State) RememberModemSend(modem config.ModemConfig, segmentsSent int) {
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var maxSeconds int
+	for _, limit := range []*util.RateLimit{modem.GetRateLimit1(), modem.GetRateLimit2()} {
+		if limit != nil {
+			maxSeconds = max(maxSeconds, limit.Interval.ToSeconds())
+		}
+	}
+	if maxSeconds == 0 || segmentsSent == 0 {
+		return
+	}
+
+	nowInSeconds := time.Now().Unix()
+	cutOffTimestamp := UnixTimestamp(nowInSeconds - int64(maxSeconds))
+	var timestamps []UnixTimestamp
+	for _, ts := range c.data.ModemTimestamps[modem.GetName()] {
+		if ts >= cutOffTimestamp {
+			timestamps = append(timestamps, ts)
+		}
+	}
+	for i := 0; i < segmentsSent; i++ {
+		timestamps = append(timestamps, UnixTimestamp(nowInSeconds))
+	}
+	if c.data.ModemTimestamps == nil {
+		c.data.ModemTimestamps = make(map[string][]UnixTimestamp)
+	}
+	c.data.ModemTimestamps[modem.GetName()] = timestamps
+}
+
 func (c *State) WasSentAlready(msgId message.MessageId) bool {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -128,6 +217,20 @@ func (c *State) NewMessageId() message.MessageId {
 	return result
 }
 
+// NewReceivedMessageId() obtains a new ID for a message received from the network
+func (c *State) NewReceivedMessageId() message.MessageId {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if c.data.NextReceivedMessageId < message.FirstMessageId() {
+		// state file written by an older version
+		c.data.NextReceivedMessageId = message.FirstMessageId()
+	}
+	result := c.data.NextReceivedMessageId
+	c.data.NextReceivedMessageId = c.data.NextReceivedMessageId.NextId()
+	return result
+}
+
 // Deletes a pending message ID, returning TRUE if the deleted message ID
 // was the oldest of all pending message IDs
 func (c *State) deletePendingMessageId(msgId message.MessageId) {
@@ -143,9 +246,22 @@ func (c *State) DiscardMessageId(msgId message.MessageId) {
 	mutex.Lock()
 	defer mutex.Unlock()
 	c.deletePendingMessageId(msgId)
+	c.deleteCompletedRecipients(msgId)
 }
 
-func (c *State) RememberSmsSend(msg message.Message) {
+// NextConcatReference returns the reference number to use for the next concatenated SMS,
+// wrapping around at the given reference number size (8 or 16 bits)
+func (c *State) NextConcatReference(referenceBits int) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	c.data.ConcatReference = (c.data.ConcatReference + 1) % (1 << referenceBits)
+	return c.data.ConcatReference
+}
+
+// RememberSmsSend records a message as successfully sent, remembering one send timestamp
+// per SMS segment so that rate limits count segments and not messages.
+func (c *State) RememberSmsSend(msg message.Message, segmentsSent int) {
 
 	mutex.Lock()
 	if c.data.LastSuccessfulMessageId != nil && msg.Id.Compare(*c.data.LastSuccessfulMessageId) <= 0 {
@@ -154,10 +270,37 @@ func (c *State) RememberSmsSend(msg message.Message) {
 	}
 
 	c.deletePendingMessageId(msg.Id)
+	c.deleteCompletedRecipients(msg.Id)
 	c.data.LastSuccessfulMessageId = &msg.Id
+	c.rememberSegments(segmentsSent)
+
+	mutex.Unlock() // unlock before doing blocking I/O
+
+	// WriteState() will log an error, we'll just swallow this one here
+	// hoping that at some future time we'll be able to persist the state again....
+	_ = c.WriteState()
+}
+
+// RememberSegmentsSent records SMS segments the network accepted for a message that did not reach all recipients,
+// so that they count against the rate limits just like the segments of messages that were sent successfully
+func (c *State) RememberSegmentsSent(segmentsSent int) {
+
+	mutex.Lock()
+	c.rememberSegments(segmentsSent)
+	mutex.Unlock()
+
+	_ = c.WriteState()
+}
+
+// rememberSegments remembers one send timestamp per SMS segment, dropping timestamps that no rate limit
+// looks at anymore. Needs to be called with the mutex held.
+func (c *State) rememberSegments(segmentsSent int) {
 
 	nowInSeconds := time.Now().Unix()
-	c.data.Timestamps = append(c.data.Timestamps, UnixTimestamp(nowInSeconds))
+	for i := 0; i < segmentsSent; i++ {
+		c.data.Timestamps = append(c.data.Timestamps, UnixTimestamp(nowInSeconds))
+	}
+	c.data.TotalSegmentsSent += int64(segmentsSent)
 
 	var cutOffTimestamp UnixTimestamp = -1
 	if appConfig.GetRateLimit1() != nil {
@@ -183,12 +326,6 @@ func (c *State) RememberSmsSend(msg message.Message) {
 			}
 		}
 	}
-
-	mutex.Unlock() // unlock before doing blocking I/O
-
-	// WriteState() will log an error, we'll just swallow this one here
-	// hoping that at some future time we'll be able to persist the state again....
-	_ = c.WriteState()
 }
 
 func getStateFile() string {